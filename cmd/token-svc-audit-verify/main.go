@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/repos/auditrepo"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// token-svc-audit-verify walks the audit hash chain (and its signed checkpoints) and reports the first break
+// ex:
+//
+//	$ TOKEN_SVC_CONF=/path/to/config.toml ./bin/token-svc-audit-verify -checkpoint
+//
+// the exit code is 1 if the chain is broken
+func main() {
+	checkpoint := flag.Bool("checkpoint", false, "sign a checkpoint of the chain head after a successful verification")
+	flag.Parse()
+
+	cfg := config.Read()
+
+	zlogger, err := zap.NewProduction()
+	if err != nil {
+		panic("failed to create logger")
+	}
+	logger := log.NewFactory(cfg, zlogger.With(zap.String("package", "auditverify")))
+
+	dbConn, err := postgres.Database(cfg)
+	if err != nil {
+		logger.Bg().Fatal("failed db connection", zap.Error(err))
+	}
+	defer dbConn.Close()
+
+	// the verification itself is not audited, the sink is only used by Record
+	sink, err := log.NewAuditLogger(cfg)
+	if err != nil {
+		logger.Bg().Fatal("failed audit logger", zap.Error(err))
+	}
+	auditor := auditservice.New(cfg, logger, sink, auditrepo.New(dbConn, logger, opentracing.NoopTracer{}), metrics.New())
+
+	report, err := auditor.Verify(context.Background())
+	if err != nil {
+		logger.Bg().Fatal("audit chain verification failed", zap.Error(err))
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(report)
+	if report.Break != nil {
+		os.Exit(1)
+	}
+
+	if *checkpoint {
+		head, err := auditor.Checkpoint(context.Background())
+		if err != nil {
+			logger.Bg().Fatal("audit checkpoint failed", zap.Error(err))
+		}
+		_ = json.NewEncoder(os.Stdout).Encode(head)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/services/hashservice"
+	"github.com/tjsampson/token-svc/internal/services/importservice"
+
+	"github.com/opentracing/opentracing-go"
+	"go.uber.org/zap"
+)
+
+// token-svc-import bulk loads users (and their legacy password hashes) into the users table
+// ex:
+//
+//	$ TOKEN_SVC_CONF=/path/to/config.toml ./bin/token-svc-import -file users.csv
+//
+// the password hashes must be tagged with their algorithm (see hashservice)
+// the imported hashes are upgraded to the current algorithm on each user's first login
+func main() {
+	file := flag.String("file", "", "path to the csv or json import file")
+	format := flag.String("format", "", "import file format: csv or json (default: file extension)")
+	dryRun := flag.Bool("dry-run", false, "validate the import file without writing to the database")
+	flag.Parse()
+
+	cfg := config.Read()
+
+	zlogger, err := zap.NewProduction()
+	if err != nil {
+		panic("failed to create logger")
+	}
+	logger := log.NewFactory(cfg, zlogger.With(zap.String("package", "import")))
+
+	if *file == "" {
+		logger.Bg().Fatal("missing required -file flag")
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(*file), ".")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		logger.Bg().Fatal("failed to open import file", zap.Error(err), zap.String("file", *file))
+	}
+	defer f.Close()
+
+	var records []usermodels.ImportRecord
+	switch strings.ToLower(*format) {
+	case "csv":
+		records, err = importservice.ReadCSV(f)
+	case "json":
+		records, err = importservice.ReadJSON(f)
+	default:
+		logger.Bg().Fatal("unsupported import format", zap.String("format", *format))
+	}
+	if err != nil {
+		logger.Bg().Fatal("failed to read import file", zap.Error(err), zap.String("file", *file))
+	}
+
+	// a real run refuses the file if any password hash is invalid, nothing is written (a dry run reports every record)
+	if !*dryRun {
+		for i, record := range records {
+			if err := hashservice.Validate(cfg, record.PasswordHash); err != nil {
+				logger.Bg().Fatal("invalid password hash, run with -dry-run for the full report", zap.Error(err), zap.Int("record", i+1), zap.String("email", record.Email))
+			}
+		}
+	}
+
+	// a dry run only validates the records, no db connection required
+	var usrRepo userrepo.Store
+	if !*dryRun {
+		dbConn, err := postgres.Database(cfg)
+		if err != nil {
+			logger.Bg().Fatal("failed db connection", zap.Error(err))
+		}
+		defer dbConn.Close()
+		usrRepo = userrepo.New(dbConn, logger, opentracing.NoopTracer{})
+	}
+
+	importSvc := importservice.New(cfg, logger, usrRepo)
+
+	result, err := importSvc.Import(context.Background(), records, *dryRun)
+	if err != nil {
+		logger.Bg().Fatal("import failed", zap.Error(err))
+	}
+
+	_ = json.NewEncoder(os.Stdout).Encode(result)
+	if len(result.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -12,6 +12,10 @@ writetimeoutsecs = {{ key "services/token-svc/config/api/writetimeoutsecs" }}
 readtimeoutsecs = {{ key "services/token-svc/config/api/readtimeoutsecs" }}                 
 timeoutsecs = {{ key "services/token-svc/config/api/timeoutsecs" }}                 
 
+[proxy]
+trustedcidrs = {{ key "services/token-svc/config/proxy/trustedcidrs" }}
+header = "{{ key "services/token-svc/config/proxy/header" }}"
+
 [logger]
 level = "{{ key "services/token-svc/config/logger/level" }}"
 encoding = "{{ key "services/token-svc/config/logger/encoding" }}"
@@ -48,9 +52,210 @@ keyuserid = "{{ key "services/token-svc/config/cookie/keyuserid" }}"
 keyemail = "{{ key "services/token-svc/config/cookie/keyemail" }}"
 keyjwtaccessid = "{{ key "services/token-svc/config/cookie/keyjwtaccessid" }}"
 keyjwtrefreshid = "{{ key "services/token-svc/config/cookie/keyjwtrefreshid" }}"
-
+samesite = "{{ key "services/token-svc/config/cookie/samesite" }}"
+{{ with secret "secret/services/token-svc/config/cookie" }}{{ if .Data.previoushashkey }}
+[[cookie.previouskeys]]
+hashkey = "{{ .Data.previoushashkey }}"
+blockkey = "{{ .Data.previousblockkey }}"
+{{ end }}{{ end }}
 [cache]
 host = "{{ key "services/token-svc/config/cache/host" }}"
 port = "{{ key "services/token-svc/config/cache/port" }}"
 useraccountlockedkeyid = "{{ key "services/token-svc/config/cache/useraccountlockedkeyid" }}"
 useraccountlockedlifespanmins = "{{ key "services/token-svc/config/cache/useraccountlockedlifespanmins" }}"
+
+[password]
+algorithm = "{{ key "services/token-svc/config/password/algorithm" }}"
+bcryptcost = {{ key "services/token-svc/config/password/bcryptcost" }}
+argon2memorykib = {{ key "services/token-svc/config/password/argon2memorykib" }}
+argon2maxmemorykib = {{ key "services/token-svc/config/password/argon2maxmemorykib" }}
+argon2iterations = {{ key "services/token-svc/config/password/argon2iterations" }}
+argon2parallelism = {{ key "services/token-svc/config/password/argon2parallelism" }}
+argon2saltlength = {{ key "services/token-svc/config/password/argon2saltlength" }}
+argon2keylength = {{ key "services/token-svc/config/password/argon2keylength" }}
+
+[passwordpolicy]
+minlength = {{ key "services/token-svc/config/passwordpolicy/minlength" }}
+maxlength = {{ key "services/token-svc/config/passwordpolicy/maxlength" }}
+requireupper = {{ key "services/token-svc/config/passwordpolicy/requireupper" }}
+requirelower = {{ key "services/token-svc/config/passwordpolicy/requirelower" }}
+requiredigit = {{ key "services/token-svc/config/passwordpolicy/requiredigit" }}
+requiresymbol = {{ key "services/token-svc/config/passwordpolicy/requiresymbol" }}
+rejectemaillocalpart = {{ key "services/token-svc/config/passwordpolicy/rejectemaillocalpart" }}
+historycount = {{ key "services/token-svc/config/passwordpolicy/historycount" }}
+breachedcorpuspath = "{{ key "services/token-svc/config/passwordpolicy/breachedcorpuspath" }}"
+
+[loginlimit]
+cachekeyid = "{{ key "services/token-svc/config/loginlimit/cachekeyid" }}"
+windowmins = {{ key "services/token-svc/config/loginlimit/windowmins" }}
+maxperip = {{ key "services/token-svc/config/loginlimit/maxperip" }}
+maxperipemail = {{ key "services/token-svc/config/loginlimit/maxperipemail" }}
+backoffafter = {{ key "services/token-svc/config/loginlimit/backoffafter" }}
+backoffbasesecs = {{ key "services/token-svc/config/loginlimit/backoffbasesecs" }}
+backoffmaxsecs = {{ key "services/token-svc/config/loginlimit/backoffmaxsecs" }}
+
+[ratelimit]
+enabled = {{ key "services/token-svc/config/ratelimit/enabled" }}
+mode = "{{ key "services/token-svc/config/ratelimit/mode" }}"
+cachekeyid = "{{ key "services/token-svc/config/ratelimit/cachekeyid" }}"
+clientidheader = "{{ key "services/token-svc/config/ratelimit/clientidheader" }}"
+routes = {{ key "services/token-svc/config/ratelimit/routes" }}
+
+[admin]
+group = "{{ key "services/token-svc/config/admin/group" }}"
+
+[audit]
+outputpaths = {{ key "services/token-svc/config/audit/outputpaths" }}
+defaultpagesize = {{ key "services/token-svc/config/audit/defaultpagesize" }}
+maxpagesize = {{ key "services/token-svc/config/audit/maxpagesize" }}
+checkpointintervalmins = {{ key "services/token-svc/config/audit/checkpointintervalmins" }}
+
+[webhook]
+enabled = {{ key "services/token-svc/config/webhook/enabled" }}
+pollintervalsecs = {{ key "services/token-svc/config/webhook/pollintervalsecs" }}
+batchsize = {{ key "services/token-svc/config/webhook/batchsize" }}
+concurrency = {{ key "services/token-svc/config/webhook/concurrency" }}
+timeoutsecs = {{ key "services/token-svc/config/webhook/timeoutsecs" }}
+maxattempts = {{ key "services/token-svc/config/webhook/maxattempts" }}
+backoffbasesecs = {{ key "services/token-svc/config/webhook/backoffbasesecs" }}
+backoffmaxsecs = {{ key "services/token-svc/config/webhook/backoffmaxsecs" }}
+
+[outbox]
+enabled = {{ key "services/token-svc/config/outbox/enabled" }}
+sink = "{{ key "services/token-svc/config/outbox/sink" }}"
+pollintervalsecs = {{ key "services/token-svc/config/outbox/pollintervalsecs" }}
+batchsize = {{ key "services/token-svc/config/outbox/batchsize" }}
+logoutputpaths = {{ key "services/token-svc/config/outbox/logoutputpaths" }}
+httpurl = "{{ key "services/token-svc/config/outbox/httpurl" }}"
+httptoken = "{{ with secret "secret/services/token-svc/config/outbox" }}{{ .Data.httptoken }}{{ end }}"
+httptimeoutsecs = {{ key "services/token-svc/config/outbox/httptimeoutsecs" }}
+streamkey = "{{ key "services/token-svc/config/outbox/streamkey" }}"
+streammaxlen = {{ key "services/token-svc/config/outbox/streammaxlen" }}
+
+[oidc]
+enabled = {{ key "services/token-svc/config/oidc/enabled" }}
+issuer = "{{ key "services/token-svc/config/oidc/issuer" }}"
+clientid = "{{ key "services/token-svc/config/oidc/clientid" }}"
+clientsecret = "{{ with secret "secret/services/token-svc/config/oidc" }}{{ .Data.clientsecret }}{{ end }}"
+redirecturl = "{{ key "services/token-svc/config/oidc/redirecturl" }}"
+scopes = {{ key "services/token-svc/config/oidc/scopes" }}
+createusers = {{ key "services/token-svc/config/oidc/createusers" }}
+statecachekeyid = "{{ key "services/token-svc/config/oidc/statecachekeyid" }}"
+statelifespansecs = {{ key "services/token-svc/config/oidc/statelifespansecs" }}
+httptimeoutsecs = {{ key "services/token-svc/config/oidc/httptimeoutsecs" }}
+
+[ldap]
+enabled = {{ key "services/token-svc/config/ldap/enabled" }}
+url = "{{ key "services/token-svc/config/ldap/url" }}"
+starttls = {{ key "services/token-svc/config/ldap/starttls" }}
+insecureskipverify = {{ key "services/token-svc/config/ldap/insecureskipverify" }}
+binddn = "{{ key "services/token-svc/config/ldap/binddn" }}"
+bindpassword = "{{ with secret "secret/services/token-svc/config/ldap" }}{{ .Data.bindpassword }}{{ end }}"
+basedn = "{{ key "services/token-svc/config/ldap/basedn" }}"
+userfilter = "{{ key "services/token-svc/config/ldap/userfilter" }}"
+groupattribute = "{{ key "services/token-svc/config/ldap/groupattribute" }}"
+syncgroups = {{ key "services/token-svc/config/ldap/syncgroups" }}
+groupmap = {{ key "services/token-svc/config/ldap/groupmap" }}
+domains = {{ key "services/token-svc/config/ldap/domains" }}
+timeoutsecs = {{ key "services/token-svc/config/ldap/timeoutsecs" }}
+
+[saml]
+enabled = {{ key "services/token-svc/config/saml/enabled" }}
+entityid = "{{ key "services/token-svc/config/saml/entityid" }}"
+acsurl = "{{ key "services/token-svc/config/saml/acsurl" }}"
+certificatepath = "{{ key "services/token-svc/config/saml/certificatepath" }}"
+privatekeypath = "{{ key "services/token-svc/config/saml/privatekeypath" }}"
+idpmetadatapath = "{{ key "services/token-svc/config/saml/idpmetadatapath" }}"
+allowidpinitiated = {{ key "services/token-svc/config/saml/allowidpinitiated" }}
+emailattribute = "{{ key "services/token-svc/config/saml/emailattribute" }}"
+nameattribute = "{{ key "services/token-svc/config/saml/nameattribute" }}"
+groupsattribute = "{{ key "services/token-svc/config/saml/groupsattribute" }}"
+trustemail = {{ key "services/token-svc/config/saml/trustemail" }}
+createusers = {{ key "services/token-svc/config/saml/createusers" }}
+syncgroups = {{ key "services/token-svc/config/saml/syncgroups" }}
+groupmap = {{ key "services/token-svc/config/saml/groupmap" }}
+requestcachekeyid = "{{ key "services/token-svc/config/saml/requestcachekeyid" }}"
+requestlifespansecs = {{ key "services/token-svc/config/saml/requestlifespansecs" }}
+assertioncachekeyid = "{{ key "services/token-svc/config/saml/assertioncachekeyid" }}"
+
+[scim]
+enabled = {{ key "services/token-svc/config/scim/enabled" }}
+token = "{{ with secret "secret/services/token-svc/config/scim" }}{{ .Data.token }}{{ end }}"
+baseurl = "{{ key "services/token-svc/config/scim/baseurl" }}"
+maxresults = {{ key "services/token-svc/config/scim/maxresults" }}
+
+[pat]
+enabled = {{ key "services/token-svc/config/pat/enabled" }}
+maxperuser = {{ key "services/token-svc/config/pat/maxperuser" }}
+defaultlifespandays = {{ key "services/token-svc/config/pat/defaultlifespandays" }}
+maxlifespandays = {{ key "services/token-svc/config/pat/maxlifespandays" }}
+lastusedintervalsecs = {{ key "services/token-svc/config/pat/lastusedintervalsecs" }}
+
+[mail]
+backend = "{{ key "services/token-svc/config/mail/backend" }}"
+host = "{{ key "services/token-svc/config/mail/host" }}"
+port = {{ key "services/token-svc/config/mail/port" }}
+username = "{{ key "services/token-svc/config/mail/username" }}"
+password = "{{ with secret "secret/services/token-svc/config/mail" }}{{ .Data.password }}{{ end }}"
+from = "{{ key "services/token-svc/config/mail/from" }}"
+allowinsecure = {{ key "services/token-svc/config/mail/allowinsecure" }}
+timeoutsecs = {{ key "services/token-svc/config/mail/timeoutsecs" }}
+
+[magic]
+enabled = {{ key "services/token-svc/config/magic/enabled" }}
+linkurl = "{{ key "services/token-svc/config/magic/linkurl" }}"
+lifespansecs = {{ key "services/token-svc/config/magic/lifespansecs" }}
+maxattempts = {{ key "services/token-svc/config/magic/maxattempts" }}
+maxsends = {{ key "services/token-svc/config/magic/maxsends" }}
+cachekeyid = "{{ key "services/token-svc/config/magic/cachekeyid" }}"
+
+[stepup]
+enabled = {{ key "services/token-svc/config/stepup/enabled" }}
+maxagemins = {{ key "services/token-svc/config/stepup/maxagemins" }}
+adminrequiremfa = {{ key "services/token-svc/config/stepup/adminrequiremfa" }}
+
+[loginhistory]
+enabled = {{ key "services/token-svc/config/loginhistory/enabled" }}
+failureburst = {{ key "services/token-svc/config/loginhistory/failureburst" }}
+notify = {{ key "services/token-svc/config/loginhistory/notify" }}
+forcemfa = {{ key "services/token-svc/config/loginhistory/forcemfa" }}
+maxhistory = {{ key "services/token-svc/config/loginhistory/maxhistory" }}
+
+[ipfilter]
+enabled = {{ key "services/token-svc/config/ipfilter/enabled" }}
+allow = {{ key "services/token-svc/config/ipfilter/allow" }}
+deny = {{ key "services/token-svc/config/ipfilter/deny" }}
+cachekeyid = "{{ key "services/token-svc/config/ipfilter/cachekeyid" }}"
+refreshsecs = {{ key "services/token-svc/config/ipfilter/refreshsecs" }}
+defaultblockmins = {{ key "services/token-svc/config/ipfilter/defaultblockmins" }}
+maxblockmins = {{ key "services/token-svc/config/ipfilter/maxblockmins" }}
+autoblock = {{ key "services/token-svc/config/ipfilter/autoblock" }}
+autoblockthreshold = {{ key "services/token-svc/config/ipfilter/autoblockthreshold" }}
+autoblockwindowmins = {{ key "services/token-svc/config/ipfilter/autoblockwindowmins" }}
+autoblockmins = {{ key "services/token-svc/config/ipfilter/autoblockmins" }}
+
+[csrf]
+enabled = {{ key "services/token-svc/config/csrf/enabled" }}
+cookiename = "{{ key "services/token-svc/config/csrf/cookiename" }}"
+headername = "{{ key "services/token-svc/config/csrf/headername" }}"
+trustedorigins = {{ key "services/token-svc/config/csrf/trustedorigins" }}
+requireorigin = {{ key "services/token-svc/config/csrf/requireorigin" }}
+exemptpaths = {{ key "services/token-svc/config/csrf/exemptpaths" }}
+
+[session]
+mode = "{{ key "services/token-svc/config/session/mode" }}"
+accesscookiename = "{{ key "services/token-svc/config/session/accesscookiename" }}"
+refreshcookiename = "{{ key "services/token-svc/config/session/refreshcookiename" }}"
+
+[dpop]
+enabled = {{ key "services/token-svc/config/dpop/enabled" }}
+cachekeyid = "{{ key "services/token-svc/config/dpop/cachekeyid" }}"
+prooflifespansecs = {{ key "services/token-svc/config/dpop/prooflifespansecs" }}
+clockskewsecs = {{ key "services/token-svc/config/dpop/clockskewsecs" }}
+
+[mtls]
+enabled = {{ key "services/token-svc/config/mtls/enabled" }}
+certificatepath = "{{ key "services/token-svc/config/mtls/certificatepath" }}"
+keypath = "{{ key "services/token-svc/config/mtls/keypath" }}"
+clientcapath = "{{ key "services/token-svc/config/mtls/clientcapath" }}"
+clients = {{ key "services/token-svc/config/mtls/clients" }}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/middleware"
+	"github.com/tjsampson/token-svc/internal/models/patmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"go.uber.org/zap"
+)
+
+// requireAdmin returns a 403 RestError unless the authenticated user is an admin
+// a personal access token also needs the admin scope
+func requireAdmin(appCtxProvider *serviceprovider.Context, req *http.Request) error {
+	if scopes, ok := middleware.TokenScopesFromContext(req.Context()); ok && !patmodels.HasScope(scopes, patmodels.ScopeAdmin) {
+		return &internalerrors.RestError{Code: http.StatusForbidden, Message: "token scope required: " + patmodels.ScopeAdmin}
+	}
+	isAdmin, err := appCtxProvider.UserService.IsAdmin(req.Context(), middleware.UserIDFromContext(req.Context()))
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return &internalerrors.RestError{Code: http.StatusForbidden, Message: "admin access required"}
+	}
+	return nil
+}
+
+// userIDVar returns the {id} url variable
+func userIDVar(req *http.Request) (int, error) {
+	userID, err := strconv.Atoi(httphelper.Vars(req)["id"])
+	if err != nil || userID <= 0 {
+		return 0, &internalerrors.RestError{Code: http.StatusBadRequest, Message: "invalid user id", OriginalError: err}
+	}
+	return userID, nil
+}
+
+func getAccountStatusHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering getAccountStatusHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "getAccountStatusHandler.requireAdmin")
+	}
+
+	userID, err := userIDVar(req)
+	if err != nil {
+		return httphelper.AppErr(err, "getAccountStatusHandler.userIDVar")
+	}
+
+	status, err := appCtxProvider.UserService.AccountStatus(req.Context(), userID)
+	if err != nil {
+		return httphelper.AppErr(err, "getAccountStatusHandler.UserService.AccountStatus")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving getAccountStatusHandler", zap.Int("user_id", userID))
+	return httphelper.AppResponse(http.StatusOK, status)
+}
+
+// parseStatusChange checks the caller is an admin and parses the user id and status change
+func parseStatusChange(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, *usermodels.StatusChange, error) {
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return 0, nil, err
+	}
+
+	userID, err := userIDVar(req)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	statusChange := &usermodels.StatusChange{}
+	if err = httphelper.ParseBody(res, req, statusChange); err != nil {
+		return 0, nil, err
+	}
+
+	if err = appCtxProvider.Validator.Validate(statusChange); err != nil {
+		return 0, nil, err
+	}
+	return userID, statusChange, nil
+}
+
+func lockUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering lockUserHandler")
+
+	userID, statusChange, err := parseStatusChange(appCtxProvider, res, req)
+	if err != nil {
+		return httphelper.AppErr(err, "lockUserHandler.parseStatusChange")
+	}
+
+	status, err := appCtxProvider.UserService.Lock(req.Context(), userID, statusChange.Reason)
+	if err != nil {
+		return httphelper.AppErr(err, "lockUserHandler.UserService.Lock")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving lockUserHandler", zap.Int("user_id", userID))
+	return httphelper.AppResponse(http.StatusOK, status)
+}
+
+func unlockUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering unlockUserHandler")
+
+	userID, statusChange, err := parseStatusChange(appCtxProvider, res, req)
+	if err != nil {
+		return httphelper.AppErr(err, "unlockUserHandler.parseStatusChange")
+	}
+
+	status, err := appCtxProvider.UserService.Unlock(req.Context(), userID, statusChange.Reason)
+	if err != nil {
+		return httphelper.AppErr(err, "unlockUserHandler.UserService.Unlock")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving unlockUserHandler", zap.Int("user_id", userID))
+	return httphelper.AppResponse(http.StatusOK, status)
+}
+
+func disableUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering disableUserHandler")
+
+	userID, statusChange, err := parseStatusChange(appCtxProvider, res, req)
+	if err != nil {
+		return httphelper.AppErr(err, "disableUserHandler.parseStatusChange")
+	}
+
+	status, err := appCtxProvider.UserService.Disable(req.Context(), userID, statusChange.Reason)
+	if err != nil {
+		return httphelper.AppErr(err, "disableUserHandler.UserService.Disable")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving disableUserHandler", zap.Int("user_id", userID))
+	return httphelper.AppResponse(http.StatusOK, status)
+}
+
+func enableUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering enableUserHandler")
+
+	userID, statusChange, err := parseStatusChange(appCtxProvider, res, req)
+	if err != nil {
+		return httphelper.AppErr(err, "enableUserHandler.parseStatusChange")
+	}
+
+	status, err := appCtxProvider.UserService.Enable(req.Context(), userID, statusChange.Reason)
+	if err != nil {
+		return httphelper.AppErr(err, "enableUserHandler.UserService.Enable")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving enableUserHandler", zap.Int("user_id", userID))
+	return httphelper.AppResponse(http.StatusOK, status)
+}
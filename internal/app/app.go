@@ -50,10 +50,16 @@ func New(appCtxProvider *serviceprovider.Context) App {
 				handlers.AllowedMethods(appCtxProvider.Config.API.AllowedMethods),
 			)(middleware.Adapt(
 				router,
+				middleware.RateLimitHandler(appCtxProvider),
 				middleware.AuthHandler(appCtxProvider),
-				middleware.LogMetricsHandler(appCtxProvider.Logger, appCtxProvider.Metrics),
+				middleware.DPoPHandler(appCtxProvider),
+				middleware.CSRFHandler(appCtxProvider),
+				middleware.IPFilterHandler(appCtxProvider),
+				middleware.LogMetricsHandler(appCtxProvider.Logger, appCtxProvider.Metrics, appCtxProvider.Config.Proxy.TrustedCIDRs, appCtxProvider.Config.Proxy.Header),
 				middleware.TimeoutHandler(appCtxProvider.Config.API.TimeoutSecs),
 				middleware.TracingHandler(appCtxProvider))),
+			// mutual tls (nil when disabled, the service is behind a tls terminating proxy)
+			TLSConfig:    appCtxProvider.MTLS.TLSConfig(),
 			ReadTimeout:  time.Duration(appCtxProvider.Config.API.ReadTimeOutSecs) * time.Second,
 			WriteTimeout: time.Duration(appCtxProvider.Config.API.WriteTimeOutSecs) * time.Second,
 			IdleTimeout:  time.Duration(appCtxProvider.Config.API.IdleTimeOutSecs) * time.Second,
@@ -117,6 +123,11 @@ func (a *app) Serve() error {
 	// goroutine to handle signals
 	go a.sigHandler()
 
+	// goroutine to sign the audit chain checkpoints (stops on shutdown)
+	go a.appCtx.Auditor.RunCheckpoints(a.done)
+	go a.appCtx.Webhooks.Run(a.done)
+	go a.appCtx.Outbox.Run(a.done)
+
 	// atomically store the health as "healthy=1"
 	atomic.StoreInt32(&a.healthy, 1)
 
@@ -147,7 +158,12 @@ func (a *app) Serve() error {
 		a.appCtx.VersionInfo.BuildHost).Set(1)
 
 	// serve up the api by listening on the configured port
-	if err := a.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	// with mutual tls the service terminates tls itself (the certificates are in the server's tls config)
+	serve := a.server.ListenAndServe
+	if a.server.TLSConfig != nil {
+		serve = func() error { return a.server.ListenAndServeTLS("", "") }
+	}
+	if err := serve(); err != nil && err != http.ErrServerClosed {
 		a.logger.Bg().Error("failed ListenAndServe", zap.String("port", a.appCtx.Config.API.Port))
 		return err
 	}
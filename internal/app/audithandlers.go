@@ -0,0 +1,114 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+)
+
+// parseAuditQuery parses the ?user=<id>&event=<event>&since=<RFC3339>&limit=<n>&before=<cursor> query
+func parseAuditQuery(req *http.Request) (auditmodels.Query, error) {
+	query := auditmodels.Query{}
+	params := req.URL.Query()
+	invalidParam := func(name string, err error) error {
+		return &internalerrors.RestError{Code: http.StatusBadRequest, Message: "invalid query parameter: " + name, OriginalError: err}
+	}
+
+	var err error
+	if user := params.Get("user"); user != "" {
+		if query.UserID, err = strconv.Atoi(user); err != nil || query.UserID <= 0 {
+			return query, invalidParam("user", err)
+		}
+	}
+	query.Event = params.Get("event")
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return query, invalidParam("since", err)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return query, invalidParam("limit", err)
+		}
+	}
+	if before := params.Get("before"); before != "" {
+		if query.Before, err = strconv.ParseInt(before, 10, 64); err != nil || query.Before <= 0 {
+			return query, invalidParam("before", err)
+		}
+	}
+	return query, nil
+}
+
+func listAuditEventsHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering listAuditEventsHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "listAuditEventsHandler.requireAdmin")
+	}
+
+	query, err := parseAuditQuery(req)
+	if err != nil {
+		return httphelper.AppErr(err, "listAuditEventsHandler.parseAuditQuery")
+	}
+
+	page, err := appCtxProvider.Auditor.List(req.Context(), query)
+	if err != nil {
+		return httphelper.AppErr(err, "listAuditEventsHandler.Auditor.List")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving listAuditEventsHandler")
+	return httphelper.AppResponse(http.StatusOK, page)
+}
+
+func verifyAuditChainHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering verifyAuditChainHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "verifyAuditChainHandler.requireAdmin")
+	}
+
+	report, err := appCtxProvider.Auditor.Verify(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "verifyAuditChainHandler.Auditor.Verify")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving verifyAuditChainHandler")
+	return httphelper.AppResponse(http.StatusOK, report)
+}
+
+func listAuditCheckpointsHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering listAuditCheckpointsHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "listAuditCheckpointsHandler.requireAdmin")
+	}
+
+	checkpoints, err := appCtxProvider.Auditor.ListCheckpoints(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "listAuditCheckpointsHandler.Auditor.ListCheckpoints")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving listAuditCheckpointsHandler")
+	return httphelper.AppResponse(http.StatusOK, checkpoints)
+}
+
+func createAuditCheckpointHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering createAuditCheckpointHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "createAuditCheckpointHandler.requireAdmin")
+	}
+
+	checkpoint, err := appCtxProvider.Auditor.Checkpoint(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "createAuditCheckpointHandler.Auditor.Checkpoint")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving createAuditCheckpointHandler")
+	return httphelper.AppResponse(http.StatusCreated, checkpoint)
+}
@@ -1,15 +1,34 @@
 package app
 
 import (
+	"crypto/subtle"
+	"fmt"
 	"net/http"
 
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
 	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/middleware"
 	"github.com/tjsampson/token-svc/internal/models/authmodels"
 	"github.com/tjsampson/token-svc/internal/serviceprovider"
+	"github.com/tjsampson/token-svc/internal/services/authservice"
 
 	"go.uber.org/zap"
 )
 
+// loginBody sets the login cookies and returns the login response body
+// in cookie session mode the tokens are only in their HttpOnly cookies (see middleware.SetSessionCookies)
+func loginBody(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request, loginResults authmodels.LoginResponse) map[string]string {
+	if middleware.SetSessionCookies(appCtxProvider, res, req, loginResults) {
+		return map[string]string{"session_mode": authmodels.SessionModeCookie}
+	}
+	// a login with a DPoP proof is issued tokens bound to the proof's key
+	tokenType := "Bearer"
+	if middleware.DPoPThumbprintFromContext(req.Context()) != "" {
+		tokenType = "DPoP"
+	}
+	return map[string]string{"access_token": loginResults.AccessToken, "refresh_token": loginResults.RefreshToken, "token_type": tokenType}
+}
+
 func loginHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
 	appCtxProvider.Logger.For(req.Context()).Info("entering loginHandler")
 	userCreds := &authmodels.UserCreds{}
@@ -28,9 +47,9 @@ func loginHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWrit
 		return httphelper.AppErr(err, "loginHandler.AuthService.Login")
 	}
 
-	http.SetCookie(res, loginResults.HTTPCookie)
+	body := loginBody(appCtxProvider, res, req, loginResults)
 	appCtxProvider.Logger.For(req.Context()).Info("leaving loginHandler", zap.String("email", userCreds.Email))
-	return httphelper.AppResponse(http.StatusOK, map[string]string{"access_token": loginResults.AccessToken, "refresh_token": loginResults.RefreshToken})
+	return httphelper.AppResponse(http.StatusOK, body)
 }
 
 func registerHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
@@ -55,3 +74,261 @@ func registerHandler(appCtxProvider *serviceprovider.Context, res http.ResponseW
 	appCtxProvider.Logger.For(req.Context()).Info("leaving registerHandler", zap.String("email", userCreds.Email))
 	return httphelper.AppResponse(http.StatusCreated, user)
 }
+
+func changePasswordHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering changePasswordHandler")
+
+	passwordChange := &authmodels.PasswordChange{}
+	var err error
+
+	if err = httphelper.ParseBody(res, req, passwordChange); err != nil {
+		return httphelper.AppErr(err, "changePasswordHandler.ParseBody")
+	}
+
+	if err = appCtxProvider.Validator.Validate(passwordChange); err != nil {
+		return httphelper.AppErr(err, "changePasswordHandler.Validate")
+	}
+
+	if err = appCtxProvider.AuthService.ChangePassword(req.Context(), middleware.UserIDFromContext(req.Context()), passwordChange); err != nil {
+		return httphelper.AppErr(err, "changePasswordHandler.AuthService.ChangePassword")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving changePasswordHandler")
+	return httphelper.AppResponse(http.StatusNoContent, nil)
+}
+
+// reauthHandler re-verifies the logged in user's password for step-up routes
+// the response is a new access token (same session) with a fresh auth_time
+func reauthHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering reauthHandler")
+
+	reauth := &authmodels.Reauthentication{}
+	var err error
+
+	if err = httphelper.ParseBody(res, req, reauth); err != nil {
+		return httphelper.AppErr(err, "reauthHandler.ParseBody")
+	}
+
+	if err = appCtxProvider.Validator.Validate(reauth); err != nil {
+		return httphelper.AppErr(err, "reauthHandler.Validate")
+	}
+
+	result, err := appCtxProvider.AuthService.Reauthenticate(req.Context(), middleware.UserIDFromContext(req.Context()), reauth)
+	if err != nil {
+		return httphelper.AppErr(err, "reauthHandler.AuthService.Reauthenticate")
+	}
+
+	// in cookie session mode the re-issued access token replaces the access token cookie
+	if middleware.CookieSession(appCtxProvider.Config, req) {
+		for _, cookie := range appCtxProvider.CookieOven.TokenCookies(result.AccessToken, "") {
+			http.SetCookie(res, cookie)
+		}
+		appCtxProvider.Logger.For(req.Context()).Info("leaving reauthHandler")
+		return httphelper.AppResponse(http.StatusOK, map[string]string{"session_mode": authmodels.SessionModeCookie})
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving reauthHandler")
+	return httphelper.AppResponse(http.StatusOK, result)
+}
+
+// magicLoginCookie binds a magic link login to the browser that requested it
+// (a link forwarded to, or intercepted by, someone else does not work)
+const magicLoginCookie = "magic_login"
+
+func magicLoginHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering magicLoginHandler")
+
+	magicReq := &authmodels.MagicLoginRequest{}
+	if err := httphelper.ParseBody(res, req, magicReq); err != nil {
+		return httphelper.AppErr(err, "magicLoginHandler.ParseBody")
+	}
+
+	if err := appCtxProvider.Validator.Validate(magicReq); err != nil {
+		return httphelper.AppErr(err, "magicLoginHandler.Validate")
+	}
+
+	binding, err := appCtxProvider.Magic.Start(req.Context(), magicReq.Email)
+	if err != nil {
+		return httphelper.AppErr(err, "magicLoginHandler.Magic.Start")
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     magicLoginCookie,
+		Value:    binding,
+		Path:     "/login/magic",
+		MaxAge:   int(appCtxProvider.Config.Magic.LifeSpanSecs),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving magicLoginHandler", zap.String("email", magicReq.Email))
+	return httphelper.AppResponse(http.StatusAccepted, map[string]string{"message": "if the email has an account, a sign in link and code were sent"})
+}
+
+func magicVerifyHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering magicVerifyHandler")
+
+	verify := &authmodels.MagicLoginVerify{}
+	if err := httphelper.ParseBody(res, req, verify); err != nil {
+		return httphelper.AppErr(err, "magicVerifyHandler.ParseBody")
+	}
+
+	if err := appCtxProvider.Validator.Validate(verify); err != nil {
+		return httphelper.AppErr(err, "magicVerifyHandler.Validate")
+	}
+
+	binding := ""
+	if bindingCookie, err := req.Cookie(magicLoginCookie); err == nil {
+		binding = bindingCookie.Value
+	}
+
+	userID, err := appCtxProvider.Magic.Verify(req.Context(), binding, verify)
+	if err != nil {
+		return httphelper.AppErr(err, "magicVerifyHandler.Magic.Verify")
+	}
+	http.SetCookie(res, &http.Cookie{Name: magicLoginCookie, Path: "/login/magic", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	loginResults, err := appCtxProvider.AuthService.PasswordlessLogin(req.Context(), authservice.LoginMethodMagic, userID)
+	if err != nil {
+		return httphelper.AppErr(err, "magicVerifyHandler.AuthService.PasswordlessLogin")
+	}
+
+	body := loginBody(appCtxProvider, res, req, loginResults)
+	appCtxProvider.Logger.For(req.Context()).Info("leaving magicVerifyHandler", zap.Int("user_id", userID))
+	return httphelper.AppResponse(http.StatusOK, body)
+}
+
+// oidcStateCookie binds the oidc login state to the browser that started the login (login CSRF)
+const oidcStateCookie = "oidc_state"
+
+func oidcLoginHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering oidcLoginHandler")
+
+	authURL, state, err := appCtxProvider.OIDC.AuthCodeURL(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "oidcLoginHandler.OIDC.AuthCodeURL")
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(appCtxProvider.Config.OIDC.StateLifeSpanSecs),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	res.Header().Set("Location", authURL)
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving oidcLoginHandler")
+	return httphelper.AppResponse(http.StatusFound, nil)
+}
+
+func oidcCallbackHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering oidcCallbackHandler")
+	query := req.URL.Query()
+
+	// the identity provider redirects errors (ex: access_denied) back to the callback
+	if providerErr := query.Get("error"); providerErr != "" {
+		return httphelper.AppErr(&internalerrors.RestError{
+			Code:    http.StatusUnauthorized,
+			Message: fmt.Sprintf("oidc login failed: %s %s", providerErr, query.Get("error_description")),
+		}, "oidcCallbackHandler")
+	}
+
+	state := query.Get("state")
+	stateCookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(state)) != 1 {
+		return httphelper.AppErr(&internalerrors.RestError{
+			Code:          http.StatusBadRequest,
+			Message:       "invalid or expired login state",
+			OriginalError: err,
+		}, "oidcCallbackHandler.stateCookie")
+	}
+	http.SetCookie(res, &http.Cookie{Name: oidcStateCookie, Path: "/login/oidc", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	identity, err := appCtxProvider.OIDC.Exchange(req.Context(), state, query.Get("code"))
+	if err != nil {
+		return httphelper.AppErr(err, "oidcCallbackHandler.OIDC.Exchange")
+	}
+
+	loginResults, err := appCtxProvider.AuthService.FederatedLogin(req.Context(), authservice.LoginMethodOIDC, identity)
+	if err != nil {
+		return httphelper.AppErr(err, "oidcCallbackHandler.AuthService.FederatedLogin")
+	}
+
+	body := loginBody(appCtxProvider, res, req, loginResults)
+	appCtxProvider.Logger.For(req.Context()).Info("leaving oidcCallbackHandler", zap.String("email", identity.Email))
+	return httphelper.AppResponse(http.StatusOK, body)
+}
+
+// samlRelayStateCookie binds the saml relay state to the browser that started the login (login CSRF)
+// the idp POSTs the response cross site, so the cookie must be SameSite=None
+const samlRelayStateCookie = "saml_relay_state"
+
+func samlMetadataHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering samlMetadataHandler")
+
+	metadata, err := appCtxProvider.SAML.Metadata(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "samlMetadataHandler.SAML.Metadata")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving samlMetadataHandler")
+	return httphelper.AppResponse(http.StatusOK, httphelper.RawResponse{ContentType: "application/samlmetadata+xml", Body: metadata})
+}
+
+func samlLoginHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering samlLoginHandler")
+
+	authURL, relayState, err := appCtxProvider.SAML.AuthRequestURL(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "samlLoginHandler.SAML.AuthRequestURL")
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     samlRelayStateCookie,
+		Value:    relayState,
+		Path:     "/saml",
+		MaxAge:   int(appCtxProvider.Config.SAML.RequestLifeSpanSecs),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	res.Header().Set("Location", authURL)
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving samlLoginHandler")
+	return httphelper.AppResponse(http.StatusFound, nil)
+}
+
+func samlACSHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering samlACSHandler")
+
+	// a login we started must come back to the same browser, without our cookie it is idp initiated
+	relayState := ""
+	if relayStateCookie, err := req.Cookie(samlRelayStateCookie); err == nil {
+		relayState = req.PostFormValue("RelayState")
+		if relayState == "" || subtle.ConstantTimeCompare([]byte(relayStateCookie.Value), []byte(relayState)) != 1 {
+			return httphelper.AppErr(&internalerrors.RestError{
+				Code:    http.StatusBadRequest,
+				Message: "invalid or expired login state",
+			}, "samlACSHandler.relayStateCookie")
+		}
+		http.SetCookie(res, &http.Cookie{Name: samlRelayStateCookie, Path: "/saml", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode})
+	}
+
+	identity, err := appCtxProvider.SAML.ParseResponse(req.Context(), req.PostFormValue("SAMLResponse"), relayState)
+	if err != nil {
+		return httphelper.AppErr(err, "samlACSHandler.SAML.ParseResponse")
+	}
+
+	loginResults, err := appCtxProvider.AuthService.FederatedLogin(req.Context(), authservice.LoginMethodSAML, identity)
+	if err != nil {
+		return httphelper.AppErr(err, "samlACSHandler.AuthService.FederatedLogin")
+	}
+
+	body := loginBody(appCtxProvider, res, req, loginResults)
+	appCtxProvider.Logger.For(req.Context()).Info("leaving samlACSHandler", zap.String("email", identity.Email))
+	return httphelper.AppResponse(http.StatusOK, body)
+}
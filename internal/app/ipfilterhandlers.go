@@ -0,0 +1,75 @@
+package app
+
+import (
+	"net/http"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/middleware"
+	"github.com/tjsampson/token-svc/internal/models/ipfiltermodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"go.uber.org/zap"
+)
+
+func listBlocklistHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering listBlocklistHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "listBlocklistHandler.requireAdmin")
+	}
+
+	blocks, err := appCtxProvider.IPFilter.List(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "listBlocklistHandler.IPFilter.List")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving listBlocklistHandler", zap.Int("count", len(blocks)))
+	return httphelper.AppResponse(http.StatusOK, blocks)
+}
+
+func blockIPHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering blockIPHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "blockIPHandler.requireAdmin")
+	}
+
+	blockReq := &ipfiltermodels.BlockRequest{}
+	if err := httphelper.ParseBody(res, req, blockReq); err != nil {
+		return httphelper.AppErr(err, "blockIPHandler.ParseBody")
+	}
+
+	if err := appCtxProvider.Validator.Validate(blockReq); err != nil {
+		return httphelper.AppErr(err, "blockIPHandler.Validate")
+	}
+
+	block, err := appCtxProvider.IPFilter.Block(req.Context(), middleware.UserIDFromContext(req.Context()), blockReq)
+	if err != nil {
+		return httphelper.AppErr(err, "blockIPHandler.IPFilter.Block")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving blockIPHandler", zap.String("cidr", block.CIDR))
+	return httphelper.AppResponse(http.StatusCreated, block)
+}
+
+// unblockIPHandler removes the block of the ?cidr= query parameter (a CIDR does not fit a url path)
+func unblockIPHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering unblockIPHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "unblockIPHandler.requireAdmin")
+	}
+
+	cidr := req.URL.Query().Get("cidr")
+	if cidr == "" {
+		return httphelper.AppErr(&internalerrors.RestError{Code: http.StatusBadRequest, Message: "cidr is required"}, "unblockIPHandler.cidr")
+	}
+
+	if err := appCtxProvider.IPFilter.Unblock(req.Context(), middleware.UserIDFromContext(req.Context()), cidr); err != nil {
+		return httphelper.AppErr(err, "unblockIPHandler.IPFilter.Unblock")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving unblockIPHandler", zap.String("cidr", cidr))
+	return httphelper.AppResponse(http.StatusNoContent, nil)
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"net/http"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/models/tokenmodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"go.uber.org/zap"
+)
+
+// oauthTokenHandler is the oauth token endpoint (client credentials grant, form encoded)
+// the client is authenticated by its tls client certificate (tls_client_auth, see mtlsservice)
+func oauthTokenHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering oauthTokenHandler")
+
+	if err := req.ParseForm(); err != nil {
+		return httphelper.AppErr(&internalerrors.RestError{
+			Code:          http.StatusBadRequest,
+			Message:       "invalid token request",
+			OriginalError: err,
+		}, "oauthTokenHandler.ParseForm")
+	}
+	tokenReq := &tokenmodels.ClientTokenRequest{
+		GrantType: req.PostForm.Get("grant_type"),
+		ClientID:  req.PostForm.Get("client_id"),
+	}
+	if err := appCtxProvider.Validator.Validate(tokenReq); err != nil {
+		return httphelper.AppErr(err, "oauthTokenHandler.Validate")
+	}
+
+	result, err := appCtxProvider.MTLS.ClientCredentials(req.Context(), tokenReq.ClientID, req.TLS)
+	if err != nil {
+		return httphelper.AppErr(err, "oauthTokenHandler.MTLS.ClientCredentials")
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	appCtxProvider.Logger.For(req.Context()).Info("leaving oauthTokenHandler", zap.String("client_id", tokenReq.ClientID))
+	return httphelper.AppResponse(http.StatusOK, result)
+}
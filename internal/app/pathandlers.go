@@ -0,0 +1,83 @@
+package app
+
+import (
+	"net/http"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/middleware"
+	"github.com/tjsampson/token-svc/internal/models/patmodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"go.uber.org/zap"
+)
+
+// requireSession returns a 403 RestError when the request was authenticated by a personal access token
+// (a leaked token must not be able to mint or list tokens)
+func requireSession(req *http.Request) error {
+	if _, ok := middleware.TokenScopesFromContext(req.Context()); ok {
+		return &internalerrors.RestError{Code: http.StatusForbidden, Message: "personal access tokens can not manage tokens"}
+	}
+	return nil
+}
+
+func listPATsHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering listPATsHandler")
+
+	if err := requireSession(req); err != nil {
+		return httphelper.AppErr(err, "listPATsHandler.requireSession")
+	}
+
+	tokens, err := appCtxProvider.PAT.List(req.Context(), middleware.UserIDFromContext(req.Context()))
+	if err != nil {
+		return httphelper.AppErr(err, "listPATsHandler.PAT.List")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving listPATsHandler")
+	return httphelper.AppResponse(http.StatusOK, tokens)
+}
+
+func createPATHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering createPATHandler")
+
+	if err := requireSession(req); err != nil {
+		return httphelper.AppErr(err, "createPATHandler.requireSession")
+	}
+
+	createReq := &patmodels.CreateRequest{}
+	if err := httphelper.ParseBody(res, req, createReq); err != nil {
+		return httphelper.AppErr(err, "createPATHandler.ParseBody")
+	}
+
+	if err := appCtxProvider.Validator.Validate(createReq); err != nil {
+		return httphelper.AppErr(err, "createPATHandler.Validate")
+	}
+
+	token, err := appCtxProvider.PAT.Create(req.Context(), middleware.UserIDFromContext(req.Context()), createReq)
+	if err != nil {
+		return httphelper.AppErr(err, "createPATHandler.PAT.Create")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving createPATHandler", zap.Int64("token_id", token.ID))
+	return httphelper.AppResponse(http.StatusCreated, token)
+}
+
+func revokePATHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering revokePATHandler")
+
+	if err := requireSession(req); err != nil {
+		return httphelper.AppErr(err, "revokePATHandler.requireSession")
+	}
+
+	id, err := idVar(req)
+	if err != nil {
+		return httphelper.AppErr(err, "revokePATHandler.idVar")
+	}
+
+	if err = appCtxProvider.PAT.Revoke(req.Context(), middleware.UserIDFromContext(req.Context()), id); err != nil {
+		return httphelper.AppErr(err, "revokePATHandler.PAT.Revoke")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving revokePATHandler", zap.Int64("token_id", id))
+	return httphelper.AppResponse(http.StatusNoContent, nil)
+}
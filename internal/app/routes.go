@@ -6,7 +6,19 @@ import (
 )
 
 func (a *app) registerRoutes(appCtxProvider *serviceprovider.Context) {
+	// sensitive routes need a recent authentication (admin changes can also require mfa), see POST /me/reauth
+	stepUp := middleware.NewStepUp(appCtxProvider.Config, false)
+	adminStepUp := middleware.NewStepUp(appCtxProvider.Config, appCtxProvider.Config.StepUp.AdminRequireMFA)
+
 	a.router.Handle("/login", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: loginHandler}).Methods("POST")
+	a.router.Handle("/login/magic", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: magicLoginHandler}).Methods("POST")
+	a.router.Handle("/login/magic/verify", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: magicVerifyHandler}).Methods("POST")
+	a.router.Handle("/login/oidc", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: oidcLoginHandler}).Methods("GET")
+	a.router.Handle("/login/oidc/callback", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: oidcCallbackHandler}).Methods("GET")
+	a.router.Handle("/saml/metadata", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: samlMetadataHandler}).Methods("GET")
+	a.router.Handle("/saml/login", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: samlLoginHandler}).Methods("GET")
+	a.router.Handle("/saml/acs", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: samlACSHandler}).Methods("POST")
+	a.router.Handle("/oauth/token", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: oauthTokenHandler}).Methods("POST")
 	a.router.Handle("/register", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: registerHandler}).Methods("POST")
 	a.router.Handle("/health", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: getFullHealthHandler}).Methods("GET")
 	a.router.Handle("/health/api", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: apiHealthHandler}).Methods("GET")
@@ -14,5 +26,42 @@ func (a *app) registerRoutes(appCtxProvider *serviceprovider.Context) {
 	a.router.Handle("/health/database", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: databaseHealthHandler}).Methods("GET")
 	a.router.Handle("/health/cache", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: cacheHealthHandler}).Methods("GET")
 	a.router.Handle("/health/memory", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: memoryHealthHandler}).Methods("GET")
+	a.router.Handle("/me/password", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: changePasswordHandler, StepUp: stepUp}).Methods("PUT")
+	a.router.Handle("/me/logins", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listLoginsHandler}).Methods("GET")
+	a.router.Handle("/me/reauth", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: reauthHandler}).Methods("POST")
+	a.router.Handle("/me/tokens", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listPATsHandler}).Methods("GET")
+	a.router.Handle("/me/tokens", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: createPATHandler, StepUp: stepUp}).Methods("POST")
+	a.router.Handle("/me/tokens/{id:[0-9]+}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: revokePATHandler}).Methods("DELETE")
 	a.router.Handle("/users", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listUsersHandler}).Methods("GET")
+	a.router.Handle("/audit", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listAuditEventsHandler}).Methods("GET")
+	a.router.Handle("/audit/verify", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: verifyAuditChainHandler}).Methods("GET")
+	a.router.Handle("/audit/checkpoints", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listAuditCheckpointsHandler}).Methods("GET")
+	a.router.Handle("/audit/checkpoints", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: createAuditCheckpointHandler}).Methods("POST")
+	a.router.Handle("/webhooks", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listWebhooksHandler}).Methods("GET")
+	a.router.Handle("/webhooks", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: createWebhookHandler, StepUp: adminStepUp}).Methods("POST")
+	a.router.Handle("/webhooks/{id:[0-9]+}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: getWebhookHandler}).Methods("GET")
+	a.router.Handle("/webhooks/{id:[0-9]+}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: deleteWebhookHandler, StepUp: adminStepUp}).Methods("DELETE")
+	a.router.Handle("/webhooks/deliveries", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listWebhookDeliveriesHandler}).Methods("GET")
+	a.router.Handle("/webhooks/deliveries/{id:[0-9]+}/retry", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: retryWebhookDeliveryHandler}).Methods("POST")
+	a.router.Handle("/admin/users/{id:[0-9]+}/status", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: getAccountStatusHandler}).Methods("GET")
+	a.router.Handle("/admin/users/{id:[0-9]+}/lock", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: lockUserHandler, StepUp: adminStepUp}).Methods("POST")
+	a.router.Handle("/admin/users/{id:[0-9]+}/unlock", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: unlockUserHandler, StepUp: adminStepUp}).Methods("POST")
+	a.router.Handle("/admin/users/{id:[0-9]+}/disable", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: disableUserHandler, StepUp: adminStepUp}).Methods("POST")
+	a.router.Handle("/admin/users/{id:[0-9]+}/enable", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: enableUserHandler, StepUp: adminStepUp}).Methods("POST")
+	a.router.Handle("/admin/blocklist", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: listBlocklistHandler}).Methods("GET")
+	a.router.Handle("/admin/blocklist", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: blockIPHandler, StepUp: adminStepUp}).Methods("POST")
+	a.router.Handle("/admin/blocklist", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: unblockIPHandler, StepUp: adminStepUp}).Methods("DELETE")
+	a.router.Handle("/scim/v2/ServiceProviderConfig", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimServiceProviderConfigHandler}).Methods("GET")
+	a.router.Handle("/scim/v2/Users", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimListUsersHandler}).Methods("GET")
+	a.router.Handle("/scim/v2/Users", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimCreateUserHandler}).Methods("POST")
+	a.router.Handle("/scim/v2/Users/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimGetUserHandler}).Methods("GET")
+	a.router.Handle("/scim/v2/Users/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimReplaceUserHandler}).Methods("PUT")
+	a.router.Handle("/scim/v2/Users/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimPatchUserHandler}).Methods("PATCH")
+	a.router.Handle("/scim/v2/Users/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimDeleteUserHandler}).Methods("DELETE")
+	a.router.Handle("/scim/v2/Groups", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimListGroupsHandler}).Methods("GET")
+	a.router.Handle("/scim/v2/Groups", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimCreateGroupHandler}).Methods("POST")
+	a.router.Handle("/scim/v2/Groups/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimGetGroupHandler}).Methods("GET")
+	a.router.Handle("/scim/v2/Groups/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimReplaceGroupHandler}).Methods("PUT")
+	a.router.Handle("/scim/v2/Groups/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimPatchGroupHandler}).Methods("PATCH")
+	a.router.Handle("/scim/v2/Groups/{id}", middleware.Handler{AppCtx: appCtxProvider, RouteHandler: scimDeleteGroupHandler}).Methods("DELETE")
 }
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// scimResponse returns the payload as an application/scim+json response
+func scimResponse(status int, payload interface{}) (int, interface{}, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return httphelper.AppErr(err, "scimResponse.Marshal")
+	}
+	return httphelper.AppResponse(status, httphelper.RawResponse{ContentType: scimmodels.ContentType, Body: body})
+}
+
+// scimError returns the error as a scim error response
+// rest errors (ex: a 409 unique violation) are mapped to their scim type, unknown errors are a 500
+func scimError(appCtxProvider *serviceprovider.Context, req *http.Request, err error, message string) (int, interface{}, error) {
+	var scimErr *scimmodels.Error
+	switch cause := errors.Cause(err).(type) {
+	case *scimmodels.Error:
+		scimErr = cause
+	case *internalerrors.RestError:
+		scimType := ""
+		switch cause.Code {
+		case http.StatusBadRequest:
+			scimType = scimmodels.ErrInvalidSyntax
+		case http.StatusConflict:
+			scimType = scimmodels.ErrUniqueness
+		}
+		scimErr = scimmodels.NewError(cause.Code, scimType, cause.Message)
+	default:
+		scimErr = scimmodels.NewError(http.StatusInternalServerError, "", "Unknown internal server error has occurred")
+	}
+	appCtxProvider.Logger.For(req.Context()).Error("scim error", zap.Error(err), zap.String("handler", message), zap.Int("code", scimErr.Code))
+	return scimResponse(scimErr.Code, scimErr)
+}
+
+// parseSCIMListQuery parses the ?filter=<filter>&startIndex=<n>&count=<n>&excludedAttributes=<attrs> query
+func parseSCIMListQuery(req *http.Request) (scimmodels.ListQuery, error) {
+	params := req.URL.Query()
+	query := scimmodels.ListQuery{Filter: params.Get("filter"), Count: -1}
+	invalidParam := func(name string) error {
+		return scimmodels.NewError(http.StatusBadRequest, scimmodels.ErrInvalidValue, "invalid query parameter: "+name)
+	}
+
+	var err error
+	if startIndex := params.Get("startIndex"); startIndex != "" {
+		if query.StartIndex, err = strconv.Atoi(startIndex); err != nil {
+			return query, invalidParam("startIndex")
+		}
+	}
+	if count := params.Get("count"); count != "" {
+		if query.Count, err = strconv.Atoi(count); err != nil {
+			return query, invalidParam("count")
+		}
+		// a negative count is a count of 0 (RFC 7644 3.4.2.4)
+		if query.Count < 0 {
+			query.Count = 0
+		}
+	}
+	if excluded := params.Get("excludedAttributes"); excluded != "" {
+		query.ExcludedAttributes = strings.Split(excluded, ",")
+	}
+	return query, nil
+}
+
+func scimServiceProviderConfigHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	return scimResponse(http.StatusOK, appCtxProvider.SCIM.ServiceProviderConfig(req.Context()))
+}
+
+func scimListUsersHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimListUsersHandler")
+
+	query, err := parseSCIMListQuery(req)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimListUsersHandler.parseSCIMListQuery")
+	}
+
+	users, err := appCtxProvider.SCIM.ListUsers(req.Context(), query)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimListUsersHandler.SCIM.ListUsers")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimListUsersHandler", zap.Int("total", users.TotalResults))
+	return scimResponse(http.StatusOK, users)
+}
+
+func scimCreateUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimCreateUserHandler")
+
+	user := &scimmodels.User{}
+	if err := httphelper.ParseBody(res, req, user); err != nil {
+		return scimError(appCtxProvider, req, err, "scimCreateUserHandler.ParseBody")
+	}
+
+	created, err := appCtxProvider.SCIM.CreateUser(req.Context(), *user)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimCreateUserHandler.SCIM.CreateUser")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimCreateUserHandler", zap.String("id", created.ID))
+	return scimResponse(http.StatusCreated, created)
+}
+
+func scimGetUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	user, err := appCtxProvider.SCIM.ReadUser(req.Context(), httphelper.Vars(req)["id"])
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimGetUserHandler.SCIM.ReadUser")
+	}
+	return scimResponse(http.StatusOK, user)
+}
+
+func scimReplaceUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimReplaceUserHandler")
+
+	user := &scimmodels.User{}
+	if err := httphelper.ParseBody(res, req, user); err != nil {
+		return scimError(appCtxProvider, req, err, "scimReplaceUserHandler.ParseBody")
+	}
+
+	replaced, err := appCtxProvider.SCIM.ReplaceUser(req.Context(), httphelper.Vars(req)["id"], *user)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimReplaceUserHandler.SCIM.ReplaceUser")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimReplaceUserHandler", zap.String("id", replaced.ID))
+	return scimResponse(http.StatusOK, replaced)
+}
+
+func scimPatchUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimPatchUserHandler")
+
+	patchOp := &scimmodels.PatchOp{}
+	if err := httphelper.ParseBody(res, req, patchOp); err != nil {
+		return scimError(appCtxProvider, req, err, "scimPatchUserHandler.ParseBody")
+	}
+
+	patched, err := appCtxProvider.SCIM.PatchUser(req.Context(), httphelper.Vars(req)["id"], *patchOp)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimPatchUserHandler.SCIM.PatchUser")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimPatchUserHandler", zap.String("id", patched.ID))
+	return scimResponse(http.StatusOK, patched)
+}
+
+func scimDeleteUserHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimDeleteUserHandler")
+
+	if err := appCtxProvider.SCIM.DeleteUser(req.Context(), httphelper.Vars(req)["id"]); err != nil {
+		return scimError(appCtxProvider, req, err, "scimDeleteUserHandler.SCIM.DeleteUser")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimDeleteUserHandler")
+	return httphelper.AppResponse(http.StatusNoContent, nil)
+}
+
+func scimListGroupsHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimListGroupsHandler")
+
+	query, err := parseSCIMListQuery(req)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimListGroupsHandler.parseSCIMListQuery")
+	}
+
+	groups, err := appCtxProvider.SCIM.ListGroups(req.Context(), query)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimListGroupsHandler.SCIM.ListGroups")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimListGroupsHandler", zap.Int("total", groups.TotalResults))
+	return scimResponse(http.StatusOK, groups)
+}
+
+func scimCreateGroupHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimCreateGroupHandler")
+
+	group := &scimmodels.Group{}
+	if err := httphelper.ParseBody(res, req, group); err != nil {
+		return scimError(appCtxProvider, req, err, "scimCreateGroupHandler.ParseBody")
+	}
+
+	created, err := appCtxProvider.SCIM.CreateGroup(req.Context(), *group)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimCreateGroupHandler.SCIM.CreateGroup")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimCreateGroupHandler", zap.String("id", created.ID))
+	return scimResponse(http.StatusCreated, created)
+}
+
+func scimGetGroupHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	group, err := appCtxProvider.SCIM.ReadGroup(req.Context(), httphelper.Vars(req)["id"])
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimGetGroupHandler.SCIM.ReadGroup")
+	}
+	return scimResponse(http.StatusOK, group)
+}
+
+func scimReplaceGroupHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimReplaceGroupHandler")
+
+	group := &scimmodels.Group{}
+	if err := httphelper.ParseBody(res, req, group); err != nil {
+		return scimError(appCtxProvider, req, err, "scimReplaceGroupHandler.ParseBody")
+	}
+
+	replaced, err := appCtxProvider.SCIM.ReplaceGroup(req.Context(), httphelper.Vars(req)["id"], *group)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimReplaceGroupHandler.SCIM.ReplaceGroup")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimReplaceGroupHandler", zap.String("id", replaced.ID))
+	return scimResponse(http.StatusOK, replaced)
+}
+
+func scimPatchGroupHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimPatchGroupHandler")
+
+	patchOp := &scimmodels.PatchOp{}
+	if err := httphelper.ParseBody(res, req, patchOp); err != nil {
+		return scimError(appCtxProvider, req, err, "scimPatchGroupHandler.ParseBody")
+	}
+
+	patched, err := appCtxProvider.SCIM.PatchGroup(req.Context(), httphelper.Vars(req)["id"], *patchOp)
+	if err != nil {
+		return scimError(appCtxProvider, req, err, "scimPatchGroupHandler.SCIM.PatchGroup")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimPatchGroupHandler", zap.String("id", patched.ID))
+	return scimResponse(http.StatusOK, patched)
+}
+
+func scimDeleteGroupHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering scimDeleteGroupHandler")
+
+	if err := appCtxProvider.SCIM.DeleteGroup(req.Context(), httphelper.Vars(req)["id"]); err != nil {
+		return scimError(appCtxProvider, req, err, "scimDeleteGroupHandler.SCIM.DeleteGroup")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving scimDeleteGroupHandler")
+	return httphelper.AppResponse(http.StatusNoContent, nil)
+}
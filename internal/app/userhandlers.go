@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/middleware"
 	"github.com/tjsampson/token-svc/internal/serviceprovider"
 )
 
@@ -18,3 +19,16 @@ func listUsersHandler(appCtxProvider *serviceprovider.Context, res http.Response
 	appCtxProvider.Logger.For(req.Context()).Info("leaving listUsersHandler")
 	return httphelper.AppResponse(http.StatusOK, users)
 }
+
+// listLoginsHandler lists the user's own recent logins (with their risk signals)
+func listLoginsHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering listLoginsHandler")
+
+	logins, err := appCtxProvider.LoginHistory.List(req.Context(), middleware.UserIDFromContext(req.Context()))
+	if err != nil {
+		return httphelper.AppErr(err, "listLoginsHandler.LoginHistory.List")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving listLoginsHandler")
+	return httphelper.AppResponse(http.StatusOK, logins)
+}
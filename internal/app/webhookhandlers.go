@@ -0,0 +1,173 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
+	"github.com/tjsampson/token-svc/internal/models/webhookmodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"go.uber.org/zap"
+)
+
+// idVar returns the {id} url variable as a database id
+func idVar(req *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(httphelper.Vars(req)["id"], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, &internalerrors.RestError{Code: http.StatusBadRequest, Message: "invalid id", OriginalError: err}
+	}
+	return id, nil
+}
+
+// parseDeliveryQuery parses the ?subscription=<id>&status=<status>&limit=<n>&before=<cursor> query
+func parseDeliveryQuery(req *http.Request) (webhookmodels.DeliveryQuery, error) {
+	params := req.URL.Query()
+	query := webhookmodels.DeliveryQuery{Status: params.Get("status")}
+	invalidParam := func(name string, err error) error {
+		return &internalerrors.RestError{Code: http.StatusBadRequest, Message: "invalid query parameter: " + name, OriginalError: err}
+	}
+
+	var err error
+	if subscription := params.Get("subscription"); subscription != "" {
+		if query.SubscriptionID, err = strconv.ParseInt(subscription, 10, 64); err != nil || query.SubscriptionID <= 0 {
+			return query, invalidParam("subscription", err)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return query, invalidParam("limit", err)
+		}
+	}
+	if before := params.Get("before"); before != "" {
+		if query.Before, err = strconv.ParseInt(before, 10, 64); err != nil || query.Before <= 0 {
+			return query, invalidParam("before", err)
+		}
+	}
+	return query, nil
+}
+
+func listWebhooksHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering listWebhooksHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "listWebhooksHandler.requireAdmin")
+	}
+
+	subs, err := appCtxProvider.Webhooks.ListSubscriptions(req.Context())
+	if err != nil {
+		return httphelper.AppErr(err, "listWebhooksHandler.Webhooks.ListSubscriptions")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving listWebhooksHandler")
+	return httphelper.AppResponse(http.StatusOK, subs)
+}
+
+func createWebhookHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering createWebhookHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "createWebhookHandler.requireAdmin")
+	}
+
+	subReq := &webhookmodels.SubscriptionRequest{}
+	if err := httphelper.ParseBody(res, req, subReq); err != nil {
+		return httphelper.AppErr(err, "createWebhookHandler.ParseBody")
+	}
+
+	if err := appCtxProvider.Validator.Validate(subReq); err != nil {
+		return httphelper.AppErr(err, "createWebhookHandler.Validate")
+	}
+
+	sub, err := appCtxProvider.Webhooks.CreateSubscription(req.Context(), subReq)
+	if err != nil {
+		return httphelper.AppErr(err, "createWebhookHandler.Webhooks.CreateSubscription")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving createWebhookHandler", zap.Int64("subscription_id", sub.ID))
+	return httphelper.AppResponse(http.StatusCreated, sub)
+}
+
+func getWebhookHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering getWebhookHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "getWebhookHandler.requireAdmin")
+	}
+
+	id, err := idVar(req)
+	if err != nil {
+		return httphelper.AppErr(err, "getWebhookHandler.idVar")
+	}
+
+	sub, err := appCtxProvider.Webhooks.ReadSubscription(req.Context(), id)
+	if err != nil {
+		return httphelper.AppErr(err, "getWebhookHandler.Webhooks.ReadSubscription")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving getWebhookHandler", zap.Int64("subscription_id", id))
+	return httphelper.AppResponse(http.StatusOK, sub)
+}
+
+func deleteWebhookHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering deleteWebhookHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "deleteWebhookHandler.requireAdmin")
+	}
+
+	id, err := idVar(req)
+	if err != nil {
+		return httphelper.AppErr(err, "deleteWebhookHandler.idVar")
+	}
+
+	if err = appCtxProvider.Webhooks.DeleteSubscription(req.Context(), id); err != nil {
+		return httphelper.AppErr(err, "deleteWebhookHandler.Webhooks.DeleteSubscription")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving deleteWebhookHandler", zap.Int64("subscription_id", id))
+	return httphelper.AppResponse(http.StatusNoContent, nil)
+}
+
+func listWebhookDeliveriesHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering listWebhookDeliveriesHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "listWebhookDeliveriesHandler.requireAdmin")
+	}
+
+	query, err := parseDeliveryQuery(req)
+	if err != nil {
+		return httphelper.AppErr(err, "listWebhookDeliveriesHandler.parseDeliveryQuery")
+	}
+
+	page, err := appCtxProvider.Webhooks.ListDeliveries(req.Context(), query)
+	if err != nil {
+		return httphelper.AppErr(err, "listWebhookDeliveriesHandler.Webhooks.ListDeliveries")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving listWebhookDeliveriesHandler")
+	return httphelper.AppResponse(http.StatusOK, page)
+}
+
+func retryWebhookDeliveryHandler(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error) {
+	appCtxProvider.Logger.For(req.Context()).Info("entering retryWebhookDeliveryHandler")
+
+	if err := requireAdmin(appCtxProvider, req); err != nil {
+		return httphelper.AppErr(err, "retryWebhookDeliveryHandler.requireAdmin")
+	}
+
+	id, err := idVar(req)
+	if err != nil {
+		return httphelper.AppErr(err, "retryWebhookDeliveryHandler.idVar")
+	}
+
+	delivery, err := appCtxProvider.Webhooks.RetryDelivery(req.Context(), id)
+	if err != nil {
+		return httphelper.AppErr(err, "retryWebhookDeliveryHandler.Webhooks.RetryDelivery")
+	}
+
+	appCtxProvider.Logger.For(req.Context()).Info("leaving retryWebhookDeliveryHandler", zap.Int64("delivery_id", id))
+	return httphelper.AppResponse(http.StatusOK, delivery)
+}
@@ -22,9 +22,14 @@ type api struct {
 	OpenEndPoints       []string `toml:"openendpoints"`
 }
 
+type proxy struct {
+	TrustedCIDRs []string `toml:"trustedcidrs"`
+	Header       string   `toml:"header"`
+}
+
 type token struct {
 	AccessTokenLifeSpanMins             uint16 `toml:"accesstokenlifespanmins"`
-	RefreshTokenLifeSpanMins            uint16 `toml:"refreshtokelifespanmins"`
+	RefreshTokenLifeSpanMins            uint16 `toml:"refreshtokenlifespanmins"`
 	FailedLoginAttemptCacheLifeSpanMins uint16 `toml:"failedloginattemptcachelifespanmins"`
 	FailedLoginAttemptsMax              uint16 `toml:"failedloginattemptsmax"`
 	AuthPrivateKeyPath                  string `toml:"authprivatekeypath"`
@@ -44,16 +49,24 @@ type db struct {
 	Timeout string `toml:"timeout"`
 }
 
+// CookieKey is a cookie hash/block key pair
+type CookieKey struct {
+	HashKey  string `toml:"hashkey"`
+	BlockKey string `toml:"blockkey"`
+}
+
 type cookie struct {
-	LifeSpanDays    uint16 `toml:"lifespandays"`
-	HashKey         string `toml:"hashkey"`
-	BlockKey        string `toml:"blockkey"`
-	Name            string `toml:"name"`
-	Domain          string `toml:"domain"`
-	KeyUserID       string `toml:"keyuserid"`
-	KeyEmail        string `toml:"keyemail"`
-	KeyJWTAccessID  string `toml:"keyjwtaccessid"`
-	KeyJWTRefreshID string `toml:"keyjwtrefreshid"`
+	LifeSpanDays    uint16      `toml:"lifespandays"`
+	HashKey         string      `toml:"hashkey"`
+	BlockKey        string      `toml:"blockkey"`
+	Name            string      `toml:"name"`
+	Domain          string      `toml:"domain"`
+	KeyUserID       string      `toml:"keyuserid"`
+	KeyEmail        string      `toml:"keyemail"`
+	KeyJWTAccessID  string      `toml:"keyjwtaccessid"`
+	KeyJWTRefreshID string      `toml:"keyjwtrefreshid"`
+	SameSite        string      `toml:"samesite"`
+	PreviousKeys    []CookieKey `toml:"previouskeys"`
 }
 
 type cache struct {
@@ -63,6 +76,240 @@ type cache struct {
 	UserAccountLockedLifeSpanMins uint16 `toml:"useraccountlockedlifespanmins"`
 }
 
+type password struct {
+	Algorithm          string `toml:"algorithm"`
+	BcryptCost         int    `toml:"bcryptcost"`
+	Argon2MemoryKiB    uint32 `toml:"argon2memorykib"`
+	Argon2MaxMemoryKiB uint32 `toml:"argon2maxmemorykib"`
+	Argon2Iterations   uint32 `toml:"argon2iterations"`
+	Argon2Parallelism  uint8  `toml:"argon2parallelism"`
+	Argon2SaltLength   uint32 `toml:"argon2saltlength"`
+	Argon2KeyLength    uint32 `toml:"argon2keylength"`
+}
+
+type passwordPolicy struct {
+	MinLength            int    `toml:"minlength"`
+	MaxLength            int    `toml:"maxlength"`
+	RequireUpper         bool   `toml:"requireupper"`
+	RequireLower         bool   `toml:"requirelower"`
+	RequireDigit         bool   `toml:"requiredigit"`
+	RequireSymbol        bool   `toml:"requiresymbol"`
+	RejectEmailLocalPart bool   `toml:"rejectemaillocalpart"`
+	HistoryCount         int    `toml:"historycount"`
+	BreachedCorpusPath   string `toml:"breachedcorpuspath"`
+}
+
+type loginLimit struct {
+	CacheKeyID      string `toml:"cachekeyid"`
+	WindowMins      uint16 `toml:"windowmins"`
+	MaxPerIP        uint16 `toml:"maxperip"`
+	MaxPerIPEmail   uint16 `toml:"maxperipemail"`
+	BackoffAfter    uint16 `toml:"backoffafter"`
+	BackoffBaseSecs uint16 `toml:"backoffbasesecs"`
+	BackoffMaxSecs  uint16 `toml:"backoffmaxsecs"`
+}
+
+// RateLimitRoute is the token bucket rate limit for a route ("*" is the default route)
+type RateLimitRoute struct {
+	Path         string  `toml:"path"`
+	Key          string  `toml:"key"`
+	Capacity     int     `toml:"capacity"`
+	RefillPerSec float64 `toml:"refillpersec"`
+}
+
+type rateLimit struct {
+	Enabled        bool             `toml:"enabled"`
+	Mode           string           `toml:"mode"`
+	CacheKeyID     string           `toml:"cachekeyid"`
+	ClientIDHeader string           `toml:"clientidheader"`
+	Routes         []RateLimitRoute `toml:"routes"`
+}
+
+type admin struct {
+	Group string `toml:"group"`
+}
+
+type audit struct {
+	OutputPaths            []string `toml:"outputpaths"`
+	DefaultPageSize        int      `toml:"defaultpagesize"`
+	MaxPageSize            int      `toml:"maxpagesize"`
+	CheckpointIntervalMins uint16   `toml:"checkpointintervalmins"`
+}
+
+type webhook struct {
+	Enabled          bool   `toml:"enabled"`
+	PollIntervalSecs uint16 `toml:"pollintervalsecs"`
+	BatchSize        int    `toml:"batchsize"`
+	Concurrency      int    `toml:"concurrency"`
+	TimeoutSecs      uint16 `toml:"timeoutsecs"`
+	MaxAttempts      int    `toml:"maxattempts"`
+	BackoffBaseSecs  uint16 `toml:"backoffbasesecs"`
+	BackoffMaxSecs   uint16 `toml:"backoffmaxsecs"`
+}
+
+type outbox struct {
+	Enabled          bool     `toml:"enabled"`
+	Sink             string   `toml:"sink"`
+	PollIntervalSecs uint16   `toml:"pollintervalsecs"`
+	BatchSize        int      `toml:"batchsize"`
+	LogOutputPaths   []string `toml:"logoutputpaths"`
+	HTTPURL          string   `toml:"httpurl"`
+	HTTPToken        string   `toml:"httptoken"`
+	HTTPTimeoutSecs  uint16   `toml:"httptimeoutsecs"`
+	StreamKey        string   `toml:"streamkey"`
+	StreamMaxLen     int64    `toml:"streammaxlen"`
+}
+
+type oidc struct {
+	Enabled           bool     `toml:"enabled"`
+	Issuer            string   `toml:"issuer"`
+	ClientID          string   `toml:"clientid"`
+	ClientSecret      string   `toml:"clientsecret"`
+	RedirectURL       string   `toml:"redirecturl"`
+	Scopes            []string `toml:"scopes"`
+	CreateUsers       bool     `toml:"createusers"`
+	StateCacheKeyID   string   `toml:"statecachekeyid"`
+	StateLifeSpanSecs uint16   `toml:"statelifespansecs"`
+	HTTPTimeoutSecs   uint16   `toml:"httptimeoutsecs"`
+}
+
+type ldap struct {
+	Enabled            bool              `toml:"enabled"`
+	URL                string            `toml:"url"`
+	StartTLS           bool              `toml:"starttls"`
+	InsecureSkipVerify bool              `toml:"insecureskipverify"`
+	BindDN             string            `toml:"binddn"`
+	BindPassword       string            `toml:"bindpassword"`
+	BaseDN             string            `toml:"basedn"`
+	UserFilter         string            `toml:"userfilter"`
+	GroupAttribute     string            `toml:"groupattribute"`
+	SyncGroups         bool              `toml:"syncgroups"`
+	GroupMap           map[string]string `toml:"groupmap"`
+	Domains            []string          `toml:"domains"`
+	TimeoutSecs        uint16            `toml:"timeoutsecs"`
+}
+
+type saml struct {
+	Enabled             bool              `toml:"enabled"`
+	EntityID            string            `toml:"entityid"`
+	ACSURL              string            `toml:"acsurl"`
+	CertificatePath     string            `toml:"certificatepath"`
+	PrivateKeyPath      string            `toml:"privatekeypath"`
+	IDPMetadataPath     string            `toml:"idpmetadatapath"`
+	AllowIDPInitiated   bool              `toml:"allowidpinitiated"`
+	EmailAttribute      string            `toml:"emailattribute"`
+	NameAttribute       string            `toml:"nameattribute"`
+	GroupsAttribute     string            `toml:"groupsattribute"`
+	TrustEmail          bool              `toml:"trustemail"`
+	CreateUsers         bool              `toml:"createusers"`
+	SyncGroups          bool              `toml:"syncgroups"`
+	GroupMap            map[string]string `toml:"groupmap"`
+	RequestCacheKeyID   string            `toml:"requestcachekeyid"`
+	RequestLifeSpanSecs uint16            `toml:"requestlifespansecs"`
+	AssertionCacheKeyID string            `toml:"assertioncachekeyid"`
+}
+
+type scim struct {
+	Enabled    bool   `toml:"enabled"`
+	Token      string `toml:"token"`
+	BaseURL    string `toml:"baseurl"`
+	MaxResults int    `toml:"maxresults"`
+}
+
+type pat struct {
+	Enabled              bool   `toml:"enabled"`
+	MaxPerUser           int    `toml:"maxperuser"`
+	DefaultLifespanDays  int    `toml:"defaultlifespandays"`
+	MaxLifespanDays      int    `toml:"maxlifespandays"`
+	LastUsedIntervalSecs uint16 `toml:"lastusedintervalsecs"`
+}
+
+type mail struct {
+	Backend       string `toml:"backend"`
+	Host          string `toml:"host"`
+	Port          int    `toml:"port"`
+	Username      string `toml:"username"`
+	Password      string `toml:"password"`
+	From          string `toml:"from"`
+	AllowInsecure bool   `toml:"allowinsecure"`
+	TimeoutSecs   uint16 `toml:"timeoutsecs"`
+}
+
+type magic struct {
+	Enabled      bool   `toml:"enabled"`
+	LinkURL      string `toml:"linkurl"`
+	LifeSpanSecs uint16 `toml:"lifespansecs"`
+	MaxAttempts  int    `toml:"maxattempts"`
+	MaxSends     int    `toml:"maxsends"`
+	CacheKeyID   string `toml:"cachekeyid"`
+}
+
+type stepUp struct {
+	Enabled         bool   `toml:"enabled"`
+	MaxAgeMins      uint16 `toml:"maxagemins"`
+	AdminRequireMFA bool   `toml:"adminrequiremfa"`
+}
+
+type loginHistory struct {
+	Enabled      bool  `toml:"enabled"`
+	FailureBurst int64 `toml:"failureburst"`
+	Notify       bool  `toml:"notify"`
+	ForceMFA     bool  `toml:"forcemfa"`
+	MaxHistory   int   `toml:"maxhistory"`
+}
+
+type csrf struct {
+	Enabled        bool     `toml:"enabled"`
+	CookieName     string   `toml:"cookiename"`
+	HeaderName     string   `toml:"headername"`
+	TrustedOrigins []string `toml:"trustedorigins"`
+	RequireOrigin  bool     `toml:"requireorigin"`
+	ExemptPaths    []string `toml:"exemptpaths"`
+}
+
+type session struct {
+	Mode              string `toml:"mode"`
+	AccessCookieName  string `toml:"accesscookiename"`
+	RefreshCookieName string `toml:"refreshcookiename"`
+}
+
+type dpop struct {
+	Enabled           bool   `toml:"enabled"`
+	CacheKeyID        string `toml:"cachekeyid"`
+	ProofLifeSpanSecs int    `toml:"prooflifespansecs"`
+	ClockSkewSecs     int    `toml:"clockskewsecs"`
+}
+
+// MTLSClient is an oauth client authenticated by its certificate (tls_client_auth, RFC 8705 2.1)
+// the certificate must have the SubjectDN (RFC 4514, ex: "CN=billing,O=Homerow") or the SANDNS dns name
+type MTLSClient struct {
+	ClientID  string `toml:"clientid"`
+	SubjectDN string `toml:"subjectdn"`
+	SANDNS    string `toml:"sandns"`
+}
+
+type mtls struct {
+	Enabled         bool         `toml:"enabled"`
+	CertificatePath string       `toml:"certificatepath"`
+	KeyPath         string       `toml:"keypath"`
+	ClientCAPath    string       `toml:"clientcapath"`
+	Clients         []MTLSClient `toml:"clients"`
+}
+
+type ipFilter struct {
+	Enabled             bool     `toml:"enabled"`
+	Allow               []string `toml:"allow"`
+	Deny                []string `toml:"deny"`
+	CacheKeyID          string   `toml:"cachekeyid"`
+	RefreshSecs         int      `toml:"refreshsecs"`
+	DefaultBlockMins    int      `toml:"defaultblockmins"`
+	MaxBlockMins        int      `toml:"maxblockmins"`
+	AutoBlock           bool     `toml:"autoblock"`
+	AutoBlockThreshold  int64    `toml:"autoblockthreshold"`
+	AutoBlockWindowMins int      `toml:"autoblockwindowmins"`
+	AutoBlockMins       int      `toml:"autoblockmins"`
+}
+
 type logger struct {
 	Level            string   `toml:"level"`
 	Encoding         string   `toml:"encoding"`
@@ -72,12 +319,35 @@ type logger struct {
 
 // Config the configuration struct for the service
 type Config struct {
-	API    api    `toml:"api"`
-	Logger logger `toml:"logger"`
-	Token  token  `toml:"token"`
-	DB     db     `toml:"db"`
-	Cookie cookie `toml:"cookie"`
-	Cache  cache  `toml:"cache"`
+	API            api            `toml:"api"`
+	Proxy          proxy          `toml:"proxy"`
+	Logger         logger         `toml:"logger"`
+	Token          token          `toml:"token"`
+	DB             db             `toml:"db"`
+	Cookie         cookie         `toml:"cookie"`
+	Cache          cache          `toml:"cache"`
+	Password       password       `toml:"password"`
+	PasswordPolicy passwordPolicy `toml:"passwordpolicy"`
+	LoginLimit     loginLimit     `toml:"loginlimit"`
+	RateLimit      rateLimit      `toml:"ratelimit"`
+	Admin          admin          `toml:"admin"`
+	Audit          audit          `toml:"audit"`
+	Webhook        webhook        `toml:"webhook"`
+	Outbox         outbox         `toml:"outbox"`
+	OIDC           oidc           `toml:"oidc"`
+	LDAP           ldap           `toml:"ldap"`
+	SAML           saml           `toml:"saml"`
+	SCIM           scim           `toml:"scim"`
+	PAT            pat            `toml:"pat"`
+	Mail           mail           `toml:"mail"`
+	Magic          magic          `toml:"magic"`
+	StepUp         stepUp         `toml:"stepup"`
+	LoginHistory   loginHistory   `toml:"loginhistory"`
+	IPFilter       ipFilter       `toml:"ipfilter"`
+	CSRF           csrf           `toml:"csrf"`
+	Session        session        `toml:"session"`
+	DPoP           dpop           `toml:"dpop"`
+	MTLS           mtls           `toml:"mtls"`
 }
 
 // defConfig which is sane defaults for development purposes (local).
@@ -95,10 +365,14 @@ func defConfig() Config {
 			WriteTimeOutSecs:    30,
 			ReadTimeOutSecs:     5,
 			TimeoutSecs:         30,
-			AllowedHeaders:      []string{"X-Requested-With", "X-Request-ID", "jaeger-debug-id", "Content-Type", "Authorization"},
+			AllowedHeaders:      []string{"X-Requested-With", "X-Request-ID", "jaeger-debug-id", "Content-Type", "Authorization", "X-CSRF-Token", "X-Session-Mode", "DPoP"},
 			AllowedOrigins:      []string{"*"},
 			AllowedMethods:      []string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"},
-			OpenEndPoints:       []string{"/login", "/health/ping", "/register"},
+			OpenEndPoints:       []string{"/login", "/health/ping", "/register", "/login/oidc", "/login/oidc/callback", "/saml/metadata", "/saml/login", "/saml/acs", "/login/magic", "/login/magic/verify", "/oauth/token"},
+		},
+		Proxy: proxy{
+			TrustedCIDRs: []string{"127.0.0.1/32", "::1/128"}, // loopback only, add the exact address of your proxy (ex: the local nginx container)
+			Header:       "X-Forwarded-For",                   // the header the local nginx sets
 		},
 		Logger: logger{
 			Level:            "debug",
@@ -136,6 +410,8 @@ func defConfig() Config {
 			KeyEmail:        "email",
 			KeyJWTAccessID:  "jti-access",
 			KeyJWTRefreshID: "jti-refresh",
+			SameSite:        "lax",         // strict, lax or none (none is only needed when a cross site page calls the api with the cookie)
+			PreviousKeys:    []CookieKey{}, // older key pairs (newest first) still decode cookies, HashKey/BlockKey encode
 		},
 		Cache: cache{
 			Host:                          "redis",
@@ -143,6 +419,208 @@ func defConfig() Config {
 			UserAccountLockedLifeSpanMins: 60,
 			UserAccountLockedKeyID:        "account-locked-user",
 		},
+		Password: password{
+			Algorithm:          "argon2id",
+			BcryptCost:         12,
+			Argon2MemoryKiB:    64 * 1024,  // 64 MiB
+			Argon2MaxMemoryKiB: 256 * 1024, // 256 MiB, the most a stored (or imported) hash may make a login allocate
+			Argon2Iterations:   3,
+			Argon2Parallelism:  2,
+			Argon2SaltLength:   16,
+			Argon2KeyLength:    32,
+		},
+		PasswordPolicy: passwordPolicy{
+			MinLength:            12,
+			MaxLength:            64,
+			RequireUpper:         true,
+			RequireLower:         true,
+			RequireDigit:         true,
+			RequireSymbol:        false,
+			RejectEmailLocalPart: true,
+			HistoryCount:         5,
+			BreachedCorpusPath:   "", // disabled, ex: /tmp/breached/sha1-prefixes.txt
+		},
+		LoginLimit: loginLimit{
+			CacheKeyID:      "login-limit",
+			WindowMins:      15,
+			MaxPerIP:        50,  // credential stuffing (many emails, one IP)
+			MaxPerIPEmail:   10,  // brute force (one email, one IP)
+			BackoffAfter:    3,   // free failures before the backoff kicks in
+			BackoffBaseSecs: 2,   // 2s, 4s, 8s...
+			BackoffMaxSecs:  300, // 5 minutes
+		},
+		RateLimit: rateLimit{
+			Enabled:        true,
+			Mode:           "redis", // redis (distributed) or memory (per instance)
+			CacheKeyID:     "rate-limit",
+			ClientIDHeader: "X-Client-ID",
+			Routes: []RateLimitRoute{
+				{Path: "/register", Key: "ip", Capacity: 5, RefillPerSec: 0.1},
+				{Path: "/login", Key: "ip", Capacity: 20, RefillPerSec: 1},
+				{Path: "/health", Key: "ip", Capacity: 10, RefillPerSec: 1},
+				{Path: "/users", Key: "subject", Capacity: 30, RefillPerSec: 1},
+				{Path: "*", Key: "ip", Capacity: 100, RefillPerSec: 10}, // default (all other routes)
+			},
+		},
+		Admin: admin{
+			Group: "admin", // members of this group can manage user accounts
+		},
+		Audit: audit{
+			OutputPaths:            []string{}, // optional audit log sink (separate from the app logs), ex: /tmp/logs/tokensvc.audit.logs
+			DefaultPageSize:        50,
+			MaxPageSize:            500,
+			CheckpointIntervalMins: 60, // signed audit chain checkpoints (0 disables)
+		},
+		Webhook: webhook{
+			Enabled:          true,
+			PollIntervalSecs: 5, // outbox and retry polling
+			BatchSize:        100,
+			Concurrency:      4,     // deliveries sent in parallel
+			TimeoutSecs:      10,    // per delivery attempt
+			MaxAttempts:      8,     // then the delivery is dead (dead-letter queue)
+			BackoffBaseSecs:  30,    // 30s, 1m, 2m...
+			BackoffMaxSecs:   21600, // 6 hours
+		},
+		Outbox: outbox{
+			Enabled:          true,
+			Sink:             "log", // log, http or redis (streams)
+			PollIntervalSecs: 2,
+			BatchSize:        100,
+			LogOutputPaths:   []string{"stdout"},
+			HTTPURL:          "", // the http sink POSTs each event, ex: https://events.homerow.tech/token-svc
+			HTTPToken:        "", // optional bearer token
+			HTTPTimeoutSecs:  10,
+			StreamKey:        "token-svc-user-events",
+			StreamMaxLen:     100000, // approximate, 0 keeps every entry
+		},
+		OIDC: oidc{
+			Enabled:           false,
+			Issuer:            "", // ex: https://accounts.google.com (the discovery document is read from the issuer)
+			ClientID:          "",
+			ClientSecret:      "",
+			RedirectURL:       "https://dev.homerow.tech/login/oidc/callback",
+			Scopes:            []string{"openid", "email", "profile"},
+			CreateUsers:       true, // create a (passwordless) user for an unknown verified email
+			StateCacheKeyID:   "oidc-state",
+			StateLifeSpanSecs: 600, // time allowed to sign in at the identity provider
+			HTTPTimeoutSecs:   10,
+		},
+		LDAP: ldap{
+			Enabled:            false,
+			URL:                "ldaps://ldap.homerow.tech:636", // ldap:// with starttls, or ldaps://
+			StartTLS:           false,
+			InsecureSkipVerify: false,
+			BindDN:             "cn=token-svc,ou=services,dc=homerow,dc=tech", // service account used to find the user
+			BindPassword:       "",
+			BaseDN:             "ou=people,dc=homerow,dc=tech",
+			UserFilter:         "(&(objectClass=person)(mail={email}))", // AD: (&(objectClass=user)(userPrincipalName={email}))
+			GroupAttribute:     "memberOf",
+			SyncGroups:         false,                          // replace the user's ldap groups with the mapped directory groups each login
+			GroupMap:           map[string]string{},            // group dn => local group, unmapped groups are dropped, ex: {"cn=token-svc-admins,ou=groups,dc=homerow,dc=tech" = "admin"}
+			Domains:            []string{"staff.homerow.tech"}, // emails in these domains authenticate against ldap
+			TimeoutSecs:        10,
+		},
+		SAML: saml{
+			Enabled:             false,
+			EntityID:            "https://dev.homerow.tech/saml/metadata",
+			ACSURL:              "https://dev.homerow.tech/saml/acs",
+			CertificatePath:     "/tmp/certs/saml.crt", // the SP signing/encryption key pair (RSA)
+			PrivateKeyPath:      "/tmp/certs/saml.key",
+			IDPMetadataPath:     "/tmp/certs/saml-idp-metadata.xml",
+			AllowIDPInitiated:   false,
+			EmailAttribute:      "email", // falls back to the NameID when it is an email address
+			NameAttribute:       "displayName",
+			GroupsAttribute:     "groups",
+			TrustEmail:          true, // the idp's emails are verified (an existing user is linked by email)
+			CreateUsers:         true,
+			SyncGroups:          false,               // replace the user's saml groups with the mapped idp groups each login
+			GroupMap:            map[string]string{}, // idp group => local group, unmapped idp groups are dropped, ex: {"Token Svc Admins" = "admin"}
+			RequestCacheKeyID:   "saml-request",
+			RequestLifeSpanSecs: 600,              // time allowed to sign in at the identity provider
+			AssertionCacheKeyID: "saml-assertion", // the used assertion ids (until they expire), a replayed assertion is rejected
+		},
+		SCIM: scim{
+			Enabled:    false,
+			Token:      "", // the provisioning client's bearer token
+			BaseURL:    "https://dev.homerow.tech/scim/v2",
+			MaxResults: 200,
+		},
+		PAT: pat{
+			Enabled:              true,
+			MaxPerUser:           50, // active tokens
+			DefaultLifespanDays:  90,
+			MaxLifespanDays:      365,
+			LastUsedIntervalSecs: 60, // last used is written at most once a minute (or when the ip changes)
+		},
+		Mail: mail{
+			Backend:       "log", // log or smtp, the log backend does not send mail
+			Host:          "smtp.homerow.tech",
+			Port:          587,
+			Username:      "",
+			Password:      "",
+			From:          "token-svc <no-reply@homerow.tech>",
+			AllowInsecure: false, // send without STARTTLS (local mail catchers only)
+			TimeoutSecs:   10,
+		},
+		Magic: magic{
+			Enabled:      false,
+			LinkURL:      "https://dev.homerow.tech/login/magic", // the page that posts the link token to /login/magic/verify
+			LifeSpanSecs: 600,
+			MaxAttempts:  5, // wrong codes, then the login is burned
+			MaxSends:     3, // emails per address per lifespan
+			CacheKeyID:   "magic-login",
+		},
+		StepUp: stepUp{
+			Enabled:         true,
+			MaxAgeMins:      10,    // sensitive routes need a login (or POST /me/reauth) within this many minutes
+			AdminRequireMFA: false, // admin changes also need a multi factor login (acr aal2)
+		},
+		LoginHistory: loginHistory{
+			Enabled:      true,
+			FailureBurst: 3,     // failed logins before a success that make it risky
+			Notify:       true,  // email the user about a risky login
+			ForceMFA:     false, // reject a risky login that is not multi factor
+			MaxHistory:   100,   // logins kept per user (older logins are forgotten, devices included)
+		},
+		CSRF: csrf{
+			Enabled:        true,
+			CookieName:     "csrf_token", // readable by the page, sent back in the HeaderName header
+			HeaderName:     "X-CSRF-Token",
+			TrustedOrigins: []string{"https://dev.homerow.tech"}, // origins (besides the api's own) allowed to make state changing requests
+			RequireOrigin:  true,                                 // a state changing request with the cookie must have an Origin or Referer
+			ExemptPaths:    []string{"/saml/acs"},                // the idp posts the saml response cross site (the assertion is signed)
+		},
+		Session: session{
+			Mode:              "header", // header (the client sends the bearer token) or cookie (the tokens are HttpOnly cookies, csrf is enforced)
+			AccessCookieName:  "homerow-access",
+			RefreshCookieName: "homerow-refresh",
+		},
+		DPoP: dpop{
+			Enabled:           true, // a client opts in by sending a proof, unbound tokens are still accepted
+			CacheKeyID:        "dpop-jti",
+			ProofLifeSpanSecs: 300, // how old a proof (iat) can be, its jti is remembered this long
+			ClockSkewSecs:     30,
+		},
+		MTLS: mtls{
+			Enabled:         false, // serve tls (the service terminates tls itself), client certificates are optional
+			CertificatePath: "/tmp/certs/server.crt",
+			KeyPath:         "/tmp/certs/server.key",
+			ClientCAPath:    "/tmp/certs/client-ca.crt", // the ca bundle client certificates are verified against
+			Clients:         []MTLSClient{},
+		},
+		IPFilter: ipFilter{
+			Enabled:             true,
+			Allow:               []string{}, // when set only these networks are allowed (the deny list and blocklist still apply)
+			Deny:                []string{},
+			CacheKeyID:          "ip-blocklist",
+			RefreshSecs:         5, // how stale an instance's copy of the blocklist can be
+			DefaultBlockMins:    60,
+			MaxBlockMins:        43200, // 30 days
+			AutoBlock:           false, // block an ip after AutoBlockThreshold suspicious token errors in AutoBlockWindowMins
+			AutoBlockThreshold:  10,
+			AutoBlockWindowMins: 10,
+			AutoBlockMins:       60,
+		},
 	}
 }
 
@@ -0,0 +1,21 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestConfigFile(t *testing.T) {
+	var cfg Config
+	md, err := toml.DecodeFile("../../config.toml", &cfg)
+	if err != nil {
+		t.Fatalf("DecodeFile() error = %v", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		t.Errorf("DecodeFile() keys without a config field = %v", undecoded)
+	}
+	if cfg.Token.RefreshTokenLifeSpanMins == 0 {
+		t.Errorf("DecodeFile() Token.RefreshTokenLifeSpanMins = 0")
+	}
+}
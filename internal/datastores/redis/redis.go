@@ -3,6 +3,7 @@ package redis
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/tjsampson/token-svc/internal/config"
@@ -22,9 +23,28 @@ type Provider interface {
 	Ping(ctx context.Context) (string, error)
 	Close() error
 	Set(ctx context.Context, key string, value string, exp time.Duration) error
+	SetNX(ctx context.Context, key string, value string, exp time.Duration) (bool, error)
 	Get(ctx context.Context, key string) (string, error)
+	Incr(ctx context.Context, key string, exp time.Duration) (int64, error)
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	Del(ctx context.Context, keys ...string) error
+	TakeToken(ctx context.Context, key string, capacity int, refillPerSec float64) (bool, float64, error)
+	XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error)
+	HSet(ctx context.Context, key, field, value string) error
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	HDel(ctx context.Context, key string, fields ...string) error
 }
 
+// incrScript atomically increments the counter and starts its expiration on the first increment
+// (a Get-then-Set is racy, concurrent requests can read the same count)
+var incrScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
 type provider struct {
 	client *redis.Client
 	cfg    *config.Config
@@ -99,6 +119,124 @@ func (p *provider) Set(ctx context.Context, key string, value string, exp time.D
 	return err
 }
 
+// SetNX sets the key only if it does not exist, it reports if the key was set
+// (a single use marker, ex: a replayed assertion id is not set)
+func (p *provider) SetNX(ctx context.Context, key string, value string, exp time.Duration) (bool, error) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := p.tracer.StartSpan("CACHE SETNX", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "redis")
+		span.SetTag("param.key", key)
+		defer span.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	set, err := p.client.SetNX(key, value, exp).Result()
+	if err != nil {
+		p.logger.For(ctx).Error("failed to setnx cache", zap.String("cache_key", key), zap.Error(err))
+		return false, err
+	}
+	p.logger.For(ctx).Info("cache setnx", zap.String("cache_key", key), zap.Bool("set", set))
+	return set, nil
+}
+
+// tokenBucketScript atomically refills the bucket (based on elapsed time) and takes a token
+// returns {allowed, remaining tokens}
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + (math.max(0, now - ts) / 1000) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((capacity / rate) * 1000))
+return {allowed, tostring(tokens)}
+`)
+
+// TakeToken takes a token from the (distributed) token bucket
+// the bucket holds up to capacity tokens and refills at refillPerSec
+func (p *provider) TakeToken(ctx context.Context, key string, capacity int, refillPerSec float64) (bool, float64, error) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := p.tracer.StartSpan("CACHE TOKEN BUCKET", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "redis")
+		span.SetTag("param.key", key)
+		defer span.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	result, err := tokenBucketScript.Run(p.client, []string{key}, capacity, refillPerSec, time.Now().UnixNano()/int64(time.Millisecond)).Result()
+	if err != nil {
+		p.logger.For(ctx).Error("failed token bucket", zap.String("cache_key", key), zap.Error(err))
+		return false, 0, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected token bucket result: %v", result)
+	}
+	allowed, _ := values[0].(int64)
+	remaining, _ := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+	return allowed == 1, remaining, nil
+}
+
+// Incr atomically increments the counter key, the expiration is set when the key is created
+func (p *provider) Incr(ctx context.Context, key string, exp time.Duration) (int64, error) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := p.tracer.StartSpan("CACHE INCR", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "redis")
+		span.SetTag("param.key", key)
+		defer span.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	count, err := incrScript.Run(p.client, []string{key}, exp.Milliseconds()).Int64()
+	if err != nil {
+		p.logger.For(ctx).Error("failed to incr cache", zap.String("cache_key", key), zap.Error(err))
+		return 0, err
+	}
+
+	p.logger.For(ctx).Info("cache incr", zap.String("cache_key", key), zap.Int64("cache_value", count))
+	return count, nil
+}
+
+// TTL returns the remaining time to live of the key
+// a missing key (or a key without an expiration) returns a negative duration
+func (p *provider) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := p.client.PTTL(key).Result()
+	if err != nil {
+		p.logger.For(ctx).Error("failed ttl cache key", zap.String("cache_key", key), zap.Error(err))
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// Del removes the keys from the cache
+func (p *provider) Del(ctx context.Context, keys ...string) error {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := p.tracer.StartSpan("CACHE DEL", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "redis")
+		defer span.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	if err := p.client.Del(keys...).Err(); err != nil {
+		p.logger.For(ctx).Error("failed to del cache", zap.Strings("cache_keys", keys), zap.Error(err))
+		return err
+	}
+	p.logger.For(ctx).Info("cache del", zap.Strings("cache_keys", keys))
+	return nil
+}
+
 // Ping issues a ping to the redis server to check health/status
 func (p *provider) Ping(ctx context.Context) (string, error) {
 	p.logger.For(ctx).Info("cache ping")
@@ -134,3 +272,70 @@ func (p *provider) Close() error {
 	}
 	return nil
 }
+
+// XAdd appends the entry to the stream, the stream is trimmed to (approximately) maxLen entries (0 does not trim)
+// returns the entry id
+func (p *provider) XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error) {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := p.tracer.StartSpan("CACHE XADD", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "redis")
+		span.SetTag("param.stream", stream)
+		defer span.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	id, err := p.client.XAdd(&redis.XAddArgs{Stream: stream, MaxLenApprox: maxLen, Values: values}).Result()
+	if err != nil {
+		p.logger.For(ctx).Error("failed stream add", zap.String("stream", stream), zap.Error(err))
+		return "", err
+	}
+	return id, nil
+}
+
+// HSet sets the hash field
+func (p *provider) HSet(ctx context.Context, key, field, value string) error {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := p.tracer.StartSpan("CACHE HSET", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "redis")
+		span.SetTag("param.key", key)
+		span.SetTag("param.field", field)
+		defer span.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	if err := p.client.HSet(key, field, value).Err(); err != nil {
+		p.logger.For(ctx).Error("failed to hset cache", zap.String("cache_key", key), zap.String("field", field), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// HGetAll returns every field of the hash (empty for a missing key)
+func (p *provider) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	values, err := p.client.HGetAll(key).Result()
+	if err != nil {
+		p.logger.For(ctx).Error("failed to hgetall cache", zap.String("cache_key", key), zap.Error(err))
+		return nil, err
+	}
+	return values, nil
+}
+
+// HDel removes the hash fields
+func (p *provider) HDel(ctx context.Context, key string, fields ...string) error {
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := p.tracer.StartSpan("CACHE HDEL", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "redis")
+		span.SetTag("param.key", key)
+		defer span.Finish()
+		ctx = opentracing.ContextWithSpan(ctx, span)
+	}
+
+	if err := p.client.HDel(key, fields...).Err(); err != nil {
+		p.logger.For(ctx).Error("failed to hdel cache", zap.String("cache_key", key), zap.Strings("fields", fields), zap.Error(err))
+		return err
+	}
+	return nil
+}
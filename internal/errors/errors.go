@@ -9,11 +9,30 @@ import (
 )
 
 // RestError represents a Rest HTTP Error that can be returned from a controller
+// RetryAfterSecs is sent as the Retry-After header (i.e. 429 Too Many Requests)
+// Reason is a machine readable error for the client to act on (i.e. step_up_required)
 type RestError struct {
-	Code          int    `json:"code"`
-	Message       string `json:"message"`
-	Messages	  []string `json:"messages"`
-	OriginalError error  `json:"-"`
+	Code           int      `json:"code"`
+	Message        string   `json:"message"`
+	Messages       []string `json:"messages"`
+	RetryAfterSecs int      `json:"retry_after,omitempty"`
+	Reason         string   `json:"error,omitempty"`
+	StepUp         *StepUp  `json:"step_up,omitempty"`
+	OriginalError  error    `json:"-"`
+}
+
+// Error reasons
+const (
+	// ReasonStepUpRequired is the Reason of a request that needs a more recent or stronger authentication
+	ReasonStepUpRequired = "step_up_required"
+	// ReasonMFARequired is the Reason of a (risky) login that must be multi factor
+	ReasonMFARequired = "mfa_required"
+)
+
+// StepUp is the authentication a step_up_required error asks for (see POST /me/reauth)
+type StepUp struct {
+	MaxAgeSecs int    `json:"max_age"`
+	ACR        string `json:"acr_values,omitempty"`
 }
 
 func (re *RestError) Error() string {
@@ -21,6 +21,12 @@ func AppResponse(code int, response interface{}) (int, interface{}, error) {
 	return code, response, nil
 }
 
+// RawResponse is a non JSON response payload (ex: XML), it is written as is
+type RawResponse struct {
+	ContentType string
+	Body        []byte
+}
+
 // Vars gets the url variables
 func Vars(r *http.Request) map[string]string {
 	return mux.Vars(r)
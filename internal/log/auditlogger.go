@@ -1,14 +1,49 @@
 package log
 
 import (
+	"github.com/tjsampson/token-svc/internal/config"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// auditLogger is the audit event sink
+// it is isolated from the application logs (separate outputs, no log level filtering)
 type auditLogger struct {
 	logger *zap.Logger
 }
 
+// NewAuditLogger creates the audit Logger for the configured audit output paths
+// no output paths returns a Logger that discards everything (the database is the audit log of record)
+func NewAuditLogger(appCfg *config.Config) (Logger, error) {
+	if len(appCfg.Audit.OutputPaths) == 0 {
+		return auditLogger{logger: zap.NewNop()}, nil
+	}
+
+	cfg := zap.Config{
+		Level:            zap.NewAtomicLevelAt(zap.InfoLevel),
+		Encoding:         "json",
+		OutputPaths:      appCfg.Audit.OutputPaths,
+		ErrorOutputPaths: appCfg.Logger.ErrorOutputPaths,
+		InitialFields: map[string]interface{}{
+			"service": appCfg.API.ServiceName,
+			"audit":   true,
+		},
+		EncoderConfig: zapcore.EncoderConfig{
+			MessageKey: "event",
+
+			TimeKey:    "time",
+			EncodeTime: zapcore.ISO8601TimeEncoder,
+		},
+	}
+
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return auditLogger{logger: logger}, nil
+}
+
 func (al auditLogger) Audit(msg string, fields ...zapcore.Field) {
 	al.logger.Info(msg, fields...)
 }
@@ -34,6 +69,6 @@ func (al auditLogger) Fatal(msg string, fields ...zapcore.Field) {
 }
 
 // With creates a child logger, and optionally adds some context fields to that logger.
-// func (al auditLogger) With(fields ...zapcore.Field) Logger {
-// 	return auditLogger{logger: al.logger.With(fields...), span: al.span}
-// }
+func (al auditLogger) With(fields ...zapcore.Field) Logger {
+	return auditLogger{logger: al.logger.With(fields...)}
+}
@@ -74,6 +74,11 @@ func NewFactory(appCfg *config.Config, logger *zap.Logger) Factory {
 	return Factory{logger: logger}
 }
 
+// NewNopFactory creates a Factory that discards all logs (i.e. tests)
+func NewNopFactory() Factory {
+	return Factory{logger: zap.NewNop()}
+}
+
 // Bg creates a context-unaware logger.
 func (b Factory) Bg() Logger {
 	return logger(b)
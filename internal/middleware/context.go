@@ -2,51 +2,60 @@ package middleware
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/services/mtlsservice"
+	"github.com/tjsampson/token-svc/pkg/helpers/iphelpers"
+
 	uuid "github.com/satori/go.uuid"
 )
 
-type key int
-
 const (
-	requestIDKey          key = 0
-	requestStartTimeKey   key = 1
-	userIPKey             key = 2
-	jwtIDKey              key = 3
-	tokenSvcRequestHeader     = "X-Request-ID"
+	tokenSvcRequestHeader = "X-Request-ID"
 )
 
-// userIPFromRequest extracts the user IP address from req, if present.
-func userIPFromRequest(req *http.Request) (net.IP, error) {
-	ip, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return nil, fmt.Errorf("userip: %q is not IP:port", req.RemoteAddr)
-	}
-
-	userIP := net.ParseIP(ip)
-	if userIP == nil {
-		return nil, fmt.Errorf("userip: %q is not IP:port", req.RemoteAddr)
-	}
-	return userIP, nil
+// userIPFromRequest extracts the user IP address (and the forwarding chain) from req, if present.
+// the forwarding headers are only believed from the trusted proxies (see iphelpers.Proxies.ClientIP)
+func userIPFromRequest(req *http.Request, proxies iphelpers.Proxies, proxyHeader string) (net.IP, []net.IP, error) {
+	return proxies.ClientIP(req, proxyHeader)
 }
 
 // NewJWTIDContext returns a new Context carrying the JWT ID.
 func newJWTIDContext(ctx context.Context, jti string) context.Context {
-	return context.WithValue(ctx, jwtIDKey, jti)
+	return requestcontext.NewJWTIDContext(ctx, jti)
+}
+
+// newUserIDContext returns a new Context carrying the authenticated user ID.
+func newUserIDContext(ctx context.Context, userID int) context.Context {
+	return requestcontext.NewUserIDContext(ctx, userID)
+}
+
+// newTokenScopesContext returns a new Context carrying the personal access token scopes.
+func newTokenScopesContext(ctx context.Context, scopes []string) context.Context {
+	return requestcontext.NewTokenScopesContext(ctx, scopes)
+}
+
+// newAuthenticationContext returns a new Context carrying the user's authentication (the access token claims).
+func newAuthenticationContext(ctx context.Context, auth requestcontext.AuthInfo) context.Context {
+	return requestcontext.NewAuthenticationContext(ctx, auth)
+}
+
+// newDPoPThumbprintContext returns a new Context carrying the thumbprint of the request's DPoP proof key.
+func newDPoPThumbprintContext(ctx context.Context, jkt string) context.Context {
+	return requestcontext.NewDPoPThumbprintContext(ctx, jkt)
 }
 
 // NewUserIPContext returns a new Context carrying userIP.
 func newUserIPContext(ctx context.Context, userIP net.IP) context.Context {
-	return context.WithValue(ctx, userIPKey, userIP)
+	return requestcontext.NewUserIPContext(ctx, userIP)
 }
 
 // NewStartTimeContext returns a new Context carrying startTime.
 func newStartTimeContext(ctx context.Context) context.Context {
-	return context.WithValue(ctx, requestStartTimeKey, time.Now())
+	return requestcontext.NewStartTimeContext(ctx, time.Now())
 }
 
 // NewRequestIDContext returns a new Context carrying startTime.
@@ -56,32 +65,63 @@ func newRequestIDContext(req *http.Request) context.Context {
 	if reqID == "" {
 		reqID = uuid.NewV4().String()
 	}
-	return context.WithValue(ctx, requestIDKey, reqID)
+	return requestcontext.NewRequestIDContext(ctx, reqID)
 }
 
-func newWrappedReqCtx(req *http.Request) context.Context {
-	userIP, _ := userIPFromRequest(req)
-	return newUserIPContext(newStartTimeContext(newRequestIDContext(req)), userIP)
+func newWrappedReqCtx(req *http.Request, proxies iphelpers.Proxies, proxyHeader string) context.Context {
+	userIP, chain, _ := userIPFromRequest(req, proxies, proxyHeader)
+	ctx := newUserIPContext(newStartTimeContext(newRequestIDContext(req)), userIP)
+	ctx = requestcontext.NewProxyChainContext(ctx, chain)
+	// a verified client certificate (mutual tls) binds the tokens issued to the request
+	if cert := mtlsservice.PeerCertificate(req.TLS); cert != nil {
+		ctx = requestcontext.NewCertThumbprintContext(ctx, mtlsservice.Thumbprint(cert))
+	}
+	return requestcontext.NewUserAgentContext(ctx, req.UserAgent())
 }
 
 // JWTIDFromContext returns the JWTD ID from the context
 func JWTIDFromContext(ctx context.Context) string {
-	return ctx.Value(jwtIDKey).(string)
+	return requestcontext.JWTID(ctx)
+}
+
+// UserIDFromContext returns the authenticated user ID from the context
+func UserIDFromContext(ctx context.Context) int {
+	return requestcontext.UserID(ctx)
+}
+
+// TokenScopesFromContext returns the personal access token scopes from the context
+// ok is false when the request was authenticated by the JWT and cookie (which have every scope)
+func TokenScopesFromContext(ctx context.Context) ([]string, bool) {
+	return requestcontext.TokenScopes(ctx)
+}
+
+// AuthenticationFromContext returns how and when the user authenticated
+// ok is false when the request was not authenticated by the JWT and cookie (ex: a personal access token)
+func AuthenticationFromContext(ctx context.Context) (requestcontext.AuthInfo, bool) {
+	return requestcontext.Authentication(ctx)
 }
 
 // UserIPFromContext extracts the user IP address from ctx, if present.
 func UserIPFromContext(ctx context.Context) net.IP {
-	// ctx.Value returns nil if ctx has no value for the key;
-	// the net.IP type assertion returns ok=false for nil.
-	return ctx.Value(userIPKey).(net.IP)
+	return requestcontext.UserIP(ctx)
+}
+
+// ProxyChainFromContext returns the forwarding chain (client first, the remote address last) from ctx, if present.
+func ProxyChainFromContext(ctx context.Context) []net.IP {
+	return requestcontext.ProxyChain(ctx)
+}
+
+// DPoPThumbprintFromContext returns the thumbprint of the request's verified DPoP proof key ("" without a proof)
+func DPoPThumbprintFromContext(ctx context.Context) string {
+	return requestcontext.DPoPThumbprint(ctx)
 }
 
 // RequestIDFromContext returns the requestID from the http Context
 func RequestIDFromContext(ctx context.Context) string {
-	return ctx.Value(requestIDKey).(string)
+	return requestcontext.RequestID(ctx)
 }
 
 // RequestStartTimeFromContext returns the requestStartTime from the http Context
 func RequestStartTimeFromContext(ctx context.Context) time.Time {
-	return ctx.Value(requestStartTimeKey).(time.Time)
+	return requestcontext.RequestStartTime(ctx)
 }
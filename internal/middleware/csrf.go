@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"go.uber.org/zap"
+)
+
+// safeMethods do not change state, they are not checked (and they refresh the csrf token cookie)
+var safeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// CSRFHandler protects the state changing requests of a browser
+// an Origin (or Referer) must be the api's own origin or a trusted origin, without either a request with the session cookie
+// is rejected (RequireOrigin), and a request with the session cookie must send the session's csrf token in the csrf header
+// a request without the session cookie (ex: a personal access token) has no ambient authority and only has the origin check
+// cookie session mode always enforces it (the tokens are cookies, they are sent with every request)
+func CSRFHandler(appCtx *serviceprovider.Context) Adapter {
+	trusted := map[string]bool{}
+	for _, origin := range appCtx.Config.CSRF.TrustedOrigins {
+		trusted[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	exempt := map[string]bool{}
+	for _, path := range appCtx.Config.CSRF.ExemptPaths {
+		exempt[path] = true
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			enforced := appCtx.Config.CSRF.Enabled || appCtx.Config.Session.Mode == authmodels.SessionModeCookie
+			if !enforced || exempt[r.URL.Path] {
+				h.ServeHTTP(w, r)
+				return
+			}
+			ctx := r.Context()
+			sessionID := appCtx.CookieOven.DecodedCookie(ctx, r)[appCtx.Config.Cookie.KeyJWTAccessID]
+
+			if safeMethods[r.Method] {
+				// the page gets (or keeps) the token of its session (with the current cookie key)
+				token := appCtx.CookieOven.CSRFToken(sessionID)
+				if current, err := r.Cookie(appCtx.Config.CSRF.CookieName); token != "" && (err != nil || current.Value != token) {
+					http.SetCookie(w, appCtx.CookieOven.CSRFCookie(token))
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			forbidden := func(message string) {
+				appCtx.Logger.For(ctx).Error("CSRFHandler - Forbidden", zap.String("reason", message), zap.String("origin", r.Header.Get("Origin")), zap.String("referer", r.Referer()))
+				rerr := internalerrors.RestError{Code: http.StatusForbidden, Message: message}
+				response, _ := json.Marshal(rerr)
+				writeResponse(w, r, rerr.Code, response)
+			}
+
+			_, cookieErr := r.Cookie(appCtx.Config.Cookie.Name)
+			hasCookie := cookieErr == nil
+			switch origin := requestOrigin(r); {
+			case origin == "" && hasCookie && appCtx.Config.CSRF.RequireOrigin:
+				forbidden("missing origin")
+				return
+			case origin != "" && !trusted[origin] && origin != ownOrigin(r):
+				forbidden("untrusted origin")
+				return
+			}
+
+			if sessionID != "" && !appCtx.CookieOven.ValidCSRFToken(sessionID, r.Header.Get(appCtx.Config.CSRF.HeaderName)) {
+				forbidden("invalid csrf token")
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestOrigin returns the request's origin (scheme://host) from the Origin header, or else the Referer
+func requestOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		referer, err := url.Parse(r.Referer())
+		if err != nil || referer.Host == "" {
+			return ""
+		}
+		origin = referer.Scheme + "://" + referer.Host
+	}
+	return strings.ToLower(origin)
+}
+
+// ownOrigin returns the api's origin as the browser sees it (the service is behind a tls terminating proxy)
+func ownOrigin(r *http.Request) string {
+	return "https://" + strings.ToLower(r.Host)
+}
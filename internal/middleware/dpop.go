@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// dpopHeader is the DPoP proof request header
+const dpopHeader = "DPoP"
+
+// DPoPHandler verifies the request's DPoP proof (RFC 9449), the proof key's thumbprint is added to the context
+// where the AuthHandler checks it against a bound token (cnf.jkt) and the login binds the new tokens to it
+// a request without a proof is passed on untouched (an unbound token is still accepted)
+func DPoPHandler(appCtx *serviceprovider.Context) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proofs := r.Header[http.CanonicalHeaderKey(dpopHeader)]
+			if !appCtx.Config.DPoP.Enabled || len(proofs) == 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			ctx := r.Context()
+
+			// a proof that could not be checked (ex: the jti cache is down) is rejected too
+			invalidProof := func(err error) {
+				appCtx.Logger.For(ctx).Error("DPoPHandler - Invalid Proof", zap.Error(err))
+				rerr := internalerrors.RestError{Code: http.StatusUnauthorized, Message: "invalid dpop proof"}
+				if cause, ok := errors.Cause(err).(*internalerrors.RestError); ok {
+					rerr.Message = cause.Message
+				}
+				response, _ := json.Marshal(rerr)
+				w.Header().Set("WWW-Authenticate", `DPoP error="invalid_dpop_proof"`)
+				writeResponse(w, r, rerr.Code, response)
+			}
+			if len(proofs) > 1 {
+				invalidProof(fmt.Errorf("multiple dpop proofs"))
+				return
+			}
+
+			_, token := extractAuthToken(r)
+			jkt, err := appCtx.DPoP.Verify(ctx, proofs[0], r.Method, ownOrigin(r)+r.URL.Path, token)
+			if err != nil {
+				invalidProof(err)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(newDPoPThumbprintContext(ctx, jkt)))
+		})
+	}
+}
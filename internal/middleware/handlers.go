@@ -3,12 +3,21 @@ package middleware
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	internalerrors "github.com/tjsampson/token-svc/internal/errors"
 	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/patmodels"
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
 	"github.com/tjsampson/token-svc/internal/serviceprovider"
+	"github.com/tjsampson/token-svc/internal/services/ratelimitservice"
+	"github.com/tjsampson/token-svc/pkg/helpers/iphelpers"
 	"github.com/tjsampson/token-svc/pkg/metrics"
 
 	"github.com/opentracing-contrib/go-gorilla/gorilla"
@@ -38,13 +47,18 @@ func TracingHandler(appCtxProvider *serviceprovider.Context) Adapter {
 }
 
 // LogMetricsHandler adapts the incoming request with Logging/Metrics (Observability)
-func LogMetricsHandler(logger log.Factory, metricProvider *metrics.Provider) Adapter {
+// the user IP is resolved through the trusted proxies (only their proxyHeader forwarding header, ex: X-Forwarded-For)
+func LogMetricsHandler(logger log.Factory, metricProvider *metrics.Provider, trustedProxies []string, proxyHeader string) Adapter {
+	proxies, err := iphelpers.ParseProxies(trustedProxies)
+	if err != nil {
+		logger.Bg().Fatal("failed trusted proxies", zap.Error(err))
+	}
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 			// Establish new Context with Request-ID, StartTime, UserIP, etc.
 			// (continue to add "contextual data" here)
-			ctx := newWrappedReqCtx(r)
+			ctx := newWrappedReqCtx(r, proxies, proxyHeader)
 
 			// Log the incoming Request
 			logger.For(ctx).Info("incoming request",
@@ -57,6 +71,7 @@ func LogMetricsHandler(logger log.Factory, metricProvider *metrics.Provider) Ada
 				zap.String("uri", r.RequestURI),
 				zap.String("method", r.Method),
 				zap.String("user_ip", UserIPFromContext(ctx).String()),
+				zap.String("proxy_chain", ipChain(ProxyChainFromContext(ctx))),
 				zap.String("protocol", r.Proto),
 			)
 			// Tally the incoming request metrics
@@ -85,9 +100,23 @@ func LogMetricsHandler(logger log.Factory, metricProvider *metrics.Provider) Ada
 	}
 }
 
+// ipChain joins the forwarding chain for the request log
+func ipChain(chain []net.IP) string {
+	hops := make([]string, len(chain))
+	for i, ip := range chain {
+		hops[i] = ip.String()
+	}
+	return strings.Join(hops, ", ")
+}
+
+// scimPathPrefix is the SCIM provisioning api, it is authenticated by the provisioning client's bearer token
+const scimPathPrefix = "/scim/v2/"
+
 // AuthHandler handles api auth
-// first we check for open routes (which are configurable)
-// if route is not open then we check the JWT and the HTTPS Cookie
+// first we check for open routes (which are configurable) and the scim api (which has its own client auth)
+// if route is not open then we check for a personal access token (scripts), which replaces the JWT and the HTTPS Cookie
+// otherwise we check the JWT and the HTTPS Cookie
+// in cookie session mode the JWT is the access token cookie, when it has expired the refresh token cookie re-issues it
 // we extract the JWT, validate it's contents, then extract/decode the cookie data
 // we also compare the JWT ID inside the JWT and what was baked into the secure cookie
 // if all is good, we create a new context with the JTI value
@@ -99,13 +128,24 @@ func AuthHandler(appCtx *serviceprovider.Context) Adapter {
 
 			// PERF: This should be a Map
 			for _, openEndPoint := range appCtx.Config.API.OpenEndPoints {
-				if openEndPoint == r.RequestURI {
+				if openEndPoint == r.URL.Path {
 					isOK = true
 					break
 				}
 			}
 			if isOK {
 				h.ServeHTTP(w, r)
+			} else if strings.HasPrefix(r.URL.Path, scimPathPrefix) {
+				if _, token := extractAuthToken(r); !appCtx.SCIM.Authenticate(ctx, token) {
+					appCtx.Logger.For(ctx).Error("AuthHandler - Invalid SCIM Auth")
+					response, _ := json.Marshal(scimmodels.NewError(http.StatusUnauthorized, "", "invalid auth"))
+					w.Header().Set("Content-Type", scimmodels.ContentType)
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					w.WriteHeader(http.StatusUnauthorized)
+					_, _ = w.Write(response)
+					return
+				}
+				h.ServeHTTP(w, r)
 			} else {
 
 				invalidAuth := func(err error) {
@@ -114,15 +154,59 @@ func AuthHandler(appCtx *serviceprovider.Context) Adapter {
 					json.NewEncoder(w).Encode(internalerrors.RestError{Message: "invalid auth", Code: http.StatusUnauthorized})
 				}
 
-				validAuth := func(tokenID string) {
-					ctx := newJWTIDContext(ctx, tokenID)
+				validAuth := func(tokenID string, userID int, auth requestcontext.AuthInfo) {
+					ctx := newAuthenticationContext(newUserIDContext(newJWTIDContext(ctx, tokenID), userID), auth)
 					appCtx.Logger.For(ctx).Info("AuthHandler - Authenticated")
 					h.ServeHTTP(w, r.WithContext(ctx))
 				}
 
+				// personal access tokens are checked against the user and the token scopes (the request method)
+				scheme, bearer := extractAuthToken(r)
+				if patmodels.IsToken(bearer) {
+					token, err := appCtx.PAT.Authenticate(ctx, bearer)
+					if err != nil {
+						invalidAuth(err)
+						return
+					}
+					user, err := appCtx.UserRepo.ReadByID(ctx, token.UserID)
+					if err != nil {
+						invalidAuth(err)
+						return
+					}
+					if !user.CanAuthenticate() {
+						invalidAuth(fmt.Errorf("user account %s", user.Status))
+						return
+					}
+					if scope := patmodels.MethodScope(r.Method); !token.HasScope(scope) {
+						appCtx.Logger.For(ctx).Error("AuthHandler - Insufficient Token Scope", zap.String("scope", scope), zap.Int64("token_id", token.ID))
+						w.WriteHeader(http.StatusForbidden)
+						json.NewEncoder(w).Encode(internalerrors.RestError{Message: "token scope required: " + scope, Code: http.StatusForbidden})
+						return
+					}
+					ctx := newTokenScopesContext(newUserIDContext(ctx, user.ID), token.Scopes)
+					appCtx.Logger.For(ctx).Info("AuthHandler - Authenticated", zap.Int64("token_id", token.ID))
+					h.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+
+				// a bearer token wins over the token cookie (an api client in cookie session mode)
+				jwtToken := bearer
+				cookieSession := jwtToken == "" && CookieSession(appCtx.Config, r)
+				if cookieSession {
+					if accessCookie, err := r.Cookie(appCtx.Config.Session.AccessCookieName); err == nil {
+						jwtToken = accessCookie.Value
+					}
+				}
+
 				// TODO: Abstract this out and use go routines
-				if jwtToken := extractAuthBearerToken(r); len(jwtToken) > 0 {
+				if len(jwtToken) > 0 {
 					if tokenClaims, validToken := appCtx.JwtClient.IsValidAccessToken(ctx, jwtToken); validToken {
+						// a DPoP bound token sent with the Bearer scheme is a downgrade, the client must use the DPoP scheme
+						if scheme == bearerScheme && tokenClaims.DPoPThumbprint() != "" {
+							w.Header().Set("WWW-Authenticate", `DPoP error="invalid_token", error_description="dpop bound token sent as a bearer token"`)
+							invalidAuth(fmt.Errorf("dpop bound token sent with the bearer scheme"))
+							return
+						}
 						if cookies := appCtx.CookieOven.DecodedCookie(ctx, r); cookies != nil {
 							if cookies[appCtx.Config.Cookie.KeyJWTAccessID] == tokenClaims.Id {
 								// check if user creds are valid
@@ -131,15 +215,42 @@ func AuthHandler(appCtx *serviceprovider.Context) Adapter {
 									invalidAuth(err)
 									return
 								}
+								// locked/disabled accounts are rejected immediately (even with an outstanding token)
+								if !user.CanAuthenticate() {
+									invalidAuth(fmt.Errorf("user account %s", user.Status))
+									return
+								}
 								cacheJTI, err := appCtx.RedisClient.Get(ctx, fmt.Sprintf("%v-%v", appCtx.Config.Token.AccessCacheKeyID, user.ID))
-								if cacheJTI == tokenClaims.Id {
-									validAuth(tokenClaims.Id)
+								// a DPoP bound token is only accepted with a proof of its key (see DPoPHandler)
+								// and a certificate bound token over a connection with the same client certificate
+								jkt, x5t := tokenClaims.DPoPThumbprint(), tokenClaims.CertThumbprint()
+								if cacheJTI == tokenClaims.Id && (jkt == "" || jkt == requestcontext.DPoPThumbprint(ctx)) && (x5t == "" || x5t == requestcontext.CertThumbprint(ctx)) {
+									validAuth(tokenClaims.Id, user.ID, tokenClaims.AuthInfo())
 									return
 								}
 							}
 						}
 					}
 				}
+
+				// the access token cookie has expired (the browser dropped it), the refresh is transparent to the page
+				if cookieSession {
+					if refreshCookie, err := r.Cookie(appCtx.Config.Session.RefreshCookieName); err == nil {
+						loginResults, err := appCtx.AuthService.Refresh(ctx, refreshCookie.Value)
+						if err != nil {
+							invalidAuth(err)
+							return
+						}
+						if tokenClaims, validToken := appCtx.JwtClient.IsValidAccessToken(ctx, loginResults.AccessToken); validToken {
+							if userID, err := strconv.Atoi(tokenClaims.Subject); err == nil {
+								SetSessionCookies(appCtx, w, r, loginResults)
+								appCtx.Logger.For(ctx).Info("AuthHandler - Refreshed", zap.Int("user_id", userID))
+								validAuth(tokenClaims.Id, userID, tokenClaims.AuthInfo())
+								return
+							}
+						}
+					}
+				}
 				invalidAuth(fmt.Errorf("Invalid JWT Token"))
 				return
 			}
@@ -147,11 +258,99 @@ func AuthHandler(appCtx *serviceprovider.Context) Adapter {
 	}
 }
 
+// RateLimitHandler applies the per route token bucket rate limits
+// the bucket is keyed by IP, authenticated subject or client ID (see config.RateLimit.Routes)
+// this must run after the AuthHandler so the subject is known
+func RateLimitHandler(appCtx *serviceprovider.Context) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !appCtx.Config.RateLimit.Enabled {
+				h.ServeHTTP(w, r)
+				return
+			}
+			ctx := r.Context()
+
+			rule, ok := appCtx.RateLimiter.Rule(r.URL.Path)
+			if !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			res := appCtx.RateLimiter.Take(ctx, rule, rateLimitID(appCtx, r, rule.Key))
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSecs(res.Reset)))
+
+			if !res.Allowed {
+				appCtx.Logger.For(ctx).Info("RateLimitHandler - rate limit exceeded", zap.String("route", rule.Route), zap.String("key", rule.Key))
+				appCtx.Metrics.StatRateLimitRejectCount.WithLabelValues(rule.Route, rule.Key).Inc()
+				rerr := internalerrors.RestError{
+					Code:           http.StatusTooManyRequests,
+					Message:        "rate limit exceeded",
+					RetryAfterSecs: ceilSecs(res.RetryAfter),
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(rerr.RetryAfterSecs))
+				response, _ := json.Marshal(rerr)
+				writeResponse(w, r, rerr.Code, response)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IPFilterHandler rejects a request from a denied or blocked ip, or an ip outside the allow list (403)
+// it runs before the AuthHandler, a blocked ip can not make any request (the health check included)
+func IPFilterHandler(appCtx *serviceprovider.Context) Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if allowed, reason := appCtx.IPFilter.Allowed(ctx, UserIPFromContext(ctx)); !allowed {
+				appCtx.Logger.For(ctx).Info("IPFilterHandler - ip rejected", zap.String("user_ip", UserIPFromContext(ctx).String()), zap.String("reason", reason))
+				appCtx.Metrics.StatIPFilterRejectCount.WithLabelValues(reason).Inc()
+				rerr := internalerrors.RestError{
+					Code:    http.StatusForbidden,
+					Message: "forbidden",
+				}
+				response, _ := json.Marshal(rerr)
+				writeResponse(w, r, rerr.Code, response)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitID returns the bucket id for the key type (falls back to the client IP)
+func rateLimitID(appCtx *serviceprovider.Context, r *http.Request, key string) string {
+	switch key {
+	case ratelimitservice.KeySubject:
+		if userID := UserIDFromContext(r.Context()); userID > 0 {
+			return fmt.Sprintf("user-%d", userID)
+		}
+	case ratelimitservice.KeyClient:
+		if clientID := r.Header.Get(appCtx.Config.RateLimit.ClientIDHeader); clientID != "" {
+			return fmt.Sprintf("client-%s", clientID)
+		}
+	}
+	return fmt.Sprintf("ip-%v", UserIPFromContext(r.Context()))
+}
+
+func ceilSecs(d time.Duration) int {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 && d > 0 {
+		return 1
+	}
+	return secs
+}
+
 // RouteHandlerSig is the route handler signature
 type RouteHandlerSig func(appCtxProvider *serviceprovider.Context, res http.ResponseWriter, req *http.Request) (int, interface{}, error)
 
 // Handler is the wrapper that provides context to the app handler
+// StepUp (optional) requires a recent (or multi factor) authentication before the route handler runs
 type Handler struct {
 	AppCtx       *serviceprovider.Context
 	RouteHandler RouteHandlerSig
+	StepUp       *StepUp
 }
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/httphelper"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -29,10 +30,20 @@ func writeResponse(w http.ResponseWriter, r *http.Request, status int, response
 
 // ServeHTTP Serves up the HTTP response
 func (fnH Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	status, payload, err := fnH.RouteHandler(fnH.AppCtx, w, r)
+	// the step-up policy (when set) is checked before the route handler runs
+	status, payload, err := 0, interface{}(nil), fnH.StepUp.check(r.Context())
+	if err == nil {
+		status, payload, err = fnH.RouteHandler(fnH.AppCtx, w, r)
+	}
 
 	if err == nil {
 		fnH.AppCtx.Metrics.StatHTTPResponseCount.WithLabelValues(strconv.Itoa(status), r.RequestURI, r.Method, r.Proto).Inc()
+		if raw, ok := payload.(httphelper.RawResponse); ok {
+			w.Header().Set("Content-Type", raw.ContentType)
+			w.WriteHeader(status)
+			_, _ = w.Write(raw.Body)
+			return
+		}
 		if payload != nil {
 			response, _ := json.Marshal(payload)
 			writeResponse(w, r, status, response)
@@ -60,6 +71,12 @@ func (fnH Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			zap.String("method", r.Method),
 			zap.String("protocol", r.Proto))
 		response, _ := json.Marshal(rerr)
+		if rerr.RetryAfterSecs > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(rerr.RetryAfterSecs))
+		}
+		if rerr.StepUp != nil {
+			w.Header().Set("WWW-Authenticate", stepUpChallenge(rerr.Message, rerr.StepUp))
+		}
 		fnH.AppCtx.Metrics.StatHTTPResponseCount.WithLabelValues(strconv.Itoa(rerr.Code), r.RequestURI, r.Method, r.Proto).Inc()
 		writeResponse(w, r, rerr.Code, response)
 		return
@@ -88,10 +105,23 @@ func (fnH Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func extractAuthBearerToken(r *http.Request) string {
+// Authorization header schemes, a DPoP bound token uses the DPoP scheme (RFC 9449 7.1)
+const (
+	bearerScheme = "Bearer"
+	dpopScheme   = "DPoP"
+)
+
+// extractAuthToken returns the Authorization header's scheme (bearerScheme or dpopScheme) and token
+// the scheme is matched case insensitively, ("", "") without a Bearer or DPoP token
+func extractAuthToken(r *http.Request) (string, string) {
 	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
-	if len(auth) == 2 && auth[0] == "Bearer" {
-		return auth[1]
+	if len(auth) != 2 {
+		return "", ""
+	}
+	for _, scheme := range []string{bearerScheme, dpopScheme} {
+		if strings.EqualFold(auth[0], scheme) {
+			return scheme, auth[1]
+		}
 	}
-	return ""
+	return "", ""
 }
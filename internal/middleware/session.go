@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/serviceprovider"
+)
+
+// CookieSession reports if the request's tokens are HttpOnly cookies (cookie session mode)
+// an api client keeps header mode (the tokens in the body, a bearer token) with the X-Session-Mode: header request header
+func CookieSession(cfg *config.Config, r *http.Request) bool {
+	if cfg.Session.Mode != authmodels.SessionModeCookie {
+		return false
+	}
+	return !strings.EqualFold(r.Header.Get(authmodels.SessionModeHeaderName), authmodels.SessionModeHeader)
+}
+
+// SetSessionCookies sets the session cookie, the csrf token cookie and, in cookie session mode, the token cookies
+// it reports if the tokens are in cookies (they must not be in the response body)
+func SetSessionCookies(appCtx *serviceprovider.Context, w http.ResponseWriter, r *http.Request, loginResults authmodels.LoginResponse) bool {
+	http.SetCookie(w, loginResults.HTTPCookie)
+	if loginResults.CSRFCookie != nil {
+		http.SetCookie(w, loginResults.CSRFCookie)
+	}
+	if !CookieSession(appCtx.Config, r) {
+		return false
+	}
+	for _, cookie := range appCtx.CookieOven.TokenCookies(loginResults.AccessToken, loginResults.RefreshToken) {
+		http.SetCookie(w, cookie)
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	internalerrors "github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+)
+
+// StepUp is a route's step-up authentication policy
+// the user must have authenticated within MaxAge, and with multiple factors when RequireMFA is set
+// a personal access token never satisfies it (there is no interactive authentication to refresh)
+type StepUp struct {
+	MaxAge     time.Duration
+	RequireMFA bool
+}
+
+// NewStepUp returns the configured step-up policy (nil when step-up is disabled)
+func NewStepUp(cfg *config.Config, requireMFA bool) *StepUp {
+	if !cfg.StepUp.Enabled {
+		return nil
+	}
+	return &StepUp{
+		MaxAge:     time.Duration(cfg.StepUp.MaxAgeMins) * time.Minute,
+		RequireMFA: requireMFA,
+	}
+}
+
+// check returns a step_up_required error unless the request's authentication satisfies the policy
+func (s *StepUp) check(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	auth, ok := AuthenticationFromContext(ctx)
+	switch {
+	case !ok:
+		return s.required("an interactive login is required")
+	case s.RequireMFA && !authmodels.IsMultiFactor(auth.Methods):
+		return s.required("multi factor authentication is required")
+	case s.MaxAge > 0 && time.Since(auth.Time) > s.MaxAge:
+		return s.required("a recent authentication is required")
+	}
+	return nil
+}
+
+func (s *StepUp) required(message string) error {
+	stepUp := &internalerrors.StepUp{MaxAgeSecs: int(s.MaxAge.Seconds())}
+	if s.RequireMFA {
+		stepUp.ACR = authmodels.ACRMultiFactor
+	}
+	return &internalerrors.RestError{
+		Code:    http.StatusUnauthorized,
+		Message: message,
+		Reason:  internalerrors.ReasonStepUpRequired,
+		StepUp:  stepUp,
+	}
+}
+
+// stepUpChallenge is the WWW-Authenticate challenge of a step_up_required error (RFC 9470)
+func stepUpChallenge(message string, stepUp *internalerrors.StepUp) string {
+	challenge := fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description=%q, max_age=%d`, message, stepUp.MaxAgeSecs)
+	if stepUp.ACR != "" {
+		challenge += fmt.Sprintf(`, acr_values=%q`, stepUp.ACR)
+	}
+	return challenge
+}
@@ -0,0 +1,140 @@
+package auditmodels
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Audit event types
+const (
+	EventLoginSuccess       = "login.success"
+	EventLoginFailure       = "login.failure"
+	EventLoginBlocked       = "login.blocked"
+	EventLockout            = "account.lockout"
+	EventRegister           = "user.register"
+	EventPasswordChange     = "password.change"
+	EventTokenAnomaly       = "token.anomaly"
+	EventAdminAccountStatus = "admin.account_status"
+	EventIdentityLinked     = "identity.linked"
+	EventSCIMProvision      = "scim.provision"
+	EventAccessTokenCreate  = "access_token.create"
+	EventAccessTokenRevoke  = "access_token.revoke"
+	EventStepUp             = "login.step_up"
+	EventLoginSuspicious    = "login.suspicious"
+	EventIPBlock            = "ip.block"
+	EventIPUnblock          = "ip.unblock"
+	EventClientToken        = "client.token"
+)
+
+// Audit event outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// Event is a security audit event (audit_events)
+// ActorID is the user that performed the action, SubjectID is the user it was performed on
+// (0 when unknown, ex: a failed login for an unknown email)
+type Event struct {
+	ID        int64                  `json:"id"`
+	Event     string                 `json:"event"`
+	Outcome   string                 `json:"outcome"`
+	ActorID   int                    `json:"actor_id,omitempty"`
+	SubjectID int                    `json:"subject_id,omitempty"`
+	Email     string                 `json:"email,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	UserAgent string                 `json:"user_agent,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt time.Time              `json:"created"`
+	PrevHash  string                 `json:"prev_hash"`
+	Hash      string                 `json:"hash"`
+}
+
+// chainContent is the hashed content of an event (the field order is part of the hash format)
+type chainContent struct {
+	PrevHash  string                 `json:"prev_hash"`
+	Event     string                 `json:"event"`
+	Outcome   string                 `json:"outcome"`
+	ActorID   int                    `json:"actor_id"`
+	SubjectID int                    `json:"subject_id"`
+	Email     string                 `json:"email"`
+	IP        string                 `json:"ip"`
+	UserAgent string                 `json:"user_agent"`
+	RequestID string                 `json:"request_id"`
+	Details   map[string]interface{} `json:"details"`
+	CreatedAt string                 `json:"created_at"`
+}
+
+// ChainHash returns the hex SHA-256 of the event content and the previous event's hash
+// the content is the compact JSON of chainContent, created_at is UTC RFC3339 (nanoseconds)
+func (e Event) ChainHash() string {
+	details := e.Details
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	content, _ := json.Marshal(chainContent{
+		PrevHash:  e.PrevHash,
+		Event:     e.Event,
+		Outcome:   e.Outcome,
+		ActorID:   e.ActorID,
+		SubjectID: e.SubjectID,
+		Email:     e.Email,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		RequestID: e.RequestID,
+		Details:   details,
+		CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Checkpoint is a signed snapshot of the head of the audit chain (audit_checkpoints)
+// the Token is an RS256 JWS (signed with the token signing key) of the checkpoint claims
+type Checkpoint struct {
+	ID          int64     `json:"id"`
+	LastEventID int64     `json:"last_event_id"`
+	LastHash    string    `json:"last_hash"`
+	EventCount  int64     `json:"event_count"`
+	Token       string    `json:"token"`
+	CreatedAt   time.Time `json:"created"`
+}
+
+// ChainBreak is the first break found in the audit chain
+type ChainBreak struct {
+	EventID      int64  `json:"event_id,omitempty"`
+	CheckpointID int64  `json:"checkpoint_id,omitempty"`
+	Reason       string `json:"reason"`
+}
+
+// ChainReport is the result of an audit chain verification
+// Unchained is the number of events recorded before the chain existed
+type ChainReport struct {
+	Verified    int64       `json:"verified"`
+	Unchained   int64       `json:"unchained"`
+	Checkpoints int64       `json:"checkpoints"`
+	LastEventID int64       `json:"last_event_id"`
+	LastHash    string      `json:"last_hash"`
+	Break       *ChainBreak `json:"break,omitempty"`
+}
+
+// Query filters the audit events (newest first)
+// UserID matches either the actor or the subject, Before is the pagination cursor (an event ID)
+type Query struct {
+	UserID int
+	Event  string
+	Since  time.Time
+	Before int64
+	Limit  int
+}
+
+// Page is a page of audit events
+// NextBefore is the cursor for the next page (0 when there are no more events)
+type Page struct {
+	Events     []Event `json:"events"`
+	NextBefore int64   `json:"next_before,omitempty"`
+}
@@ -9,10 +9,18 @@ type UserCreds struct {
 }
 
 // UserRegistration is the data required to register a user
+// password strength is enforced by the configurable password policy (see policyservice)
 type UserRegistration struct {
 	Email           string `json:"email" validate:"required,email"`
-	Password        string `json:"password" validate:"eqfield=ConfirmPassword,required,max=50,min=12"`
-	ConfirmPassword string `json:"confirm_password" validate:"eqfield=Password,required,max=50,min=12"`
+	Password        string `json:"password" validate:"eqfield=ConfirmPassword,required"`
+	ConfirmPassword string `json:"confirm_password" validate:"eqfield=Password,required"`
+}
+
+// PasswordChange is the data required to change a user's password
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	Password        string `json:"password" validate:"eqfield=ConfirmPassword,required"`
+	ConfirmPassword string `json:"confirm_password" validate:"eqfield=Password,required"`
 }
 
 // LoginResponse represents the login response object
@@ -20,4 +28,97 @@ type LoginResponse struct {
 	AccessToken  string       `json:"access_token"`
 	RefreshToken string       `json:"refresh_token"`
 	HTTPCookie   *http.Cookie `json:"cookie"`
+	CSRFCookie   *http.Cookie `json:"-"`
+}
+
+// Session modes (config session.mode), how a browser holds its tokens
+const (
+	// SessionModeHeader the client holds the tokens and sends the access token as a bearer token
+	SessionModeHeader = "header"
+	// SessionModeCookie the tokens are HttpOnly cookies, the page never sees them
+	SessionModeCookie = "cookie"
+	// SessionModeHeaderName lets an api client ask for header mode (the tokens in the body) when the service is in cookie mode
+	SessionModeHeaderName = "X-Session-Mode"
+)
+
+// MagicLoginRequest starts a passwordless login, a single use link and code are emailed to the user
+type MagicLoginRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// MagicLoginVerify completes a passwordless login with the link token or the emailed code
+type MagicLoginVerify struct {
+	Token string `json:"token" validate:"required_without=Code,max=100"`
+	Code  string `json:"code" validate:"required_without=Token,omitempty,len=6,numeric"`
+}
+
+// Authentication methods (the access token amr claim, RFC 8176)
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRHardwareKey = "hwk"
+	AMRMFA         = "mfa"
+)
+
+// Authentication levels (the access token acr claim, NIST 800-63 assurance levels)
+const (
+	ACRSingleFactor = "aal1"
+	ACRMultiFactor  = "aal2"
+)
+
+// factors are the amr values that are a distinct authentication factor
+var factors = map[string]bool{AMRPassword: true, AMROTP: true, AMRHardwareKey: true}
+
+// IsMultiFactor reports if the authentication methods are multi factor (mfa, or two distinct factors)
+func IsMultiFactor(amr []string) bool {
+	distinct := map[string]bool{}
+	for _, method := range amr {
+		if method == AMRMFA {
+			return true
+		}
+		if factors[method] {
+			distinct[method] = true
+		}
+	}
+	return len(distinct) > 1
+}
+
+// ACR returns the authentication level of the authentication methods
+func ACR(amr []string) string {
+	if IsMultiFactor(amr) {
+		return ACRMultiFactor
+	}
+	return ACRSingleFactor
+}
+
+// KnownAMR returns the amr values this service understands (ex: from an identity provider's id token)
+func KnownAMR(amr []string) []string {
+	known := []string{}
+	for _, method := range amr {
+		if factors[method] || method == AMRMFA {
+			known = append(known, method)
+		}
+	}
+	return known
+}
+
+// WithAMR returns the amr with the method added (once), ex: a step-up adds its factor to the session's amr
+func WithAMR(amr []string, method string) []string {
+	merged := append([]string{}, amr...)
+	for _, m := range merged {
+		if m == method {
+			return merged
+		}
+	}
+	return append(merged, method)
+}
+
+// Reauthentication re-verifies the logged in user's password, it refreshes the access token auth_time (see step-up)
+type Reauthentication struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// ReauthResponse is the access token with the new auth_time, the session (jti, refresh token and cookie) is unchanged
+type ReauthResponse struct {
+	AccessToken string `json:"access_token"`
 }
@@ -0,0 +1,35 @@
+package ipfiltermodels
+
+import "time"
+
+// Block sources
+const (
+	// SourceAdmin is a block added through the admin api
+	SourceAdmin = "admin"
+	// SourceAuto is a block added for too many suspicious token errors
+	SourceAuto = "auto"
+)
+
+// Block is a blocklist entry (GET /admin/blocklist)
+// CIDR is normalized, a single IP is a /32 or /128
+type Block struct {
+	CIDR      string    `json:"cidr"`
+	Reason    string    `json:"reason"`
+	Source    string    `json:"source"`
+	CreatedBy int       `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created"`
+	ExpiresAt time.Time `json:"expires"`
+}
+
+// Expired reports if the block has expired
+func (b Block) Expired(now time.Time) bool {
+	return !now.Before(b.ExpiresAt)
+}
+
+// BlockRequest is the block payload (POST /admin/blocklist)
+// TTLMins defaults to the configured block duration (0)
+type BlockRequest struct {
+	CIDR    string `json:"cidr" validate:"required,cidr|ip"`
+	Reason  string `json:"reason" validate:"required,max=500"`
+	TTLMins int    `json:"ttl_mins" validate:"min=0"`
+}
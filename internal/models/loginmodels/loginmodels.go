@@ -0,0 +1,114 @@
+package loginmodels
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Risk signals of a login
+const (
+	// SignalNewDevice is a login from a user agent family (browser and os) the user has not logged in from
+	SignalNewDevice = "new_device"
+	// SignalNewNetwork is a login from a network (ipv4 /24, ipv6 /64) the user has not logged in from
+	SignalNewNetwork = "new_network"
+	// SignalFailureBurst is a login after a burst of failed logins
+	SignalFailureBurst = "failure_burst"
+)
+
+// Attempt is a login to assess and record, the ip and user agent are the request's
+// RecentFailures is the failed logins (for the email) before this one
+type Attempt struct {
+	UserID         int
+	Email          string
+	Method         string
+	AMR            []string
+	RecentFailures int64
+}
+
+// Login is a recorded login (GET /me/logins)
+type Login struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"-"`
+	Method    string    `json:"method"`
+	IP        string    `json:"ip"`
+	Network   string    `json:"network"`
+	UserAgent string    `json:"user_agent"`
+	Device    string    `json:"device"`
+	Signals   []string  `json:"signals"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Risky reports if the login has a risk signal
+func (l Login) Risky() bool {
+	return len(l.Signals) > 0
+}
+
+// Known is how often the user has logged in, from the device and from the network
+type Known struct {
+	Logins  int
+	Device  int
+	Network int
+}
+
+// Network returns the ip's network, ipv4 /24 or ipv6 /64 ("" without an ip)
+func Network(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%v/24", ip4.Mask(net.CIDRMask(24, 32)))
+	}
+	return fmt.Sprintf("%v/64", ip.Mask(net.CIDRMask(64, 128)))
+}
+
+// browsers and systems are matched in order (ex: edge and opera user agents also say Chrome and Safari)
+var (
+	browsers = []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"CriOS/", "Chrome"},
+		{"Safari/", "Safari"},
+	}
+	systems = []struct{ token, name string }{
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// Device returns the user agent family (browser and os, without versions), a browser update is not a new device
+// other clients are their product name (ex: curl/7.64.1 is curl)
+func Device(userAgent string) string {
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return ""
+	}
+	browser, system := "", ""
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+	if browser == "" {
+		browser = strings.SplitN(fields[0], "/", 2)[0]
+	}
+	if system == "" {
+		return browser
+	}
+	return browser + " on " + system
+}
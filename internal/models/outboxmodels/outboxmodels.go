@@ -0,0 +1,52 @@
+package outboxmodels
+
+import "time"
+
+// Identity event types
+const (
+	EventUserRegistered  = "user.registered"
+	EventUserImported    = "user.imported"
+	EventPasswordChanged = "user.password_changed"
+	EventEmailVerified   = "user.email_verified"
+	EventUserLocked      = "user.locked"
+	EventUserUnlocked    = "user.unlocked"
+	EventUserDisabled    = "user.disabled"
+	EventUserEnabled     = "user.enabled"
+	EventUserDeleted     = "user.deleted"
+	EventSessionRevoked  = "session.revoked"
+)
+
+// EventTypes are the known identity event types
+var EventTypes = []string{
+	EventUserRegistered,
+	EventUserImported,
+	EventPasswordChanged,
+	EventEmailVerified,
+	EventUserLocked,
+	EventUserUnlocked,
+	EventUserDisabled,
+	EventUserEnabled,
+	EventUserDeleted,
+	EventSessionRevoked,
+}
+
+// IsEventType reports if the event type is known
+func IsEventType(eventType string) bool {
+	for _, known := range EventTypes {
+		if known == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is an identity event (outbox)
+// the event is written in the same transaction as the change it describes
+type Event struct {
+	ID        int64                  `json:"-"`
+	UID       string                 `json:"id"`
+	Type      string                 `json:"type"`
+	UserID    int                    `json:"user_id,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+	CreatedAt time.Time              `json:"occurred_at"`
+}
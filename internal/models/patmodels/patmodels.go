@@ -0,0 +1,76 @@
+package patmodels
+
+import (
+	"strings"
+	"time"
+)
+
+// TokenPrefix starts every personal access token (tsvc_pat_<lookup prefix>_<secret>)
+// it tells the AuthHandler the bearer token is not a JWT
+const TokenPrefix = "tsvc_pat_"
+
+// Token scopes
+// read allows GET/HEAD requests, write allows every method (and implies read),
+// admin allows the admin endpoints (for an admin user)
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// Scopes are the valid token scopes
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// IsToken reports if the bearer token is a personal access token
+func IsToken(bearer string) bool {
+	return strings.HasPrefix(bearer, TokenPrefix)
+}
+
+// CreateRequest is the personal access token payload
+// ExpiresInDays defaults to the configured lifespan (0)
+type CreateRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,min=1,dive,oneof=read write admin"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"min=0"`
+}
+
+// Token is a personal access token (personal_access_tokens)
+// the token is only returned when it is created, only its hash is stored (Prefix finds it)
+type Token struct {
+	ID         int64      `json:"id"`
+	UID        string     `json:"uid"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Token      string     `json:"token,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires"`
+	LastUsedAt *time.Time `json:"last_used,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	CreatedAt  time.Time  `json:"created"`
+}
+
+// HasScope reports if the token grants the scope (write implies read)
+func (t Token) HasScope(scope string) bool {
+	return HasScope(t.Scopes, scope)
+}
+
+// HasScope reports if the scopes grant the scope (write implies read)
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || (scope == ScopeRead && s == ScopeWrite) {
+			return true
+		}
+	}
+	return false
+}
+
+// MethodScope is the scope a request method requires
+func MethodScope(method string) string {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return ScopeRead
+	}
+	return ScopeWrite
+}
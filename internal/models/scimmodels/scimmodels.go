@@ -0,0 +1,227 @@
+package scimmodels
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// ContentType is the SCIM media type (RFC 7644)
+const ContentType = "application/scim+json"
+
+// SCIM schema URNs
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// SCIM resource types
+const (
+	ResourceUser  = "User"
+	ResourceGroup = "Group"
+)
+
+// SCIM error types (the scimType of a 400 or 409 error)
+const (
+	ErrInvalidFilter = "invalidFilter"
+	ErrInvalidSyntax = "invalidSyntax"
+	ErrInvalidPath   = "invalidPath"
+	ErrInvalidValue  = "invalidValue"
+	ErrNoTarget      = "noTarget"
+	ErrMutability    = "mutability"
+	ErrUniqueness    = "uniqueness"
+)
+
+// Error is a SCIM error response, it is returned (as an error) by the scim service and repo
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+	Code     int      `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+// NewError returns a SCIM error with the http status code
+func NewError(code int, scimType, detail string) *Error {
+	return &Error{
+		Schemas:  []string{SchemaError},
+		Status:   strconv.Itoa(code),
+		ScimType: scimType,
+		Detail:   detail,
+		Code:     code,
+	}
+}
+
+// Meta is the resource metadata
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// Name is the user's name (user_profile)
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	MiddleName string `json:"middleName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// Email is a user email, a user has one (primary, work) email
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Ref is a reference to a user (group member) or group (user's group)
+type Ref struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// User is a SCIM user resource
+// the userName is the user's email, Active maps to the account status (inactive is disabled)
+// Groups are read only (memberships are managed through the group resources)
+type User struct {
+	Schemas    []string `json:"schemas"`
+	ID         string   `json:"id,omitempty"`
+	ExternalID string   `json:"externalId,omitempty"`
+	UserName   string   `json:"userName"`
+	Name       *Name    `json:"name,omitempty"`
+	Emails     []Email  `json:"emails,omitempty"`
+	Active     *bool    `json:"active,omitempty"`
+	Groups     []Ref    `json:"groups,omitempty"`
+	Meta       *Meta    `json:"meta,omitempty"`
+}
+
+// Group is a SCIM group resource, the members are users
+type Group struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []Ref    `json:"members,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+// ListResponse is a page of resources (StartIndex is 1 based)
+type ListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// PatchOp is a SCIM PATCH request
+type PatchOp struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation is an add, replace or remove operation, the value is decoded against the path
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ListQuery is the list (search) request
+// StartIndex is 0 and Count is -1 when they were not requested
+type ListQuery struct {
+	Filter             string
+	StartIndex         int
+	Count              int
+	ExcludedAttributes []string
+}
+
+// Supported is a ServiceProviderConfig feature
+type Supported struct {
+	Supported bool `json:"supported"`
+}
+
+// FilterSupport is the ServiceProviderConfig filter feature
+type FilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+// BulkSupport is the ServiceProviderConfig bulk feature
+type BulkSupport struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+// AuthenticationScheme is a ServiceProviderConfig authentication scheme
+type AuthenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ServiceProviderConfig describes the supported SCIM features
+type ServiceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	Patch                 Supported              `json:"patch"`
+	Bulk                  BulkSupport            `json:"bulk"`
+	Filter                FilterSupport          `json:"filter"`
+	ChangePassword        Supported              `json:"changePassword"`
+	Sort                  Supported              `json:"sort"`
+	ETag                  Supported              `json:"etag"`
+	AuthenticationSchemes []AuthenticationScheme `json:"authenticationSchemes"`
+}
+
+// Filter is a parsed SCIM filter
+// Op is a logical operator (and, or, not) over Filters, or an attribute operator (eq, ne, co, sw, ew, gt, ge, lt, le, pr)
+// Attr is the lower case attribute path (ex: name.familyname), Value is a string, bool, float64 or nil
+type Filter struct {
+	Op      string
+	Attr    string
+	Value   interface{}
+	Filters []*Filter
+}
+
+// ResourceRef is a stored reference to a user or group (uid and display name)
+type ResourceRef struct {
+	UID     string `json:"value"`
+	Display string `json:"display"`
+}
+
+// UserRecord is a provisioned user (users, user_profile) with its groups
+type UserRecord struct {
+	ID           int
+	UID          string
+	ExternalID   string
+	Email        string
+	Status       string
+	StatusReason string
+	FirstName    string
+	MiddleName   string
+	LastName     string
+	Groups       []ResourceRef
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// GroupRecord is a provisioned group (groups) with its members (user_groups)
+type GroupRecord struct {
+	ID         int
+	UID        string
+	ExternalID string
+	Name       string
+	Members    []ResourceRef
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
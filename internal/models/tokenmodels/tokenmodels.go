@@ -4,3 +4,16 @@ type TokenResult struct {
 	Token string
 	Err   error
 }
+
+// ClientTokenRequest is an oauth client's token request (client credentials grant, form encoded)
+type ClientTokenRequest struct {
+	GrantType string `validate:"required,eq=client_credentials"`
+	ClientID  string `validate:"required"`
+}
+
+// ClientTokenResponse is the oauth token response (RFC 6749 5.1)
+type ClientTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
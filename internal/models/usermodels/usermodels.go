@@ -3,12 +3,79 @@ package usermodels
 import "time"
 
 // Record is a user record in the database
+// the status reason (an admin's note) is never serialized, admins read it from AccountStatus
 type Record struct {
-	ID            int       `json:"id"`
-	UID           string    `json:"uid"`
-	Email         string    `json:"email"`
-	EmailVerified bool      `json:"email_verified"`
-	PasswordHash  string    `json:"-"`
-	CreatedAt     time.Time `json:"created"`
-	UpdatedAt     time.Time `json:"updated"`
+	ID              int       `json:"id"`
+	UID             string    `json:"uid"`
+	Email           string    `json:"email"`
+	EmailVerified   bool      `json:"email_verified"`
+	PasswordHash    string    `json:"-"`
+	Status          string    `json:"status"`
+	StatusReason    string    `json:"-"`
+	StatusChangedAt time.Time `json:"status_changed"`
+	CreatedAt       time.Time `json:"created"`
+	UpdatedAt       time.Time `json:"updated"`
+}
+
+// User account statuses (users.status)
+const (
+	StatusActive              = "active"
+	StatusLocked              = "locked"
+	StatusDisabled            = "disabled"
+	StatusPendingVerification = "pending_verification"
+)
+
+// CanAuthenticate reports if the account status allows logins and token use
+func (r Record) CanAuthenticate() bool {
+	return r.Status != StatusLocked && r.Status != StatusDisabled
+}
+
+// HasPassword reports if the user can log in with a password (federated users have none)
+func (r Record) HasPassword() bool {
+	return r.PasswordHash != ""
+}
+
+// Identity is an external (federated) identity, the issuer and subject identify it
+// EmailVerified is the identity provider's claim, only a verified email is linked to an existing user
+// Groups are the identity provider's groups for the user (nil leaves the user's groups unchanged)
+// AMR is how the identity provider authenticated the user (the id token amr claim, when sent)
+type Identity struct {
+	Issuer        string   `json:"issuer"`
+	Subject       string   `json:"subject"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	Groups        []string `json:"groups,omitempty"`
+	AMR           []string `json:"amr,omitempty"`
+}
+
+// StatusChange is an admin account status change request
+type StatusChange struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+// AccountStatus is the admin view of a user's account status
+// TemporaryLockSecs is the remaining time of a failed login lock (which expires on its own)
+type AccountStatus struct {
+	UserID            int       `json:"user_id"`
+	Email             string    `json:"email"`
+	Status            string    `json:"status"`
+	Reason            string    `json:"reason"`
+	ChangedAt         time.Time `json:"changed_at"`
+	TemporaryLockSecs int       `json:"temporary_lock_secs"`
+}
+
+// ImportRecord is a user migrated from a legacy app
+// the password hash must already be tagged with its algorithm (never plaintext)
+type ImportRecord struct {
+	Email         string `json:"email"`
+	PasswordHash  string `json:"password_hash"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+// ImportResult is the summary of a bulk user import
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Failed   []string `json:"failed"`
 }
@@ -0,0 +1,76 @@
+package webhookmodels
+
+import (
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+)
+
+// Webhook delivery statuses
+// a dead delivery exhausted its attempts (the dead-letter queue)
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusDead      = "dead"
+)
+
+// AllEvents subscribes to every event type
+const AllEvents = "*"
+
+// SubscriptionRequest is the webhook subscription payload
+type SubscriptionRequest struct {
+	URL         string   `json:"url" validate:"required,url,max=2000"`
+	Events      []string `json:"events" validate:"required,min=1,dive,required"`
+	Description string   `json:"description" validate:"max=500"`
+}
+
+// Subscription is a webhook subscription (webhook_subscriptions)
+// the secret is only returned when the subscription is created
+type Subscription struct {
+	ID          int64     `json:"id"`
+	UID         string    `json:"uid"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"secret,omitempty"`
+	Events      []string  `json:"events"`
+	Description string    `json:"description"`
+	CreatedBy   int       `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created"`
+	UpdatedAt   time.Time `json:"updated"`
+}
+
+// Delivery is a webhook delivery (webhook_deliveries), one per subscription and outbox event
+type Delivery struct {
+	ID             int64      `json:"id"`
+	UID            string     `json:"uid"`
+	SubscriptionID int64      `json:"subscription_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt"`
+	ResponseCode   int        `json:"response_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered,omitempty"`
+	CreatedAt      time.Time  `json:"created"`
+	UpdatedAt      time.Time  `json:"updated"`
+
+	// URL, Secret and Event are loaded when the delivery is claimed for sending
+	URL    string             `json:"-"`
+	Secret string             `json:"-"`
+	Event  outboxmodels.Event `json:"-"`
+}
+
+// DeliveryQuery filters the delivery log
+// Before is the (exclusive) delivery id cursor, 0 starts at the newest delivery
+type DeliveryQuery struct {
+	SubscriptionID int64
+	Status         string
+	Before         int64
+	Limit          int
+}
+
+// DeliveryPage is a page of deliveries (newest first)
+// NextBefore is the cursor for the next page (0 when there are no more deliveries)
+type DeliveryPage struct {
+	Deliveries []Delivery `json:"deliveries"`
+	NextBefore int64      `json:"next_before,omitempty"`
+}
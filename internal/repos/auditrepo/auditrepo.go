@@ -0,0 +1,266 @@
+package auditrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+
+	"github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+// chainLockID is the postgres advisory lock that serializes the audit chain appends
+const chainLockID = 4260331
+
+// Store is the append-only audit event store (audit_events, audit_checkpoints)
+type Store interface {
+	Insert(ctx context.Context, event auditmodels.Event) error
+	List(ctx context.Context, query auditmodels.Query) ([]auditmodels.Event, error)
+	ListChain(ctx context.Context, afterID int64, limit int) ([]auditmodels.Event, error)
+	ChainHead(ctx context.Context) (auditmodels.Checkpoint, error)
+	InsertCheckpoint(ctx context.Context, checkpoint auditmodels.Checkpoint) error
+	ListCheckpoints(ctx context.Context) ([]auditmodels.Checkpoint, error)
+}
+
+// New returns a conrete implementation of the Store interface
+func New(dbConn *sql.DB, logger log.Factory, tracer opentracing.Tracer) Store {
+	return &store{
+		db:     dbConn,
+		logger: logger.With(zap.String("package", "auditrepo")),
+		tracer: tracer,
+	}
+}
+
+type store struct {
+	db     *sql.DB
+	tracer opentracing.Tracer
+	logger log.Factory
+}
+
+// nullID maps the "unknown" user id (0) to NULL
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id > 0}
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Insert appends the event to the audit chain
+// the appends are serialized (advisory lock) so each event links to the previous event's hash
+func (s *store) Insert(ctx context.Context, event auditmodels.Event) error {
+	query := `
+	INSERT INTO audit_events (event, outcome, actor_id, subject_id, email, ip, user_agent, request_id, details, created_at, prev_hash, hash)
+	VALUES ($1, $2, $3, $4, $5, $6::inet, $7, $8, $9, $10, $11, $12)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.event", event.Event)
+		defer span.Finish()
+	}
+
+	detailsJSON, err := json.Marshal(event.Details)
+	if err != nil || event.Details == nil {
+		detailsJSON = []byte("{}")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", chainLockID); err != nil {
+		s.logger.For(ctx).Error("failed auditrepo.Insert.Lock", zap.Error(err))
+		return postgres.ErrorCheck(err)
+	}
+
+	if err = tx.QueryRow("SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1").Scan(&event.PrevHash); err != nil && err != sql.ErrNoRows {
+		s.logger.For(ctx).Error("failed auditrepo.Insert.PrevHash", zap.Error(err))
+		return postgres.ErrorCheck(err)
+	}
+
+	// postgres stores microseconds, the hashed timestamp must survive the round trip
+	event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	event.Hash = event.ChainHash()
+
+	if _, err = tx.Exec(query, event.Event, event.Outcome, nullID(event.ActorID), nullID(event.SubjectID), event.Email, nullString(event.IP), event.UserAgent, event.RequestID, detailsJSON, event.CreatedAt, event.PrevHash, event.Hash); err != nil {
+		s.logger.For(ctx).Error("failed auditrepo.Insert.Exec", zap.Error(err), zap.String("event", event.Event))
+		return postgres.ErrorCheck(err)
+	}
+	return postgres.ErrorCheck(tx.Commit())
+}
+
+// List returns the matching events, newest first
+func (s *store) List(ctx context.Context, q auditmodels.Query) ([]auditmodels.Event, error) {
+	s.logger.For(ctx).Info("entering auditrepo.List", zap.Int("user_id", q.UserID), zap.String("event", q.Event))
+	defer s.logger.For(ctx).Info("leaving auditrepo.List", zap.Int("user_id", q.UserID), zap.String("event", q.Event))
+	query := `
+	SELECT id, event, outcome, actor_id, subject_id, email, host(ip), user_agent, request_id, details, created_at, prev_hash, hash
+	FROM audit_events
+	WHERE ($1 = 0 OR actor_id = $1 OR subject_id = $1)
+	AND ($2 = '' OR event = $2)
+	AND created_at >= $3
+	AND ($4 = 0 OR id < $4)
+	ORDER BY id DESC
+	LIMIT $5`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", q.UserID)
+		span.SetTag("param.event", q.Event)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, q.UserID, q.Event, q.Since, q.Before, q.Limit)
+	if err != nil {
+		s.logger.For(ctx).Error("failed auditrepo.List.Query", zap.Error(err))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	return s.scanEvents(ctx, rows)
+}
+
+// ListChain returns the events after the id in chain (id) order
+func (s *store) ListChain(ctx context.Context, afterID int64, limit int) ([]auditmodels.Event, error) {
+	query := `
+	SELECT id, event, outcome, actor_id, subject_id, email, host(ip), user_agent, request_id, details, created_at, prev_hash, hash
+	FROM audit_events
+	WHERE id > $1
+	ORDER BY id ASC
+	LIMIT $2`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.after_id", afterID)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, afterID, limit)
+	if err != nil {
+		s.logger.For(ctx).Error("failed auditrepo.ListChain.Query", zap.Error(err))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	return s.scanEvents(ctx, rows)
+}
+
+func (s *store) scanEvents(ctx context.Context, rows *sql.Rows) ([]auditmodels.Event, error) {
+	events := []auditmodels.Event{}
+	for rows.Next() {
+		var event auditmodels.Event
+		var actorID, subjectID sql.NullInt64
+		var ip sql.NullString
+		var details []byte
+
+		if err := rows.Scan(&event.ID, &event.Event, &event.Outcome, &actorID, &subjectID, &event.Email, &ip, &event.UserAgent, &event.RequestID, &details, &event.CreatedAt, &event.PrevHash, &event.Hash); err != nil {
+			s.logger.For(ctx).Error("failed auditrepo.scanEvents.Rows.Scan", zap.Error(err))
+			return nil, err
+		}
+		event.ActorID = int(actorID.Int64)
+		event.SubjectID = int(subjectID.Int64)
+		event.IP = ip.String
+		if err := json.Unmarshal(details, &event.Details); err != nil {
+			return nil, err
+		}
+		if len(event.Details) == 0 {
+			event.Details = nil
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// ChainHead returns the last chained event (as an unsigned checkpoint)
+func (s *store) ChainHead(ctx context.Context) (auditmodels.Checkpoint, error) {
+	head := auditmodels.Checkpoint{}
+	query := `
+	SELECT id, hash, (SELECT count(*) FROM audit_events WHERE hash <> '' AND id <= head.id)
+	FROM audit_events head
+	WHERE hash <> ''
+	ORDER BY id DESC
+	LIMIT 1`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		defer span.Finish()
+	}
+
+	if err := s.db.QueryRow(query).Scan(&head.LastEventID, &head.LastHash, &head.EventCount); err != nil {
+		if err == sql.ErrNoRows {
+			return head, nil
+		}
+		s.logger.For(ctx).Error("failed auditrepo.ChainHead.QueryRow", zap.Error(err))
+		return head, postgres.ErrorCheck(err)
+	}
+	return head, nil
+}
+
+func (s *store) InsertCheckpoint(ctx context.Context, checkpoint auditmodels.Checkpoint) error {
+	query := `
+	INSERT INTO audit_checkpoints (last_event_id, last_hash, event_count, token)
+	VALUES ($1, $2, $3, $4)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.last_event_id", checkpoint.LastEventID)
+		defer span.Finish()
+	}
+
+	if _, err := s.db.Exec(query, checkpoint.LastEventID, checkpoint.LastHash, checkpoint.EventCount, checkpoint.Token); err != nil {
+		s.logger.For(ctx).Error("failed auditrepo.InsertCheckpoint.Exec", zap.Error(err))
+		return postgres.ErrorCheck(err)
+	}
+	return nil
+}
+
+// ListCheckpoints returns all of the checkpoints (oldest first)
+func (s *store) ListCheckpoints(ctx context.Context) ([]auditmodels.Checkpoint, error) {
+	checkpoints := []auditmodels.Checkpoint{}
+	query := "SELECT id, last_event_id, last_hash, event_count, token, created_at FROM audit_checkpoints ORDER BY id ASC"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		s.logger.For(ctx).Error("failed auditrepo.ListCheckpoints.Query", zap.Error(err))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var checkpoint auditmodels.Checkpoint
+		if err = rows.Scan(&checkpoint.ID, &checkpoint.LastEventID, &checkpoint.LastHash, &checkpoint.EventCount, &checkpoint.Token, &checkpoint.CreatedAt); err != nil {
+			s.logger.For(ctx).Error("failed auditrepo.ListCheckpoints.Rows.Scan", zap.Error(err))
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints, rows.Err()
+}
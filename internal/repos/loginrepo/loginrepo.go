@@ -0,0 +1,156 @@
+package loginrepo
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/loginmodels"
+
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+// Store is the login history store (login_history)
+type Store interface {
+	Insert(ctx context.Context, login loginmodels.Login) (loginmodels.Login, error)
+	List(ctx context.Context, userID int, limit int) ([]loginmodels.Login, error)
+	Known(ctx context.Context, userID int, device, network string) (loginmodels.Known, error)
+	Prune(ctx context.Context, userID int, keep int) error
+}
+
+// New returns a conrete implementation of the Store interface
+func New(dbConn *sql.DB, logger log.Factory, tracer opentracing.Tracer) Store {
+	return &store{
+		db:     dbConn,
+		logger: logger.With(zap.String("package", "loginrepo")),
+		tracer: tracer,
+	}
+}
+
+type store struct {
+	db     *sql.DB
+	tracer opentracing.Tracer
+	logger log.Factory
+}
+
+const loginColumns = "id, user_id, method, ip, network, user_agent, device, signals, created_at"
+
+func scanLogin(row interface{ Scan(...interface{}) error }) (loginmodels.Login, error) {
+	login := loginmodels.Login{}
+	err := row.Scan(&login.ID, &login.UserID, &login.Method, &login.IP, &login.Network, &login.UserAgent, &login.Device, pq.Array(&login.Signals), &login.CreatedAt)
+	return login, err
+}
+
+// Insert inserts the login
+func (s *store) Insert(ctx context.Context, login loginmodels.Login) (loginmodels.Login, error) {
+	s.logger.For(ctx).Info("entering loginrepo.Insert", zap.Int("user_id", login.UserID))
+	defer s.logger.For(ctx).Info("leaving loginrepo.Insert", zap.Int("user_id", login.UserID))
+
+	query := `
+	INSERT INTO login_history (user_id, method, ip, network, user_agent, device, signals)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING ` + loginColumns
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", login.UserID)
+		defer span.Finish()
+	}
+
+	inserted, err := scanLogin(s.db.QueryRow(query, login.UserID, login.Method, login.IP, login.Network, login.UserAgent, login.Device, pq.Array(login.Signals)))
+	if err != nil {
+		s.logger.For(ctx).Error("failed loginrepo.Insert.QueryRow", zap.Error(err), zap.Int("user_id", login.UserID))
+		return inserted, postgres.ErrorCheck(err)
+	}
+	return inserted, nil
+}
+
+// List lists the user's most recent logins (newest first)
+func (s *store) List(ctx context.Context, userID int, limit int) ([]loginmodels.Login, error) {
+	s.logger.For(ctx).Info("entering loginrepo.List", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving loginrepo.List", zap.Int("user_id", userID))
+
+	query := "SELECT " + loginColumns + " FROM login_history WHERE user_id=$1 ORDER BY id DESC LIMIT $2"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, userID, limit)
+	if err != nil {
+		s.logger.For(ctx).Error("failed loginrepo.List.Query", zap.Error(err), zap.Int("user_id", userID))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	logins := []loginmodels.Login{}
+	for rows.Next() {
+		login, err := scanLogin(rows)
+		if err != nil {
+			s.logger.For(ctx).Error("failed loginrepo.List.Rows.Scan", zap.Error(err), zap.Int("user_id", userID))
+			return nil, err
+		}
+		logins = append(logins, login)
+	}
+	return logins, rows.Err()
+}
+
+// Known counts the user's logins, and the logins from the device and from the network
+func (s *store) Known(ctx context.Context, userID int, device, network string) (loginmodels.Known, error) {
+	s.logger.For(ctx).Info("entering loginrepo.Known", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving loginrepo.Known", zap.Int("user_id", userID))
+
+	query := `
+	SELECT count(*), count(*) FILTER (WHERE device=$2), count(*) FILTER (WHERE network=$3)
+	FROM login_history WHERE user_id=$1`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	known := loginmodels.Known{}
+	if err := s.db.QueryRow(query, userID, device, network).Scan(&known.Logins, &known.Device, &known.Network); err != nil {
+		s.logger.For(ctx).Error("failed loginrepo.Known.QueryRow", zap.Error(err), zap.Int("user_id", userID))
+		return known, postgres.ErrorCheck(err)
+	}
+	return known, nil
+}
+
+// Prune deletes all but the user's most recent logins
+func (s *store) Prune(ctx context.Context, userID int, keep int) error {
+	query := `
+	DELETE FROM login_history WHERE user_id=$1 AND id NOT IN (
+		SELECT id FROM login_history WHERE user_id=$1 ORDER BY id DESC LIMIT $2
+	)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL DELETE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	if _, err := s.db.Exec(query, userID, keep); err != nil {
+		s.logger.For(ctx).Error("failed loginrepo.Prune.Exec", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package outboxrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+// relayLockID is the postgres advisory lock held by the (single) active relay
+const relayLockID = 4260332
+
+const insertQuery = `
+	INSERT INTO outbox (event_type, user_id, payload)
+	VALUES ($1, $2, $3)`
+
+// Store is the outbox store (identity events awaiting publication)
+// changes to the users table write their events with Append (in the change's transaction)
+// Insert is for changes that are not stored in postgres (ex: a cached temporary lock)
+type Store interface {
+	Insert(ctx context.Context, events ...outboxmodels.Event) error
+	Relay(ctx context.Context, limit int, publish func(outboxmodels.Event) error) (int, error)
+}
+
+// New returns a conrete implementation of the Store interface
+func New(dbConn *sql.DB, logger log.Factory, tracer opentracing.Tracer) Store {
+	return &store{
+		db:     dbConn,
+		logger: logger.With(zap.String("package", "outboxrepo")),
+		tracer: tracer,
+	}
+}
+
+type store struct {
+	db     *sql.DB
+	tracer opentracing.Tracer
+	logger log.Factory
+}
+
+// Append writes the events in the transaction, the events commit (or roll back) with the change
+func Append(tx *sql.Tx, events ...outboxmodels.Event) error {
+	for _, event := range events {
+		data := event.Data
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		userID := sql.NullInt64{Int64: int64(event.UserID), Valid: event.UserID > 0}
+		if _, err = tx.Exec(insertQuery, event.Type, userID, payload); err != nil {
+			return postgres.ErrorCheck(err)
+		}
+	}
+	return nil
+}
+
+func (s *store) Insert(ctx context.Context, events ...outboxmodels.Event) error {
+	s.logger.For(ctx).Info("entering outboxrepo.Insert", zap.Int("events", len(events)))
+	defer s.logger.For(ctx).Info("leaving outboxrepo.Insert", zap.Int("events", len(events)))
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", insertQuery)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	if err = Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed outboxrepo.Insert.Append", zap.Error(err))
+		return err
+	}
+	return postgres.ErrorCheck(tx.Commit())
+}
+
+// Relay publishes the oldest unpublished events (in id order) and marks them published
+// the relay holds an advisory lock, so only one relay publishes at a time (and the stream stays in order)
+// publishing stops at the first failure, the events before it are marked published and the rest are retried on the next relay
+// returns the number of published events (0 when another relay holds the lock)
+func (s *store) Relay(ctx context.Context, limit int, publish func(outboxmodels.Event) error) (int, error) {
+	query := `
+	SELECT id, uid, event_type, user_id, payload, created_at
+	FROM outbox
+	WHERE published_at IS NULL
+	ORDER BY id
+	LIMIT $1`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err = tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", relayLockID).Scan(&locked); err != nil {
+		s.logger.For(ctx).Error("failed outboxrepo.Relay.Lock", zap.Error(err))
+		return 0, postgres.ErrorCheck(err)
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	rows, err := tx.Query(query, limit)
+	if err != nil {
+		s.logger.For(ctx).Error("failed outboxrepo.Relay.Query", zap.Error(err))
+		return 0, postgres.ErrorCheck(err)
+	}
+	events := []outboxmodels.Event{}
+	for rows.Next() {
+		event := outboxmodels.Event{}
+		var userID sql.NullInt64
+		var payload []byte
+		if err = rows.Scan(&event.ID, &event.UID, &event.Type, &userID, &payload, &event.CreatedAt); err != nil {
+			rows.Close()
+			s.logger.For(ctx).Error("failed outboxrepo.Relay.Rows.Scan", zap.Error(err))
+			return 0, err
+		}
+		event.UserID = int(userID.Int64)
+		if err = json.Unmarshal(payload, &event.Data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := []int64{}
+	var publishErr error
+	for _, event := range events {
+		if publishErr = publish(event); publishErr != nil {
+			break
+		}
+		published = append(published, event.ID)
+	}
+	if len(published) == 0 {
+		return 0, publishErr
+	}
+
+	if _, err = tx.Exec("UPDATE outbox SET published_at = now() WHERE id = ANY($1)", pq.Array(published)); err != nil {
+		s.logger.For(ctx).Error("failed outboxrepo.Relay.Exec", zap.Error(err))
+		return 0, postgres.ErrorCheck(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, postgres.ErrorCheck(err)
+	}
+	return len(published), publishErr
+}
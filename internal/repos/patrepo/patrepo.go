@@ -0,0 +1,216 @@
+package patrepo
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/patmodels"
+
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+// Store is the personal access token store (personal_access_tokens)
+// revoked and expired tokens are never returned
+type Store interface {
+	Insert(ctx context.Context, token patmodels.Token, lifespanDays int) (patmodels.Token, error)
+	ReadByPrefix(ctx context.Context, prefix string) (patmodels.Token, error)
+	List(ctx context.Context, userID int) ([]patmodels.Token, error)
+	CountActive(ctx context.Context, userID int) (int, error)
+	Revoke(ctx context.Context, userID int, id int64) error
+	TouchLastUsed(ctx context.Context, id int64, ip string, interval time.Duration) error
+}
+
+// New returns a conrete implementation of the Store interface
+func New(dbConn *sql.DB, logger log.Factory, tracer opentracing.Tracer) Store {
+	return &store{
+		db:     dbConn,
+		logger: logger.With(zap.String("package", "patrepo")),
+		tracer: tracer,
+	}
+}
+
+type store struct {
+	db     *sql.DB
+	tracer opentracing.Tracer
+	logger log.Factory
+}
+
+const tokenColumns = "id, uid, user_id, name, prefix, token_hash, scopes, expires_at, last_used_at, last_used_ip, created_at"
+
+// activeClause matches the tokens that can authenticate
+const activeClause = "revoked_at IS NULL AND expires_at > now()"
+
+func scanToken(row interface{ Scan(...interface{}) error }) (patmodels.Token, error) {
+	token := patmodels.Token{}
+	var lastUsedAt pq.NullTime
+	err := row.Scan(&token.ID, &token.UID, &token.UserID, &token.Name, &token.Prefix, &token.Hash, pq.Array(&token.Scopes), &token.ExpiresAt, &lastUsedAt, &token.LastUsedIP, &token.CreatedAt)
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return token, err
+}
+
+// Insert inserts the token, it expires lifespanDays from now (database time)
+func (s *store) Insert(ctx context.Context, token patmodels.Token, lifespanDays int) (patmodels.Token, error) {
+	s.logger.For(ctx).Info("entering patrepo.Insert", zap.Int("user_id", token.UserID), zap.String("prefix", token.Prefix))
+	defer s.logger.For(ctx).Info("leaving patrepo.Insert", zap.Int("user_id", token.UserID), zap.String("prefix", token.Prefix))
+
+	query := `
+	INSERT INTO personal_access_tokens (user_id, name, prefix, token_hash, scopes, expires_at)
+	VALUES ($1, $2, $3, $4, $5, now() + make_interval(days => $6))
+	RETURNING ` + tokenColumns
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", token.UserID)
+		defer span.Finish()
+	}
+
+	inserted, err := scanToken(s.db.QueryRow(query, token.UserID, token.Name, token.Prefix, token.Hash, pq.Array(token.Scopes), lifespanDays))
+	if err != nil {
+		s.logger.For(ctx).Error("failed patrepo.Insert.QueryRow", zap.Error(err), zap.Int("user_id", token.UserID))
+		return inserted, postgres.ErrorCheck(err)
+	}
+	return inserted, nil
+}
+
+// ReadByPrefix reads the active token with the lookup prefix
+func (s *store) ReadByPrefix(ctx context.Context, prefix string) (patmodels.Token, error) {
+	s.logger.For(ctx).Info("entering patrepo.ReadByPrefix", zap.String("prefix", prefix))
+	defer s.logger.For(ctx).Info("leaving patrepo.ReadByPrefix", zap.String("prefix", prefix))
+
+	query := "SELECT " + tokenColumns + " FROM personal_access_tokens WHERE prefix=$1 AND " + activeClause
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.prefix", prefix)
+		defer span.Finish()
+	}
+
+	token, err := scanToken(s.db.QueryRow(query, prefix))
+	if err != nil {
+		s.logger.For(ctx).Error("failed patrepo.ReadByPrefix.QueryRow", zap.Error(err), zap.String("prefix", prefix))
+		return token, postgres.ErrorCheck(err)
+	}
+	return token, nil
+}
+
+// List lists the user's active tokens (newest first)
+func (s *store) List(ctx context.Context, userID int) ([]patmodels.Token, error) {
+	s.logger.For(ctx).Info("entering patrepo.List", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving patrepo.List", zap.Int("user_id", userID))
+
+	query := "SELECT " + tokenColumns + " FROM personal_access_tokens WHERE user_id=$1 AND " + activeClause + " ORDER BY id DESC"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed patrepo.List.Query", zap.Error(err), zap.Int("user_id", userID))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	tokens := []patmodels.Token{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			s.logger.For(ctx).Error("failed patrepo.List.Rows.Scan", zap.Error(err), zap.Int("user_id", userID))
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// CountActive counts the user's active tokens
+func (s *store) CountActive(ctx context.Context, userID int) (int, error) {
+	s.logger.For(ctx).Info("entering patrepo.CountActive", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving patrepo.CountActive", zap.Int("user_id", userID))
+
+	query := "SELECT count(*) FROM personal_access_tokens WHERE user_id=$1 AND " + activeClause
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	var count int
+	if err := s.db.QueryRow(query, userID).Scan(&count); err != nil {
+		s.logger.For(ctx).Error("failed patrepo.CountActive.QueryRow", zap.Error(err), zap.Int("user_id", userID))
+		return 0, postgres.ErrorCheck(err)
+	}
+	return count, nil
+}
+
+// Revoke revokes the user's token (another user's token is not found)
+func (s *store) Revoke(ctx context.Context, userID int, id int64) error {
+	s.logger.For(ctx).Info("entering patrepo.Revoke", zap.Int("user_id", userID), zap.Int64("token_id", id))
+	defer s.logger.For(ctx).Info("leaving patrepo.Revoke", zap.Int("user_id", userID), zap.Int64("token_id", id))
+
+	query := "UPDATE personal_access_tokens SET revoked_at = now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		span.SetTag("param.token_id", id)
+		defer span.Finish()
+	}
+
+	result, err := s.db.Exec(query, id, userID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed patrepo.Revoke.Exec", zap.Error(err), zap.Int64("token_id", id))
+		return postgres.ErrorCheck(err)
+	}
+	if revoked, err := result.RowsAffected(); err == nil && revoked == 0 {
+		return postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	return nil
+}
+
+// TouchLastUsed records the token use, at most once per interval (a token used by a busy script is not written every request)
+func (s *store) TouchLastUsed(ctx context.Context, id int64, ip string, interval time.Duration) error {
+	query := `
+	UPDATE personal_access_tokens SET last_used_at = now(), last_used_ip = $2
+	WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < now() - make_interval(secs => $3) OR last_used_ip <> $2)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.token_id", id)
+		defer span.Finish()
+	}
+
+	if _, err := s.db.Exec(query, id, ip, interval.Seconds()); err != nil {
+		s.logger.For(ctx).Error("failed patrepo.TouchLastUsed.Exec", zap.Error(err), zap.Int64("token_id", id))
+		return postgres.ErrorCheck(err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package scimrepo
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+)
+
+// attribute value kinds
+const (
+	kindString    = iota // case insensitive string
+	kindCaseExact        // case sensitive string (ids)
+	kindBool
+	kindTime
+)
+
+// attribute is a filterable attribute, the column is an sql expression
+// a multi valued attribute is matched with an EXISTS sub query (exists has a %s for the condition)
+type attribute struct {
+	column string
+	kind   int
+	exists string
+}
+
+// userAttributes are the filterable user attributes (lower case paths)
+var userAttributes = map[string]attribute{
+	"id":                {column: "u.uid::text", kind: kindCaseExact},
+	"externalid":        {column: "u.external_id", kind: kindCaseExact},
+	"username":          {column: "u.email", kind: kindString},
+	"emails":            {column: "u.email", kind: kindString},
+	"emails.value":      {column: "u.email", kind: kindString},
+	"emails.type":       {column: "'work'", kind: kindString},
+	"name.givenname":    {column: "COALESCE(p.first_name, '')", kind: kindString},
+	"name.middlename":   {column: "COALESCE(p.middle_name, '')", kind: kindString},
+	"name.familyname":   {column: "COALESCE(p.last_name, '')", kind: kindString},
+	"active":            {column: "(u.status <> 'disabled')", kind: kindBool},
+	"meta.created":      {column: "u.created_at", kind: kindTime},
+	"meta.lastmodified": {column: "u.updated_at", kind: kindTime},
+	"groups":            {column: "ug_g.uid::text", kind: kindCaseExact, exists: userGroupsExists},
+	"groups.value":      {column: "ug_g.uid::text", kind: kindCaseExact, exists: userGroupsExists},
+	"groups.display":    {column: "ug_g.name", kind: kindString, exists: userGroupsExists},
+}
+
+const userGroupsExists = "EXISTS (SELECT 1 FROM user_groups ug_f JOIN groups ug_g ON ug_g.id = ug_f.group_id WHERE ug_f.user_id = u.id AND %s)"
+
+// groupAttributes are the filterable group attributes (lower case paths)
+var groupAttributes = map[string]attribute{
+	"id":                {column: "g.uid::text", kind: kindCaseExact},
+	"externalid":        {column: "g.external_id", kind: kindCaseExact},
+	"displayname":       {column: "g.name", kind: kindString},
+	"meta.created":      {column: "g.created_at", kind: kindTime},
+	"meta.lastmodified": {column: "g.updated_at", kind: kindTime},
+	"members":           {column: "gm_u.uid::text", kind: kindCaseExact, exists: groupMembersExists},
+	"members.value":     {column: "gm_u.uid::text", kind: kindCaseExact, exists: groupMembersExists},
+	"members.display":   {column: "gm_u.email", kind: kindString, exists: groupMembersExists},
+}
+
+const groupMembersExists = "EXISTS (SELECT 1 FROM user_groups gm_f JOIN users gm_u ON gm_u.id = gm_f.user_id WHERE gm_f.group_id = g.id AND %s)"
+
+func invalidFilter(format string, args ...interface{}) error {
+	return scimmodels.NewError(400, scimmodels.ErrInvalidFilter, fmt.Sprintf(format, args...))
+}
+
+// whereClause translates the filter to a where clause (an empty clause matches every row)
+func whereClause(filter *scimmodels.Filter, attributes map[string]attribute) (*postgres.WhereClause, error) {
+	where := postgres.Where()
+	if filter == nil {
+		return where, nil
+	}
+	params := []interface{}{}
+	condition, err := translate(filter, attributes, &params)
+	if err != nil {
+		return nil, err
+	}
+	return where.AddAndClause(condition, params...), nil
+}
+
+// translate returns the sql condition of the filter, each param is a %s in the condition (see postgres.WhereClause)
+func translate(filter *scimmodels.Filter, attributes map[string]attribute, params *[]interface{}) (string, error) {
+	switch filter.Op {
+	case "and", "or":
+		conditions := make([]string, 0, len(filter.Filters))
+		for _, operand := range filter.Filters {
+			condition, err := translate(operand, attributes, params)
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+		return "(" + strings.Join(conditions, " "+strings.ToUpper(filter.Op)+" ") + ")", nil
+	case "not":
+		if len(filter.Filters) != 1 {
+			return "", invalidFilter("not takes one filter")
+		}
+		condition, err := translate(filter.Filters[0], attributes, params)
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + condition + ")", nil
+	}
+
+	attr, ok := attributes[filter.Attr]
+	if !ok {
+		return "", invalidFilter("unsupported filter attribute %q", filter.Attr)
+	}
+	condition, err := compare(filter, attr, params)
+	if err != nil {
+		return "", err
+	}
+	if attr.exists != "" {
+		return fmt.Sprintf(attr.exists, condition), nil
+	}
+	return condition, nil
+}
+
+// compare returns the sql condition of an attribute operator
+func compare(filter *scimmodels.Filter, attr attribute, params *[]interface{}) (string, error) {
+	if filter.Op == "pr" {
+		if attr.kind == kindString || attr.kind == kindCaseExact {
+			return fmt.Sprintf("(%s IS NOT NULL AND %s <> '')", attr.column, attr.column), nil
+		}
+		return fmt.Sprintf("(%s IS NOT NULL)", attr.column), nil
+	}
+
+	operators := map[string]string{"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}
+
+	switch attr.kind {
+	case kindBool:
+		value, ok := filter.Value.(bool)
+		if !ok {
+			return "", invalidFilter("%s takes a boolean", filter.Attr)
+		}
+		if filter.Op != "eq" && filter.Op != "ne" {
+			return "", invalidFilter("%s does not support %s", filter.Attr, filter.Op)
+		}
+		*params = append(*params, value)
+		return fmt.Sprintf("%s %s %%s", attr.column, operators[filter.Op]), nil
+	case kindTime:
+		raw, ok := filter.Value.(string)
+		if !ok {
+			return "", invalidFilter("%s takes a date time", filter.Attr)
+		}
+		value, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return "", invalidFilter("%s takes a date time", filter.Attr)
+		}
+		operator, ok := operators[filter.Op]
+		if !ok {
+			return "", invalidFilter("%s does not support %s", filter.Attr, filter.Op)
+		}
+		*params = append(*params, value.UTC())
+		return fmt.Sprintf("%s %s %%s", attr.column, operator), nil
+	}
+
+	value, ok := filter.Value.(string)
+	if !ok {
+		return "", invalidFilter("%s takes a string", filter.Attr)
+	}
+	column, like := attr.column, "LIKE"
+	if attr.kind == kindString {
+		column, value, like = fmt.Sprintf("lower(%s)", attr.column), strings.ToLower(value), "ILIKE"
+	}
+	switch filter.Op {
+	case "co":
+		*params = append(*params, "%"+escapeLike(value)+"%")
+	case "sw":
+		*params = append(*params, escapeLike(value)+"%")
+	case "ew":
+		*params = append(*params, "%"+escapeLike(value))
+	default:
+		operator, ok := operators[filter.Op]
+		if !ok {
+			return "", invalidFilter("unsupported filter operator %q", filter.Op)
+		}
+		*params = append(*params, value)
+		return fmt.Sprintf("%s %s %%s", column, operator), nil
+	}
+	return fmt.Sprintf("%s %s %%s", column, like), nil
+}
+
+// escapeLike escapes the LIKE wildcards in the value
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
@@ -0,0 +1,541 @@
+package scimrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
+
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+// Store is the SCIM provisioning store (users, user_profile, groups, user_groups)
+// users and groups are addressed by their uid, the events passed to a user change are written to the outbox
+// in the change's transaction
+type Store interface {
+	ListUsers(ctx context.Context, filter *scimmodels.Filter, offset, limit int) ([]scimmodels.UserRecord, int, error)
+	ReadUser(ctx context.Context, uid string) (scimmodels.UserRecord, error)
+	InsertUser(ctx context.Context, user scimmodels.UserRecord, events ...outboxmodels.Event) (scimmodels.UserRecord, error)
+	UpdateUser(ctx context.Context, user scimmodels.UserRecord, events ...outboxmodels.Event) (scimmodels.UserRecord, error)
+	DeleteUser(ctx context.Context, userID int, events ...outboxmodels.Event) error
+	ListGroups(ctx context.Context, filter *scimmodels.Filter, offset, limit int, excludeMembers bool) ([]scimmodels.GroupRecord, int, error)
+	ReadGroup(ctx context.Context, uid string) (scimmodels.GroupRecord, error)
+	InsertGroup(ctx context.Context, group scimmodels.GroupRecord) (scimmodels.GroupRecord, error)
+	UpdateGroup(ctx context.Context, group scimmodels.GroupRecord) (scimmodels.GroupRecord, error)
+	DeleteGroup(ctx context.Context, groupID int) error
+}
+
+// New returns a conrete implementation of the Store interface
+func New(dbConn *sql.DB, logger log.Factory, tracer opentracing.Tracer) Store {
+	return &store{
+		db:     dbConn,
+		logger: logger.With(zap.String("package", "scimrepo")),
+		tracer: tracer,
+	}
+}
+
+type store struct {
+	db     *sql.DB
+	tracer opentracing.Tracer
+	logger log.Factory
+}
+
+// groupSource is the user_groups source of the memberships provisioned through scim
+const groupSource = "scim"
+
+const (
+	userColumns = `u.id, u.uid, u.external_id, u.email, u.status, u.status_reason,
+	COALESCE(p.first_name, ''), COALESCE(p.middle_name, ''), COALESCE(p.last_name, ''),
+	u.created_at, GREATEST(u.updated_at, COALESCE(p.updated_at, u.updated_at)),
+	COALESCE((
+		SELECT json_agg(json_build_object('value', g.uid, 'display', g.name) ORDER BY g.name)
+		FROM groups g WHERE g.id IN (SELECT ug.group_id FROM user_groups ug WHERE ug.user_id = u.id)
+	), '[]')`
+	userFrom = "FROM users u LEFT JOIN user_profile p ON p.user_id = u.id"
+
+	groupColumns = "g.id, g.uid, g.external_id, g.name, g.created_at, g.updated_at"
+	groupMembers = `COALESCE((
+		SELECT json_agg(json_build_object('value', u.uid, 'display', u.email) ORDER BY u.email)
+		FROM users u WHERE u.id IN (SELECT ug.user_id FROM user_groups ug WHERE ug.group_id = g.id)
+	), '[]')`
+	groupFrom = "FROM groups g"
+)
+
+func scanUser(row interface{ Scan(...interface{}) error }) (scimmodels.UserRecord, error) {
+	user := scimmodels.UserRecord{}
+	var groups []byte
+	err := row.Scan(&user.ID, &user.UID, &user.ExternalID, &user.Email, &user.Status, &user.StatusReason,
+		&user.FirstName, &user.MiddleName, &user.LastName, &user.CreatedAt, &user.UpdatedAt, &groups)
+	if err != nil {
+		return user, err
+	}
+	return user, json.Unmarshal(groups, &user.Groups)
+}
+
+func scanGroup(row interface{ Scan(...interface{}) error }) (scimmodels.GroupRecord, error) {
+	group := scimmodels.GroupRecord{}
+	var members []byte
+	err := row.Scan(&group.ID, &group.UID, &group.ExternalID, &group.Name, &group.CreatedAt, &group.UpdatedAt, &members)
+	if err != nil {
+		return group, err
+	}
+	return group, json.Unmarshal(members, &group.Members)
+}
+
+// ListUsers lists a page of the users matching the filter (in id order) and the total number of matches
+func (s *store) ListUsers(ctx context.Context, filter *scimmodels.Filter, offset, limit int) ([]scimmodels.UserRecord, int, error) {
+	s.logger.For(ctx).Info("entering scimrepo.ListUsers", zap.Int("offset", offset), zap.Int("limit", limit))
+	defer s.logger.For(ctx).Info("leaving scimrepo.ListUsers", zap.Int("offset", offset), zap.Int("limit", limit))
+
+	where, err := whereClause(filter, userAttributes)
+	if err != nil {
+		return nil, 0, err
+	}
+	params := where.Params()
+	countQuery := fmt.Sprintf("SELECT count(*) %s %s", userFrom, where.Value())
+	query := fmt.Sprintf("SELECT %s %s %s ORDER BY u.id OFFSET $%d LIMIT $%d", userColumns, userFrom, where.Value(), len(params)+1, len(params)+2)
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.offset", offset)
+		span.SetTag("param.limit", limit)
+		defer span.Finish()
+	}
+
+	var total int
+	if err = s.db.QueryRow(countQuery, params...).Scan(&total); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.ListUsers.count", zap.Error(err))
+		return nil, 0, postgres.ErrorCheck(err)
+	}
+
+	users := []scimmodels.UserRecord{}
+	if limit <= 0 || offset >= total {
+		return users, total, nil
+	}
+	rows, err := s.db.Query(query, append(params, offset, limit)...)
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.ListUsers.Query", zap.Error(err))
+		return nil, 0, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			s.logger.For(ctx).Error("failed scimrepo.ListUsers.Rows.Scan", zap.Error(err))
+			return nil, 0, postgres.ErrorCheck(err)
+		}
+		users = append(users, user)
+	}
+	return users, total, postgres.ErrorCheck(rows.Err())
+}
+
+func (s *store) ReadUser(ctx context.Context, uid string) (scimmodels.UserRecord, error) {
+	s.logger.For(ctx).Info("entering scimrepo.ReadUser", zap.String("uid", uid))
+	defer s.logger.For(ctx).Info("leaving scimrepo.ReadUser", zap.String("uid", uid))
+
+	query := fmt.Sprintf("SELECT %s %s WHERE u.uid::text = $1", userColumns, userFrom)
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.uid", uid)
+		defer span.Finish()
+	}
+
+	user, err := scanUser(s.db.QueryRow(query, uid))
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.ReadUser.QueryRow", zap.Error(err), zap.String("uid", uid))
+		return user, postgres.ErrorCheck(err)
+	}
+	return user, nil
+}
+
+// InsertUser inserts a (passwordless) user and its profile, events without a user id are for the inserted user
+func (s *store) InsertUser(ctx context.Context, user scimmodels.UserRecord, events ...outboxmodels.Event) (scimmodels.UserRecord, error) {
+	s.logger.For(ctx).Info("entering scimrepo.InsertUser", zap.String("email", user.Email))
+	defer s.logger.For(ctx).Info("leaving scimrepo.InsertUser", zap.String("email", user.Email))
+
+	// the provisioning client is the source of truth for the email, so it is verified
+	query := `
+	INSERT INTO users (email, password_hash, email_verified, external_id, status, status_reason)
+	VALUES ($1, '', TRUE, $2, $3, $4)
+	RETURNING id, uid`
+
+	profileQuery := `
+	INSERT INTO user_profile (user_id, first_name, middle_name, last_name)
+	VALUES ($1, $2, $3, $4)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query+profileQuery)
+		span.SetTag("param.email", user.Email)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	if err = tx.QueryRow(query, user.Email, user.ExternalID, user.Status, user.StatusReason).Scan(&user.ID, &user.UID); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.InsertUser.QueryRow", zap.Error(err), zap.String("email", user.Email))
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+	if _, err = tx.Exec(profileQuery, user.ID, user.FirstName, user.MiddleName, user.LastName); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.InsertUser.profile", zap.Error(err), zap.String("email", user.Email))
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+
+	for i := range events {
+		if events[i].UserID == 0 {
+			events[i].UserID = user.ID
+		}
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.InsertUser.outbox", zap.Error(err), zap.String("email", user.Email))
+		return scimmodels.UserRecord{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+	return s.ReadUser(ctx, user.UID)
+}
+
+// UpdateUser replaces the user's email, external id, status and profile
+// the status reason and change time are only updated when the status changes
+func (s *store) UpdateUser(ctx context.Context, user scimmodels.UserRecord, events ...outboxmodels.Event) (scimmodels.UserRecord, error) {
+	s.logger.For(ctx).Info("entering scimrepo.UpdateUser", zap.Int("user_id", user.ID), zap.String("status", user.Status))
+	defer s.logger.For(ctx).Info("leaving scimrepo.UpdateUser", zap.Int("user_id", user.ID), zap.String("status", user.Status))
+
+	query := `
+	UPDATE users
+	SET email = $2, external_id = $3, status = $4,
+		status_reason = CASE WHEN status <> $4 THEN $5 ELSE status_reason END,
+		status_changed_at = CASE WHEN status <> $4 THEN now() ELSE status_changed_at END,
+		updated_at = now()
+	WHERE id = $1`
+
+	profileQuery := `
+	INSERT INTO user_profile (user_id, first_name, middle_name, last_name)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (user_id) DO UPDATE
+	SET first_name = EXCLUDED.first_name, middle_name = EXCLUDED.middle_name, last_name = EXCLUDED.last_name, updated_at = now()`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query+profileQuery)
+		span.SetTag("param.user_id", user.ID)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, user.ID, user.Email, user.ExternalID, user.Status, user.StatusReason)
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.UpdateUser.Exec", zap.Error(err), zap.Int("user_id", user.ID))
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	if _, err = tx.Exec(profileQuery, user.ID, user.FirstName, user.MiddleName, user.LastName); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.UpdateUser.profile", zap.Error(err), zap.Int("user_id", user.ID))
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.UpdateUser.outbox", zap.Error(err), zap.Int("user_id", user.ID))
+		return scimmodels.UserRecord{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return scimmodels.UserRecord{}, postgres.ErrorCheck(err)
+	}
+	return s.ReadUser(ctx, user.UID)
+}
+
+// DeleteUser deletes the user (profile, groups, identities and password history cascade)
+func (s *store) DeleteUser(ctx context.Context, userID int, events ...outboxmodels.Event) error {
+	s.logger.For(ctx).Info("entering scimrepo.DeleteUser", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving scimrepo.DeleteUser", zap.Int("user_id", userID))
+
+	query := "DELETE FROM users WHERE id = $1"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL DELETE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, userID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.DeleteUser.Exec", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.DeleteUser.outbox", zap.Error(err), zap.Int("user_id", userID))
+		return err
+	}
+	return postgres.ErrorCheck(tx.Commit())
+}
+
+// ListGroups lists a page of the groups matching the filter (in id order) and the total number of matches
+// excludeMembers skips loading the members (large groups)
+func (s *store) ListGroups(ctx context.Context, filter *scimmodels.Filter, offset, limit int, excludeMembers bool) ([]scimmodels.GroupRecord, int, error) {
+	s.logger.For(ctx).Info("entering scimrepo.ListGroups", zap.Int("offset", offset), zap.Int("limit", limit))
+	defer s.logger.For(ctx).Info("leaving scimrepo.ListGroups", zap.Int("offset", offset), zap.Int("limit", limit))
+
+	where, err := whereClause(filter, groupAttributes)
+	if err != nil {
+		return nil, 0, err
+	}
+	members := groupMembers
+	if excludeMembers {
+		members = "'[]'::json"
+	}
+	params := where.Params()
+	countQuery := fmt.Sprintf("SELECT count(*) %s %s", groupFrom, where.Value())
+	query := fmt.Sprintf("SELECT %s, %s %s %s ORDER BY g.id OFFSET $%d LIMIT $%d", groupColumns, members, groupFrom, where.Value(), len(params)+1, len(params)+2)
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.offset", offset)
+		span.SetTag("param.limit", limit)
+		defer span.Finish()
+	}
+
+	var total int
+	if err = s.db.QueryRow(countQuery, params...).Scan(&total); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.ListGroups.count", zap.Error(err))
+		return nil, 0, postgres.ErrorCheck(err)
+	}
+
+	groups := []scimmodels.GroupRecord{}
+	if limit <= 0 || offset >= total {
+		return groups, total, nil
+	}
+	rows, err := s.db.Query(query, append(params, offset, limit)...)
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.ListGroups.Query", zap.Error(err))
+		return nil, 0, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			s.logger.For(ctx).Error("failed scimrepo.ListGroups.Rows.Scan", zap.Error(err))
+			return nil, 0, postgres.ErrorCheck(err)
+		}
+		groups = append(groups, group)
+	}
+	return groups, total, postgres.ErrorCheck(rows.Err())
+}
+
+func (s *store) ReadGroup(ctx context.Context, uid string) (scimmodels.GroupRecord, error) {
+	s.logger.For(ctx).Info("entering scimrepo.ReadGroup", zap.String("uid", uid))
+	defer s.logger.For(ctx).Info("leaving scimrepo.ReadGroup", zap.String("uid", uid))
+
+	query := fmt.Sprintf("SELECT %s, %s %s WHERE g.uid::text = $1", groupColumns, groupMembers, groupFrom)
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.uid", uid)
+		defer span.Finish()
+	}
+
+	group, err := scanGroup(s.db.QueryRow(query, uid))
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.ReadGroup.QueryRow", zap.Error(err), zap.String("uid", uid))
+		return group, postgres.ErrorCheck(err)
+	}
+	return group, nil
+}
+
+// InsertGroup inserts the group and its members
+func (s *store) InsertGroup(ctx context.Context, group scimmodels.GroupRecord) (scimmodels.GroupRecord, error) {
+	s.logger.For(ctx).Info("entering scimrepo.InsertGroup", zap.String("name", group.Name))
+	defer s.logger.For(ctx).Info("leaving scimrepo.InsertGroup", zap.String("name", group.Name))
+
+	query := `
+	INSERT INTO groups (name, external_id)
+	VALUES ($1, $2)
+	RETURNING id, uid`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.name", group.Name)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return scimmodels.GroupRecord{}, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	if err = tx.QueryRow(query, group.Name, group.ExternalID).Scan(&group.ID, &group.UID); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.InsertGroup.QueryRow", zap.Error(err), zap.String("name", group.Name))
+		return scimmodels.GroupRecord{}, postgres.ErrorCheck(err)
+	}
+	if err = setMembers(tx, group); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.InsertGroup.setMembers", zap.Error(err), zap.String("name", group.Name))
+		return scimmodels.GroupRecord{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return scimmodels.GroupRecord{}, postgres.ErrorCheck(err)
+	}
+	return s.ReadGroup(ctx, group.UID)
+}
+
+// UpdateGroup replaces the group's name, external id and members
+func (s *store) UpdateGroup(ctx context.Context, group scimmodels.GroupRecord) (scimmodels.GroupRecord, error) {
+	s.logger.For(ctx).Info("entering scimrepo.UpdateGroup", zap.Int("group_id", group.ID))
+	defer s.logger.For(ctx).Info("leaving scimrepo.UpdateGroup", zap.Int("group_id", group.ID))
+
+	query := `
+	UPDATE groups
+	SET name = $2, external_id = $3, updated_at = now()
+	WHERE id = $1`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.group_id", group.ID)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return scimmodels.GroupRecord{}, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, group.ID, group.Name, group.ExternalID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.UpdateGroup.Exec", zap.Error(err), zap.Int("group_id", group.ID))
+		return scimmodels.GroupRecord{}, postgres.ErrorCheck(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return scimmodels.GroupRecord{}, postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	if err = setMembers(tx, group); err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.UpdateGroup.setMembers", zap.Error(err), zap.Int("group_id", group.ID))
+		return scimmodels.GroupRecord{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return scimmodels.GroupRecord{}, postgres.ErrorCheck(err)
+	}
+	return s.ReadGroup(ctx, group.UID)
+}
+
+// setMembers replaces the group's memberships (from every source) with the members
+// new memberships are from the scim source, an unknown member fails the change
+func setMembers(tx *sql.Tx, group scimmodels.GroupRecord) error {
+	unknownQuery := `
+	SELECT m FROM unnest($1::text[]) m
+	WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.uid::text = m)
+	LIMIT 1`
+
+	removeQuery := `
+	DELETE FROM user_groups ug
+	USING users u
+	WHERE u.id = ug.user_id AND ug.group_id = $1 AND NOT (u.uid::text = ANY($2::text[]))`
+
+	addQuery := `
+	INSERT INTO user_groups (user_id, group_id, source)
+	SELECT u.id, $1, $3 FROM users u
+	WHERE u.uid::text = ANY($2::text[])
+	AND NOT EXISTS (SELECT 1 FROM user_groups ug WHERE ug.user_id = u.id AND ug.group_id = $1)`
+
+	members := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		members = append(members, member.UID)
+	}
+
+	var unknown string
+	err := tx.QueryRow(unknownQuery, pq.Array(members)).Scan(&unknown)
+	if err == nil {
+		return scimmodels.NewError(400, scimmodels.ErrInvalidValue, fmt.Sprintf("unknown member %q", unknown))
+	}
+	if err != sql.ErrNoRows {
+		return postgres.ErrorCheck(err)
+	}
+	if _, err = tx.Exec(removeQuery, group.ID, pq.Array(members)); err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	if _, err = tx.Exec(addQuery, group.ID, pq.Array(members), groupSource); err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	return nil
+}
+
+// DeleteGroup deletes the group (its memberships cascade)
+func (s *store) DeleteGroup(ctx context.Context, groupID int) error {
+	s.logger.For(ctx).Info("entering scimrepo.DeleteGroup", zap.Int("group_id", groupID))
+	defer s.logger.For(ctx).Info("leaving scimrepo.DeleteGroup", zap.Int("group_id", groupID))
+
+	query := "DELETE FROM groups WHERE id = $1"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL DELETE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.group_id", groupID)
+		defer span.Finish()
+	}
+
+	result, err := s.db.Exec(query, groupID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed scimrepo.DeleteGroup.Exec", zap.Error(err), zap.Int("group_id", groupID))
+		return postgres.ErrorCheck(err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	return nil
+}
@@ -6,8 +6,11 @@ import (
 
 	"github.com/tjsampson/token-svc/internal/datastores/postgres"
 	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
 	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
 
+	"github.com/lib/pq"
 	"github.com/opentracing/opentracing-go"
 	tags "github.com/opentracing/opentracing-go/ext"
 	"go.uber.org/zap"
@@ -15,10 +18,24 @@ import (
 
 // Store is the database store Interface
 // typically maps to a table in the DB, but not a requirement
+// the events passed to a change are written to the outbox in the change's transaction
 type Store interface {
 	ReadByEmail(ctx context.Context, email string) (usermodels.Record, error)
-	Insert(ctx context.Context, email, passHash string) (usermodels.Record, error)
+	Insert(ctx context.Context, email, passHash string, events ...outboxmodels.Event) (usermodels.Record, error)
 	List(ctx context.Context) ([]usermodels.Record, error)
+	UpdatePasswordHash(ctx context.Context, userID int, passHash string, events ...outboxmodels.Event) error
+	Import(ctx context.Context, record usermodels.ImportRecord, events ...outboxmodels.Event) (bool, error)
+	ReadByID(ctx context.Context, userID int) (usermodels.Record, error)
+	InsertPasswordHistory(ctx context.Context, userID int, passHash string) error
+	ListPasswordHistory(ctx context.Context, userID int, limit int) ([]string, error)
+	UpdateStatus(ctx context.Context, userID int, status, reason string, events ...outboxmodels.Event) error
+	VerifyEmail(ctx context.Context, userID int, events ...outboxmodels.Event) (bool, error)
+	IsGroupMember(ctx context.Context, userID int, group string) (bool, error)
+	ReadByIdentity(ctx context.Context, issuer, subject string) (usermodels.Record, bool, error)
+	LinkIdentity(ctx context.Context, userID int, identity usermodels.Identity) error
+	InsertFederated(ctx context.Context, identity usermodels.Identity, events ...outboxmodels.Event) (usermodels.Record, error)
+	ListGroups(ctx context.Context, userID int) ([]string, error)
+	SyncGroups(ctx context.Context, userID int, source string, groups []string) error
 }
 
 // New returns a conrete implementation of the Store interface
@@ -36,7 +53,8 @@ type store struct {
 	logger log.Factory
 }
 
-func (s *store) Insert(ctx context.Context, email, passHash string) (usermodels.Record, error) {
+// Insert inserts the user, events without a user id are for the inserted user
+func (s *store) Insert(ctx context.Context, email, passHash string, events ...outboxmodels.Event) (usermodels.Record, error) {
 	s.logger.For(ctx).Info("entering userrepo.Insert", zap.String("email", email))
 
 	query := `
@@ -54,12 +72,31 @@ func (s *store) Insert(ctx context.Context, email, passHash string) (usermodels.
 		// ctx = opentracing.ContextWithSpan(ctx, span)
 	}
 
-	_, err := s.db.Exec(query, email, passHash)
+	tx, err := s.db.Begin()
 	if err != nil {
+		return usermodels.Record{}, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	if err = tx.QueryRow(query, email, passHash).Scan(&userID); err != nil {
 		s.logger.For(ctx).Error("failed userrepo.Insert.Exec", zap.Error(err), zap.String("email", email))
 		return usermodels.Record{}, err
 	}
 
+	for i := range events {
+		if events[i].UserID == 0 {
+			events[i].UserID = userID
+		}
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.Insert.outbox", zap.Error(err), zap.String("email", email))
+		return usermodels.Record{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return usermodels.Record{}, postgres.ErrorCheck(err)
+	}
+
 	user, err := s.ReadByEmail(ctx, email)
 	if err != nil {
 		s.logger.For(ctx).Error("failed userrepo.Insert.ReadByEmail", zap.Error(err), zap.String("email", email))
@@ -73,7 +110,7 @@ func (s *store) ReadByEmail(ctx context.Context, email string) (usermodels.Recor
 	s.logger.For(ctx).Info("entering userrepo.ReadByEmail", zap.String("email", email))
 	defer s.logger.For(ctx).Info("leaving userrepo.ReadByEmail", zap.String("email", email))
 	userData := usermodels.Record{}
-	query := "SELECT id, uid, email, email_verified, password_hash, created_at, updated_at FROM users WHERE email=$1"
+	query := "SELECT id, uid, email, email_verified, password_hash, status, status_reason, status_changed_at, created_at, updated_at FROM users WHERE email=$1"
 	queryStmt, err := s.db.Prepare(query)
 
 	if err != nil {
@@ -91,7 +128,7 @@ func (s *store) ReadByEmail(ctx context.Context, email string) (usermodels.Recor
 		// ctx = opentracing.ContextWithSpan(ctx, span)
 	}
 
-	err = queryStmt.QueryRow(email).Scan(&userData.ID, &userData.UID, &userData.Email, &userData.EmailVerified, &userData.PasswordHash, &userData.CreatedAt, &userData.UpdatedAt)
+	err = queryStmt.QueryRow(email).Scan(&userData.ID, &userData.UID, &userData.Email, &userData.EmailVerified, &userData.PasswordHash, &userData.Status, &userData.StatusReason, &userData.StatusChangedAt, &userData.CreatedAt, &userData.UpdatedAt)
 	if err != nil {
 		s.logger.For(ctx).Error("failed userrepo.ReadByEmail.QueryRow", zap.Error(err), zap.String("email", email))
 		return usermodels.Record{}, postgres.ErrorCheck(err)
@@ -105,7 +142,7 @@ func (s *store) List(ctx context.Context) ([]usermodels.Record, error) {
 	s.logger.For(ctx).Info("entering userrepo.List")
 	defer s.logger.For(ctx).Info("leaving userrepo.List")
 	users := []usermodels.Record{}
-	query := "SELECT id, uid, email, email_verified, password_hash, created_at, updated_at FROM users"
+	query := "SELECT id, uid, email, email_verified, password_hash, status, status_reason, status_changed_at, created_at, updated_at FROM users"
 
 	if span := opentracing.SpanFromContext(ctx); span != nil {
 		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
@@ -125,7 +162,7 @@ func (s *store) List(ctx context.Context) ([]usermodels.Record, error) {
 	for rows.Next() {
 		var user usermodels.Record
 
-		err = rows.Scan(&user.ID, &user.UID, &user.Email, &user.EmailVerified, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+		err = rows.Scan(&user.ID, &user.UID, &user.Email, &user.EmailVerified, &user.PasswordHash, &user.Status, &user.StatusReason, &user.StatusChangedAt, &user.CreatedAt, &user.UpdatedAt)
 		if err != nil {
 			s.logger.For(ctx).Error("failed userrepo.List.Query.Rows.Scan")
 			return nil, err
@@ -135,3 +172,493 @@ func (s *store) List(ctx context.Context) ([]usermodels.Record, error) {
 
 	return users, nil
 }
+
+func (s *store) UpdatePasswordHash(ctx context.Context, userID int, passHash string, events ...outboxmodels.Event) error {
+	s.logger.For(ctx).Info("entering userrepo.UpdatePasswordHash", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving userrepo.UpdatePasswordHash", zap.Int("user_id", userID))
+
+	query := `
+	UPDATE users
+	SET password_hash = $1, updated_at = now()
+	WHERE id = $2`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(query, passHash, userID); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.UpdatePasswordHash.Exec", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.UpdatePasswordHash.outbox", zap.Error(err), zap.Int("user_id", userID))
+		return err
+	}
+	return postgres.ErrorCheck(tx.Commit())
+}
+
+// Import inserts a migrated user, existing users (by email) are left untouched
+// the returned bool reports if the user was inserted, the events are only written for an inserted user
+// (events without a user id are for the inserted user)
+func (s *store) Import(ctx context.Context, record usermodels.ImportRecord, events ...outboxmodels.Event) (bool, error) {
+	s.logger.For(ctx).Info("entering userrepo.Import", zap.String("email", record.Email))
+	defer s.logger.For(ctx).Info("leaving userrepo.Import", zap.String("email", record.Email))
+
+	query := `
+	INSERT INTO users (email, password_hash, email_verified)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (email) DO NOTHING
+	RETURNING id`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.email", record.Email)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(query, record.Email, record.PasswordHash, record.EmailVerified).Scan(&userID)
+	if err == sql.ErrNoRows {
+		// the email already exists
+		return false, nil
+	}
+	if err != nil {
+		s.logger.For(ctx).Error("failed userrepo.Import.Exec", zap.Error(err), zap.String("email", record.Email))
+		return false, postgres.ErrorCheck(err)
+	}
+
+	for i := range events {
+		if events[i].UserID == 0 {
+			events[i].UserID = userID
+		}
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.Import.outbox", zap.Error(err), zap.String("email", record.Email))
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, postgres.ErrorCheck(err)
+	}
+	return true, nil
+}
+
+func (s *store) ReadByID(ctx context.Context, userID int) (usermodels.Record, error) {
+	s.logger.For(ctx).Info("entering userrepo.ReadByID", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving userrepo.ReadByID", zap.Int("user_id", userID))
+	userData := usermodels.Record{}
+	query := "SELECT id, uid, email, email_verified, password_hash, status, status_reason, status_changed_at, created_at, updated_at FROM users WHERE id=$1"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	err := s.db.QueryRow(query, userID).Scan(&userData.ID, &userData.UID, &userData.Email, &userData.EmailVerified, &userData.PasswordHash, &userData.Status, &userData.StatusReason, &userData.StatusChangedAt, &userData.CreatedAt, &userData.UpdatedAt)
+	if err != nil {
+		s.logger.For(ctx).Error("failed userrepo.ReadByID.QueryRow", zap.Error(err), zap.Int("user_id", userID))
+		return usermodels.Record{}, postgres.ErrorCheck(err)
+	}
+	return userData, nil
+}
+
+func (s *store) InsertPasswordHistory(ctx context.Context, userID int, passHash string) error {
+	s.logger.For(ctx).Info("entering userrepo.InsertPasswordHistory", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving userrepo.InsertPasswordHistory", zap.Int("user_id", userID))
+
+	query := `
+	INSERT INTO password_history (user_id, password_hash)
+	VALUES ($1, $2)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	if _, err := s.db.Exec(query, userID, passHash); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.InsertPasswordHistory.Exec", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	return nil
+}
+
+// ListPasswordHistory returns the user's most recent password hashes (newest first)
+func (s *store) ListPasswordHistory(ctx context.Context, userID int, limit int) ([]string, error) {
+	s.logger.For(ctx).Info("entering userrepo.ListPasswordHistory", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving userrepo.ListPasswordHistory", zap.Int("user_id", userID))
+	hashes := []string{}
+	query := "SELECT password_hash FROM password_history WHERE user_id=$1 ORDER BY created_at DESC, id DESC LIMIT $2"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, userID, limit)
+	if err != nil {
+		s.logger.For(ctx).Error("failed userrepo.ListPasswordHistory.Query", zap.Error(err))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			s.logger.For(ctx).Error("failed userrepo.ListPasswordHistory.Rows.Scan", zap.Error(err))
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+func (s *store) UpdateStatus(ctx context.Context, userID int, status, reason string, events ...outboxmodels.Event) error {
+	s.logger.For(ctx).Info("entering userrepo.UpdateStatus", zap.Int("user_id", userID), zap.String("status", status))
+	defer s.logger.For(ctx).Info("leaving userrepo.UpdateStatus", zap.Int("user_id", userID), zap.String("status", status))
+
+	query := `
+	UPDATE users
+	SET status = $1, status_reason = $2, status_changed_at = now(), updated_at = now()
+	WHERE id = $3`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		span.SetTag("param.status", status)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, status, reason, userID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed userrepo.UpdateStatus.Exec", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.UpdateStatus.outbox", zap.Error(err), zap.Int("user_id", userID))
+		return err
+	}
+	return postgres.ErrorCheck(tx.Commit())
+}
+
+// VerifyEmail marks the user's email verified
+// the returned bool reports if the email was unverified, the events are only written then
+func (s *store) VerifyEmail(ctx context.Context, userID int, events ...outboxmodels.Event) (bool, error) {
+	s.logger.For(ctx).Info("entering userrepo.VerifyEmail", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving userrepo.VerifyEmail", zap.Int("user_id", userID))
+
+	query := `
+	UPDATE users
+	SET email_verified = true, updated_at = now()
+	WHERE id = $1 AND NOT email_verified`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, userID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed userrepo.VerifyEmail.Exec", zap.Error(err), zap.Int("user_id", userID))
+		return false, postgres.ErrorCheck(err)
+	}
+	// already verified (or no such user), nothing changed
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return false, postgres.ErrorCheck(err)
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.VerifyEmail.outbox", zap.Error(err), zap.Int("user_id", userID))
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, postgres.ErrorCheck(err)
+	}
+	return true, nil
+}
+
+// IsGroupMember reports if the user belongs to the named group
+func (s *store) IsGroupMember(ctx context.Context, userID int, group string) (bool, error) {
+	s.logger.For(ctx).Info("entering userrepo.IsGroupMember", zap.Int("user_id", userID), zap.String("group", group))
+	defer s.logger.For(ctx).Info("leaving userrepo.IsGroupMember", zap.Int("user_id", userID), zap.String("group", group))
+
+	query := `
+	SELECT EXISTS (
+		SELECT 1 FROM user_groups ug
+		JOIN groups g ON g.id = ug.group_id
+		WHERE ug.user_id = $1 AND g.name = $2
+	)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		span.SetTag("param.group", group)
+		defer span.Finish()
+	}
+
+	var member bool
+	if err := s.db.QueryRow(query, userID, group).Scan(&member); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.IsGroupMember.QueryRow", zap.Error(err), zap.Int("user_id", userID))
+		return false, postgres.ErrorCheck(err)
+	}
+	return member, nil
+}
+
+// ReadByIdentity reads the user linked to the external identity (and stamps the identity's last login)
+// the returned bool reports if the identity is linked to a user
+func (s *store) ReadByIdentity(ctx context.Context, issuer, subject string) (usermodels.Record, bool, error) {
+	s.logger.For(ctx).Info("entering userrepo.ReadByIdentity", zap.String("issuer", issuer))
+	defer s.logger.For(ctx).Info("leaving userrepo.ReadByIdentity", zap.String("issuer", issuer))
+	userData := usermodels.Record{}
+
+	query := `
+	WITH identity AS (
+		UPDATE user_identities SET last_login_at = now()
+		WHERE issuer = $1 AND subject = $2
+		RETURNING user_id
+	)
+	SELECT u.id, u.uid, u.email, u.email_verified, u.password_hash, u.status, u.status_reason, u.status_changed_at, u.created_at, u.updated_at
+	FROM users u JOIN identity i ON i.user_id = u.id`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.issuer", issuer)
+		defer span.Finish()
+	}
+
+	err := s.db.QueryRow(query, issuer, subject).Scan(&userData.ID, &userData.UID, &userData.Email, &userData.EmailVerified, &userData.PasswordHash, &userData.Status, &userData.StatusReason, &userData.StatusChangedAt, &userData.CreatedAt, &userData.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return userData, false, nil
+	}
+	if err != nil {
+		s.logger.For(ctx).Error("failed userrepo.ReadByIdentity.QueryRow", zap.Error(err), zap.String("issuer", issuer))
+		return usermodels.Record{}, false, postgres.ErrorCheck(err)
+	}
+	return userData, true, nil
+}
+
+// LinkIdentity links the external identity to an existing user
+func (s *store) LinkIdentity(ctx context.Context, userID int, identity usermodels.Identity) error {
+	s.logger.For(ctx).Info("entering userrepo.LinkIdentity", zap.Int("user_id", userID), zap.String("issuer", identity.Issuer))
+	defer s.logger.For(ctx).Info("leaving userrepo.LinkIdentity", zap.Int("user_id", userID), zap.String("issuer", identity.Issuer))
+
+	query := `
+	INSERT INTO user_identities (user_id, issuer, subject, email)
+	VALUES ($1, $2, $3, $4)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		span.SetTag("param.issuer", identity.Issuer)
+		defer span.Finish()
+	}
+
+	if _, err := s.db.Exec(query, userID, identity.Issuer, identity.Subject, identity.Email); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.LinkIdentity.Exec", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	return nil
+}
+
+// InsertFederated inserts a user without a password and links the external identity to it
+// events without a user id are for the inserted user
+func (s *store) InsertFederated(ctx context.Context, identity usermodels.Identity, events ...outboxmodels.Event) (usermodels.Record, error) {
+	s.logger.For(ctx).Info("entering userrepo.InsertFederated", zap.String("email", identity.Email), zap.String("issuer", identity.Issuer))
+	defer s.logger.For(ctx).Info("leaving userrepo.InsertFederated", zap.String("email", identity.Email), zap.String("issuer", identity.Issuer))
+
+	query := `
+	WITH new_user AS (
+		INSERT INTO users (email, password_hash, email_verified)
+		VALUES ($1, '', $2)
+		RETURNING id
+	)
+	INSERT INTO user_identities (user_id, issuer, subject, email)
+	SELECT id, $3, $4, $1 FROM new_user
+	RETURNING user_id`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.email", identity.Email)
+		span.SetTag("param.issuer", identity.Issuer)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return usermodels.Record{}, postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	if err = tx.QueryRow(query, identity.Email, identity.EmailVerified, identity.Issuer, identity.Subject).Scan(&userID); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.InsertFederated.Exec", zap.Error(err), zap.String("email", identity.Email))
+		return usermodels.Record{}, postgres.ErrorCheck(err)
+	}
+
+	for i := range events {
+		if events[i].UserID == 0 {
+			events[i].UserID = userID
+		}
+	}
+	if err = outboxrepo.Append(tx, events...); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.InsertFederated.outbox", zap.Error(err), zap.String("email", identity.Email))
+		return usermodels.Record{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return usermodels.Record{}, postgres.ErrorCheck(err)
+	}
+	return s.ReadByID(ctx, userID)
+}
+
+// ListGroups lists the names of the user's groups
+func (s *store) ListGroups(ctx context.Context, userID int) ([]string, error) {
+	s.logger.For(ctx).Info("entering userrepo.ListGroups", zap.Int("user_id", userID))
+	defer s.logger.For(ctx).Info("leaving userrepo.ListGroups", zap.Int("user_id", userID))
+
+	query := `
+	SELECT DISTINCT g.name FROM user_groups ug
+	JOIN groups g ON g.id = ug.group_id
+	WHERE ug.user_id = $1
+	ORDER BY g.name`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.user_id", userID)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed userrepo.ListGroups.Query", zap.Error(err), zap.Int("user_id", userID))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+
+	groups := []string{}
+	for rows.Next() {
+		var group string
+		if err = rows.Scan(&group); err != nil {
+			return nil, postgres.ErrorCheck(err)
+		}
+		groups = append(groups, group)
+	}
+	return groups, postgres.ErrorCheck(rows.Err())
+}
+
+// SyncGroups replaces the user's group memberships from the source (ex: ldap) with the named groups
+// missing groups are created, memberships from other sources are left untouched
+func (s *store) SyncGroups(ctx context.Context, userID int, source string, groups []string) error {
+	s.logger.For(ctx).Info("entering userrepo.SyncGroups", zap.Int("user_id", userID), zap.String("source", source), zap.Strings("groups", groups))
+	defer s.logger.For(ctx).Info("leaving userrepo.SyncGroups", zap.Int("user_id", userID), zap.String("source", source))
+
+	createQuery := `
+	INSERT INTO groups (name)
+	SELECT unnest($1::text[])
+	ON CONFLICT (name) DO NOTHING`
+
+	removeQuery := `
+	DELETE FROM user_groups ug
+	USING groups g
+	WHERE g.id = ug.group_id AND ug.user_id = $1 AND ug.source = $2 AND NOT (g.name = ANY($3::citext[]))`
+
+	addQuery := `
+	INSERT INTO user_groups (user_id, group_id, source)
+	SELECT $1, g.id, $2 FROM groups g
+	WHERE g.name = ANY($3::citext[])
+	AND NOT EXISTS (SELECT 1 FROM user_groups ug WHERE ug.user_id = $1 AND ug.group_id = g.id)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", createQuery+removeQuery+addQuery)
+		span.SetTag("param.user_id", userID)
+		span.SetTag("param.source", source)
+		defer span.Finish()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return postgres.ErrorCheck(err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(createQuery, pq.Array(groups)); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.SyncGroups.create", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	if _, err = tx.Exec(removeQuery, userID, source, pq.Array(groups)); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.SyncGroups.remove", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	if _, err = tx.Exec(addQuery, userID, source, pq.Array(groups)); err != nil {
+		s.logger.For(ctx).Error("failed userrepo.SyncGroups.add", zap.Error(err), zap.Int("user_id", userID))
+		return postgres.ErrorCheck(err)
+	}
+	return postgres.ErrorCheck(tx.Commit())
+}
@@ -0,0 +1,368 @@
+package webhookrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/datastores/postgres"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/webhookmodels"
+
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+// Store is the webhook store (webhook_subscriptions, webhook_deliveries)
+type Store interface {
+	InsertSubscription(ctx context.Context, sub webhookmodels.Subscription) (webhookmodels.Subscription, error)
+	ReadSubscription(ctx context.Context, id int64) (webhookmodels.Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]webhookmodels.Subscription, error)
+	DeleteSubscription(ctx context.Context, id int64) error
+	FanOut(ctx context.Context, limit int) (int64, error)
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookmodels.Delivery, error)
+	UpdateDelivery(ctx context.Context, delivery webhookmodels.Delivery) error
+	ReadDelivery(ctx context.Context, id int64) (webhookmodels.Delivery, error)
+	ListDeliveries(ctx context.Context, query webhookmodels.DeliveryQuery) ([]webhookmodels.Delivery, error)
+}
+
+// New returns a conrete implementation of the Store interface
+func New(dbConn *sql.DB, logger log.Factory, tracer opentracing.Tracer) Store {
+	return &store{
+		db:     dbConn,
+		logger: logger.With(zap.String("package", "webhookrepo")),
+		tracer: tracer,
+	}
+}
+
+type store struct {
+	db     *sql.DB
+	tracer opentracing.Tracer
+	logger log.Factory
+}
+
+const (
+	subscriptionColumns = "id, uid, url, secret, events, description, created_by, created_at, updated_at"
+	deliveryColumns     = "id, uid, subscription_id, event_type, status, attempts, next_attempt_at, response_code, last_error, delivered_at, created_at, updated_at"
+)
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (webhookmodels.Subscription, error) {
+	sub := webhookmodels.Subscription{}
+	var createdBy sql.NullInt64
+	err := row.Scan(&sub.ID, &sub.UID, &sub.URL, &sub.Secret, pq.Array(&sub.Events), &sub.Description, &createdBy, &sub.CreatedAt, &sub.UpdatedAt)
+	sub.CreatedBy = int(createdBy.Int64)
+	return sub, err
+}
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (webhookmodels.Delivery, error) {
+	delivery := webhookmodels.Delivery{}
+	var deliveredAt pq.NullTime
+	err := row.Scan(&delivery.ID, &delivery.UID, &delivery.SubscriptionID, &delivery.EventType, &delivery.Status, &delivery.Attempts, &delivery.NextAttemptAt, &delivery.ResponseCode, &delivery.LastError, &deliveredAt, &delivery.CreatedAt, &delivery.UpdatedAt)
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	return delivery, err
+}
+
+func (s *store) InsertSubscription(ctx context.Context, sub webhookmodels.Subscription) (webhookmodels.Subscription, error) {
+	s.logger.For(ctx).Info("entering webhookrepo.InsertSubscription", zap.String("url", sub.URL))
+	defer s.logger.For(ctx).Info("leaving webhookrepo.InsertSubscription", zap.String("url", sub.URL))
+
+	query := `
+	INSERT INTO webhook_subscriptions (url, secret, events, description, created_by)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING ` + subscriptionColumns
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.url", sub.URL)
+		defer span.Finish()
+	}
+
+	createdBy := sql.NullInt64{Int64: int64(sub.CreatedBy), Valid: sub.CreatedBy > 0}
+	inserted, err := scanSubscription(s.db.QueryRow(query, sub.URL, sub.Secret, pq.Array(sub.Events), sub.Description, createdBy))
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.InsertSubscription.QueryRow", zap.Error(err))
+		return inserted, postgres.ErrorCheck(err)
+	}
+	return inserted, nil
+}
+
+func (s *store) ReadSubscription(ctx context.Context, id int64) (webhookmodels.Subscription, error) {
+	s.logger.For(ctx).Info("entering webhookrepo.ReadSubscription", zap.Int64("subscription_id", id))
+	defer s.logger.For(ctx).Info("leaving webhookrepo.ReadSubscription", zap.Int64("subscription_id", id))
+
+	query := "SELECT " + subscriptionColumns + " FROM webhook_subscriptions WHERE id=$1"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.subscription_id", id)
+		defer span.Finish()
+	}
+
+	sub, err := scanSubscription(s.db.QueryRow(query, id))
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.ReadSubscription.QueryRow", zap.Error(err), zap.Int64("subscription_id", id))
+		return sub, postgres.ErrorCheck(err)
+	}
+	return sub, nil
+}
+
+func (s *store) ListSubscriptions(ctx context.Context) ([]webhookmodels.Subscription, error) {
+	s.logger.For(ctx).Info("entering webhookrepo.ListSubscriptions")
+	defer s.logger.For(ctx).Info("leaving webhookrepo.ListSubscriptions")
+
+	query := "SELECT " + subscriptionColumns + " FROM webhook_subscriptions ORDER BY id"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.ListSubscriptions.Query", zap.Error(err))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	subs := []webhookmodels.Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			s.logger.For(ctx).Error("failed webhookrepo.ListSubscriptions.Rows.Scan", zap.Error(err))
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// DeleteSubscription deletes the subscription and its deliveries
+func (s *store) DeleteSubscription(ctx context.Context, id int64) error {
+	s.logger.For(ctx).Info("entering webhookrepo.DeleteSubscription", zap.Int64("subscription_id", id))
+	defer s.logger.For(ctx).Info("leaving webhookrepo.DeleteSubscription", zap.Int64("subscription_id", id))
+
+	query := "DELETE FROM webhook_subscriptions WHERE id=$1"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL DELETE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.subscription_id", id)
+		defer span.Finish()
+	}
+
+	result, err := s.db.Exec(query, id)
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.DeleteSubscription.Exec", zap.Error(err), zap.Int64("subscription_id", id))
+		return postgres.ErrorCheck(err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	return nil
+}
+
+// FanOut creates the deliveries for the (oldest) undispatched outbox events and marks them dispatched
+// a single statement, so an outbox event is fanned out exactly once (concurrent dispatchers skip locked events)
+// the returned count is the number of outbox events dispatched
+func (s *store) FanOut(ctx context.Context, limit int) (int64, error) {
+	query := `
+	WITH pending AS (
+		SELECT id, event_type FROM outbox
+		WHERE webhooks_dispatched_at IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	), deliveries AS (
+		INSERT INTO webhook_deliveries (subscription_id, outbox_id, event_type)
+		SELECT sub.id, pending.id, pending.event_type
+		FROM pending
+		JOIN webhook_subscriptions sub ON pending.event_type = ANY(sub.events) OR '*' = ANY(sub.events)
+		ON CONFLICT DO NOTHING
+	)
+	UPDATE outbox SET webhooks_dispatched_at = now()
+	WHERE id IN (SELECT id FROM pending)`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL INSERT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		defer span.Finish()
+	}
+
+	result, err := s.db.Exec(query, limit)
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.FanOut.Exec", zap.Error(err))
+		return 0, postgres.ErrorCheck(err)
+	}
+	return result.RowsAffected()
+}
+
+// ClaimDeliveries leases the due deliveries (with their subscription and event) for sending
+// the lease pushes next_attempt_at out, so a delivery that is never updated (ex: a crash) is retried once the lease expires
+func (s *store) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookmodels.Delivery, error) {
+	query := `
+	UPDATE webhook_deliveries d
+	SET next_attempt_at = now() + $2 * interval '1 second', updated_at = now()
+	FROM webhook_subscriptions sub, outbox o
+	WHERE d.id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= now()
+		ORDER BY next_attempt_at, id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	AND sub.id = d.subscription_id
+	AND o.id = d.outbox_id
+	RETURNING d.id, d.uid, d.subscription_id, d.event_type, d.status, d.attempts, d.next_attempt_at, d.response_code, d.last_error, d.delivered_at, d.created_at, d.updated_at,
+		sub.url, sub.secret, o.id, o.uid, o.event_type, o.user_id, o.payload, o.created_at`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, limit, int64(lease.Seconds()))
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.ClaimDeliveries.Query", zap.Error(err))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+
+	deliveries := []webhookmodels.Delivery{}
+	for rows.Next() {
+		delivery := webhookmodels.Delivery{}
+		var deliveredAt pq.NullTime
+		var userID sql.NullInt64
+		var payload []byte
+		if err = rows.Scan(&delivery.ID, &delivery.UID, &delivery.SubscriptionID, &delivery.EventType, &delivery.Status, &delivery.Attempts, &delivery.NextAttemptAt, &delivery.ResponseCode, &delivery.LastError, &deliveredAt, &delivery.CreatedAt, &delivery.UpdatedAt,
+			&delivery.URL, &delivery.Secret, &delivery.Event.ID, &delivery.Event.UID, &delivery.Event.Type, &userID, &payload, &delivery.Event.CreatedAt); err != nil {
+			s.logger.For(ctx).Error("failed webhookrepo.ClaimDeliveries.Rows.Scan", zap.Error(err))
+			return nil, err
+		}
+		if deliveredAt.Valid {
+			delivery.DeliveredAt = &deliveredAt.Time
+		}
+		delivery.Event.UserID = int(userID.Int64)
+		if err = json.Unmarshal(payload, &delivery.Event.Data); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// UpdateDelivery stores the delivery status and attempt result
+func (s *store) UpdateDelivery(ctx context.Context, delivery webhookmodels.Delivery) error {
+	query := `
+	UPDATE webhook_deliveries
+	SET status = $1, attempts = $2, next_attempt_at = $3, response_code = $4, last_error = $5, delivered_at = $6, updated_at = now()
+	WHERE id = $7`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL UPDATE", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.delivery_id", delivery.ID)
+		span.SetTag("param.status", delivery.Status)
+		defer span.Finish()
+	}
+
+	deliveredAt := pq.NullTime{}
+	if delivery.DeliveredAt != nil {
+		deliveredAt = pq.NullTime{Time: *delivery.DeliveredAt, Valid: true}
+	}
+	result, err := s.db.Exec(query, delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.ResponseCode, delivery.LastError, deliveredAt, delivery.ID)
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.UpdateDelivery.Exec", zap.Error(err), zap.Int64("delivery_id", delivery.ID))
+		return postgres.ErrorCheck(err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return postgres.ErrorCheck(sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (s *store) ReadDelivery(ctx context.Context, id int64) (webhookmodels.Delivery, error) {
+	s.logger.For(ctx).Info("entering webhookrepo.ReadDelivery", zap.Int64("delivery_id", id))
+	defer s.logger.For(ctx).Info("leaving webhookrepo.ReadDelivery", zap.Int64("delivery_id", id))
+
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE id=$1"
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.delivery_id", id)
+		defer span.Finish()
+	}
+
+	delivery, err := scanDelivery(s.db.QueryRow(query, id))
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.ReadDelivery.QueryRow", zap.Error(err), zap.Int64("delivery_id", id))
+		return delivery, postgres.ErrorCheck(err)
+	}
+	return delivery, nil
+}
+
+// ListDeliveries returns the matching deliveries, newest first
+func (s *store) ListDeliveries(ctx context.Context, q webhookmodels.DeliveryQuery) ([]webhookmodels.Delivery, error) {
+	s.logger.For(ctx).Info("entering webhookrepo.ListDeliveries", zap.Int64("subscription_id", q.SubscriptionID), zap.String("status", q.Status))
+	defer s.logger.For(ctx).Info("leaving webhookrepo.ListDeliveries", zap.Int64("subscription_id", q.SubscriptionID), zap.String("status", q.Status))
+
+	query := `
+	SELECT ` + deliveryColumns + `
+	FROM webhook_deliveries
+	WHERE ($1 = 0 OR subscription_id = $1)
+	AND ($2 = '' OR status::text = $2)
+	AND ($3 = 0 OR id < $3)
+	ORDER BY id DESC
+	LIMIT $4`
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span := s.tracer.StartSpan("SQL SELECT", opentracing.ChildOf(span.Context()))
+		tags.SpanKindRPCClient.Set(span)
+		tags.PeerService.Set(span, "postgres")
+		span.SetTag("sql.query", query)
+		span.SetTag("param.subscription_id", q.SubscriptionID)
+		span.SetTag("param.status", q.Status)
+		defer span.Finish()
+	}
+
+	rows, err := s.db.Query(query, q.SubscriptionID, q.Status, q.Before, q.Limit)
+	if err != nil {
+		s.logger.For(ctx).Error("failed webhookrepo.ListDeliveries.Query", zap.Error(err))
+		return nil, postgres.ErrorCheck(err)
+	}
+	defer rows.Close()
+	deliveries := []webhookmodels.Delivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			s.logger.For(ctx).Error("failed webhookrepo.ListDeliveries.Rows.Scan", zap.Error(err))
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,160 @@
+package requestcontext
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// requestcontext holds the per request (contextual) data
+// it has no internal deps so both the middleware and the services can share it
+
+type key int
+
+const (
+	requestIDKey        key = 0
+	requestStartTimeKey key = 1
+	userIPKey           key = 2
+	jwtIDKey            key = 3
+	userIDKey           key = 4
+	userAgentKey        key = 5
+	tokenScopesKey      key = 6
+	authenticationKey   key = 7
+	proxyChainKey       key = 8
+	dpopThumbprintKey   key = 9
+	certThumbprintKey   key = 10
+)
+
+// AuthInfo is how and when the user authenticated (the access token auth_time, amr and acr claims)
+// Expires is the access token (session) expiry
+type AuthInfo struct {
+	Time    time.Time
+	Methods []string
+	Level   string
+	Expires time.Time
+}
+
+// NewRequestIDContext returns a new Context carrying the request ID.
+func NewRequestIDContext(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, reqID)
+}
+
+// NewStartTimeContext returns a new Context carrying startTime.
+func NewStartTimeContext(ctx context.Context, startTime time.Time) context.Context {
+	return context.WithValue(ctx, requestStartTimeKey, startTime)
+}
+
+// NewUserIPContext returns a new Context carrying userIP.
+func NewUserIPContext(ctx context.Context, userIP net.IP) context.Context {
+	return context.WithValue(ctx, userIPKey, userIP)
+}
+
+// NewProxyChainContext returns a new Context carrying the forwarding chain (client first, the remote address last).
+func NewProxyChainContext(ctx context.Context, chain []net.IP) context.Context {
+	return context.WithValue(ctx, proxyChainKey, chain)
+}
+
+// NewUserAgentContext returns a new Context carrying the user agent.
+func NewUserAgentContext(ctx context.Context, userAgent string) context.Context {
+	return context.WithValue(ctx, userAgentKey, userAgent)
+}
+
+// NewJWTIDContext returns a new Context carrying the JWT ID.
+func NewJWTIDContext(ctx context.Context, jti string) context.Context {
+	return context.WithValue(ctx, jwtIDKey, jti)
+}
+
+// NewUserIDContext returns a new Context carrying the authenticated user ID.
+func NewUserIDContext(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+// NewTokenScopesContext returns a new Context carrying the personal access token scopes.
+func NewTokenScopesContext(ctx context.Context, scopes []string) context.Context {
+	return context.WithValue(ctx, tokenScopesKey, scopes)
+}
+
+// NewAuthenticationContext returns a new Context carrying the user's authentication.
+func NewAuthenticationContext(ctx context.Context, auth AuthInfo) context.Context {
+	return context.WithValue(ctx, authenticationKey, auth)
+}
+
+// NewDPoPThumbprintContext returns a new Context carrying the thumbprint (jkt) of the request's DPoP proof key.
+func NewDPoPThumbprintContext(ctx context.Context, jkt string) context.Context {
+	return context.WithValue(ctx, dpopThumbprintKey, jkt)
+}
+
+// NewCertThumbprintContext returns a new Context carrying the thumbprint (x5t#S256) of the request's verified client certificate.
+func NewCertThumbprintContext(ctx context.Context, x5t string) context.Context {
+	return context.WithValue(ctx, certThumbprintKey, x5t)
+}
+
+// RequestID returns the request ID from the context ("" if not present)
+func RequestID(ctx context.Context) string {
+	reqID, _ := ctx.Value(requestIDKey).(string)
+	return reqID
+}
+
+// RequestStartTime returns the request start time from the context
+func RequestStartTime(ctx context.Context) time.Time {
+	startTime, _ := ctx.Value(requestStartTimeKey).(time.Time)
+	return startTime
+}
+
+// UserIP returns the user IP address from the context (nil if not present)
+func UserIP(ctx context.Context) net.IP {
+	// ctx.Value returns nil if ctx has no value for the key;
+	// the net.IP type assertion returns ok=false for nil.
+	userIP, _ := ctx.Value(userIPKey).(net.IP)
+	return userIP
+}
+
+// ProxyChain returns the forwarding chain from the context (nil if not present)
+func ProxyChain(ctx context.Context) []net.IP {
+	chain, _ := ctx.Value(proxyChainKey).([]net.IP)
+	return chain
+}
+
+// UserAgent returns the user agent from the context ("" if not present)
+func UserAgent(ctx context.Context) string {
+	userAgent, _ := ctx.Value(userAgentKey).(string)
+	return userAgent
+}
+
+// JWTID returns the JWT ID from the context ("" if not present)
+func JWTID(ctx context.Context) string {
+	jti, _ := ctx.Value(jwtIDKey).(string)
+	return jti
+}
+
+// UserID returns the authenticated user ID from the context (0 if not present)
+func UserID(ctx context.Context) int {
+	userID, _ := ctx.Value(userIDKey).(int)
+	return userID
+}
+
+// TokenScopes returns the personal access token scopes from the context
+// ok is false when the request was not authenticated by a personal access token
+func TokenScopes(ctx context.Context) ([]string, bool) {
+	scopes, ok := ctx.Value(tokenScopesKey).([]string)
+	return scopes, ok
+}
+
+// Authentication returns the user's authentication from the context
+// ok is false when the request was not authenticated by an access token (ex: a personal access token)
+func Authentication(ctx context.Context) (AuthInfo, bool) {
+	auth, ok := ctx.Value(authenticationKey).(AuthInfo)
+	return auth, ok
+}
+
+// DPoPThumbprint returns the thumbprint of the request's verified DPoP proof key ("" if the request has no proof)
+func DPoPThumbprint(ctx context.Context) string {
+	jkt, _ := ctx.Value(dpopThumbprintKey).(string)
+	return jkt
+}
+
+// CertThumbprint returns the thumbprint of the request's verified client certificate ("" without one)
+func CertThumbprint(ctx context.Context) string {
+	x5t, _ := ctx.Value(certThumbprintKey).(string)
+	return x5t
+}
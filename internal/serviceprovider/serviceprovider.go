@@ -9,14 +9,38 @@ import (
 	"github.com/tjsampson/token-svc/internal/log"
 	"github.com/tjsampson/token-svc/internal/validation"
 
+	"github.com/tjsampson/token-svc/internal/repos/auditrepo"
 	"github.com/tjsampson/token-svc/internal/repos/healthrepo"
+	"github.com/tjsampson/token-svc/internal/repos/loginrepo"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
+	"github.com/tjsampson/token-svc/internal/repos/patrepo"
+	"github.com/tjsampson/token-svc/internal/repos/scimrepo"
 	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/repos/webhookrepo"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/internal/services/authenticatorservice"
 	"github.com/tjsampson/token-svc/internal/services/authservice"
 	"github.com/tjsampson/token-svc/internal/services/cookieservice"
+	"github.com/tjsampson/token-svc/internal/services/dpopservice"
+	"github.com/tjsampson/token-svc/internal/services/hashservice"
 	"github.com/tjsampson/token-svc/internal/services/healthservice"
+	"github.com/tjsampson/token-svc/internal/services/ipfilterservice"
 	"github.com/tjsampson/token-svc/internal/services/jwtservice"
+	"github.com/tjsampson/token-svc/internal/services/loginhistoryservice"
+	"github.com/tjsampson/token-svc/internal/services/magicservice"
+	"github.com/tjsampson/token-svc/internal/services/mtlsservice"
+	"github.com/tjsampson/token-svc/internal/services/mailservice"
+	"github.com/tjsampson/token-svc/internal/services/oidcservice"
+	"github.com/tjsampson/token-svc/internal/services/outboxservice"
+	"github.com/tjsampson/token-svc/internal/services/patservice"
+	"github.com/tjsampson/token-svc/internal/services/policyservice"
+	"github.com/tjsampson/token-svc/internal/services/ratelimitservice"
+	"github.com/tjsampson/token-svc/internal/services/samlservice"
+	"github.com/tjsampson/token-svc/internal/services/scimservice"
+	"github.com/tjsampson/token-svc/internal/services/throttleservice"
 	"github.com/tjsampson/token-svc/internal/services/tracingservice"
 	"github.com/tjsampson/token-svc/internal/services/userservice"
+	"github.com/tjsampson/token-svc/internal/services/webhookservice"
 	"github.com/tjsampson/token-svc/pkg/metrics"
 	"github.com/tjsampson/token-svc/pkg/version"
 
@@ -33,10 +57,25 @@ type Context struct {
 	VersionInfo   version.Info
 	Config        *config.Config
 	Metrics       *metrics.Provider
+	OIDC          oidcservice.Provider
+	SAML          samlservice.Provider
+	SCIM          scimservice.Provider
+	PAT           patservice.Provider
+	Magic         magicservice.Provider
+	LoginHistory  loginhistoryservice.Provider
+	IPFilter      ipfilterservice.Provider
+	DPoP          dpopservice.Provider
+	MTLS          mtlsservice.Provider
+	Outbox        outboxservice.Provider
+	Auditor       auditservice.Provider
 	CookieOven    cookieservice.Provider
+	Hasher        hashservice.Provider
+	Policy        policyservice.Provider
+	RateLimiter   ratelimitservice.Provider
 	RedisClient   redis.Provider
 	TraceProvider tracingservice.Provider
 	Validator     validation.Provider
+	Webhooks      webhookservice.Provider
 	Logger        log.Factory
 	AuthService   authservice.Service
 	HealthService healthservice.Service
@@ -73,12 +112,16 @@ func Initialize(vInfo version.Info) *Context {
 
 	metricProvider := metrics.New()
 
-	jwtProvider, err := jwtservice.New(cfg, logger, tracingProvider.Tracer, metricProvider)
+	auditSink, err := log.NewAuditLogger(cfg)
 
 	if err != nil {
-		logger.Bg().Fatal("failed jwt clien", zap.Error(err))
+		logger.Bg().Fatal("failed audit logger", zap.Error(err))
 	}
 
+	auditRepo := auditrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
+
+	auditor := auditservice.New(cfg, logger, auditSink, auditRepo, metricProvider)
+
 	redisProvider, err := redis.New(cfg, logger, tracingservice.New("redis", logger, false).Tracer)
 
 	if err != nil {
@@ -86,7 +129,35 @@ func Initialize(vInfo version.Info) *Context {
 		logger.Bg().Fatal("failed redis client", zap.Error(err))
 	}
 
-	cookieOven := cookieservice.New(cfg, logger)
+	ipFilter, err := ipfilterservice.New(cfg, logger, redisProvider, auditor)
+
+	if err != nil {
+		logger.Bg().Fatal("failed ip filter", zap.Error(err))
+	}
+
+	jwtProvider, err := jwtservice.New(cfg, logger, tracingProvider.Tracer, metricProvider, auditor, ipFilter)
+
+	if err != nil {
+		logger.Bg().Fatal("failed jwt clien", zap.Error(err))
+	}
+
+	mtlsProvider, err := mtlsservice.New(cfg, logger, jwtProvider, auditor)
+
+	if err != nil {
+		logger.Bg().Fatal("failed mtls", zap.Error(err))
+	}
+
+	cookieOven, err := cookieservice.New(cfg, logger, metricProvider)
+
+	if err != nil {
+		logger.Bg().Fatal("failed cookie oven", zap.Error(err))
+	}
+
+	hasher, err := hashservice.New(cfg, logger)
+
+	if err != nil {
+		logger.Bg().Fatal("failed password hasher", zap.Error(err))
+	}
 
 	healthRepo := healthrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
 
@@ -94,24 +165,89 @@ func Initialize(vInfo version.Info) *Context {
 
 	userRepo := userrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
 
-	authSvc := authservice.New(logger, cfg, jwtProvider, userRepo, tracingProvider.Tracer, tracingProvider, redisProvider, cookieOven)
+	policy, err := policyservice.New(cfg, logger, hasher, userRepo)
+
+	if err != nil {
+		logger.Bg().Fatal("failed password policy", zap.Error(err))
+	}
+
+	rateLimiter, err := ratelimitservice.New(cfg, logger, redisProvider)
+
+	if err != nil {
+		logger.Bg().Fatal("failed rate limiter", zap.Error(err))
+	}
+
+	throttle := throttleservice.New(cfg, logger, redisProvider, metricProvider)
+
+	outboxRepo := outboxrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
+
+	webhookRepo := webhookrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
+
+	webhooks := webhookservice.New(cfg, logger, webhookRepo, metricProvider)
+
+	outboxRelay, err := outboxservice.New(cfg, logger, outboxRepo, redisProvider, metricProvider)
+
+	if err != nil {
+		logger.Bg().Fatal("failed outbox relay", zap.Error(err))
+	}
+
+	authenticator := authenticatorservice.New(cfg, logger, userRepo, hasher)
+
+	mailer := mailservice.New(cfg, logger)
+
+	loginRepo := loginrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
+
+	loginHistory := loginhistoryservice.New(cfg, logger, loginRepo, auditor, mailer)
+
+	authSvc := authservice.New(logger, cfg, jwtProvider, userRepo, tracingProvider.Tracer, tracingProvider, redisProvider, cookieOven, hasher, policy, throttle, auditor, outboxRepo, authenticator, loginHistory)
+
+	oidcProvider := oidcservice.New(cfg, logger, redisProvider)
+
+	samlProvider := samlservice.New(cfg, logger, redisProvider)
+
+	dpopProvider := dpopservice.New(cfg, logger, redisProvider)
+
+	scimRepo := scimrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
+
+	patRepo := patrepo.New(dbConn, logger, tracingservice.New("postgres", logger, false).Tracer)
+
+	patProvider := patservice.New(cfg, logger, patRepo, auditor)
+
+	magicProvider := magicservice.New(cfg, logger, redisProvider, userRepo, authenticator, throttle, auditor, mailer)
 
 	validator := validation.New(validator.New())
 
-	userSvc := userservice.New(logger,cfg,jwtProvider,userRepo,tracingProvider.Tracer, tracingProvider, redisProvider)
+	userSvc := userservice.New(logger, cfg, jwtProvider, userRepo, tracingProvider.Tracer, tracingProvider, redisProvider, throttle, auditor, outboxRepo)
+
+	scimProvider := scimservice.New(cfg, logger, scimRepo, userSvc, auditor)
 
 	return &Context{
 		DB:            dbConn,
 		Logger:        logger,
 		CookieOven:    cookieOven,
+		Hasher:        hasher,
+		Policy:        policy,
+		RateLimiter:   rateLimiter,
 		HealthService: healthSvc,
 		AuthService:   authSvc,
 		VersionInfo:   vInfo,
 		Config:        cfg,
 		RedisClient:   redisProvider,
 		Metrics:       metricProvider,
+		OIDC:          oidcProvider,
+		SAML:          samlProvider,
+		SCIM:          scimProvider,
+		PAT:           patProvider,
+		Magic:         magicProvider,
+		LoginHistory:  loginHistory,
+		IPFilter:      ipFilter,
+		DPoP:          dpopProvider,
+		MTLS:          mtlsProvider,
+		Outbox:        outboxRelay,
+		Auditor:       auditor,
 		TraceProvider: tracingProvider,
 		Validator:     validator,
+		Webhooks:      webhooks,
 		JwtClient:     jwtProvider,
 		UserRepo:      userRepo,
 		UserService: userSvc,
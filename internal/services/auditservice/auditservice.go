@@ -0,0 +1,119 @@
+package auditservice
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/repos/auditrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"go.uber.org/zap"
+)
+
+// Provider is the security audit provider interface
+// events are written to the append-only audit store and (optionally) the audit log sink
+// the stored events are hash chained, signed checkpoints of the chain head allow offline verification
+type Provider interface {
+	Record(ctx context.Context, event auditmodels.Event)
+	List(ctx context.Context, query auditmodels.Query) (auditmodels.Page, error)
+	Verify(ctx context.Context) (auditmodels.ChainReport, error)
+	Checkpoint(ctx context.Context) (auditmodels.Checkpoint, error)
+	ListCheckpoints(ctx context.Context) ([]auditmodels.Checkpoint, error)
+	RunCheckpoints(done <-chan bool)
+}
+
+type provider struct {
+	logger  log.Factory
+	cfg     *config.Config
+	sink    log.Logger
+	repo    auditrepo.Store
+	metrics *metrics.Provider
+}
+
+// New returns a new audit Provider
+func New(cfg *config.Config, logger log.Factory, sink log.Logger, repo auditrepo.Store, metricProvider *metrics.Provider) Provider {
+	return &provider{
+		logger:  logger.With(zap.String("package", "auditservice")),
+		cfg:     cfg,
+		sink:    sink,
+		repo:    repo,
+		metrics: metricProvider,
+	}
+}
+
+// Record records the audit event
+// the request context fills in the actor, IP, user agent and request ID (when not already set)
+// failures are logged, auditing never fails the audited action
+func (p *provider) Record(ctx context.Context, event auditmodels.Event) {
+	if event.ActorID == 0 {
+		event.ActorID = requestcontext.UserID(ctx)
+	}
+	if event.IP == "" {
+		if ip := requestcontext.UserIP(ctx); ip != nil {
+			event.IP = ip.String()
+		}
+	} else if ip := net.ParseIP(event.IP); ip != nil {
+		// the hashed IP must match the postgres inet text form
+		event.IP = ip.String()
+	}
+	if event.UserAgent == "" {
+		event.UserAgent = requestcontext.UserAgent(ctx)
+	}
+	if event.RequestID == "" {
+		event.RequestID = requestcontext.RequestID(ctx)
+	}
+
+	p.metrics.StatAuditCount.WithLabelValues(event.Event).Inc()
+
+	p.sink.Audit(event.Event,
+		zap.String("outcome", event.Outcome),
+		zap.Int("actor_id", event.ActorID),
+		zap.Int("subject_id", event.SubjectID),
+		zap.String("email", event.Email),
+		zap.String("ip", event.IP),
+		zap.String("user_agent", event.UserAgent),
+		zap.String("request_id", event.RequestID),
+		zap.Any("details", event.Details),
+	)
+
+	if err := p.repo.Insert(ctx, event); err != nil {
+		p.logger.For(ctx).Error("failed to record audit event", zap.Error(err), zap.String("event", event.Event), zap.Bool("audit", true))
+	}
+}
+
+// List returns a page of audit events (newest first)
+func (p *provider) List(ctx context.Context, query auditmodels.Query) (auditmodels.Page, error) {
+	p.logger.For(ctx).Info("entering auditservice.List")
+	defer p.logger.For(ctx).Info("leaving auditservice.List")
+
+	if query.Limit <= 0 {
+		query.Limit = p.cfg.Audit.DefaultPageSize
+	}
+	if query.Limit > p.cfg.Audit.MaxPageSize {
+		query.Limit = p.cfg.Audit.MaxPageSize
+	}
+	if query.Since.IsZero() {
+		query.Since = time.Unix(0, 0)
+	}
+
+	// fetch one extra event to know if there is a next page
+	limit := query.Limit
+	query.Limit++
+	events, err := p.repo.List(ctx, query)
+	if err != nil {
+		return auditmodels.Page{}, errors.ErrorWrapper(err, "AuditService.List")
+	}
+
+	page := auditmodels.Page{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.NextBefore = page.Events[limit-1].ID
+	}
+	return page, nil
+}
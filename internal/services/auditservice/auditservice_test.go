@@ -0,0 +1,157 @@
+package auditservice
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type mockAuditRepo struct {
+	events      []auditmodels.Event
+	checkpoints []auditmodels.Checkpoint
+	query       auditmodels.Query
+}
+
+// Insert chains the event the same way as the postgres store
+func (m *mockAuditRepo) Insert(ctx context.Context, event auditmodels.Event) error {
+	event.ID = int64(len(m.events) + 1)
+	if len(m.events) > 0 {
+		event.PrevHash = m.events[len(m.events)-1].Hash
+	}
+	event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	event.Hash = event.ChainHash()
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *mockAuditRepo) ListChain(ctx context.Context, afterID int64, limit int) ([]auditmodels.Event, error) {
+	events := []auditmodels.Event{}
+	for _, event := range m.events {
+		if event.ID > afterID && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *mockAuditRepo) ChainHead(ctx context.Context) (auditmodels.Checkpoint, error) {
+	head := auditmodels.Checkpoint{}
+	for _, event := range m.events {
+		if event.Hash != "" {
+			head.LastEventID = event.ID
+			head.LastHash = event.Hash
+			head.EventCount++
+		}
+	}
+	return head, nil
+}
+
+func (m *mockAuditRepo) InsertCheckpoint(ctx context.Context, checkpoint auditmodels.Checkpoint) error {
+	checkpoint.ID = int64(len(m.checkpoints) + 1)
+	m.checkpoints = append(m.checkpoints, checkpoint)
+	return nil
+}
+
+func (m *mockAuditRepo) ListCheckpoints(ctx context.Context) ([]auditmodels.Checkpoint, error) {
+	return m.checkpoints, nil
+}
+
+// List returns the events newest first (ignoring the filters)
+func (m *mockAuditRepo) List(ctx context.Context, query auditmodels.Query) ([]auditmodels.Event, error) {
+	m.query = query
+	events := []auditmodels.Event{}
+	for i := len(m.events) - 1; i >= 0 && len(events) < query.Limit; i-- {
+		if query.Before == 0 || m.events[i].ID < query.Before {
+			events = append(events, m.events[i])
+		}
+	}
+	return events, nil
+}
+
+func testProvider(repo *mockAuditRepo) Provider {
+	cfg := &config.Config{}
+	cfg.Audit.DefaultPageSize = 2
+	cfg.Audit.MaxPageSize = 3
+	metricProvider := &metrics.Provider{
+		StatAuditCount: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "audit_total"}, []string{"event"}),
+	}
+	sink, _ := log.NewAuditLogger(cfg)
+	return New(cfg, log.NewNopFactory(), sink, repo, metricProvider)
+}
+
+func TestRecordRequestContext(t *testing.T) {
+	repo := &mockAuditRepo{}
+	p := testProvider(repo)
+
+	ctx := requestcontext.NewRequestIDContext(context.Background(), "req-1")
+	ctx = requestcontext.NewUserIPContext(ctx, net.ParseIP("10.0.0.1"))
+	ctx = requestcontext.NewUserAgentContext(ctx, "curl/7.64")
+	ctx = requestcontext.NewUserIDContext(ctx, 3)
+
+	p.Record(ctx, auditmodels.Event{Event: auditmodels.EventAdminAccountStatus, Outcome: auditmodels.OutcomeSuccess, SubjectID: 7})
+	p.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginSuccess, Outcome: auditmodels.OutcomeSuccess, ActorID: 7, IP: "10.0.0.2"})
+
+	want := []auditmodels.Event{
+		{ActorID: 3, SubjectID: 7, IP: "10.0.0.1", UserAgent: "curl/7.64", RequestID: "req-1"},
+		{ActorID: 7, IP: "10.0.0.2", UserAgent: "curl/7.64", RequestID: "req-1"},
+	}
+	if len(repo.events) != len(want) {
+		t.Fatalf("Record() stored %d events, want %d", len(repo.events), len(want))
+	}
+	for i, got := range repo.events {
+		if got.ActorID != want[i].ActorID || got.SubjectID != want[i].SubjectID || got.IP != want[i].IP || got.UserAgent != want[i].UserAgent || got.RequestID != want[i].RequestID {
+			t.Errorf("Record() event %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	repo := &mockAuditRepo{}
+	p := testProvider(repo)
+	for i := 0; i < 5; i++ {
+		p.Record(context.Background(), auditmodels.Event{Event: auditmodels.EventLoginFailure, Outcome: auditmodels.OutcomeFailure})
+	}
+
+	tests := []struct {
+		name     string
+		query    auditmodels.Query
+		wantIDs  []int64
+		wantNext int64
+	}{
+		{"default page size", auditmodels.Query{}, []int64{5, 4}, 4},
+		{"next page", auditmodels.Query{Before: 4}, []int64{3, 2}, 2},
+		{"last page", auditmodels.Query{Before: 2}, []int64{1}, 0},
+		{"max page size", auditmodels.Query{Limit: 100}, []int64{5, 4, 3}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := p.List(context.Background(), tt.query)
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if len(page.Events) != len(tt.wantIDs) {
+				t.Fatalf("List() returned %d events, want %d", len(page.Events), len(tt.wantIDs))
+			}
+			for i, event := range page.Events {
+				if event.ID != tt.wantIDs[i] {
+					t.Errorf("List() event %d id = %d, want %d", i, event.ID, tt.wantIDs[i])
+				}
+			}
+			if page.NextBefore != tt.wantNext {
+				t.Errorf("List() next = %d, want %d", page.NextBefore, tt.wantNext)
+			}
+			if repo.query.Since.IsZero() {
+				t.Errorf("List() since was not defaulted")
+			}
+		})
+	}
+}
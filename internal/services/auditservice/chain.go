@@ -0,0 +1,240 @@
+package auditservice
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// verifyBatchSize is the number of events read per query while walking the chain
+	verifyBatchSize = 1000
+
+	checkpointSubject = "audit-checkpoint"
+)
+
+// checkpointClaims are the signed claims of an audit checkpoint
+type checkpointClaims struct {
+	*jwt.StandardClaims
+	LastEventID int64  `json:"last_event_id"`
+	LastHash    string `json:"last_hash"`
+	EventCount  int64  `json:"event_count"`
+}
+
+// signingKey reads the token signing key (checkpoints are rare, the key is not kept in memory)
+func (p *provider) signingKey() (*rsa.PrivateKey, error) {
+	signBytes, err := ioutil.ReadFile(p.cfg.Token.AuthPrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.ParseRSAPrivateKeyFromPEM(signBytes)
+}
+
+func (p *provider) verifyKey() (*rsa.PublicKey, error) {
+	verifyBytes, err := ioutil.ReadFile(p.cfg.Token.AuthPublicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+}
+
+// Checkpoint signs and stores the current head of the audit chain
+// nothing is stored if the chain is empty or the head is already checkpointed
+func (p *provider) Checkpoint(ctx context.Context) (auditmodels.Checkpoint, error) {
+	head, err := p.repo.ChainHead(ctx)
+	if err != nil {
+		return head, errors.ErrorWrapper(err, "AuditService.Checkpoint.ChainHead")
+	}
+	if head.LastEventID == 0 {
+		return head, nil
+	}
+
+	checkpoints, err := p.repo.ListCheckpoints(ctx)
+	if err != nil {
+		return head, errors.ErrorWrapper(err, "AuditService.Checkpoint.ListCheckpoints")
+	}
+	if len(checkpoints) > 0 && checkpoints[len(checkpoints)-1].LastEventID == head.LastEventID {
+		return checkpoints[len(checkpoints)-1], nil
+	}
+
+	key, err := p.signingKey()
+	if err != nil {
+		return head, errors.ErrorWrapper(err, "AuditService.Checkpoint.signingKey")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &checkpointClaims{
+		StandardClaims: &jwt.StandardClaims{
+			Issuer:   p.cfg.Token.Issuer,
+			Subject:  checkpointSubject,
+			IssuedAt: time.Now().Unix(),
+		},
+		LastEventID: head.LastEventID,
+		LastHash:    head.LastHash,
+		EventCount:  head.EventCount,
+	})
+	if head.Token, err = token.SignedString(key); err != nil {
+		return head, errors.ErrorWrapper(err, "AuditService.Checkpoint.SignedString")
+	}
+
+	if err = p.repo.InsertCheckpoint(ctx, head); err != nil {
+		return head, errors.ErrorWrapper(err, "AuditService.Checkpoint.InsertCheckpoint")
+	}
+	p.logger.For(ctx).Info("audit checkpoint", zap.Int64("last_event_id", head.LastEventID), zap.Int64("event_count", head.EventCount))
+	return head, nil
+}
+
+// ListCheckpoints returns the signed checkpoints (oldest first)
+func (p *provider) ListCheckpoints(ctx context.Context) ([]auditmodels.Checkpoint, error) {
+	checkpoints, err := p.repo.ListCheckpoints(ctx)
+	return checkpoints, errors.ErrorWrapper(err, "AuditService.ListCheckpoints")
+}
+
+// RunCheckpoints checkpoints the audit chain on the configured interval until done is closed
+func (p *provider) RunCheckpoints(done <-chan bool) {
+	if p.cfg.Audit.CheckpointIntervalMins == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(p.cfg.Audit.CheckpointIntervalMins) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := p.Checkpoint(context.Background()); err != nil {
+				p.logger.Bg().Error("failed audit checkpoint", zap.Error(err))
+			}
+		}
+	}
+}
+
+// parseCheckpoint verifies the checkpoint signature and returns its claims
+func parseCheckpoint(token string, key *rsa.PublicKey) (*checkpointClaims, error) {
+	claims := &checkpointClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.StandardClaims == nil || claims.Subject != checkpointSubject {
+		return nil, fmt.Errorf("not an audit checkpoint")
+	}
+	return claims, nil
+}
+
+// verifyCheckpoint checks the checkpoint row and its signed claims against the chain
+func verifyCheckpoint(checkpoint auditmodels.Checkpoint, event auditmodels.Event, eventCount int64, key *rsa.PublicKey) string {
+	claims, err := parseCheckpoint(checkpoint.Token, key)
+	if err != nil {
+		return fmt.Sprintf("invalid checkpoint signature: %v", err)
+	}
+	if claims.LastEventID != checkpoint.LastEventID || claims.LastHash != checkpoint.LastHash || claims.EventCount != checkpoint.EventCount {
+		return "checkpoint does not match its signed claims"
+	}
+	if checkpoint.LastHash != event.Hash {
+		return "checkpoint hash does not match the event hash"
+	}
+	if checkpoint.EventCount != eventCount {
+		return fmt.Sprintf("checkpoint event count %d does not match the chain (%d)", checkpoint.EventCount, eventCount)
+	}
+	return ""
+}
+
+// Verify walks the audit chain and reports the first break
+// each event must link to the previous event's hash and match its own content hash
+// each checkpoint must be correctly signed and match the chain at its event
+func (p *provider) Verify(ctx context.Context) (auditmodels.ChainReport, error) {
+	p.logger.For(ctx).Info("entering auditservice.Verify")
+	report := auditmodels.ChainReport{}
+
+	checkpoints, err := p.repo.ListCheckpoints(ctx)
+	if err != nil {
+		return report, errors.ErrorWrapper(err, "AuditService.Verify.ListCheckpoints")
+	}
+	pending := map[int64][]auditmodels.Checkpoint{}
+	for _, checkpoint := range checkpoints {
+		pending[checkpoint.LastEventID] = append(pending[checkpoint.LastEventID], checkpoint)
+	}
+	var key *rsa.PublicKey
+	if len(checkpoints) > 0 {
+		if key, err = p.verifyKey(); err != nil {
+			return report, errors.ErrorWrapper(err, "AuditService.Verify.verifyKey")
+		}
+	}
+
+	chained := false
+	var afterID int64
+	for report.Break == nil {
+		events, err := p.repo.ListChain(ctx, afterID, verifyBatchSize)
+		if err != nil {
+			return report, errors.ErrorWrapper(err, "AuditService.Verify.ListChain")
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			afterID = event.ID
+			if event.Hash == "" && !chained {
+				// recorded before the chain existed
+				report.Unchained++
+				continue
+			}
+			chained = true
+
+			switch {
+			case event.Hash == "":
+				report.Break = &auditmodels.ChainBreak{EventID: event.ID, Reason: "event is missing its hash"}
+			case event.PrevHash != report.LastHash:
+				report.Break = &auditmodels.ChainBreak{EventID: event.ID, Reason: "prev_hash does not match the previous event (an event was removed or reordered)"}
+			case event.ChainHash() != event.Hash:
+				report.Break = &auditmodels.ChainBreak{EventID: event.ID, Reason: "content does not match the event hash (the event was modified)"}
+			}
+			if report.Break != nil {
+				break
+			}
+			report.Verified++
+			report.LastEventID = event.ID
+			report.LastHash = event.Hash
+
+			for _, checkpoint := range pending[event.ID] {
+				if reason := verifyCheckpoint(checkpoint, event, report.Verified, key); reason != "" {
+					report.Break = &auditmodels.ChainBreak{EventID: event.ID, CheckpointID: checkpoint.ID, Reason: reason}
+					break
+				}
+				report.Checkpoints++
+			}
+			delete(pending, event.ID)
+			if report.Break != nil {
+				break
+			}
+		}
+	}
+
+	// a checkpoint for an event that is not in the chain means the event was removed
+	if report.Break == nil {
+		for _, checkpoint := range checkpoints {
+			if _, missing := pending[checkpoint.LastEventID]; missing {
+				report.Break = &auditmodels.ChainBreak{EventID: checkpoint.LastEventID, CheckpointID: checkpoint.ID, Reason: "checkpointed event is missing from the chain"}
+				break
+			}
+		}
+	}
+
+	if report.Break != nil {
+		p.logger.For(ctx).Error("audit chain break", zap.Int64("event_id", report.Break.EventID), zap.Int64("checkpoint_id", report.Break.CheckpointID), zap.String("reason", report.Break.Reason), zap.Bool("audit", true))
+	}
+	p.logger.For(ctx).Info("leaving auditservice.Verify", zap.Int64("verified", report.Verified))
+	return report, nil
+}
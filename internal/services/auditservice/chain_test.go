@@ -0,0 +1,129 @@
+package auditservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+)
+
+// writeKeys writes a PEM encoded RSA key pair and returns the private and public key paths
+func writeKeys(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+	privPath := filepath.Join(dir, "app.rsa")
+	pubPath := filepath.Join(dir, "app.rsa.pub")
+	if err = ioutil.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return privPath, pubPath
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privPath, pubPath := writeKeys(t, dir)
+	otherDir, err := ioutil.TempDir(dir, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPrivPath, _ := writeKeys(t, otherDir)
+
+	tests := []struct {
+		name      string
+		tamper    func(repo *mockAuditRepo)
+		wantBreak int64
+	}{
+		{"intact chain", func(repo *mockAuditRepo) {}, 0},
+		{"modified event", func(repo *mockAuditRepo) { repo.events[2].Outcome = auditmodels.OutcomeSuccess }, 3},
+		{"removed event", func(repo *mockAuditRepo) { repo.events = append(repo.events[:1], repo.events[2:]...) }, 3},
+		{"removed checkpointed event", func(repo *mockAuditRepo) { repo.events = repo.events[:4] }, 5},
+		{"rehashed event", func(repo *mockAuditRepo) {
+			// an attacker can rehash the modified event, but not the rest of the chain
+			repo.events[2].Outcome = auditmodels.OutcomeSuccess
+			repo.events[2].Hash = repo.events[2].ChainHash()
+		}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &mockAuditRepo{}
+			p := testProvider(repo).(*provider)
+			p.cfg.Token.AuthPrivateKeyPath = privPath
+			p.cfg.Token.AuthPublicKeyPath = pubPath
+
+			for i := 0; i < 5; i++ {
+				p.Record(context.Background(), auditmodels.Event{Event: auditmodels.EventLoginFailure, Outcome: auditmodels.OutcomeFailure, Email: "jane@example.com"})
+			}
+			if _, err := p.Checkpoint(context.Background()); err != nil {
+				t.Fatalf("Checkpoint() error = %v", err)
+			}
+			tt.tamper(repo)
+
+			report, err := p.Verify(context.Background())
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if tt.wantBreak == 0 {
+				if report.Break != nil || report.Verified != 5 || report.Checkpoints != 1 {
+					t.Errorf("Verify() = %+v %+v, want 5 verified events and 1 checkpoint", report, report.Break)
+				}
+				return
+			}
+			if report.Break == nil || report.Break.EventID != tt.wantBreak {
+				t.Errorf("Verify() break = %+v, want event %d", report.Break, tt.wantBreak)
+			}
+		})
+	}
+
+	t.Run("forged checkpoint", func(t *testing.T) {
+		repo := &mockAuditRepo{}
+		p := testProvider(repo).(*provider)
+		p.cfg.Token.AuthPrivateKeyPath = otherPrivPath
+		p.cfg.Token.AuthPublicKeyPath = pubPath
+
+		p.Record(context.Background(), auditmodels.Event{Event: auditmodels.EventLoginSuccess, Outcome: auditmodels.OutcomeSuccess})
+		if _, err := p.Checkpoint(context.Background()); err != nil {
+			t.Fatalf("Checkpoint() error = %v", err)
+		}
+		report, err := p.Verify(context.Background())
+		if err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+		if report.Break == nil || report.Break.CheckpointID != 1 {
+			t.Errorf("Verify() break = %+v, want checkpoint 1", report.Break)
+		}
+	})
+
+	t.Run("unchained events", func(t *testing.T) {
+		repo := &mockAuditRepo{events: []auditmodels.Event{{ID: 1, Event: auditmodels.EventRegister}, {ID: 2, Event: auditmodels.EventLoginSuccess}}}
+		p := testProvider(repo)
+		p.Record(context.Background(), auditmodels.Event{Event: auditmodels.EventLoginSuccess, Outcome: auditmodels.OutcomeSuccess})
+
+		report, err := p.Verify(context.Background())
+		if err != nil {
+			t.Fatalf("Verify() error = %v", err)
+		}
+		if report.Break != nil || report.Unchained != 2 || report.Verified != 1 {
+			t.Errorf("Verify() = %+v, want 2 unchained and 1 verified", report)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package authenticatorservice
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/services/hashservice"
+
+	"go.uber.org/zap"
+)
+
+// Authentication backends
+const (
+	BackendLocal = "local"
+	BackendLDAP  = "ldap"
+)
+
+// Authenticator validates the user's credentials and returns the authenticated user
+// invalid credentials are a 401 RestError, the user is returned (when known) for auditing
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds *authmodels.UserCreds) (usermodels.Record, error)
+}
+
+// Provider authenticates the credentials with the backend selected by the email domain
+// (ldap for the configured ldap domains, otherwise the local password hashes)
+type Provider interface {
+	Authenticator
+	Backend(email string) string
+}
+
+type provider struct {
+	logger         log.Factory
+	authenticators map[string]Authenticator
+	domains        map[string]string
+}
+
+// New returns a new authenticator Provider
+func New(cfg *config.Config, logger log.Factory, userRepo userrepo.Store, hasher hashservice.Provider) Provider {
+	p := &provider{
+		logger: logger.With(zap.String("package", "authenticatorservice")),
+		authenticators: map[string]Authenticator{
+			BackendLocal: newLocal(logger, userRepo, hasher),
+		},
+		domains: make(map[string]string),
+	}
+	if cfg.LDAP.Enabled {
+		p.authenticators[BackendLDAP] = newLDAP(cfg, logger, userRepo)
+		for _, domain := range cfg.LDAP.Domains {
+			p.domains[strings.ToLower(domain)] = BackendLDAP
+		}
+	}
+	return p
+}
+
+// Backend returns the authentication backend for the email
+func (p *provider) Backend(email string) string {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	if backend, ok := p.domains[domain]; ok {
+		return backend
+	}
+	return BackendLocal
+}
+
+// Authenticate validates the credentials with the email's backend
+func (p *provider) Authenticate(ctx context.Context, creds *authmodels.UserCreds) (usermodels.Record, error) {
+	backend := p.Backend(creds.Email)
+	p.logger.For(ctx).Info("authenticating", zap.String("email", creds.Email), zap.String("backend", backend))
+	return p.authenticators[backend].Authenticate(ctx, creds)
+}
+
+func invalidCredsErr(originalErr error) error {
+	return &errors.RestError{
+		Code:          401,
+		Message:       "Invalid Credentials",
+		OriginalError: originalErr,
+	}
+}
+
+// IsUnavailable reports if the authentication failed because the backend is unavailable
+// (not a failed login, the credentials were never checked)
+func IsUnavailable(err error) bool {
+	restErr, ok := err.(*errors.RestError)
+	return ok && restErr.Code == 503
+}
@@ -0,0 +1,259 @@
+package authenticatorservice
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+
+	ldapv3 "github.com/go-ldap/ldap/v3"
+)
+
+type mockUserRepo struct {
+	userrepo.Store
+	users  map[string]usermodels.Record
+	groups map[int][]string
+	events []string
+}
+
+func (m *mockUserRepo) ReadByEmail(ctx context.Context, email string) (usermodels.Record, error) {
+	user, ok := m.users[email]
+	if !ok {
+		return user, &errors.RestError{Code: 404, Message: "Resource not found"}
+	}
+	return user, nil
+}
+
+func (m *mockUserRepo) InsertFederated(ctx context.Context, identity usermodels.Identity, events ...outboxmodels.Event) (usermodels.Record, error) {
+	user := usermodels.Record{ID: len(m.users) + 1, Email: identity.Email, EmailVerified: identity.EmailVerified, Status: usermodels.StatusActive}
+	m.users[identity.Email] = user
+	for _, event := range events {
+		m.events = append(m.events, event.Type)
+	}
+	return user, nil
+}
+
+func (m *mockUserRepo) SyncGroups(ctx context.Context, userID int, source string, groups []string) error {
+	m.groups[userID] = groups
+	return nil
+}
+
+type mockHasher struct{}
+
+func (m *mockHasher) Hash(ctx context.Context, password string) (string, error) {
+	return "hashed:" + password, nil
+}
+func (m *mockHasher) Verify(ctx context.Context, encodedHash, password string) (bool, error) {
+	return encodedHash == "hashed:"+password, nil
+}
+func (m *mockHasher) NeedsRehash(ctx context.Context, encodedHash string) bool { return false }
+
+// mockDirectory is a directory with one user (jane) and a service account
+type mockDirectory struct {
+	entries []*ldapv3.Entry
+	binds   []string
+	filter  string
+}
+
+func (m *mockDirectory) Bind(username, password string) error {
+	m.binds = append(m.binds, username)
+	switch {
+	case username == "cn=token-svc,ou=services,dc=homerow,dc=tech" && password == "svc-secret":
+		return nil
+	case username == "uid=jane,ou=people,dc=homerow,dc=tech" && password == "directory-pass":
+		return nil
+	}
+	return ldapv3.NewError(ldapv3.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials"))
+}
+
+func (m *mockDirectory) Search(searchRequest *ldapv3.SearchRequest) (*ldapv3.SearchResult, error) {
+	m.filter = searchRequest.Filter
+	return &ldapv3.SearchResult{Entries: m.entries}, nil
+}
+
+func (m *mockDirectory) Close() {}
+
+func testConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.LDAP.Enabled = true
+	cfg.LDAP.URL = "ldaps://ldap.homerow.tech:636"
+	cfg.LDAP.BindDN = "cn=token-svc,ou=services,dc=homerow,dc=tech"
+	cfg.LDAP.BindPassword = "svc-secret"
+	cfg.LDAP.BaseDN = "ou=people,dc=homerow,dc=tech"
+	cfg.LDAP.UserFilter = "(&(objectClass=person)(mail={email}))"
+	cfg.LDAP.GroupAttribute = "memberOf"
+	cfg.LDAP.SyncGroups = true
+	cfg.LDAP.GroupMap = map[string]string{"cn=Support,ou=Groups,dc=homerow,dc=tech": "support"}
+	cfg.LDAP.Domains = []string{"Staff.Homerow.tech"}
+	return cfg
+}
+
+func janeEntry() *ldapv3.Entry {
+	return ldapv3.NewEntry("uid=jane,ou=people,dc=homerow,dc=tech", map[string][]string{
+		"memberOf": {"cn=admin,ou=groups,dc=homerow,dc=tech", "cn=support,ou=groups,dc=homerow,dc=tech"},
+	})
+}
+
+func TestBackend(t *testing.T) {
+	p := New(testConfig(), log.NewNopFactory(), &mockUserRepo{}, &mockHasher{})
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"jane@staff.homerow.tech", BackendLDAP},
+		{"JANE@STAFF.HOMEROW.TECH", BackendLDAP},
+		{"jane@homerow.tech", BackendLocal},
+		{"jane@staff.homerow.tech.evil.com", BackendLocal},
+		{"jane@sub.staff.homerow.tech", BackendLocal},
+	}
+	for _, tt := range tests {
+		if got := p.Backend(tt.email); got != tt.want {
+			t.Errorf("Backend(%s) = %s, want %s", tt.email, got, tt.want)
+		}
+	}
+
+	cfg := testConfig()
+	cfg.LDAP.Enabled = false
+	if got := New(cfg, log.NewNopFactory(), &mockUserRepo{}, &mockHasher{}).Backend("jane@staff.homerow.tech"); got != BackendLocal {
+		t.Errorf("Backend() with ldap disabled = %s, want %s", got, BackendLocal)
+	}
+}
+
+func TestLocalAuthenticate(t *testing.T) {
+	repo := &mockUserRepo{users: map[string]usermodels.Record{
+		"jane@homerow.tech": {ID: 7, Email: "jane@homerow.tech", PasswordHash: "hashed:s3cret"},
+		"fed@homerow.tech":  {ID: 8, Email: "fed@homerow.tech", PasswordHash: ""},
+	}}
+	a := newLocal(log.NewNopFactory(), repo, &mockHasher{})
+	tests := []struct {
+		name     string
+		creds    authmodels.UserCreds
+		wantUser int
+		wantErr  bool
+	}{
+		{"valid", authmodels.UserCreds{Email: "jane@homerow.tech", Password: "s3cret"}, 7, false},
+		{"wrong password", authmodels.UserCreds{Email: "jane@homerow.tech", Password: "guess"}, 7, true},
+		{"unknown user", authmodels.UserCreds{Email: "who@homerow.tech", Password: "s3cret"}, 0, true},
+		{"passwordless user", authmodels.UserCreds{Email: "fed@homerow.tech", Password: ""}, 8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := a.Authenticate(context.Background(), &tt.creds)
+			if (err != nil) != tt.wantErr || user.ID != tt.wantUser {
+				t.Errorf("Authenticate() = %d, %v, want %d, wantErr %v", user.ID, err, tt.wantUser, tt.wantErr)
+			}
+			if err != nil && err.(*errors.RestError).Code != 401 {
+				t.Errorf("Authenticate() error code = %d, want 401", err.(*errors.RestError).Code)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		password   string
+		entries    []*ldapv3.Entry
+		existing   bool
+		down       bool
+		wantCode   int
+		wantGroups []string
+		wantEvents []string
+	}{
+		{"new user", "directory-pass", []*ldapv3.Entry{janeEntry()}, false, false, 0, []string{"support"}, []string{outboxmodels.EventUserRegistered}},
+		{"existing user", "directory-pass", []*ldapv3.Entry{janeEntry()}, true, false, 0, []string{"support"}, nil},
+		{"wrong password", "guess", []*ldapv3.Entry{janeEntry()}, true, false, 401, nil, nil},
+		{"empty password", "", []*ldapv3.Entry{janeEntry()}, true, false, 401, nil, nil},
+		{"not in directory", "directory-pass", nil, false, false, 401, nil, nil},
+		{"ambiguous user", "directory-pass", []*ldapv3.Entry{janeEntry(), janeEntry()}, false, false, 401, nil, nil},
+		{"directory down", "directory-pass", []*ldapv3.Entry{janeEntry()}, true, true, 503, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &mockUserRepo{users: map[string]usermodels.Record{}, groups: map[int][]string{}}
+			if tt.existing {
+				repo.users["jane@staff.homerow.tech"] = usermodels.Record{ID: 42, Email: "jane@staff.homerow.tech", Status: usermodels.StatusActive}
+			}
+			directory := &mockDirectory{entries: tt.entries}
+			a := newLDAP(testConfig(), log.NewNopFactory(), repo).(*ldap)
+			a.dial = func() (ldapConn, error) {
+				if tt.down {
+					return nil, fmt.Errorf("connection refused")
+				}
+				return directory, nil
+			}
+
+			user, err := a.Authenticate(context.Background(), &authmodels.UserCreds{Email: "jane@staff.homerow.tech", Password: tt.password})
+			if tt.wantCode != 0 {
+				if restErr, ok := err.(*errors.RestError); !ok || restErr.Code != tt.wantCode {
+					t.Fatalf("Authenticate() error = %v, want code %d", err, tt.wantCode)
+				}
+				if len(repo.groups) != 0 {
+					t.Errorf("Authenticate() synced groups on a failed login")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if user.Email != "jane@staff.homerow.tech" || (tt.existing && user.ID != 42) {
+				t.Errorf("Authenticate() = %+v", user)
+			}
+			if !reflect.DeepEqual(repo.groups[user.ID], tt.wantGroups) || !reflect.DeepEqual(repo.events, tt.wantEvents) {
+				t.Errorf("Authenticate() groups = %v events = %v, want %v %v", repo.groups[user.ID], repo.events, tt.wantGroups, tt.wantEvents)
+			}
+			if directory.filter != "(&(objectClass=person)(mail=jane@staff.homerow.tech))" {
+				t.Errorf("Authenticate() filter = %s", directory.filter)
+			}
+			if !reflect.DeepEqual(directory.binds, []string{"cn=token-svc,ou=services,dc=homerow,dc=tech", "uid=jane,ou=people,dc=homerow,dc=tech"}) {
+				t.Errorf("Authenticate() binds = %v, want the service account then the user", directory.binds)
+			}
+		})
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	directory := &mockDirectory{}
+	a := newLDAP(testConfig(), log.NewNopFactory(), &mockUserRepo{}).(*ldap)
+	a.dial = func() (ldapConn, error) { return directory, nil }
+
+	a.Authenticate(context.Background(), &authmodels.UserCreds{Email: "*)(uid=*@staff.homerow.tech", Password: "x"})
+	if directory.filter != `(&(objectClass=person)(mail=\2a\29\28uid=\2a@staff.homerow.tech))` {
+		t.Errorf("Authenticate() filter = %s", directory.filter)
+	}
+}
+
+func TestMapGroups(t *testing.T) {
+	groupMap := map[string]string{
+		"cn=token-svc-admins,ou=groups,dc=homerow,dc=tech": "admin",
+		"cn=support,ou=groups,dc=homerow,dc=tech":          "support",
+		"cn=helpdesk,ou=groups,dc=homerow,dc=tech":         "support",
+	}
+	tests := []struct {
+		name     string
+		groupDNs []string
+		want     []string
+	}{
+		{"mapped", []string{"cn=token-svc-admins,ou=groups,dc=homerow,dc=tech", "cn=support,ou=groups,dc=homerow,dc=tech"}, []string{"admin", "support"}},
+		{"unmapped dropped", []string{"cn=admin,ou=groups,dc=homerow,dc=tech", "cn=support,ou=groups,dc=homerow,dc=tech"}, []string{"support"}},
+		{"same name elsewhere", []string{"cn=token-svc-admins,ou=contractors,dc=homerow,dc=tech"}, []string{}},
+		{"case and spacing", []string{"CN=Support, OU=Groups, DC=homerow, DC=tech"}, []string{"support"}},
+		{"duplicates", []string{"cn=support,ou=groups,dc=homerow,dc=tech", "cn=helpdesk,ou=groups,dc=homerow,dc=tech"}, []string{"support"}},
+		{"invalid dn", []string{"not a dn"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapGroups(groupMap, tt.groupDNs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapGroups() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
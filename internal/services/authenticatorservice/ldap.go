@@ -0,0 +1,197 @@
+package authenticatorservice
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+
+	ldapv3 "github.com/go-ldap/ldap/v3"
+	"go.uber.org/zap"
+)
+
+// ldapConn is the subset of the ldap connection used to authenticate
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldapv3.SearchRequest) (*ldapv3.SearchResult, error)
+	Close()
+}
+
+// ldap authenticates with an ldap bind as the user (the directory checks the password)
+// the user is found with the service account, then mapped to (or created as) a users row
+// and the directory groups are synced into the user's groups
+type ldap struct {
+	logger   log.Factory
+	cfg      *config.Config
+	userRepo userrepo.Store
+	dial     func() (ldapConn, error)
+}
+
+func newLDAP(cfg *config.Config, logger log.Factory, userRepo userrepo.Store) Authenticator {
+	a := &ldap{
+		logger:   logger.With(zap.String("package", "authenticatorservice")),
+		cfg:      cfg,
+		userRepo: userRepo,
+	}
+	a.dial = a.dialDirectory
+	return a
+}
+
+func (a *ldap) dialDirectory() (ldapConn, error) {
+	timeout := time.Duration(a.cfg.LDAP.TimeoutSecs) * time.Second
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.cfg.LDAP.InsecureSkipVerify}
+	if u, err := url.Parse(a.cfg.LDAP.URL); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	conn, err := ldapv3.DialURL(a.cfg.LDAP.URL, ldapv3.DialWithDialer(&net.Dialer{Timeout: timeout}), ldapv3.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if a.cfg.LDAP.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func unavailableErr(originalErr error) error {
+	return &errors.RestError{
+		Code:          503,
+		Message:       "directory unavailable, try again later",
+		OriginalError: originalErr,
+	}
+}
+
+func (a *ldap) Authenticate(ctx context.Context, creds *authmodels.UserCreds) (usermodels.Record, error) {
+	a.logger.For(ctx).Info("entering authenticatorservice.ldap.Authenticate", zap.String("email", creds.Email))
+
+	// an empty password is an unauthenticated bind (which "succeeds" on most directories)
+	if creds.Password == "" {
+		return usermodels.Record{}, invalidCredsErr(fmt.Errorf("empty password"))
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		a.logger.For(ctx).Error("failed ldap dial", zap.Error(err))
+		return usermodels.Record{}, unavailableErr(err)
+	}
+	defer conn.Close()
+
+	if a.cfg.LDAP.BindDN != "" {
+		if err = conn.Bind(a.cfg.LDAP.BindDN, a.cfg.LDAP.BindPassword); err != nil {
+			a.logger.For(ctx).Error("failed ldap service account bind", zap.Error(err))
+			return usermodels.Record{}, unavailableErr(err)
+		}
+	}
+
+	result, err := conn.Search(ldapv3.NewSearchRequest(
+		a.cfg.LDAP.BaseDN,
+		ldapv3.ScopeWholeSubtree,
+		ldapv3.NeverDerefAliases,
+		2, // more than one match is ambiguous
+		int(a.cfg.LDAP.TimeoutSecs),
+		false,
+		strings.Replace(a.cfg.LDAP.UserFilter, "{email}", ldapv3.EscapeFilter(creds.Email), -1),
+		[]string{"dn", a.cfg.LDAP.GroupAttribute},
+		nil,
+	))
+	if err != nil && !ldapv3.IsErrorWithCode(err, ldapv3.LDAPResultSizeLimitExceeded) {
+		a.logger.For(ctx).Error("failed ldap user search", zap.Error(err))
+		return usermodels.Record{}, unavailableErr(err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return usermodels.Record{}, invalidCredsErr(fmt.Errorf("ldap user not found (or not unique)"))
+	}
+	entry := result.Entries[0]
+
+	if err = conn.Bind(entry.DN, creds.Password); err != nil {
+		if ldapv3.IsErrorWithCode(err, ldapv3.LDAPResultInvalidCredentials) {
+			user, _ := a.userRepo.ReadByEmail(ctx, creds.Email)
+			return user, invalidCredsErr(err)
+		}
+		a.logger.For(ctx).Error("failed ldap user bind", zap.Error(err))
+		return usermodels.Record{}, unavailableErr(err)
+	}
+
+	user, err := a.mapUser(ctx, creds.Email, entry.DN)
+	if err != nil {
+		return usermodels.Record{}, err
+	}
+
+	if a.cfg.LDAP.SyncGroups {
+		groups := mapGroups(a.cfg.LDAP.GroupMap, entry.GetAttributeValues(a.cfg.LDAP.GroupAttribute))
+		if err = a.userRepo.SyncGroups(ctx, user.ID, BackendLDAP, groups); err != nil {
+			return usermodels.Record{}, errors.ErrorWrapper(err, "AuthenticatorService.ldap.SyncGroups")
+		}
+	}
+
+	a.logger.For(ctx).Info("leaving authenticatorservice.ldap.Authenticate", zap.String("email", creds.Email))
+	return user, nil
+}
+
+// mapUser returns the users row for the directory user, a missing user is created without a password
+func (a *ldap) mapUser(ctx context.Context, email, dn string) (usermodels.Record, error) {
+	user, err := a.userRepo.ReadByEmail(ctx, email)
+	if err == nil {
+		return user, nil
+	}
+	if restErr, ok := err.(*errors.RestError); !ok || restErr.Code != 404 {
+		return user, errors.ErrorWrapper(err, "AuthenticatorService.ldap.ReadByEmail")
+	}
+
+	user, err = a.userRepo.InsertFederated(ctx, usermodels.Identity{
+		Issuer:        a.cfg.LDAP.URL,
+		Subject:       dn,
+		Email:         email,
+		EmailVerified: true,
+	}, outboxmodels.Event{
+		Type: outboxmodels.EventUserRegistered,
+		Data: map[string]interface{}{"email": email, "issuer": a.cfg.LDAP.URL},
+	})
+	return user, errors.ErrorWrapper(err, "AuthenticatorService.ldap.InsertFederated")
+}
+
+// mapGroups maps the entry's group DNs to local groups with ldap.groupmap, an unmapped group is dropped
+// (the whole DN must match, a group named admin elsewhere in the directory must not grant the admin api)
+// the DNs are compared case insensitively, as the directory matches them
+func mapGroups(groupMap map[string]string, groupDNs []string) []string {
+	groups := []string{}
+	for _, groupDN := range groupDNs {
+		dn, err := ldapv3.ParseDN(strings.ToLower(groupDN))
+		if err != nil {
+			continue
+		}
+		for mappedDN, group := range groupMap {
+			mapped, err := ldapv3.ParseDN(strings.ToLower(mappedDN))
+			if err != nil || group == "" || !dn.Equal(mapped) || containsGroup(groups, group) {
+				continue
+			}
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func containsGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package authenticatorservice
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/services/hashservice"
+
+	"go.uber.org/zap"
+)
+
+// local authenticates against the password hashes in postgres
+type local struct {
+	logger   log.Factory
+	userRepo userrepo.Store
+	hasher   hashservice.Provider
+}
+
+func newLocal(logger log.Factory, userRepo userrepo.Store, hasher hashservice.Provider) Authenticator {
+	return &local{
+		logger:   logger.With(zap.String("package", "authenticatorservice")),
+		userRepo: userRepo,
+		hasher:   hasher,
+	}
+}
+
+func (a *local) Authenticate(ctx context.Context, creds *authmodels.UserCreds) (usermodels.Record, error) {
+	a.logger.For(ctx).Info("entering authenticatorservice.local.Authenticate", zap.String("email", creds.Email))
+	a.logger.For(ctx).Info("start authenticatorservice.local.ReadByEmail", zap.String("email", creds.Email))
+	user, err := a.userRepo.ReadByEmail(ctx, creds.Email)
+	a.logger.For(ctx).Info("stop authenticatorservice.local.ReadByEmail", zap.String("email", creds.Email))
+	if err != nil {
+		a.logger.For(ctx).Error("failed authenticatorservice.local.ReadByEmail", zap.Error(err))
+		return user, invalidCredsErr(err)
+	}
+	a.logger.For(ctx).Info("start authenticatorservice.local.Verify", zap.String("email", creds.Email))
+	match, err := a.hasher.Verify(ctx, user.PasswordHash, creds.Password)
+	a.logger.For(ctx).Info("stop authenticatorservice.local.Verify", zap.String("email", creds.Email))
+	if err != nil {
+		a.logger.For(ctx).Error("failed authenticatorservice.local.Verify", zap.Error(err))
+		return user, invalidCredsErr(err)
+	}
+	if !match {
+		return user, invalidCredsErr(fmt.Errorf("password mismatch"))
+	}
+
+	// the creds are valid, upgrade the stored hash if it is weaker than our current config
+	if a.hasher.NeedsRehash(ctx, user.PasswordHash) {
+		a.rehashPassword(ctx, user, creds.Password)
+	}
+
+	a.logger.For(ctx).Info("leaving authenticatorservice.local.Authenticate", zap.String("email", creds.Email))
+	return user, nil
+}
+
+// rehashPassword transparently upgrades the user's stored password hash
+// failures are logged but never fail the login (the old hash is still valid)
+func (a *local) rehashPassword(ctx context.Context, user usermodels.Record, password string) {
+	a.logger.For(ctx).Info("entering authenticatorservice.local.rehashPassword", zap.String("email", user.Email))
+	passHash, err := a.hasher.Hash(ctx, password)
+	if err != nil {
+		a.logger.For(ctx).Error("failed authenticatorservice.local.rehashPassword.Hash", zap.Error(err), zap.String("email", user.Email))
+		return
+	}
+	if err = a.userRepo.UpdatePasswordHash(ctx, user.ID, passHash); err != nil {
+		a.logger.For(ctx).Error("failed authenticatorservice.local.rehashPassword.UpdatePasswordHash", zap.Error(err), zap.String("email", user.Email))
+		return
+	}
+	a.logger.For(ctx).Info("leaving authenticatorservice.local.rehashPassword", zap.String("email", user.Email))
+}
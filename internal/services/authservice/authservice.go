@@ -8,31 +8,47 @@ import (
 	"time"
 
 	"github.com/tjsampson/token-svc/internal/config"
-	"github.com/tjsampson/token-svc/internal/datastores/redis"
 	"github.com/tjsampson/token-svc/internal/errors"
 	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
 	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/loginmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
 	"github.com/tjsampson/token-svc/internal/models/tokenmodels"
 	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
 	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/internal/services/authenticatorservice"
 	"github.com/tjsampson/token-svc/internal/services/cookieservice"
+	"github.com/tjsampson/token-svc/internal/services/hashservice"
 	"github.com/tjsampson/token-svc/internal/services/jwtservice"
+	"github.com/tjsampson/token-svc/internal/services/loginhistoryservice"
+	"github.com/tjsampson/token-svc/internal/services/policyservice"
+	"github.com/tjsampson/token-svc/internal/services/throttleservice"
 	"github.com/tjsampson/token-svc/internal/services/tracingservice"
 
 	"github.com/opentracing/opentracing-go"
 	uuid "github.com/satori/go.uuid"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/bcrypt"
-)
-
-const (
-	lockKeyVal = "1"
 )
 
 // Service is the auth service interface
 type Service interface {
 	Login(ctx context.Context, creds *authmodels.UserCreds) (authmodels.LoginResponse, error)
 	Register(ctx context.Context, creds *authmodels.UserRegistration) (usermodels.Record, error)
+	ChangePassword(ctx context.Context, userID int, change *authmodels.PasswordChange) error
+	FederatedLogin(ctx context.Context, method string, identity usermodels.Identity) (authmodels.LoginResponse, error)
+	PasswordlessLogin(ctx context.Context, method string, userID int) (authmodels.LoginResponse, error)
+	Reauthenticate(ctx context.Context, userID int, reauth *authmodels.Reauthentication) (authmodels.ReauthResponse, error)
+	Refresh(ctx context.Context, refreshToken string) (authmodels.LoginResponse, error)
+}
+
+// Cache is the subset of redis.Provider the auth service uses (the token caches)
+type Cache interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, exp time.Duration) error
 }
 
 type service struct {
@@ -42,12 +58,19 @@ type service struct {
 	userRepo      userrepo.Store
 	tracer        opentracing.Tracer
 	traceProvider tracingservice.Provider
-	redis         redis.Provider
+	redis         Cache
 	cookieOven    cookieservice.Provider
+	hasher        hashservice.Provider
+	policy        policyservice.Provider
+	throttle      throttleservice.Provider
+	auditor       auditservice.Provider
+	outbox        outboxrepo.Store
+	authenticator authenticatorservice.Provider
+	loginHistory  loginhistoryservice.Provider
 }
 
 // New returns a new Service interface implementation
-func New(logger log.Factory, cfg *config.Config, jwtClient jwtservice.Provider, usrRepo userrepo.Store, tracer opentracing.Tracer, traceProvider tracingservice.Provider, redis redis.Provider, cookieOven cookieservice.Provider) Service {
+func New(logger log.Factory, cfg *config.Config, jwtClient jwtservice.Provider, usrRepo userrepo.Store, tracer opentracing.Tracer, traceProvider tracingservice.Provider, redis Cache, cookieOven cookieservice.Provider, hasher hashservice.Provider, policy policyservice.Provider, throttle throttleservice.Provider, auditor auditservice.Provider, outbox outboxrepo.Store, authenticator authenticatorservice.Provider, loginHistory loginhistoryservice.Provider) Service {
 	return &service{
 		logger:        logger.With(zap.String("package", "authservice")),
 		cfg:           cfg,
@@ -57,6 +80,13 @@ func New(logger log.Factory, cfg *config.Config, jwtClient jwtservice.Provider,
 		redis:         redis,
 		cookieOven:    cookieOven,
 		traceProvider: traceProvider,
+		hasher:        hasher,
+		policy:        policy,
+		throttle:      throttle,
+		auditor:       auditor,
+		outbox:        outbox,
+		authenticator: authenticator,
+		loginHistory:  loginHistory,
 	}
 }
 
@@ -64,91 +94,131 @@ func (svc *service) Register(ctx context.Context, userReg *authmodels.UserRegist
 	svc.logger.For(ctx).Info("entering authservice.Register", zap.String("email", userReg.Email))
 	var err error
 	var result usermodels.Record
+
+	if err = svc.policy.Validate(ctx, userReg.Email, userReg.Password); err != nil {
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventRegister, Outcome: auditmodels.OutcomeFailure, Email: userReg.Email, Details: map[string]interface{}{"reason": "password policy"}})
+		return result, errors.ErrorWrapper(err, "AuthService.Register.policy.Validate")
+	}
+
 	svc.logger.For(ctx).Info("start authservice.Register.hashPassword", zap.String("email", userReg.Email))
-	passHashBytes, err := bcrypt.GenerateFromPassword([]byte(userReg.Password), bcrypt.DefaultCost)
+	passHash, err := svc.hasher.Hash(ctx, userReg.Password)
 	svc.logger.For(ctx).Info("stop authservice.Register.hashPassword", zap.String("email", userReg.Email))
 	if err != nil {
-		svc.logger.For(ctx).Error("failed to GenerateFromPassword", zap.Error(err), zap.String("email", userReg.Email))
+		svc.logger.For(ctx).Error("failed to hash password", zap.Error(err), zap.String("email", userReg.Email))
 		return result, errors.ErrorWrapper(err, "AuthService.Register.hashPassword")
 	}
 
-	user, err := svc.userRepo.Insert(ctx, userReg.Email, string(passHashBytes))
+	user, err := svc.userRepo.Insert(ctx, userReg.Email, passHash, outboxmodels.Event{
+		Type: outboxmodels.EventUserRegistered,
+		Data: map[string]interface{}{"email": userReg.Email},
+	})
 
 	if err != nil {
 		svc.logger.For(ctx).Error("failed to insert user", zap.Error(err), zap.String("email", userReg.Email))
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventRegister, Outcome: auditmodels.OutcomeFailure, Email: userReg.Email, Details: map[string]interface{}{"reason": err.Error()}})
 		return result, errors.ErrorWrapper(err, fmt.Sprintf("failed to register %s", userReg.Email))
 	}
+
+	if err = svc.userRepo.InsertPasswordHistory(ctx, user.ID, passHash); err != nil {
+		// the user is registered, a missing history entry only weakens reuse prevention
+		svc.logger.For(ctx).Error("failed to insert password history", zap.Error(err), zap.String("email", userReg.Email))
+	}
+	svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventRegister, Outcome: auditmodels.OutcomeSuccess, ActorID: user.ID, SubjectID: user.ID, Email: user.Email})
 	svc.logger.For(ctx).Info("leaving authservice.Register", zap.String("email", userReg.Email))
 	return user, nil
 }
 
-func (svc *service) validateUserCreds(ctx context.Context, creds *authmodels.UserCreds) (usermodels.Record, error) {
-	svc.logger.For(ctx).Info("entering authservice.validateUserCreds", zap.String("email", creds.Email))
-	user := usermodels.Record{}
-	var invalidCredsErr = func(originalErr error) error {
+// ChangePassword verifies the current password and replaces it with the new password
+// the new password must satisfy the password policy (including password history)
+func (svc *service) ChangePassword(ctx context.Context, userID int, change *authmodels.PasswordChange) error {
+	svc.logger.For(ctx).Info("entering authservice.ChangePassword", zap.Int("user_id", userID))
+
+	user, err := svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return errors.ErrorWrapper(err, "AuthService.ChangePassword.ReadByID")
+	}
+
+	auditFailure := func(reason string) {
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventPasswordChange, Outcome: auditmodels.OutcomeFailure, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"reason": reason}})
+	}
+
+	match, err := svc.hasher.Verify(ctx, user.PasswordHash, change.CurrentPassword)
+	if err != nil || !match {
+		auditFailure("invalid current password")
 		return &errors.RestError{
 			Code:          401,
 			Message:       "Invalid Credentials",
-			OriginalError: originalErr,
+			OriginalError: err,
 		}
 	}
-	svc.logger.For(ctx).Info("start authservice.validateUserCreds.ReadByEmail", zap.String("email", creds.Email))
-	user, err := svc.userRepo.ReadByEmail(ctx, creds.Email)
-	svc.logger.For(ctx).Info("stop authservice.validateUserCreds.ReadByEmail", zap.String("email", creds.Email))
-	if err != nil {
-		svc.logger.For(ctx).Error("failed authservice.validateUserCreds.ReadByEmail", zap.Error(err))
-		return user, invalidCredsErr(err)
-	}
-	svc.logger.For(ctx).Info("start authservice.validateUserCreds.CompareHashAndPassword", zap.String("email", creds.Email))
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(creds.Password))
-	svc.logger.For(ctx).Info("stop authservice.validateUserCreds.CompareHashAndPassword", zap.String("email", creds.Email))
-	if err != nil {
-		svc.logger.For(ctx).Error("failed authservice.validateUserCreds.CompareHashAndPassword", zap.Error(err))
-		return user, invalidCredsErr(err)
+
+	if err = svc.policy.Validate(ctx, user.Email, change.Password); err != nil {
+		auditFailure("password policy")
+		return errors.ErrorWrapper(err, "AuthService.ChangePassword.policy.Validate")
 	}
-	svc.logger.For(ctx).Info("leaving authservice.validateUserCreds", zap.String("email", creds.Email))
-	return user, nil
-}
 
-func (svc *service) failedLoginAttemps(ctx context.Context, email string) int {
-	failedAttemps := 0
-	failedLogins, err := svc.redis.Get(ctx, fmt.Sprintf("%v-%v", svc.cfg.Token.FailedLoginCacheKeyID, email))
-	if err != nil {
-		// If this is first failure, the key does not exists
-		svc.logger.For(ctx).Error("failed login attempt cache retrieval", zap.String("email", email))
-	} else {
-		svc.logger.For(ctx).Info("failed login attempts", zap.String("email", email), zap.String("failed_attempts", failedLogins))
-		i, err := strconv.Atoi(failedLogins)
-		if err != nil {
-			svc.logger.For(ctx).Error("failed login attempt int conversion", zap.String("email", email), zap.String("failedLogins", failedLogins))
+	// the current password always counts as history (even if it predates the history table)
+	if match, _ = svc.hasher.Verify(ctx, user.PasswordHash, change.Password); match {
+		auditFailure("password reuse")
+		return &errors.RestError{
+			Code:     400,
+			Message:  "password policy violation(s)",
+			Messages: []string{"Password must be different from your current password"},
 		}
-		failedAttemps = i
 	}
-	failedAttemps = failedAttemps + 1
+	if err = svc.policy.ValidateHistory(ctx, user.ID, change.Password); err != nil {
+		auditFailure("password reuse")
+		return errors.ErrorWrapper(err, "AuthService.ChangePassword.policy.ValidateHistory")
+	}
 
-	// Set the Redis Cache Key for failed login attempts
-	err = svc.redis.Set(
-		ctx,
-		fmt.Sprintf("%v-%v", svc.cfg.Token.FailedLoginCacheKeyID, email),
-		strconv.Itoa(failedAttemps),
-		time.Duration(svc.cfg.Token.FailedLoginAttemptCacheLifeSpanMins)*time.Minute,
-	)
+	passHash, err := svc.hasher.Hash(ctx, change.Password)
 	if err != nil {
-		svc.logger.For(ctx).Error("cache set failed: failed login attempt", zap.Error(err), zap.String("email", email))
+		return errors.ErrorWrapper(err, "AuthService.ChangePassword.hashPassword")
+	}
+
+	if err = svc.userRepo.UpdatePasswordHash(ctx, user.ID, passHash, outboxmodels.Event{
+		Type:   outboxmodels.EventPasswordChanged,
+		UserID: user.ID,
+		Data:   map[string]interface{}{"email": user.Email},
+	}); err != nil {
+		return errors.ErrorWrapper(err, "AuthService.ChangePassword.UpdatePasswordHash")
+	}
+
+	if err = svc.userRepo.InsertPasswordHistory(ctx, user.ID, passHash); err != nil {
+		svc.logger.For(ctx).Error("failed to insert password history", zap.Error(err), zap.Int("user_id", userID))
 	}
-	return failedAttemps
+
+	svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventPasswordChange, Outcome: auditmodels.OutcomeSuccess, SubjectID: user.ID, Email: user.Email})
+	svc.logger.For(ctx).Info("leaving authservice.ChangePassword", zap.Int("user_id", userID))
+	return nil
+}
+
+// validateUserCreds validates the creds with the authenticator for the email's domain (local passwords or ldap)
+func (svc *service) validateUserCreds(ctx context.Context, creds *authmodels.UserCreds) (usermodels.Record, error) {
+	svc.logger.For(ctx).Info("entering authservice.validateUserCreds", zap.String("email", creds.Email))
+	user, err := svc.authenticator.Authenticate(ctx, creds)
+	svc.logger.For(ctx).Info("leaving authservice.validateUserCreds", zap.String("email", creds.Email))
+	return user, err
 }
 
-func (svc *service) setUserLock(ctx context.Context, email string) {
-	// Set the Redis Cache Key for user account locked
-	err := svc.redis.Set(
-		ctx,
-		fmt.Sprintf("%v-%v", svc.cfg.Cache.UserAccountLockedKeyID, email),
-		lockKeyVal,
-		time.Duration(svc.cfg.Cache.UserAccountLockedLifeSpanMins)*time.Minute,
-	)
+// publishLockout writes the temporary (failed login) account lock to the outbox
+// the lock only lives in the cache, so there is no user change to share a transaction with
+func (svc *service) publishLockout(ctx context.Context, user usermodels.Record, lockRemaining time.Duration) {
+	if user.ID == 0 {
+		return
+	}
+	err := svc.outbox.Insert(ctx, outboxmodels.Event{
+		Type:   outboxmodels.EventUserLocked,
+		UserID: user.ID,
+		Data: map[string]interface{}{
+			"email":     user.Email,
+			"reason":    "too many failed login attempts",
+			"temporary": true,
+			"lock_secs": int(lockRemaining.Seconds()),
+		},
+	})
 	if err != nil {
-		svc.logger.For(ctx).Error("cache set failed: setUserLock", zap.Error(err), zap.String("email", email))
+		svc.logger.For(ctx).Error("failed to publish account lockout", zap.Error(err), zap.Int("user_id", user.ID))
 	}
 }
 
@@ -159,28 +229,384 @@ func (svc *service) setUserLock(ctx context.Context, email string) {
 func (svc *service) Login(ctx context.Context, creds *authmodels.UserCreds) (authmodels.LoginResponse, error) {
 	svc.logger.For(ctx).Info("entering authservice.Login", zap.String("email", creds.Email))
 
-	locked, _ := svc.redis.Get(ctx, fmt.Sprintf("%v-%v", svc.cfg.Cache.UserAccountLockedKeyID, creds.Email))
+	userIP := requestcontext.UserIP(ctx)
 
-	if locked == lockKeyVal {
-		return authmodels.LoginResponse{}, &errors.RestError{
-			Code:    403, // Forbidden - Account is currently Locked
-			Message: fmt.Sprintf("user account locked (%s)", creds.Email),
-		}
+	// Too Many Requests - the IP, email or IP+email is currently blocked (or the account is locked)
+	if err := svc.throttle.Allow(ctx, userIP, creds.Email); err != nil {
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginBlocked, Outcome: auditmodels.OutcomeDenied, Email: creds.Email, Details: map[string]interface{}{"reason": err.Error()}})
+		return authmodels.LoginResponse{}, err
 	}
 
 	user, err := svc.validateUserCreds(ctx, creds)
+	if authenticatorservice.IsUnavailable(err) {
+		// the creds were never checked (ex: the directory is down), this is not a failed login
+		return authmodels.LoginResponse{}, err
+	}
 	if err != nil {
 		svc.logger.For(ctx).Error("failed user cred validation", zap.Error(err), zap.String("email", creds.Email))
-		if svc.failedLoginAttemps(ctx, creds.Email) > int(svc.cfg.Token.FailedLoginAttemptsMax) {
-			svc.logger.For(ctx).Info("user exceeded failed login attempts", zap.String("email", creds.Email), zap.Uint16("failed_attempts_max", svc.cfg.Token.FailedLoginAttemptsMax))
-			svc.setUserLock(ctx, creds.Email)
-			return authmodels.LoginResponse{}, &errors.RestError{
-				Code:          418, // I'm a teapot HTTP 218 (people could be trying to break in)
-				Message:       fmt.Sprintf("user account locked (%s)", creds.Email),
-				OriginalError: err,
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginFailure, Outcome: auditmodels.OutcomeFailure, SubjectID: user.ID, Email: creds.Email, Details: map[string]interface{}{"reason": "invalid credentials"}})
+		if throttleErr := svc.throttle.Failed(ctx, userIP, creds.Email); throttleErr != nil {
+			// this failure triggered a block, the account lock is the lockout (IP blocks are login.blocked)
+			event := auditmodels.EventLoginBlocked
+			if lockRemaining := svc.throttle.LockRemaining(ctx, creds.Email); lockRemaining > 0 {
+				event = auditmodels.EventLockout
+				svc.publishLockout(ctx, user, lockRemaining)
+			}
+			svc.auditor.Record(ctx, auditmodels.Event{Event: event, Outcome: auditmodels.OutcomeDenied, SubjectID: user.ID, Email: creds.Email, Details: map[string]interface{}{"reason": throttleErr.Error()}})
+			return authmodels.LoginResponse{}, throttleErr
+		}
+		return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.Login.validateUserCreds")
+	}
+	failures := svc.throttle.Failures(ctx, creds.Email)
+
+	// the status is only revealed to a caller holding valid creds
+	if !user.CanAuthenticate() {
+		svc.logger.For(ctx).Info("login rejected by account status", zap.String("email", creds.Email), zap.String("status", user.Status))
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginFailure, Outcome: auditmodels.OutcomeDenied, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"reason": "account " + user.Status}})
+		return authmodels.LoginResponse{}, &errors.RestError{
+			Code:    403,
+			Message: fmt.Sprintf("user account %s", user.Status),
+		}
+	}
+
+	amr := []string{authmodels.AMRPassword}
+	if _, err = svc.loginHistory.Record(ctx, loginmodels.Attempt{UserID: user.ID, Email: user.Email, Method: svc.authenticator.Backend(creds.Email), AMR: amr, RecentFailures: failures}); err != nil {
+		return authmodels.LoginResponse{}, err
+	}
+	// the failure counters are only reset once the login is allowed (a locked account or a forced mfa is not a success)
+	svc.throttle.Succeeded(ctx, userIP, creds.Email)
+
+	result, err := svc.issueTokens(ctx, user, amr)
+	if err != nil {
+		return result, err
+	}
+	svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginSuccess, Outcome: auditmodels.OutcomeSuccess, ActorID: user.ID, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"method": svc.authenticator.Backend(creds.Email)}})
+	svc.logger.For(ctx).Info("leaving authservice.Login", zap.String("email", creds.Email))
+	return result, nil
+}
+
+// Federated login methods
+const (
+	LoginMethodOIDC = "oidc"
+	LoginMethodSAML = "saml"
+)
+
+// FederatedLogin logs in the user authenticated by an external identity provider (oidc or saml)
+// the identity is matched by its link (issuer + subject), then linked to the user with the identity's verified email,
+// otherwise a new (passwordless) user is created (when enabled)
+// the identity's groups (when present) replace the user's groups from the login method
+func (svc *service) FederatedLogin(ctx context.Context, method string, identity usermodels.Identity) (authmodels.LoginResponse, error) {
+	svc.logger.For(ctx).Info("entering authservice.FederatedLogin", zap.String("email", identity.Email), zap.String("issuer", identity.Issuer), zap.String("method", method))
+
+	loginFailure := func(userID int, reason string, err error) (authmodels.LoginResponse, error) {
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginFailure, Outcome: auditmodels.OutcomeDenied, SubjectID: userID, Email: identity.Email, Details: map[string]interface{}{"reason": reason, "method": method, "issuer": identity.Issuer}})
+		return authmodels.LoginResponse{}, err
+	}
+
+	user, linked, err := svc.userRepo.ReadByIdentity(ctx, identity.Issuer, identity.Subject)
+	if err != nil {
+		return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.FederatedLogin.ReadByIdentity")
+	}
+
+	if !linked {
+		// an unverified email could claim someone else's account
+		if !identity.EmailVerified || identity.Email == "" {
+			return loginFailure(0, "email not verified", &errors.RestError{
+				Code:    403,
+				Message: "the identity provider has not verified your email",
+			})
+		}
+
+		user, err = svc.userRepo.ReadByEmail(ctx, identity.Email)
+		switch {
+		case err == nil:
+			if err = svc.userRepo.LinkIdentity(ctx, user.ID, identity); err != nil {
+				return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.FederatedLogin.LinkIdentity")
+			}
+			// the identity provider verified the email the account is linked by
+			if !user.EmailVerified {
+				if _, err = svc.userRepo.VerifyEmail(ctx, user.ID, outboxmodels.Event{
+					Type:   outboxmodels.EventEmailVerified,
+					UserID: user.ID,
+					Data:   map[string]interface{}{"email": user.Email, "method": method, "issuer": identity.Issuer},
+				}); err != nil {
+					return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.FederatedLogin.VerifyEmail")
+				}
+				user.EmailVerified = true
+			}
+			svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventIdentityLinked, Outcome: auditmodels.OutcomeSuccess, ActorID: user.ID, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"issuer": identity.Issuer}})
+		case svc.createsUsers(method) && isNotFound(err):
+			user, err = svc.userRepo.InsertFederated(ctx, identity, outboxmodels.Event{
+				Type: outboxmodels.EventUserRegistered,
+				Data: map[string]interface{}{"email": identity.Email, "issuer": identity.Issuer},
+			})
+			if err != nil {
+				return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.FederatedLogin.InsertFederated")
+			}
+			svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventRegister, Outcome: auditmodels.OutcomeSuccess, ActorID: user.ID, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"issuer": identity.Issuer}})
+		case isNotFound(err):
+			return loginFailure(0, "no account", &errors.RestError{
+				Code:    403,
+				Message: "no account exists for your email",
+			})
+		default:
+			return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.FederatedLogin.ReadByEmail")
+		}
+	}
+
+	if !user.CanAuthenticate() {
+		svc.logger.For(ctx).Info("federated login rejected by account status", zap.String("email", user.Email), zap.String("status", user.Status))
+		return loginFailure(user.ID, "account "+user.Status, &errors.RestError{
+			Code:    403,
+			Message: fmt.Sprintf("user account %s", user.Status),
+		})
+	}
+
+	if identity.Groups != nil {
+		if err = svc.userRepo.SyncGroups(ctx, user.ID, method, identity.Groups); err != nil {
+			return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.FederatedLogin.SyncGroups")
+		}
+	}
+
+	// the identity provider's amr (when it sends one) is how the user authenticated
+	amr := authmodels.KnownAMR(identity.AMR)
+	if _, err = svc.loginHistory.Record(ctx, loginmodels.Attempt{UserID: user.ID, Email: user.Email, Method: method, AMR: amr}); err != nil {
+		return authmodels.LoginResponse{}, err
+	}
+
+	result, err := svc.issueTokens(ctx, user, amr)
+	if err != nil {
+		return result, err
+	}
+	svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginSuccess, Outcome: auditmodels.OutcomeSuccess, ActorID: user.ID, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"method": method, "issuer": identity.Issuer}})
+	svc.logger.For(ctx).Info("leaving authservice.FederatedLogin", zap.String("email", user.Email))
+	return result, nil
+}
+
+// Passwordless login methods
+const (
+	LoginMethodMagic = "magic"
+)
+
+// passwordlessAMR is the amr claim of the passwordless login methods
+var passwordlessAMR = map[string][]string{
+	LoginMethodMagic: {authmodels.AMROTP},
+}
+
+// PasswordlessLogin logs in the user whose email was verified by the login method (ex: a magic link or emailed code)
+func (svc *service) PasswordlessLogin(ctx context.Context, method string, userID int) (authmodels.LoginResponse, error) {
+	svc.logger.For(ctx).Info("entering authservice.PasswordlessLogin", zap.Int("user_id", userID), zap.String("method", method))
+
+	user, err := svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.PasswordlessLogin.ReadByID")
+	}
+
+	// the status may have changed since the code was sent
+	if !user.CanAuthenticate() {
+		svc.logger.For(ctx).Info("passwordless login rejected by account status", zap.String("email", user.Email), zap.String("status", user.Status))
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginFailure, Outcome: auditmodels.OutcomeDenied, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"reason": "account " + user.Status, "method": method}})
+		return authmodels.LoginResponse{}, &errors.RestError{
+			Code:    403,
+			Message: fmt.Sprintf("user account %s", user.Status),
+		}
+	}
+	failures := svc.throttle.Failures(ctx, user.Email)
+
+	amr := passwordlessAMR[method]
+	if _, err = svc.loginHistory.Record(ctx, loginmodels.Attempt{UserID: user.ID, Email: user.Email, Method: method, AMR: amr, RecentFailures: failures}); err != nil {
+		return authmodels.LoginResponse{}, err
+	}
+	svc.throttle.Succeeded(ctx, requestcontext.UserIP(ctx), user.Email)
+
+	result, err := svc.issueTokens(ctx, user, amr)
+	if err != nil {
+		return result, err
+	}
+	svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginSuccess, Outcome: auditmodels.OutcomeSuccess, ActorID: user.ID, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"method": method}})
+	svc.logger.For(ctx).Info("leaving authservice.PasswordlessLogin", zap.String("email", user.Email))
+	return result, nil
+}
+
+// Reauthenticate re-verifies the logged in user's password and re-issues the access token with a new auth_time (step-up)
+// the token keeps its id and expiry, so the session (the cookie, the refresh token and the cached token id) is unchanged
+func (svc *service) Reauthenticate(ctx context.Context, userID int, reauth *authmodels.Reauthentication) (authmodels.ReauthResponse, error) {
+	svc.logger.For(ctx).Info("entering authservice.Reauthenticate", zap.Int("user_id", userID))
+
+	auth, ok := requestcontext.Authentication(ctx)
+	tokenID := requestcontext.JWTID(ctx)
+	if !ok || tokenID == "" {
+		return authmodels.ReauthResponse{}, &errors.RestError{
+			Code:    403,
+			Message: "re-authentication requires a login session",
+		}
+	}
+
+	user, err := svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return authmodels.ReauthResponse{}, errors.ErrorWrapper(err, "AuthService.Reauthenticate.ReadByID")
+	}
+
+	userIP := requestcontext.UserIP(ctx)
+	stepUpFailure := func(outcome, reason string) {
+		svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventStepUp, Outcome: outcome, ActorID: user.ID, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"reason": reason}})
+	}
+
+	// a password guess from a stolen session is throttled (and locks the account) like a login
+	if err = svc.throttle.Allow(ctx, userIP, user.Email); err != nil {
+		stepUpFailure(auditmodels.OutcomeDenied, err.Error())
+		return authmodels.ReauthResponse{}, err
+	}
+	_, err = svc.validateUserCreds(ctx, &authmodels.UserCreds{Email: user.Email, Password: reauth.Password})
+	if authenticatorservice.IsUnavailable(err) {
+		return authmodels.ReauthResponse{}, err
+	}
+	if err != nil {
+		stepUpFailure(auditmodels.OutcomeFailure, "invalid credentials")
+		if throttleErr := svc.throttle.Failed(ctx, userIP, user.Email); throttleErr != nil {
+			if lockRemaining := svc.throttle.LockRemaining(ctx, user.Email); lockRemaining > 0 {
+				svc.publishLockout(ctx, user, lockRemaining)
+				svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLockout, Outcome: auditmodels.OutcomeDenied, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"reason": throttleErr.Error()}})
 			}
+			return authmodels.ReauthResponse{}, throttleErr
+		}
+		return authmodels.ReauthResponse{}, &errors.RestError{
+			Code:          401,
+			Message:       "Invalid Credentials",
+			OriginalError: err,
+		}
+	}
+	svc.throttle.Succeeded(ctx, userIP, user.Email)
+
+	roles, err := svc.userRepo.ListGroups(ctx, user.ID)
+	if err != nil {
+		return authmodels.ReauthResponse{}, errors.ErrorWrapper(err, "AuthService.Reauthenticate.ListGroups")
+	}
+	// the password is added to the session's factors, a multi factor (aal2) session stays multi factor
+	amr := authmodels.WithAMR(auth.Methods, authmodels.AMRPassword)
+	accessTokenChan := make(chan tokenmodels.TokenResult, 1)
+	svc.jwtClient.GenerateAccessToken(ctx, accessTokenChan, map[string]interface{}{
+		"subject":    strconv.Itoa(user.ID),
+		"id":         tokenID,
+		"name":       user.Email,
+		"roles":      roles,
+		"amr":        amr,
+		"acr":        authmodels.ACR(amr),
+		"expires_at": auth.Expires.Unix(),
+		"jkt":        requestcontext.DPoPThumbprint(ctx),
+		"x5t":        requestcontext.CertThumbprint(ctx),
+	})
+	accessTokenResult := <-accessTokenChan
+	if accessTokenResult.Err != nil {
+		return authmodels.ReauthResponse{}, errors.ErrorWrapper(accessTokenResult.Err, "AuthService.Reauthenticate.GenerateAccessToken")
+	}
+
+	svc.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventStepUp, Outcome: auditmodels.OutcomeSuccess, ActorID: user.ID, SubjectID: user.ID, Email: user.Email, Details: map[string]interface{}{"amr": amr}})
+	svc.logger.For(ctx).Info("leaving authservice.Reauthenticate", zap.Int("user_id", userID))
+	return authmodels.ReauthResponse{AccessToken: accessTokenResult.Token}, nil
+}
+
+// Refresh re-issues the access token (and the cookie) of the refresh token's session
+// the refresh token must be the session's current one (a new login or a disabled account revokes it),
+// the new access token keeps the login's auth_time and amr, the refresh token is unchanged (it is not returned)
+func (svc *service) Refresh(ctx context.Context, refreshToken string) (authmodels.LoginResponse, error) {
+	svc.logger.For(ctx).Info("entering authservice.Refresh")
+	invalidToken := &errors.RestError{
+		Code:    401,
+		Message: "invalid refresh token",
+	}
+
+	claims, ok := svc.jwtClient.IsValidRefreshToken(ctx, refreshToken)
+	if !ok {
+		return authmodels.LoginResponse{}, invalidToken
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return authmodels.LoginResponse{}, invalidToken
+	}
+	cacheJTI, err := svc.redis.Get(ctx, fmt.Sprintf("%v-%v", svc.cfg.Token.RefreshCacheKeyID, userID))
+	if err != nil || cacheJTI != claims.Id {
+		svc.logger.For(ctx).Error("refresh token is not the session's current refresh token", zap.Int("user_id", userID), zap.Error(err))
+		return authmodels.LoginResponse{}, invalidToken
+	}
+	// a DPoP bound refresh token is only accepted with a proof of its key
+	if jkt := claims.DPoPThumbprint(); jkt != "" && jkt != requestcontext.DPoPThumbprint(ctx) {
+		svc.logger.For(ctx).Error("refresh token is bound to another dpop key", zap.Int("user_id", userID))
+		return authmodels.LoginResponse{}, invalidToken
+	}
+	// a certificate bound refresh token is only accepted over a connection with the same client certificate
+	if x5t := claims.CertThumbprint(); x5t != "" && x5t != requestcontext.CertThumbprint(ctx) {
+		svc.logger.For(ctx).Error("refresh token is bound to another client certificate", zap.Int("user_id", userID))
+		return authmodels.LoginResponse{}, invalidToken
+	}
+
+	user, err := svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.Refresh.ReadByID")
+	}
+	if !user.CanAuthenticate() {
+		return authmodels.LoginResponse{}, &errors.RestError{
+			Code:    401,
+			Message: fmt.Sprintf("user account %s", user.Status),
 		}
-		return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "HealthService.GetDatabaseHealth")
+	}
+
+	result, err := svc.issueSession(ctx, user, sessionGrant{
+		amr:            claims.AMR,
+		authTime:       claims.AuthTime,
+		refreshToken:   refreshToken,
+		refreshTokenID: claims.Id,
+	})
+	if err != nil {
+		return authmodels.LoginResponse{}, err
+	}
+	result.RefreshToken = ""
+	svc.logger.For(ctx).Info("leaving authservice.Refresh", zap.Int("user_id", userID))
+	return result, nil
+}
+
+// createsUsers reports if the login method creates a user for an unknown (verified) email
+func (svc *service) createsUsers(method string) bool {
+	switch method {
+	case LoginMethodOIDC:
+		return svc.cfg.OIDC.CreateUsers
+	case LoginMethodSAML:
+		return svc.cfg.SAML.CreateUsers
+	}
+	return false
+}
+
+// isNotFound reports if the repo error is a missing record
+func isNotFound(err error) bool {
+	restErr, ok := err.(*errors.RestError)
+	return ok && restErr.Code == 404
+}
+
+// issueTokens generates the following for the authenticated user...
+//  - JWT Access Token
+// 	- JWT Refresh Token
+//	- Secure Cookie
+// and caches the access and refresh token ids
+// amr is how the user authenticated (the access token amr and acr claims)
+func (svc *service) issueTokens(ctx context.Context, user usermodels.Record, amr []string) (authmodels.LoginResponse, error) {
+	return svc.issueSession(ctx, user, sessionGrant{amr: amr})
+}
+
+// sessionGrant is what a session's tokens are issued from
+// a login has no refresh token (one is issued), a refresh keeps the session's refresh token, auth_time and amr
+type sessionGrant struct {
+	amr            []string
+	authTime       int64
+	refreshToken   string
+	refreshTokenID string
+}
+
+func (svc *service) issueSession(ctx context.Context, user usermodels.Record, grant sessionGrant) (authmodels.LoginResponse, error) {
+	var err error
+	amr := grant.amr
+	authTime := grant.authTime
+	if authTime == 0 {
+		authTime = time.Now().Unix()
 	}
 
 	// Setup our Channels for concurrent calls
@@ -190,20 +616,36 @@ func (svc *service) Login(ctx context.Context, creds *authmodels.UserCreds) (aut
 
 	// Generate the New JWT IDs (GUIDs)
 	accessTokenID := uuid.NewV4().String()
-	refreshTokenID := uuid.NewV4().String()
+	refreshTokenID := grant.refreshTokenID
+	if refreshTokenID == "" {
+		refreshTokenID = uuid.NewV4().String()
+	}
 
 	// Establish the cookie data
 	cookieData := map[string]string{
-		svc.cfg.Cookie.KeyUserID:       string(user.ID),
+		svc.cfg.Cookie.KeyUserID:       strconv.Itoa(user.ID),
 		svc.cfg.Cookie.KeyEmail:        user.Email,
 		svc.cfg.Cookie.KeyJWTAccessID:  accessTokenID,
 		svc.cfg.Cookie.KeyJWTRefreshID: refreshTokenID}
 
+	// the roles claim is the user's groups (local and directory)
+	roles, err := svc.userRepo.ListGroups(ctx, user.ID)
+	if err != nil {
+		svc.logger.For(ctx).Error("failed to list user groups", zap.Error(err))
+		return authmodels.LoginResponse{}, errors.ErrorWrapper(err, "AuthService.issueTokens.ListGroups")
+	}
+
 	// Establish accesssTokenData
 	accessTokenData := map[string]interface{}{
 		"subject": strconv.Itoa(user.ID),
 		"id": accessTokenID,
 		"name": user.Email,
+		"roles": roles,
+		"amr": amr,
+		"acr": authmodels.ACR(amr),
+		"auth_time": authTime,
+		"jkt": requestcontext.DPoPThumbprint(ctx),
+		"x5t": requestcontext.CertThumbprint(ctx),
 	}
 
 	// Establish refreshTokenData
@@ -211,11 +653,20 @@ func (svc *service) Login(ctx context.Context, creds *authmodels.UserCreds) (aut
 		"subject": strconv.Itoa(user.ID),
 		"id": refreshTokenID,
 		"name": user.Email,
+		"amr": amr,
+		"auth_time": authTime,
+		"jkt": requestcontext.DPoPThumbprint(ctx),
+		"x5t": requestcontext.CertThumbprint(ctx),
 	}
 
 	go svc.cookieOven.BakeCookie(ctx, cookieDataChan, cookieData)
 	go svc.jwtClient.GenerateAccessToken(ctx, accessTokenChan, accessTokenData)
-	go svc.jwtClient.GenerateRefreshToken(ctx, refreshTokenChan, refreshTokenData)
+	if grant.refreshToken == "" {
+		go svc.jwtClient.GenerateRefreshToken(ctx, refreshTokenChan, refreshTokenData)
+	} else {
+		refreshTokenChan <- tokenmodels.TokenResult{Token: grant.refreshToken}
+		close(refreshTokenChan)
+	}
 
 	result := authmodels.LoginResponse{}
 	for {
@@ -250,14 +701,25 @@ func (svc *service) Login(ctx context.Context, creds *authmodels.UserCreds) (aut
 
 	if err != nil {
 		svc.logger.For(ctx).Error("failed token/cookie generation", zap.Error(err))
-		return result, errors.ErrorWrapper(err, "AuthService.Login")
+		return result, errors.ErrorWrapper(err, "AuthService.issueTokens")
+	}
+
+	// the page reads the session's csrf token from its own cookie
+	if svc.cfg.CSRF.Enabled || svc.cfg.Session.Mode == authmodels.SessionModeCookie {
+		result.CSRFCookie = svc.cookieOven.CSRFCookie(svc.cookieOven.CSRFToken(accessTokenID))
 	}
 
 	// Set the Redis Cache Key
 	if err = svc.redis.Set(ctx, fmt.Sprintf("%v-%v", svc.cfg.Token.AccessCacheKeyID, user.ID), accessTokenID, time.Duration(svc.cfg.Token.AccessTokenLifeSpanMins)*time.Minute); err != nil {
 		svc.logger.For(ctx).Error("failed set token cache", zap.Error(err))
-		return result, errors.ErrorWrapper(err, "AuthService.Login")
+		return result, errors.ErrorWrapper(err, "AuthService.issueTokens")
+	}
+	// a refresh token is only valid while it is the session's current one
+	if grant.refreshToken == "" {
+		if err = svc.redis.Set(ctx, fmt.Sprintf("%v-%v", svc.cfg.Token.RefreshCacheKeyID, user.ID), refreshTokenID, time.Duration(svc.cfg.Token.RefreshTokenLifeSpanMins)*time.Minute); err != nil {
+			svc.logger.For(ctx).Error("failed set refresh token cache", zap.Error(err))
+			return result, errors.ErrorWrapper(err, "AuthService.issueTokens")
+		}
 	}
-	svc.logger.For(ctx).Info("leaving authservice.Login", zap.String("email", creds.Email))
 	return result, nil
 }
@@ -2,10 +2,16 @@ package cookieservice
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/tjsampson/token-svc/internal/config"
 	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/pkg/metrics"
 
 	"github.com/gorilla/securecookie"
 	"go.uber.org/zap"
@@ -15,29 +21,79 @@ import (
 type Provider interface {
 	BakeCookie(ctx context.Context, cookieChan chan *http.Cookie, cookieData map[string]string)
 	DecodedCookie(ctx context.Context, r *http.Request) map[string]string
+	CSRFToken(sessionID string) string
+	ValidCSRFToken(sessionID, token string) bool
+	CSRFCookie(token string) *http.Cookie
+	TokenCookies(accessToken, refreshToken string) []*http.Cookie
 }
 
 type provider struct {
-	logger    log.Factory
-	cfg       *config.Config
-	secCookie *securecookie.SecureCookie
+	logger  log.Factory
+	cfg     *config.Config
+	metrics *metrics.Provider
+	// codecs are the key pairs, the current pair (codecs[0]) encodes and every pair decodes
+	codecs   []securecookie.Codec
+	hashKeys [][]byte
 }
 
 // New returns a new implementation of the Cookie.Oven interface
-func New(cfg *config.Config, logger log.Factory) Provider {
+// the cookies are encoded with HashKey/BlockKey, the PreviousKeys still decode (key rotation without logging everyone out)
+func New(cfg *config.Config, logger log.Factory, metricProvider *metrics.Provider) (Provider, error) {
+	keys := append([]config.CookieKey{{HashKey: cfg.Cookie.HashKey, BlockKey: cfg.Cookie.BlockKey}}, cfg.Cookie.PreviousKeys...)
+	pairs := [][]byte{}
+	hashKeys := [][]byte{}
+	for i, key := range keys {
+		if err := validateKey(key); err != nil {
+			return nil, fmt.Errorf("invalid cookie key pair %d: %v", i, err)
+		}
+		pairs = append(pairs, []byte(key.HashKey), []byte(key.BlockKey))
+		hashKeys = append(hashKeys, []byte(key.HashKey))
+	}
+
+	codecs := securecookie.CodecsFromPairs(pairs...)
+	for _, codec := range codecs {
+		secCookie := codec.(*securecookie.SecureCookie)
+		secCookie.MaxAge(86400 * int(cfg.Cookie.LifeSpanDays))
+		secCookie.SetSerializer(securecookie.JSONEncoder{})
+	}
+
 	return &provider{
-		logger:    logger.With(zap.String("package", "cookieoven")),
-		cfg:       cfg,
-		secCookie: securecookie.New([]byte(cfg.Cookie.BlockKey), []byte(cfg.Cookie.BlockKey)),
+		logger:   logger.With(zap.String("package", "cookieoven")),
+		cfg:      cfg,
+		metrics:  metricProvider,
+		codecs:   codecs,
+		hashKeys: hashKeys,
+	}, nil
+}
+
+// validateKey checks the key lengths, the hash key (HMAC-SHA256) is at least 32 bytes
+// and the block key (AES) is 16, 24 or 32 bytes
+func validateKey(key config.CookieKey) error {
+	if len(key.HashKey) < 32 {
+		return fmt.Errorf("hash key is %d bytes, want at least 32", len(key.HashKey))
+	}
+	switch len(key.BlockKey) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("block key is %d bytes, want 16, 24 or 32", len(key.BlockKey))
 	}
+	return nil
 }
 
 // DecodeCookie attempted to decode the incoming cookie
 // be sure and check for valid nil (cookie doesn't exist)
 func (p *provider) DecodedCookie(ctx context.Context, r *http.Request) map[string]string {
-	if cookie, err := r.Cookie(p.cfg.Cookie.Name); err == nil {
+	cookie, err := r.Cookie(p.cfg.Cookie.Name)
+	if err != nil {
+		return nil
+	}
+	for i, codec := range p.codecs {
 		value := make(map[string]string)
-		if err = p.secCookie.Decode(p.cfg.Cookie.Name, cookie.Value, &value); err == nil {
+		if err = codec.Decode(p.cfg.Cookie.Name, cookie.Value, &value); err == nil {
+			if i > 0 {
+				p.logger.For(ctx).Info("cookie decoded with a previous key pair", zap.Int("key_pair", i))
+				p.metrics.StatCookieKeyFallbackCount.Inc()
+			}
 			return value
 		}
 	}
@@ -45,9 +101,7 @@ func (p *provider) DecodedCookie(ctx context.Context, r *http.Request) map[strin
 }
 
 func (p *provider) BakeCookie(ctx context.Context, cookieChan chan *http.Cookie, cookieData map[string]string) {
-	p.secCookie.MaxAge(86400 * int(p.cfg.Cookie.LifeSpanDays))
-	p.secCookie.SetSerializer(securecookie.JSONEncoder{})
-	encodedCookieData, err := p.secCookie.Encode(p.cfg.Cookie.Name, cookieData)
+	encodedCookieData, err := p.codecs[0].Encode(p.cfg.Cookie.Name, cookieData)
 
 	if err != nil {
 		p.logger.For(ctx).Error("failed BakeCookie Encode", zap.Error(err))
@@ -63,8 +117,89 @@ func (p *provider) BakeCookie(ctx context.Context, cookieChan chan *http.Cookie,
 		HttpOnly: true,
 		Domain:   p.cfg.Cookie.Domain,
 		Secure:   true,
+		SameSite: sameSite(p.cfg.Cookie.SameSite),
 	}
 
 	cookieChan <- cookie
 	close(cookieChan)
 }
+
+// sameSite returns the cookie SameSite mode (strict, lax or none), lax when it is not set
+func sameSite(mode string) http.SameSite {
+	switch strings.ToLower(mode) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// CSRFToken returns the session's CSRF token (the HMAC of the session's access token id)
+// the token changes with the session, it does not need to be stored
+func (p *provider) CSRFToken(sessionID string) string {
+	if sessionID == "" {
+		return ""
+	}
+	return csrfToken(p.hashKeys[0], sessionID)
+}
+
+// ValidCSRFToken reports if the token is the session's CSRF token (with the current or a previous hash key)
+func (p *provider) ValidCSRFToken(sessionID, token string) bool {
+	if sessionID == "" {
+		return false
+	}
+	for _, hashKey := range p.hashKeys {
+		if hmac.Equal([]byte(token), []byte(csrfToken(hashKey, sessionID))) {
+			return true
+		}
+	}
+	return false
+}
+
+func csrfToken(hashKey []byte, sessionID string) string {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte("csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CSRFCookie returns the cookie that hands the CSRF token to the page
+// it is readable by the page (not HttpOnly), the page sends it back in the CSRF header
+func (p *provider) CSRFCookie(token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     p.cfg.CSRF.CookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   86400 * int(p.cfg.Cookie.LifeSpanDays),
+		Domain:   p.cfg.Cookie.Domain,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// TokenCookies returns the HttpOnly cookies that hold the tokens in cookie session mode
+// each cookie lives as long as its token (an empty token has no cookie, ex: a refresh only re-issues the access token)
+func (p *provider) TokenCookies(accessToken, refreshToken string) []*http.Cookie {
+	cookies := []*http.Cookie{}
+	if accessToken != "" {
+		cookies = append(cookies, p.tokenCookie(p.cfg.Session.AccessCookieName, accessToken, 60*int(p.cfg.Token.AccessTokenLifeSpanMins)))
+	}
+	if refreshToken != "" {
+		cookies = append(cookies, p.tokenCookie(p.cfg.Session.RefreshCookieName, refreshToken, 60*int(p.cfg.Token.RefreshTokenLifeSpanMins)))
+	}
+	return cookies
+}
+
+func (p *provider) tokenCookie(name, token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Domain:   p.cfg.Cookie.Domain,
+		Secure:   true,
+		SameSite: sameSite(p.cfg.Cookie.SameSite),
+	}
+}
@@ -0,0 +1,191 @@
+package cookieservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	testHashKey  = "something-that-is-32-byte-secret"
+	testBlockKey = "something-else-16-24-or-32secret"
+)
+
+func testConfig(sameSite string) *config.Config {
+	cfg := &config.Config{}
+	cfg.Cookie.Name = "homerow-auth"
+	cfg.Cookie.HashKey = testHashKey
+	cfg.Cookie.BlockKey = testBlockKey
+	cfg.Cookie.LifeSpanDays = 7
+	cfg.Cookie.SameSite = sameSite
+	cfg.CSRF.CookieName = "csrf_token"
+	cfg.Session.AccessCookieName = "homerow-access"
+	cfg.Session.RefreshCookieName = "homerow-refresh"
+	cfg.Token.AccessTokenLifeSpanMins = 15
+	cfg.Token.RefreshTokenLifeSpanMins = 1440
+	return cfg
+}
+
+func newTestProvider(t *testing.T, cfg *config.Config) (Provider, *metrics.Provider) {
+	metricProvider := &metrics.Provider{StatCookieKeyFallbackCount: prometheus.NewCounter(prometheus.CounterOpts{Name: "cookie_key_fallback_total"})}
+	p, err := New(cfg, log.NewNopFactory(), metricProvider)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return p, metricProvider
+}
+
+// bake returns a request with the baked cookie
+func bake(p Provider, cookieData map[string]string) (*http.Cookie, *http.Request) {
+	cookieChan := make(chan *http.Cookie, 1)
+	p.BakeCookie(context.Background(), cookieChan, cookieData)
+	cookie := <-cookieChan
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	return cookie, req
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		hashKey  string
+		blockKey string
+		previous []config.CookieKey
+		wantErr  bool
+	}{
+		{name: "valid", hashKey: testHashKey, blockKey: testBlockKey},
+		{name: "16 byte block key", hashKey: testHashKey, blockKey: "0123456789abcdef"},
+		{name: "short hash key", hashKey: "short", blockKey: testBlockKey, wantErr: true},
+		{name: "bad block key length", hashKey: testHashKey, blockKey: "0123456789", wantErr: true},
+		{name: "bad previous pair", hashKey: testHashKey, blockKey: testBlockKey, previous: []config.CookieKey{{HashKey: testHashKey, BlockKey: ""}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig("lax")
+			cfg.Cookie.HashKey, cfg.Cookie.BlockKey, cfg.Cookie.PreviousKeys = tt.hashKey, tt.blockKey, tt.previous
+			_, err := New(cfg, log.NewNopFactory(), &metrics.Provider{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBakeCookie(t *testing.T) {
+	tests := []struct {
+		sameSite string
+		want     http.SameSite
+	}{
+		{sameSite: "strict", want: http.SameSiteStrictMode},
+		{sameSite: "Lax", want: http.SameSiteLaxMode},
+		{sameSite: "none", want: http.SameSiteNoneMode},
+		{sameSite: "", want: http.SameSiteLaxMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sameSite, func(t *testing.T) {
+			p, _ := newTestProvider(t, testConfig(tt.sameSite))
+			cookie, req := bake(p, map[string]string{"jti-access": "abc"})
+			if cookie.SameSite != tt.want || !cookie.Secure || !cookie.HttpOnly {
+				t.Errorf("cookie = %+v, want SameSite %v, Secure and HttpOnly", cookie, tt.want)
+			}
+			if got := p.DecodedCookie(context.Background(), req); got["jti-access"] != "abc" {
+				t.Errorf("DecodedCookie() = %v", got)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldCfg := testConfig("lax")
+	oldProvider, _ := newTestProvider(t, oldCfg)
+	_, oldReq := bake(oldProvider, map[string]string{"jti-access": "old"})
+
+	// the new pair encodes, the old pair still decodes
+	rotated := testConfig("lax")
+	rotated.Cookie.HashKey = "a-new-hash-key-that-is-32-bytes!"
+	rotated.Cookie.BlockKey = "a-new-block-key-that-is-32-byte!"
+	rotated.Cookie.PreviousKeys = []config.CookieKey{{HashKey: oldCfg.Cookie.HashKey, BlockKey: oldCfg.Cookie.BlockKey}}
+	p, metricProvider := newTestProvider(t, rotated)
+
+	if got := p.DecodedCookie(context.Background(), oldReq); got["jti-access"] != "old" {
+		t.Errorf("DecodedCookie(old cookie) = %v", got)
+	}
+	if fallbacks := testutil.ToFloat64(metricProvider.StatCookieKeyFallbackCount); fallbacks != 1 {
+		t.Errorf("fallback count = %v, want 1", fallbacks)
+	}
+
+	_, newReq := bake(p, map[string]string{"jti-access": "new"})
+	if got := p.DecodedCookie(context.Background(), newReq); got["jti-access"] != "new" {
+		t.Errorf("DecodedCookie(new cookie) = %v", got)
+	}
+	if fallbacks := testutil.ToFloat64(metricProvider.StatCookieKeyFallbackCount); fallbacks != 1 {
+		t.Errorf("fallback count = %v, want 1 (the new cookie uses the current pair)", fallbacks)
+	}
+	// the old key can not read a new cookie
+	if got := oldProvider.DecodedCookie(context.Background(), newReq); got != nil {
+		t.Errorf("old provider DecodedCookie(new cookie) = %v, want nil", got)
+	}
+
+	// a csrf token of the old key is still valid, the page gets the new one on its next GET
+	oldToken := oldProvider.CSRFToken("session-1")
+	if !p.ValidCSRFToken("session-1", oldToken) || p.CSRFToken("session-1") == oldToken {
+		t.Errorf("ValidCSRFToken(old token) = false or the token did not rotate")
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	p, _ := newTestProvider(t, testConfig("lax"))
+	token := p.CSRFToken("session-1")
+	if token == "" || token != p.CSRFToken("session-1") {
+		t.Errorf("CSRFToken() = %q, want a stable token", token)
+	}
+	if p.ValidCSRFToken("session-2", token) || !p.ValidCSRFToken("session-1", token) {
+		t.Errorf("ValidCSRFToken() does not bind the token to the session")
+	}
+	if p.CSRFToken("") != "" || p.ValidCSRFToken("", "") {
+		t.Errorf("a token without a session")
+	}
+
+	cookie := p.CSRFCookie(token)
+	if cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || cookie.Name != "csrf_token" {
+		t.Errorf("CSRFCookie() = %+v, want a readable strict cookie", cookie)
+	}
+}
+
+func TestTokenCookies(t *testing.T) {
+	p, _ := newTestProvider(t, testConfig("strict"))
+
+	cookies := p.TokenCookies("access", "refresh")
+	if len(cookies) != 2 {
+		t.Fatalf("TokenCookies() = %d cookies, want 2", len(cookies))
+	}
+	want := []struct {
+		name   string
+		value  string
+		maxAge int
+	}{
+		{name: "homerow-access", value: "access", maxAge: 900},
+		{name: "homerow-refresh", value: "refresh", maxAge: 86400},
+	}
+	for i, cookie := range cookies {
+		if cookie.Name != want[i].name || cookie.Value != want[i].value || cookie.MaxAge != want[i].maxAge {
+			t.Errorf("TokenCookies()[%d] = %+v, want %+v", i, cookie, want[i])
+		}
+		if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+			t.Errorf("TokenCookies()[%d] = %+v, want an HttpOnly, Secure and strict cookie", i, cookie)
+		}
+	}
+
+	// a refresh only replaces the access token cookie
+	if cookies = p.TokenCookies("access", ""); len(cookies) != 1 || cookies[0].Name != "homerow-access" {
+		t.Errorf("TokenCookies(access only) = %+v", cookies)
+	}
+}
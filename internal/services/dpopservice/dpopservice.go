@@ -0,0 +1,160 @@
+package dpopservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/pkg/helpers/jwkhelpers"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.uber.org/zap"
+)
+
+// ProofType is the typ header of a DPoP proof
+const ProofType = "dpop+jwt"
+
+// Provider is the DPoP (RFC 9449) proof verifier
+// Verify checks the proof of a request and returns the thumbprint (jkt) of the proof's key,
+// the key the tokens issued to the request are bound to (the access token cnf.jkt claim)
+type Provider interface {
+	Verify(ctx context.Context, proof, method, uri, accessToken string) (string, error)
+}
+
+// Cache is the subset of redis.Provider the dpop provider uses (the proof jti cache)
+type Cache interface {
+	Incr(ctx context.Context, key string, exp time.Duration) (int64, error)
+}
+
+type provider struct {
+	logger log.Factory
+	cfg    *config.Config
+	redis  Cache
+	now    func() time.Time
+}
+
+// New returns a new DPoP Provider
+func New(cfg *config.Config, logger log.Factory, redisClient Cache) Provider {
+	return &provider{
+		logger: logger.With(zap.String("package", "dpopservice")),
+		cfg:    cfg,
+		redis:  redisClient,
+		now:    time.Now,
+	}
+}
+
+// proofClaims are the DPoP proof claims (RFC 9449 4.2)
+type proofClaims struct {
+	ID       string `json:"jti"`
+	Method   string `json:"htm"`
+	URI      string `json:"htu"`
+	IssuedAt int64  `json:"iat"`
+	// AccessTokenHash is the hash of the access token sent with the proof
+	AccessTokenHash string `json:"ath,omitempty"`
+}
+
+// Valid is checked by Verify (the proof times need the provider's clock and config)
+func (c *proofClaims) Valid() error {
+	return nil
+}
+
+func invalidProof(format string, a ...interface{}) error {
+	return &errors.RestError{Code: http.StatusUnauthorized, Message: "invalid dpop proof: " + fmt.Sprintf(format, a...)}
+}
+
+// Verify checks the proof's header (typ, an asymmetric alg and a public jwk), signature, htm, htu, iat and jti
+// accessToken is the token sent with the proof, its hash must be the proof's ath ("" when there is none, ex: a login)
+// a jti is only accepted once (a replayed proof is rejected)
+func (p *provider) Verify(ctx context.Context, proof, method, uri, accessToken string) (string, error) {
+	var jkt string
+	claims := &proofClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); !strings.EqualFold(typ, ProofType) {
+			return nil, fmt.Errorf("unexpected typ %q", typ)
+		}
+		// asymmetric algorithms only (never none or an HMAC keyed with the public key)
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing algorithm %v", token.Header["alg"])
+		}
+		header, ok := token.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("missing jwk")
+		}
+		if _, private := header["d"]; private {
+			return nil, fmt.Errorf("jwk is a private key")
+		}
+		jwk, err := jwkhelpers.FromMap(header)
+		if err != nil {
+			return nil, err
+		}
+		if jkt, err = jwk.Thumbprint(); err != nil {
+			return nil, err
+		}
+		return jwk.PublicKey()
+	})
+	if err != nil {
+		p.logger.For(ctx).Error("invalid dpop proof", zap.Error(err))
+		return "", invalidProof("%v", err)
+	}
+
+	if claims.ID == "" {
+		return "", invalidProof("missing jti")
+	}
+	if claims.Method != method {
+		return "", invalidProof("htm %q does not match the request method", claims.Method)
+	}
+	if !sameURI(claims.URI, uri) {
+		return "", invalidProof("htu %q does not match the request uri", claims.URI)
+	}
+	lifeSpan := time.Duration(p.cfg.DPoP.ProofLifeSpanSecs) * time.Second
+	skew := time.Duration(p.cfg.DPoP.ClockSkewSecs) * time.Second
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if now := p.now(); claims.IssuedAt == 0 || issuedAt.Before(now.Add(-lifeSpan-skew)) || issuedAt.After(now.Add(skew)) {
+		return "", invalidProof("iat is outside the acceptance window")
+	}
+	if accessToken != "" && claims.AccessTokenHash != AccessTokenHash(accessToken) {
+		return "", invalidProof("ath does not match the access token")
+	}
+
+	// the jti is remembered while the proof could still be accepted
+	uses, err := p.redis.Incr(ctx, fmt.Sprintf("%v-%v-%v", p.cfg.DPoP.CacheKeyID, jkt, claims.ID), lifeSpan+2*skew)
+	if err != nil {
+		p.logger.For(ctx).Error("failed dpop jti cache", zap.Error(err))
+		return "", errors.ErrorWrapper(err, "DPoPService.Verify.Incr")
+	}
+	if uses > 1 {
+		p.logger.For(ctx).Error("dpop proof replayed", zap.String("jkt", jkt), zap.String("jti", claims.ID))
+		return "", invalidProof("jti has been used")
+	}
+	return jkt, nil
+}
+
+// AccessTokenHash is the proof's ath of the access token (base64url SHA-256)
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// sameURI compares the htu to the request uri without the query and fragment (RFC 9449 4.3),
+// the scheme and host are case insensitive
+func sameURI(htu, uri string) bool {
+	a, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	b, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host) && a.Path == b.Path
+}
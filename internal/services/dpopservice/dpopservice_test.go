@@ -0,0 +1,135 @@
+package dpopservice
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+	"github.com/tjsampson/token-svc/pkg/helpers/jwkhelpers"
+
+	"github.com/dgrijalva/jwt-go"
+	gopkgerrors "github.com/pkg/errors"
+)
+
+const testURI = "https://api.homerow.tech/me"
+
+func newTestProvider(now time.Time) (*provider, *testhelper.Redis) {
+	cfg := &config.Config{}
+	cfg.DPoP.Enabled = true
+	cfg.DPoP.CacheKeyID = "dpop-jti"
+	cfg.DPoP.ProofLifeSpanSecs = 300
+	cfg.DPoP.ClockSkewSecs = 30
+	redisClient := testhelper.NewRedis()
+	p := New(cfg, log.NewNopFactory(), redisClient).(*provider)
+	p.now = func() time.Time { return now }
+	return p, redisClient
+}
+
+// proof signs the proof claims with the key, the header has the key's public jwk
+func proof(t *testing.T, key *ecdsa.PrivateKey, method jwt.SigningMethod, header map[string]interface{}, claims jwt.MapClaims) string {
+	jwk, err := jwkhelpers.FromPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["typ"] = ProofType
+	token.Header["jwk"] = map[string]interface{}{"kty": jwk.Kty, "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y}
+	for name, value := range header {
+		token.Header[name] = value
+	}
+	var signKey interface{} = key
+	if method == jwt.SigningMethodHS256 {
+		signKey = []byte(jwk.X)
+	}
+	signed, err := token.SignedString(signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := jwkhelpers.FromPublicKey(&key.PublicKey)
+	wantJKT, _ := jwk.Thumbprint()
+	now := time.Now()
+
+	claims := func(edit func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{"jti": "proof-1", "htm": http.MethodGet, "htu": testURI, "iat": now.Unix(), "ath": AccessTokenHash("access-token")}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name        string
+		proof       string
+		accessToken string
+		wantErr     bool
+	}{
+		{name: "valid", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(nil)), accessToken: "access-token"},
+		{name: "login (no access token)", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(func(c jwt.MapClaims) { delete(c, "ath") }))},
+		{name: "query is ignored", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(func(c jwt.MapClaims) { c["htu"] = "HTTPS://api.homerow.tech/me?x=1" })), accessToken: "access-token"},
+		{name: "wrong method", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(func(c jwt.MapClaims) { c["htm"] = http.MethodPost })), accessToken: "access-token", wantErr: true},
+		{name: "wrong uri", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(func(c jwt.MapClaims) { c["htu"] = "https://api.homerow.tech/admin" })), accessToken: "access-token", wantErr: true},
+		{name: "expired", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(func(c jwt.MapClaims) { c["iat"] = now.Add(-6 * time.Minute).Unix() })), accessToken: "access-token", wantErr: true},
+		{name: "issued in the future", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(func(c jwt.MapClaims) { c["iat"] = now.Add(time.Minute).Unix() })), accessToken: "access-token", wantErr: true},
+		{name: "missing jti", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(func(c jwt.MapClaims) { delete(c, "jti") })), accessToken: "access-token", wantErr: true},
+		{name: "another access token", proof: proof(t, key, jwt.SigningMethodES256, nil, claims(nil)), accessToken: "stolen-token", wantErr: true},
+		{name: "wrong typ", proof: proof(t, key, jwt.SigningMethodES256, map[string]interface{}{"typ": "JWT"}, claims(nil)), accessToken: "access-token", wantErr: true},
+		{name: "hmac", proof: proof(t, key, jwt.SigningMethodHS256, nil, claims(nil)), accessToken: "access-token", wantErr: true},
+		{name: "private jwk", proof: proof(t, key, jwt.SigningMethodES256, map[string]interface{}{"jwk": map[string]interface{}{"kty": "EC", "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y, "d": "secret"}}, claims(nil)), accessToken: "access-token", wantErr: true},
+		{name: "signed by another key", proof: proof(t, otherKey, jwt.SigningMethodES256, map[string]interface{}{"jwk": map[string]interface{}{"kty": "EC", "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y}}, claims(nil)), accessToken: "access-token", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestProvider(now)
+			jkt, err := p.Verify(context.Background(), tt.proof, http.MethodGet, testURI, tt.accessToken)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if rerr, ok := gopkgerrors.Cause(err).(*errors.RestError); !ok || rerr.Code != http.StatusUnauthorized {
+					t.Errorf("Verify() error = %v, want a 401", err)
+				}
+				return
+			}
+			if jkt != wantJKT {
+				t.Errorf("Verify() = %v, want %v", jkt, wantJKT)
+			}
+		})
+	}
+}
+
+func TestVerify_Replay(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now()
+	p, redisClient := newTestProvider(now)
+	signed := proof(t, key, jwt.SigningMethodES256, nil, jwt.MapClaims{"jti": "proof-1", "htm": http.MethodPost, "htu": testURI, "iat": now.Unix()})
+
+	if _, err := p.Verify(context.Background(), signed, http.MethodPost, testURI, ""); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if _, err := p.Verify(context.Background(), signed, http.MethodPost, testURI, ""); err == nil {
+		t.Errorf("Verify(replayed proof) error = nil, want an error")
+	}
+
+	// the replay check fails closed
+	redisClient.Down = true
+	fresh := proof(t, key, jwt.SigningMethodES256, nil, jwt.MapClaims{"jti": "proof-2", "htm": http.MethodPost, "htu": testURI, "iat": now.Unix()})
+	if _, err := p.Verify(context.Background(), fresh, http.MethodPost, testURI, ""); err == nil {
+		t.Errorf("Verify(redis down) error = nil, want an error")
+	}
+}
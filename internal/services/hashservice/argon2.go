@@ -0,0 +1,125 @@
+package hashservice
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// argon2MinSaltLength is the shortest argon2id salt accepted
+	argon2MinSaltLength = 16
+	// argon2MinKeyLength is the shortest argon2id key accepted (an empty key matches any password)
+	argon2MinKeyLength = 16
+)
+
+// argon2idHasher produces PHC formatted argon2id hashes
+// ex: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  uint32
+	keyLength   uint32
+	// maxMemory bounds the memory (KiB) of the hashes it verifies, a hash can not make a login allocate more
+	maxMemory uint32
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (h *argon2idHasher) hash(password string) (string, error) {
+	salt := make([]byte, h.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, h.keyLength)
+
+	return fmt.Sprintf(
+		"$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		Argon2id,
+		argon2.Version,
+		h.memory,
+		h.iterations,
+		h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *argon2idHasher) verify(encodedHash, password string) (bool, error) {
+	params, err := decodeArgon2id(encodedHash, h.maxMemory)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (h *argon2idHasher) weakerThan(encodedHash string) bool {
+	params, err := decodeArgon2id(encodedHash, h.maxMemory)
+	if err != nil {
+		return true
+	}
+	return params.memory < h.memory ||
+		params.iterations < h.iterations ||
+		params.parallelism < h.parallelism ||
+		uint32(len(params.key)) < h.keyLength
+}
+
+// decodeArgon2id parses the PHC string, the params must be usable:
+// t and p at least 1, m at most maxMemory KiB, and the salt and key at least 16 bytes
+func decodeArgon2id(encodedHash string, maxMemory uint32) (argon2idParams, error) {
+	params := argon2idParams{}
+
+	// ["", "argon2id", "v=19", "m=65536,t=3,p=2", "<salt>", "<hash>"]
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return params, fmt.Errorf("invalid argon2id hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, fmt.Errorf("invalid argon2id version: %v", err)
+	}
+	if version != argon2.Version {
+		return params, fmt.Errorf("incompatible argon2id version: %d", version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, fmt.Errorf("invalid argon2id params: %v", err)
+	}
+	if params.iterations < 1 || params.parallelism < 1 {
+		return params, fmt.Errorf("invalid argon2id params: t and p must be at least 1")
+	}
+	if params.memory > maxMemory {
+		return params, fmt.Errorf("invalid argon2id params: m above the %d KiB maximum", maxMemory)
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if len(params.salt) < argon2MinSaltLength {
+		return params, fmt.Errorf("invalid argon2id salt: shorter than %d bytes", argon2MinSaltLength)
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, fmt.Errorf("invalid argon2id key: %v", err)
+	}
+	if len(params.key) < argon2MinKeyLength {
+		return params, fmt.Errorf("invalid argon2id key: shorter than %d bytes", argon2MinKeyLength)
+	}
+	return params, nil
+}
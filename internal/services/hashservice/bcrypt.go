@@ -0,0 +1,35 @@
+package hashservice
+
+import (
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptHasher produces bcrypt hashes in their native modular crypt format
+// ex: $2a$12$<salt+hash>
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) hash(password string) (string, error) {
+	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashBytes), nil
+}
+
+func (h *bcryptHasher) verify(encodedHash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) weakerThan(encodedHash string) bool {
+	cost, err := bcrypt.Cost([]byte(encodedHash))
+	if err != nil {
+		return true
+	}
+	return cost < h.cost
+}
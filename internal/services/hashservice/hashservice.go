@@ -0,0 +1,153 @@
+package hashservice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Argon2id is the argon2id PHC algorithm identifier
+	Argon2id = "argon2id"
+	// Bcrypt is the bcrypt algorithm identifier
+	Bcrypt = "bcrypt"
+	// PBKDF2SHA256 is the legacy (verify only) pbkdf2-sha256 algorithm identifier
+	PBKDF2SHA256 = "pbkdf2-sha256"
+	// SaltedSHA1 is the legacy (verify only) salted sha1 algorithm identifier
+	SaltedSHA1 = "sha1-salted"
+)
+
+// currentAlgorithms are the algorithms that can be used to create new hashes
+var currentAlgorithms = map[string]bool{
+	Argon2id: true,
+	Bcrypt:   true,
+}
+
+// Provider is the password hashing provider interface
+// hashes are self-describing (PHC string format) so the provider
+// can verify any hash it knows about regardless of the current algorithm
+type Provider interface {
+	Hash(ctx context.Context, password string) (string, error)
+	Verify(ctx context.Context, encodedHash, password string) (bool, error)
+	NeedsRehash(ctx context.Context, encodedHash string) bool
+}
+
+// hasher is implemented by each supported password hashing algorithm
+type hasher interface {
+	// hash returns the encoded (self-describing) hash of the password
+	hash(password string) (string, error)
+	// verify compares the password against the encoded hash
+	verify(encodedHash, password string) (bool, error)
+	// weakerThan reports if the encoded hash uses weaker params than the hasher
+	weakerThan(encodedHash string) bool
+}
+
+type provider struct {
+	logger    log.Factory
+	cfg       *config.Config
+	algorithm string
+	hashers   map[string]hasher
+}
+
+// New returns a new password hashing Provider
+// the configured algorithm is used for all new hashes
+func New(cfg *config.Config, logger log.Factory) (Provider, error) {
+	hashers := map[string]hasher{
+		Argon2id: &argon2idHasher{
+			memory:      cfg.Password.Argon2MemoryKiB,
+			iterations:  cfg.Password.Argon2Iterations,
+			parallelism: cfg.Password.Argon2Parallelism,
+			saltLength:  cfg.Password.Argon2SaltLength,
+			keyLength:   cfg.Password.Argon2KeyLength,
+			maxMemory:   cfg.Password.Argon2MaxMemoryKiB,
+		},
+		Bcrypt:       &bcryptHasher{cost: cfg.Password.BcryptCost},
+		PBKDF2SHA256: &pbkdf2SHA256Hasher{},
+		SaltedSHA1:   &saltedSHA1Hasher{},
+	}
+
+	if !currentAlgorithms[cfg.Password.Algorithm] {
+		return nil, fmt.Errorf("unsupported password algorithm: %q", cfg.Password.Algorithm)
+	}
+	if cfg.Password.Argon2MemoryKiB > cfg.Password.Argon2MaxMemoryKiB {
+		return nil, fmt.Errorf("argon2 memory %d KiB is above the %d KiB maximum", cfg.Password.Argon2MemoryKiB, cfg.Password.Argon2MaxMemoryKiB)
+	}
+
+	return &provider{
+		logger:    logger.With(zap.String("package", "hashservice")),
+		cfg:       cfg,
+		algorithm: cfg.Password.Algorithm,
+		hashers:   hashers,
+	}, nil
+}
+
+// Validate fully parses the encoded hash with the algorithm it is tagged with (within the configured argon2 limits)
+// used to vet hashes before they are imported, a hash that fails here could never be verified (or could match any password)
+func Validate(cfg *config.Config, encodedHash string) error {
+	var err error
+	switch algorithmOf(encodedHash) {
+	case Argon2id:
+		_, err = decodeArgon2id(encodedHash, cfg.Password.Argon2MaxMemoryKiB)
+	case Bcrypt:
+		_, err = bcrypt.Cost([]byte(encodedHash))
+	case PBKDF2SHA256:
+		_, err = decodePBKDF2SHA256(encodedHash)
+	case SaltedSHA1:
+		_, _, err = decodeSaltedSHA1(encodedHash)
+	default:
+		// the value is not echoed back, it could be a plaintext password
+		err = fmt.Errorf("unsupported password hash algorithm")
+	}
+	return err
+}
+
+// algorithmOf returns the algorithm identifier encoded in the hash
+// bcrypt hashes use the modular crypt prefixes ($2a$, $2b$, $2y$)
+func algorithmOf(encodedHash string) string {
+	parts := strings.SplitN(encodedHash, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	switch parts[1] {
+	case "2a", "2b", "2y":
+		return Bcrypt
+	default:
+		return parts[1]
+	}
+}
+
+// Hash hashes the password with the configured algorithm
+func (p *provider) Hash(ctx context.Context, password string) (string, error) {
+	p.logger.For(ctx).Info("entering hashservice.Hash", zap.String("algorithm", p.algorithm))
+	defer p.logger.For(ctx).Info("leaving hashservice.Hash", zap.String("algorithm", p.algorithm))
+	return p.hashers[p.algorithm].hash(password)
+}
+
+// Verify checks the password against the encoded hash
+// using whichever algorithm the hash was created with
+func (p *provider) Verify(ctx context.Context, encodedHash, password string) (bool, error) {
+	algorithm := algorithmOf(encodedHash)
+	p.logger.For(ctx).Info("entering hashservice.Verify", zap.String("algorithm", algorithm))
+	defer p.logger.For(ctx).Info("leaving hashservice.Verify", zap.String("algorithm", algorithm))
+
+	h, ok := p.hashers[algorithm]
+	if !ok {
+		return false, fmt.Errorf("unknown password hash algorithm: %q", algorithm)
+	}
+	return h.verify(encodedHash, password)
+}
+
+// NeedsRehash reports if the encoded hash should be upgraded
+// this is true when the hash uses a different algorithm or weaker params than configured
+func (p *provider) NeedsRehash(ctx context.Context, encodedHash string) bool {
+	if algorithmOf(encodedHash) != p.algorithm {
+		return true
+	}
+	return p.hashers[p.algorithm].weakerThan(encodedHash)
+}
@@ -0,0 +1,235 @@
+package hashservice
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const testPassword = "correct-horse-battery-staple"
+
+func stubConfig(algorithm string) *config.Config {
+	cfg := &config.Config{}
+	cfg.Password.Algorithm = algorithm
+	cfg.Password.BcryptCost = 4
+	cfg.Password.Argon2MemoryKiB = 1024
+	cfg.Password.Argon2MaxMemoryKiB = 4096
+	cfg.Password.Argon2Iterations = 1
+	cfg.Password.Argon2Parallelism = 1
+	cfg.Password.Argon2SaltLength = 16
+	cfg.Password.Argon2KeyLength = 32
+	return cfg
+}
+
+func stubProvider(t *testing.T, cfg *config.Config) Provider {
+	p, err := New(cfg, log.NewNopFactory())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return p
+}
+
+func TestNew_UnsupportedAlgorithm(t *testing.T) {
+	if _, err := New(stubConfig("md5"), log.NewNopFactory()); err == nil {
+		t.Errorf("New() expected error for unsupported algorithm")
+	}
+}
+
+func TestNew_Argon2MemoryAboveMax(t *testing.T) {
+	cfg := stubConfig(Argon2id)
+	cfg.Password.Argon2MemoryKiB = cfg.Password.Argon2MaxMemoryKiB + 1
+	if _, err := New(cfg, log.NewNopFactory()); err == nil {
+		t.Errorf("New() expected error for argon2 memory above the maximum")
+	}
+}
+
+func Test_provider_HashVerify(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		prefix    string
+	}{
+		{"argon2id", Argon2id, "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{"bcrypt", Bcrypt, "$2a$04$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p := stubProvider(t, stubConfig(tt.algorithm))
+
+			encoded, err := p.Hash(ctx, testPassword)
+			if err != nil {
+				t.Fatalf("Hash() error = %v", err)
+			}
+			if !strings.HasPrefix(encoded, tt.prefix) {
+				t.Errorf("Hash() = %v, want prefix %v", encoded, tt.prefix)
+			}
+			if ok, err := p.Verify(ctx, encoded, testPassword); !ok || err != nil {
+				t.Errorf("Verify() = %v, %v, want true, nil", ok, err)
+			}
+			if ok, _ := p.Verify(ctx, encoded, "wrong-password"); ok {
+				t.Errorf("Verify() = true for wrong password")
+			}
+			if p.NeedsRehash(ctx, encoded) {
+				t.Errorf("NeedsRehash() = true for freshly hashed password")
+			}
+		})
+	}
+}
+
+func Test_provider_NeedsRehash(t *testing.T) {
+	ctx := context.Background()
+
+	bcryptHash, _ := stubProvider(t, stubConfig(Bcrypt)).Hash(ctx, testPassword)
+	argonHash, _ := stubProvider(t, stubConfig(Argon2id)).Hash(ctx, testPassword)
+
+	strongBcryptCfg := stubConfig(Bcrypt)
+	strongBcryptCfg.Password.BcryptCost = 5
+
+	strongArgonCfg := stubConfig(Argon2id)
+	strongArgonCfg.Password.Argon2MemoryKiB = 2048
+
+	tests := []struct {
+		name string
+		cfg  *config.Config
+		hash string
+		want bool
+	}{
+		{"bcrypt to argon2id", stubConfig(Argon2id), bcryptHash, true},
+		{"argon2id to bcrypt", stubConfig(Bcrypt), argonHash, true},
+		{"bcrypt same cost", stubConfig(Bcrypt), bcryptHash, false},
+		{"argon2id same params", stubConfig(Argon2id), argonHash, false},
+		{"bcrypt higher cost", strongBcryptCfg, bcryptHash, true},
+		{"argon2id more memory", strongArgonCfg, argonHash, true},
+		{"unknown hash", stubConfig(Argon2id), "plaintext-is-not-a-hash", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stubProvider(t, tt.cfg).NeedsRehash(ctx, tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_provider_VerifyLegacy(t *testing.T) {
+	ctx := context.Background()
+	salt := []byte("legacy-salt")
+
+	pbkdf2Hash := fmt.Sprintf("$%s$i=%d$%s$%s",
+		PBKDF2SHA256,
+		1000,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(pbkdf2.Key([]byte(testPassword), salt, 1000, 32, sha256.New)))
+
+	sha1Digest := sha1.Sum([]byte(string(salt) + testPassword))
+	sha1Hash := fmt.Sprintf("$%s$%s$%s", SaltedSHA1, salt, hex.EncodeToString(sha1Digest[:]))
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+		wantErr  bool
+	}{
+		{"pbkdf2-sha256 match", pbkdf2Hash, testPassword, true, false},
+		{"pbkdf2-sha256 mismatch", pbkdf2Hash, "wrong-password", false, false},
+		{"pbkdf2-sha256 malformed", "$pbkdf2-sha256$i=x$salt$hash", testPassword, false, true},
+		{"pbkdf2-sha256 empty key", "$pbkdf2-sha256$i=1$c2FsdHNhbHQ$", "any-password", false, true},
+		{"sha1-salted match", sha1Hash, testPassword, true, false},
+		{"sha1-salted mismatch", sha1Hash, "wrong-password", false, false},
+		{"sha1-salted malformed", "$sha1-salted$salt$zz", testPassword, false, true},
+		{"unknown algorithm", "$md5$salt$hash", testPassword, false, true},
+	}
+	p := stubProvider(t, stubConfig(Argon2id))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Verify(ctx, tt.hash, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+			if !p.NeedsRehash(ctx, tt.hash) {
+				t.Errorf("NeedsRehash() = false for legacy hash")
+			}
+		})
+	}
+}
+
+func TestNew_LegacyAlgorithm(t *testing.T) {
+	for _, algorithm := range []string{PBKDF2SHA256, SaltedSHA1} {
+		if _, err := New(stubConfig(algorithm), log.NewNopFactory()); err == nil {
+			t.Errorf("New() expected error for legacy algorithm %s", algorithm)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	salt16 := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key32 := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{"argon2id", "$argon2id$v=19$m=1024,t=1,p=1$" + salt16 + "$" + key32, false},
+		{"argon2id bad salt", "$argon2id$v=19$m=1024,t=1,p=1$!!$" + key32, true},
+		{"bcrypt", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", false},
+		{"bcrypt truncated", "$2a$10$abcdefghijklmnopqrstuv", true},
+		{"pbkdf2-sha256", "$pbkdf2-sha256$i=1000$" + salt16 + "$" + key32, false},
+		{"pbkdf2-sha256 empty key", "$pbkdf2-sha256$i=1$c2FsdHNhbHQ$", true},
+		{"pbkdf2-sha256 short key", "$pbkdf2-sha256$i=1000$" + salt16 + "$aGFzaA", true},
+		{"pbkdf2-sha256 short salt", "$pbkdf2-sha256$i=1000$c2FsdA$" + key32, true},
+		{"sha1-salted", "$sha1-salted$salt$2fd4e1c67a2d28fced849ee1bb76e7391b93eb12", false},
+		{"sha1-salted short digest", "$sha1-salted$salt$0000", true},
+		{"sha1-salted empty salt", "$sha1-salted$$2fd4e1c67a2d28fced849ee1bb76e7391b93eb12", true},
+		{"unknown algorithm", "$md5$salt$hash", true},
+		{"plaintext", "plaintext", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(stubConfig(Argon2id), tt.hash); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_decodeArgon2id(t *testing.T) {
+	salt16 := base64.RawStdEncoding.EncodeToString(make([]byte, 16))
+	key16 := base64.RawStdEncoding.EncodeToString(make([]byte, 16))
+	short := base64.RawStdEncoding.EncodeToString(make([]byte, 15))
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{"valid", "$argon2id$v=19$m=4096,t=1,p=1$" + salt16 + "$" + key16, false},
+		{"zero iterations", "$argon2id$v=19$m=1024,t=0,p=1$" + salt16 + "$" + key16, true},
+		{"zero parallelism", "$argon2id$v=19$m=1024,t=1,p=0$" + salt16 + "$" + key16, true},
+		{"memory above the maximum", "$argon2id$v=19$m=4097,t=1,p=1$" + salt16 + "$" + key16, true},
+		{"short salt", "$argon2id$v=19$m=1024,t=1,p=1$" + short + "$" + key16, true},
+		{"short key", "$argon2id$v=19$m=1024,t=1,p=1$" + salt16 + "$" + short, true},
+		{"empty key", "$argon2id$v=19$m=1024,t=1,p=1$" + salt16 + "$", true},
+		{"wrong version", "$argon2id$v=16$m=1024,t=1,p=1$" + salt16 + "$" + key16, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeArgon2id(tt.hash, 4096); (err != nil) != tt.wantErr {
+				t.Errorf("decodeArgon2id() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package hashservice
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// errLegacyHash is returned when attempting to create a new legacy hash
+// legacy hashers are verify-only, they exist to migrate imported users
+var errLegacyHash = fmt.Errorf("legacy password algorithms are verify only")
+
+const (
+	// pbkdf2MinKeyLength is the shortest pbkdf2-sha256 key accepted (an empty key matches any password)
+	pbkdf2MinKeyLength = 16
+	// pbkdf2MinSaltLength is the shortest pbkdf2-sha256 salt accepted
+	pbkdf2MinSaltLength = 8
+)
+
+// pbkdf2SHA256Hasher verifies imported PBKDF2-SHA256 hashes
+// ex: $pbkdf2-sha256$i=29000$<salt>$<hash>
+type pbkdf2SHA256Hasher struct{}
+
+func (h *pbkdf2SHA256Hasher) hash(password string) (string, error) {
+	return "", errLegacyHash
+}
+
+func (h *pbkdf2SHA256Hasher) verify(encodedHash, password string) (bool, error) {
+	params, err := decodePBKDF2SHA256(encodedHash)
+	if err != nil {
+		return false, err
+	}
+
+	derived := pbkdf2.Key([]byte(password), params.salt, params.iterations, len(params.key), sha256.New)
+	return subtle.ConstantTimeCompare(derived, params.key) == 1, nil
+}
+
+func (h *pbkdf2SHA256Hasher) weakerThan(encodedHash string) bool {
+	return true
+}
+
+type pbkdf2SHA256Params struct {
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+func decodePBKDF2SHA256(encodedHash string) (pbkdf2SHA256Params, error) {
+	params := pbkdf2SHA256Params{}
+
+	// ["", "pbkdf2-sha256", "i=29000", "<salt>", "<hash>"]
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 5 || parts[1] != PBKDF2SHA256 {
+		return params, fmt.Errorf("invalid pbkdf2-sha256 hash format")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "i=%d", &params.iterations); err != nil || params.iterations <= 0 {
+		return params, fmt.Errorf("invalid pbkdf2-sha256 iterations")
+	}
+
+	var err error
+	if params.salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return params, fmt.Errorf("invalid pbkdf2-sha256 salt: %v", err)
+	}
+	if len(params.salt) < pbkdf2MinSaltLength {
+		return params, fmt.Errorf("invalid pbkdf2-sha256 salt: shorter than %d bytes", pbkdf2MinSaltLength)
+	}
+	if params.key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, fmt.Errorf("invalid pbkdf2-sha256 key: %v", err)
+	}
+	if len(params.key) < pbkdf2MinKeyLength {
+		return params, fmt.Errorf("invalid pbkdf2-sha256 key: shorter than %d bytes", pbkdf2MinKeyLength)
+	}
+	return params, nil
+}
+
+// saltedSHA1Hasher verifies imported salted SHA-1 hashes, sha1(salt + password)
+// ex: $sha1-salted$<salt>$<hex digest>
+type saltedSHA1Hasher struct{}
+
+func (h *saltedSHA1Hasher) hash(password string) (string, error) {
+	return "", errLegacyHash
+}
+
+func (h *saltedSHA1Hasher) verify(encodedHash, password string) (bool, error) {
+	salt, digest, err := decodeSaltedSHA1(encodedHash)
+	if err != nil {
+		return false, err
+	}
+
+	derived := sha1.Sum([]byte(salt + password))
+	return subtle.ConstantTimeCompare(derived[:], digest) == 1, nil
+}
+
+func (h *saltedSHA1Hasher) weakerThan(encodedHash string) bool {
+	return true
+}
+
+func decodeSaltedSHA1(encodedHash string) (string, []byte, error) {
+	// ["", "sha1-salted", "<salt>", "<hex digest>"]
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 4 || parts[1] != SaltedSHA1 {
+		return "", nil, fmt.Errorf("invalid sha1-salted hash format")
+	}
+	if parts[2] == "" {
+		return "", nil, fmt.Errorf("invalid sha1-salted salt")
+	}
+
+	digest, err := hex.DecodeString(parts[3])
+	if err != nil || len(digest) != sha1.Size {
+		return "", nil, fmt.Errorf("invalid sha1-salted digest")
+	}
+	return parts[2], digest, nil
+}
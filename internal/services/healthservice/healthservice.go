@@ -5,7 +5,6 @@ import (
 	"runtime"
 	"time"
 
-	"github.com/tjsampson/token-svc/internal/datastores/redis"
 	"github.com/tjsampson/token-svc/internal/errors"
 	"github.com/tjsampson/token-svc/internal/log"
 	"github.com/tjsampson/token-svc/internal/models/healthmodels"
@@ -30,7 +29,7 @@ type Service interface {
 // New returns a new healthRepo store
 func New(
 	healthRepo healthrepo.Store,
-	redisClient redis.Provider,
+	redisClient Cache,
 	versionInfo version.Info,
 	metricProvider *metrics.Provider,
 	logger log.Factory) Service {
@@ -45,10 +44,15 @@ func New(
 
 }
 
+// Cache is the subset of redis.Provider the health service uses
+type Cache interface {
+	Ping(ctx context.Context) (string, error)
+}
+
 type service struct {
 	logger         log.Factory
 	repo           healthrepo.Store
-	redisClient    redis.Provider
+	redisClient    Cache
 	versionInfo    version.Info
 	metricProvider *metrics.Provider
 }
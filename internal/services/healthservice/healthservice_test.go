@@ -45,7 +45,7 @@ func MockHealthRepo() healthrepo.Store {
 	return &mockHealthRepo{}
 }
 
-func MockRedisClient() redis.Provider {
+func MockRedisClient() Cache {
 	return &mockRedisClient{}
 }
 
@@ -0,0 +1,139 @@
+package importservice
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/services/hashservice"
+
+	"go.uber.org/zap"
+)
+
+// Service is the bulk user import service interface
+// it only ever handles pre-hashed passwords (never plaintext)
+type Service interface {
+	Import(ctx context.Context, records []usermodels.ImportRecord, dryRun bool) (usermodels.ImportResult, error)
+}
+
+type service struct {
+	cfg      *config.Config
+	logger   log.Factory
+	userRepo userrepo.Store
+}
+
+// New returns a new Service interface implementation
+func New(cfg *config.Config, logger log.Factory, usrRepo userrepo.Store) Service {
+	return &service{
+		cfg:      cfg,
+		logger:   logger.With(zap.String("package", "importservice")),
+		userRepo: usrRepo,
+	}
+}
+
+// Import loads the records into the users table
+// invalid records are reported in the result and do not stop the import
+func (svc *service) Import(ctx context.Context, records []usermodels.ImportRecord, dryRun bool) (usermodels.ImportResult, error) {
+	svc.logger.For(ctx).Info("entering importservice.Import", zap.Int("records", len(records)), zap.Bool("dry_run", dryRun))
+	result := usermodels.ImportResult{Failed: []string{}}
+
+	for i, record := range records {
+		record.Email = strings.TrimSpace(record.Email)
+		if record.Email == "" {
+			result.Failed = append(result.Failed, fmt.Sprintf("record %d: missing email", i+1))
+			continue
+		}
+		if err := hashservice.Validate(svc.cfg, record.PasswordHash); err != nil {
+			result.Failed = append(result.Failed, fmt.Sprintf("record %d (%s): invalid password hash: %v", i+1, record.Email, err))
+			continue
+		}
+		if dryRun {
+			result.Imported++
+			continue
+		}
+
+		inserted, err := svc.userRepo.Import(ctx, record, outboxmodels.Event{
+			Type: outboxmodels.EventUserImported,
+			Data: map[string]interface{}{"email": record.Email, "email_verified": record.EmailVerified},
+		})
+		if err != nil {
+			svc.logger.For(ctx).Error("failed importservice.Import", zap.Error(err), zap.String("email", record.Email))
+			result.Failed = append(result.Failed, fmt.Sprintf("record %d (%s): %v", i+1, record.Email, err))
+			continue
+		}
+		if inserted {
+			result.Imported++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	svc.logger.For(ctx).Info("leaving importservice.Import",
+		zap.Int("imported", result.Imported),
+		zap.Int("skipped", result.Skipped),
+		zap.Int("failed", len(result.Failed)))
+	return result, nil
+}
+
+// ReadJSON reads a JSON array of import records
+func ReadJSON(r io.Reader) ([]usermodels.ImportRecord, error) {
+	records := []usermodels.ImportRecord{}
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, fmt.Errorf("invalid json import: %v", err)
+	}
+	return records, nil
+}
+
+// ReadCSV reads import records from a CSV with a header row
+// required columns: email, password_hash (optional: email_verified)
+func ReadCSV(r io.Reader) ([]usermodels.ImportRecord, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv header: %v", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"email", "password_hash"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv missing required column: %s", required)
+		}
+	}
+
+	records := []usermodels.ImportRecord{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv row: %v", err)
+		}
+
+		record := usermodels.ImportRecord{
+			Email:        row[columns["email"]],
+			PasswordHash: row[columns["password_hash"]],
+		}
+		if i, ok := columns["email_verified"]; ok && row[i] != "" {
+			if record.EmailVerified, err = strconv.ParseBool(row[i]); err != nil {
+				return nil, fmt.Errorf("invalid csv email_verified (%s): %v", record.Email, err)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,103 @@
+package importservice
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+)
+
+const (
+	stubBcryptHash = "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+	stubSHA1Hash   = "$sha1-salted$salt$2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"
+)
+
+type mockUserRepo struct {
+	userrepo.Store
+	existing map[string]bool
+}
+
+func (m *mockUserRepo) Import(ctx context.Context, record usermodels.ImportRecord, events ...outboxmodels.Event) (bool, error) {
+	if m.existing[record.Email] {
+		return false, nil
+	}
+	m.existing[record.Email] = true
+	return true, nil
+}
+
+func TestReadCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []usermodels.ImportRecord
+		wantErr bool
+	}{
+		{
+			name:  "with email_verified",
+			input: "email,password_hash,email_verified\na@homerow.tech," + stubSHA1Hash + ",true\n",
+			want:  []usermodels.ImportRecord{{Email: "a@homerow.tech", PasswordHash: stubSHA1Hash, EmailVerified: true}},
+		},
+		{
+			name:  "reordered columns",
+			input: "password_hash,email\n" + stubBcryptHash + ",b@homerow.tech\n",
+			want:  []usermodels.ImportRecord{{Email: "b@homerow.tech", PasswordHash: stubBcryptHash}},
+		},
+		{name: "missing column", input: "email\na@homerow.tech\n", wantErr: true},
+		{name: "invalid bool", input: "email,password_hash,email_verified\na@homerow.tech,x,nope\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadCSV(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadCSV() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadCSV() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	got, err := ReadJSON(strings.NewReader(`[{"email":"a@homerow.tech","password_hash":"` + stubSHA1Hash + `","email_verified":true}]`))
+	if err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	want := []usermodels.ImportRecord{{Email: "a@homerow.tech", PasswordHash: stubSHA1Hash, EmailVerified: true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadJSON() = %v, want %v", got, want)
+	}
+	if _, err := ReadJSON(strings.NewReader(`{"email":`)); err == nil {
+		t.Errorf("ReadJSON() expected error for invalid json")
+	}
+}
+
+func Test_service_Import(t *testing.T) {
+	records := []usermodels.ImportRecord{
+		{Email: "new@homerow.tech", PasswordHash: stubBcryptHash},
+		{Email: "existing@homerow.tech", PasswordHash: stubSHA1Hash},
+		{Email: "plaintext@homerow.tech", PasswordHash: "hunter2"},
+		{Email: " ", PasswordHash: stubBcryptHash},
+	}
+	repo := &mockUserRepo{existing: map[string]bool{"existing@homerow.tech": true}}
+	svc := New(&config.Config{}, log.NewNopFactory(), repo)
+
+	got, err := svc.Import(context.Background(), records, false)
+	if err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if got.Imported != 1 || got.Skipped != 1 || len(got.Failed) != 2 {
+		t.Errorf("Import() = %+v, want 1 imported, 1 skipped, 2 failed", got)
+	}
+	for _, failure := range got.Failed {
+		if strings.Contains(failure, "hunter2") {
+			t.Errorf("Import() leaked password hash in failure: %s", failure)
+		}
+	}
+}
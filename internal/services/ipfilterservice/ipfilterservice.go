@@ -0,0 +1,302 @@
+package ipfilterservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/ipfiltermodels"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/pkg/helpers/iphelpers"
+
+	"go.uber.org/zap"
+)
+
+// Reasons an ip is rejected (the ip_filter_rejected_total reason label)
+const (
+	// ReasonDeny is an ip in the static deny list
+	ReasonDeny = "deny"
+	// ReasonBlocklist is an ip in the blocklist
+	ReasonBlocklist = "blocklist"
+	// ReasonAllow is an ip outside the static allow list
+	ReasonAllow = "allow"
+)
+
+// Provider is the ip filter interface
+// Allowed checks the static deny list, the blocklist (redis, shared by every instance) then the static allow list,
+// TokenAnomaly counts an ip's suspicious token errors and blocks the ip when it has too many
+type Provider interface {
+	Allowed(ctx context.Context, ip net.IP) (bool, string)
+	Block(ctx context.Context, actorID int, req *ipfiltermodels.BlockRequest) (ipfiltermodels.Block, error)
+	Unblock(ctx context.Context, actorID int, cidr string) error
+	List(ctx context.Context) ([]ipfiltermodels.Block, error)
+	TokenAnomaly(ctx context.Context, ip net.IP)
+}
+
+// Cache is the subset of redis.Provider the ip filter uses (the shared blocklist)
+type Cache interface {
+	Incr(ctx context.Context, key string, exp time.Duration) (int64, error)
+	HSet(ctx context.Context, key, field, value string) error
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	HDel(ctx context.Context, key string, fields ...string) error
+}
+
+type provider struct {
+	logger  log.Factory
+	cfg     *config.Config
+	redis   Cache
+	auditor auditservice.Provider
+	allow   iphelpers.Networks
+	deny    iphelpers.Networks
+	now     func() time.Time
+
+	mu          sync.Mutex
+	blocklist   iphelpers.Networks
+	refreshedAt time.Time
+}
+
+// New returns a new ip filter Provider (an invalid allow or deny entry is an error)
+func New(cfg *config.Config, logger log.Factory, redisClient Cache, auditor auditservice.Provider) (Provider, error) {
+	allow, err := iphelpers.ParseNetworks(cfg.IPFilter.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip filter allow list: %v", err)
+	}
+	deny, err := iphelpers.ParseNetworks(cfg.IPFilter.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip filter deny list: %v", err)
+	}
+	return &provider{
+		logger:  logger.With(zap.String("package", "ipfilterservice")),
+		cfg:     cfg,
+		redis:   redisClient,
+		auditor: auditor,
+		allow:   allow,
+		deny:    deny,
+		now:     time.Now,
+	}, nil
+}
+
+func notEnabled() error {
+	return &errors.RestError{Code: http.StatusNotFound, Message: "ip filtering is disabled"}
+}
+
+// normalize returns the canonical CIDR (a single ip is a /32 or /128)
+func normalize(cidr string) (string, error) {
+	network, err := iphelpers.ParseNetwork(cidr)
+	if err != nil {
+		return "", &errors.RestError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid ip or cidr %q", cidr)}
+	}
+	return network.String(), nil
+}
+
+// Allowed reports if the ip may make requests and, when it may not, why
+// the blocklist fails open, an instance that can not reach redis keeps its last copy
+func (p *provider) Allowed(ctx context.Context, ip net.IP) (bool, string) {
+	if !p.cfg.IPFilter.Enabled || ip == nil {
+		return true, ""
+	}
+	if p.deny.Contains(ip) {
+		return false, ReasonDeny
+	}
+	if p.cachedBlocklist(ctx).Contains(ip) {
+		return false, ReasonBlocklist
+	}
+	if len(p.allow) > 0 && !p.allow.Contains(ip) {
+		return false, ReasonAllow
+	}
+	return true, ""
+}
+
+// cachedBlocklist returns the blocklist, reloaded from redis every RefreshSecs
+func (p *provider) cachedBlocklist(ctx context.Context) iphelpers.Networks {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.now().Sub(p.refreshedAt) < time.Duration(p.cfg.IPFilter.RefreshSecs)*time.Second {
+		return p.blocklist
+	}
+	// a failed reload is not retried until the next refresh (redis is not hit on every request)
+	p.refreshedAt = p.now()
+	blocks, err := p.load(ctx)
+	if err != nil {
+		p.logger.For(ctx).Error("failed to reload the ip blocklist", zap.Error(err))
+		return p.blocklist
+	}
+	blocklist := make(iphelpers.Networks, 0, len(blocks))
+	for _, block := range blocks {
+		if network, err := iphelpers.ParseNetwork(block.CIDR); err == nil {
+			blocklist = append(blocklist, network)
+		}
+	}
+	p.blocklist = blocklist
+	return p.blocklist
+}
+
+// expireCache makes the next Allowed reload the blocklist (this instance sees its own changes at once)
+func (p *provider) expireCache() {
+	p.mu.Lock()
+	p.refreshedAt = time.Time{}
+	p.mu.Unlock()
+}
+
+// load returns the active blocks, the expired blocks are removed
+func (p *provider) load(ctx context.Context) ([]ipfiltermodels.Block, error) {
+	entries, err := p.redis.HGetAll(ctx, p.cfg.IPFilter.CacheKeyID)
+	if err != nil {
+		return nil, err
+	}
+	now := p.now()
+	blocks := []ipfiltermodels.Block{}
+	expired := []string{}
+	for cidr, entry := range entries {
+		block := ipfiltermodels.Block{}
+		if err = json.Unmarshal([]byte(entry), &block); err != nil || block.Expired(now) {
+			expired = append(expired, cidr)
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	if len(expired) > 0 {
+		if err = p.redis.HDel(ctx, p.cfg.IPFilter.CacheKeyID, expired...); err != nil {
+			p.logger.For(ctx).Error("failed to remove expired ip blocks", zap.Strings("cidrs", expired), zap.Error(err))
+		}
+	}
+	return blocks, nil
+}
+
+// store adds (or replaces) the block
+func (p *provider) store(ctx context.Context, block ipfiltermodels.Block) error {
+	entry, _ := json.Marshal(block)
+	if err := p.redis.HSet(ctx, p.cfg.IPFilter.CacheKeyID, block.CIDR, string(entry)); err != nil {
+		return err
+	}
+	p.expireCache()
+	p.auditor.Record(ctx, auditmodels.Event{
+		Event:   auditmodels.EventIPBlock,
+		Outcome: auditmodels.OutcomeSuccess,
+		ActorID: block.CreatedBy,
+		Details: map[string]interface{}{"cidr": block.CIDR, "reason": block.Reason, "source": block.Source, "expires": block.ExpiresAt},
+	})
+	p.logger.For(ctx).Info("ip blocked", zap.String("cidr", block.CIDR), zap.String("source", block.Source), zap.Time("expires", block.ExpiresAt))
+	return nil
+}
+
+// Block blocks the ip or network for TTLMins (defaults to DefaultBlockMins), blocking it again replaces the block
+func (p *provider) Block(ctx context.Context, actorID int, req *ipfiltermodels.BlockRequest) (ipfiltermodels.Block, error) {
+	if !p.cfg.IPFilter.Enabled {
+		return ipfiltermodels.Block{}, notEnabled()
+	}
+	cidr, err := normalize(req.CIDR)
+	if err != nil {
+		return ipfiltermodels.Block{}, err
+	}
+	ttlMins := req.TTLMins
+	if ttlMins == 0 {
+		ttlMins = p.cfg.IPFilter.DefaultBlockMins
+	}
+	if ttlMins > p.cfg.IPFilter.MaxBlockMins {
+		return ipfiltermodels.Block{}, &errors.RestError{Code: http.StatusBadRequest, Message: fmt.Sprintf("block ttl exceeds %d minutes", p.cfg.IPFilter.MaxBlockMins)}
+	}
+
+	now := p.now().UTC()
+	block := ipfiltermodels.Block{
+		CIDR:      cidr,
+		Reason:    req.Reason,
+		Source:    ipfiltermodels.SourceAdmin,
+		CreatedBy: actorID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(ttlMins) * time.Minute),
+	}
+	if err = p.store(ctx, block); err != nil {
+		return ipfiltermodels.Block{}, errors.ErrorWrapper(err, "IPFilterService.Block.HSet")
+	}
+	return block, nil
+}
+
+// Unblock removes the block of the ip or network (the exact CIDR, a block is not split)
+func (p *provider) Unblock(ctx context.Context, actorID int, cidr string) error {
+	if !p.cfg.IPFilter.Enabled {
+		return notEnabled()
+	}
+	cidr, err := normalize(cidr)
+	if err != nil {
+		return err
+	}
+	blocks, err := p.load(ctx)
+	if err != nil {
+		return errors.ErrorWrapper(err, "IPFilterService.Unblock.load")
+	}
+	found := false
+	for _, block := range blocks {
+		found = found || block.CIDR == cidr
+	}
+	if !found {
+		return &errors.RestError{Code: http.StatusNotFound, Message: fmt.Sprintf("%s is not blocked", cidr)}
+	}
+
+	if err = p.redis.HDel(ctx, p.cfg.IPFilter.CacheKeyID, cidr); err != nil {
+		return errors.ErrorWrapper(err, "IPFilterService.Unblock.HDel")
+	}
+	p.expireCache()
+	p.auditor.Record(ctx, auditmodels.Event{
+		Event:   auditmodels.EventIPUnblock,
+		Outcome: auditmodels.OutcomeSuccess,
+		ActorID: actorID,
+		Details: map[string]interface{}{"cidr": cidr},
+	})
+	p.logger.For(ctx).Info("ip unblocked", zap.String("cidr", cidr), zap.Int("actor_id", actorID))
+	return nil
+}
+
+// List lists the active blocks, oldest first
+func (p *provider) List(ctx context.Context) ([]ipfiltermodels.Block, error) {
+	if !p.cfg.IPFilter.Enabled {
+		return nil, notEnabled()
+	}
+	blocks, err := p.load(ctx)
+	if err != nil {
+		return nil, errors.ErrorWrapper(err, "IPFilterService.List")
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].CreatedAt.Before(blocks[j].CreatedAt)
+	})
+	return blocks, nil
+}
+
+// TokenAnomaly counts the ip's suspicious token errors, the ip is blocked for AutoBlockMins
+// once it has more than AutoBlockThreshold in AutoBlockWindowMins (only the error over the threshold blocks it)
+func (p *provider) TokenAnomaly(ctx context.Context, ip net.IP) {
+	if !p.cfg.IPFilter.Enabled || !p.cfg.IPFilter.AutoBlock || ip == nil {
+		return
+	}
+	window := time.Duration(p.cfg.IPFilter.AutoBlockWindowMins) * time.Minute
+	count, err := p.redis.Incr(ctx, fmt.Sprintf("%v-anomalies-%v", p.cfg.IPFilter.CacheKeyID, ip), window)
+	if err != nil {
+		p.logger.For(ctx).Error("failed to count the token anomaly", zap.String("ip", ip.String()), zap.Error(err))
+		return
+	}
+	if count != p.cfg.IPFilter.AutoBlockThreshold+1 {
+		return
+	}
+
+	cidr, _ := normalize(ip.String())
+	now := p.now().UTC()
+	block := ipfiltermodels.Block{
+		CIDR:      cidr,
+		Reason:    fmt.Sprintf("more than %d suspicious token errors in %d minutes", p.cfg.IPFilter.AutoBlockThreshold, p.cfg.IPFilter.AutoBlockWindowMins),
+		Source:    ipfiltermodels.SourceAuto,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(p.cfg.IPFilter.AutoBlockMins) * time.Minute),
+	}
+	if err = p.store(ctx, block); err != nil {
+		p.logger.For(ctx).Error("failed to auto block the ip", zap.String("ip", ip.String()), zap.Error(err))
+	}
+}
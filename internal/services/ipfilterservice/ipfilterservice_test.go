@@ -0,0 +1,242 @@
+package ipfilterservice
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/ipfiltermodels"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	gopkgerrors "github.com/pkg/errors"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func newTestProvider(t *testing.T, allow, deny []string) (*provider, *testhelper.Redis, *testhelper.Auditor, *testClock) {
+	cfg := &config.Config{}
+	cfg.IPFilter.Enabled = true
+	cfg.IPFilter.Allow = allow
+	cfg.IPFilter.Deny = deny
+	cfg.IPFilter.CacheKeyID = "ip-blocklist"
+	cfg.IPFilter.RefreshSecs = 5
+	cfg.IPFilter.DefaultBlockMins = 60
+	cfg.IPFilter.MaxBlockMins = 1440
+	cfg.IPFilter.AutoBlock = true
+	cfg.IPFilter.AutoBlockThreshold = 3
+	cfg.IPFilter.AutoBlockWindowMins = 10
+	cfg.IPFilter.AutoBlockMins = 30
+	redisClient := testhelper.NewRedis()
+	auditor := &testhelper.Auditor{}
+	filter, err := New(cfg, log.NewNopFactory(), redisClient, auditor)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	clock := &testClock{now: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)}
+	p := filter.(*provider)
+	p.now = clock.Now
+	return p, redisClient, auditor, clock
+}
+
+func errCode(err error) int {
+	if rerr, ok := gopkgerrors.Cause(err).(*errors.RestError); ok {
+		return rerr.Code
+	}
+	return 0
+}
+
+func TestNew(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.IPFilter.Deny = []string{"10.0.0.0/33"}
+	if _, err := New(cfg, log.NewNopFactory(), testhelper.NewRedis(), &testhelper.Auditor{}); err == nil {
+		t.Errorf("New() expected an error for an invalid deny entry")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		allow      []string
+		deny       []string
+		blocked    string
+		ip         string
+		want       bool
+		wantReason string
+	}{
+		{name: "no lists", ip: "203.0.113.7", want: true},
+		{name: "deny list", deny: []string{"203.0.113.0/24"}, ip: "203.0.113.7", wantReason: ReasonDeny},
+		{name: "blocklist", blocked: "203.0.113.7", ip: "203.0.113.7", wantReason: ReasonBlocklist},
+		{name: "blocked network", blocked: "203.0.113.0/24", ip: "203.0.113.9", wantReason: ReasonBlocklist},
+		{name: "another ip", blocked: "203.0.113.7", ip: "203.0.113.8", want: true},
+		{name: "in the allow list", allow: []string{"10.0.0.0/8"}, ip: "10.1.2.3", want: true},
+		{name: "outside the allow list", allow: []string{"10.0.0.0/8"}, ip: "203.0.113.7", wantReason: ReasonAllow},
+		{name: "blocked in the allow list", allow: []string{"10.0.0.0/8"}, blocked: "10.1.2.3", ip: "10.1.2.3", wantReason: ReasonBlocklist},
+		{name: "ipv6 block", blocked: "2001:db8::/64", ip: "2001:db8::1", wantReason: ReasonBlocklist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, _, _ := newTestProvider(t, tt.allow, tt.deny)
+			ctx := context.Background()
+			if tt.blocked != "" {
+				if _, err := p.Block(ctx, 1, &ipfiltermodels.BlockRequest{CIDR: tt.blocked, Reason: "test"}); err != nil {
+					t.Fatalf("Block() error = %v", err)
+				}
+			}
+			got, reason := p.Allowed(ctx, net.ParseIP(tt.ip))
+			if got != tt.want || reason != tt.wantReason {
+				t.Errorf("Allowed(%s) = %v, %q, want %v, %q", tt.ip, got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestAllowedCache(t *testing.T) {
+	p, redisClient, _, clock := newTestProvider(t, nil, nil)
+	ctx := context.Background()
+	ip := net.ParseIP("203.0.113.7")
+
+	p.Allowed(ctx, ip)
+	p.Allowed(ctx, ip)
+	if redisClient.Calls["HGetAll"] != 1 {
+		t.Errorf("blocklist loaded %d times, want 1 (cached)", redisClient.Calls["HGetAll"])
+	}
+
+	// another instance blocks the ip, this instance sees it after the refresh
+	redisClient.Hashes["ip-blocklist"] = map[string]string{"203.0.113.7/32": fmt.Sprintf(`{"cidr":"203.0.113.7/32","expires":%q}`, clock.now.Add(time.Hour).Format(time.RFC3339))}
+	if allowed, _ := p.Allowed(ctx, ip); !allowed {
+		t.Errorf("Allowed() = false before the refresh")
+	}
+	clock.now = clock.now.Add(6 * time.Second)
+	if allowed, _ := p.Allowed(ctx, ip); allowed {
+		t.Errorf("Allowed() = true after the refresh")
+	}
+
+	// redis is down, the last copy is used
+	redisClient.Down = true
+	clock.now = clock.now.Add(6 * time.Second)
+	if allowed, _ := p.Allowed(ctx, ip); allowed {
+		t.Errorf("Allowed() = true with redis down, want the last copy")
+	}
+}
+
+func TestBlock(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      ipfiltermodels.BlockRequest
+		wantCIDR string
+		wantTTL  time.Duration
+		wantCode int
+	}{
+		{name: "ip", req: ipfiltermodels.BlockRequest{CIDR: "203.0.113.7", Reason: "abuse"}, wantCIDR: "203.0.113.7/32", wantTTL: time.Hour},
+		{name: "network", req: ipfiltermodels.BlockRequest{CIDR: "203.0.113.7/24", Reason: "abuse", TTLMins: 5}, wantCIDR: "203.0.113.0/24", wantTTL: 5 * time.Minute},
+		{name: "ttl over the max", req: ipfiltermodels.BlockRequest{CIDR: "203.0.113.7", Reason: "abuse", TTLMins: 1441}, wantCode: http.StatusBadRequest},
+		{name: "invalid cidr", req: ipfiltermodels.BlockRequest{CIDR: "203.0.113.7/40", Reason: "abuse"}, wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, auditor, clock := newTestProvider(t, nil, nil)
+			block, err := p.Block(context.Background(), 1, &tt.req)
+			if tt.wantCode != 0 {
+				if errCode(err) != tt.wantCode {
+					t.Fatalf("Block() error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Block() error = %v", err)
+			}
+			if block.CIDR != tt.wantCIDR || block.Source != ipfiltermodels.SourceAdmin || block.CreatedBy != 1 {
+				t.Errorf("Block() = %+v, want %s by admin 1", block, tt.wantCIDR)
+			}
+			if ttl := block.ExpiresAt.Sub(clock.now); ttl != tt.wantTTL {
+				t.Errorf("ttl = %v, want %v", ttl, tt.wantTTL)
+			}
+			if len(auditor.Events) != 1 || auditor.Events[0].Event != auditmodels.EventIPBlock {
+				t.Errorf("audit events = %+v", auditor.Events)
+			}
+		})
+	}
+}
+
+func TestUnblockAndExpiry(t *testing.T) {
+	p, redisClient, auditor, clock := newTestProvider(t, nil, nil)
+	ctx := context.Background()
+	for _, cidr := range []string{"203.0.113.7", "198.51.100.0/24"} {
+		if _, err := p.Block(ctx, 1, &ipfiltermodels.BlockRequest{CIDR: cidr, Reason: "abuse", TTLMins: 10}); err != nil {
+			t.Fatalf("Block() error = %v", err)
+		}
+	}
+	if _, err := p.Block(ctx, 1, &ipfiltermodels.BlockRequest{CIDR: "192.0.2.1", Reason: "abuse", TTLMins: 120}); err != nil {
+		t.Fatalf("Block() error = %v", err)
+	}
+
+	if err := p.Unblock(ctx, 2, "203.0.113.7/32"); err != nil {
+		t.Fatalf("Unblock() error = %v", err)
+	}
+	if err := p.Unblock(ctx, 2, "203.0.113.7"); errCode(err) != http.StatusNotFound {
+		t.Errorf("second Unblock() error = %v, want 404", err)
+	}
+	if last := auditor.Events[len(auditor.Events)-1]; last.Event != auditmodels.EventIPUnblock || last.ActorID != 2 {
+		t.Errorf("last audit event = %+v, want an unblock by 2", last)
+	}
+
+	// the network block expires and is removed
+	clock.now = clock.now.Add(11 * time.Minute)
+	blocks, err := p.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(blocks) != 1 || blocks[0].CIDR != "192.0.2.1/32" {
+		t.Errorf("List() = %+v, want only 192.0.2.1/32", blocks)
+	}
+	if len(redisClient.Hashes["ip-blocklist"]) != 1 {
+		t.Errorf("expired blocks were not removed: %v", redisClient.Hashes["ip-blocklist"])
+	}
+}
+
+func TestTokenAnomaly(t *testing.T) {
+	p, _, auditor, clock := newTestProvider(t, nil, nil)
+	ctx := context.Background()
+	ip := net.ParseIP("203.0.113.7")
+
+	for i := 1; i <= 5; i++ {
+		p.TokenAnomaly(ctx, ip)
+		allowed, _ := p.Allowed(ctx, ip)
+		if want := i <= 3; allowed != want {
+			t.Errorf("after %d anomalies Allowed() = %v, want %v", i, allowed, want)
+		}
+	}
+	if len(auditor.Events) != 1 {
+		t.Fatalf("audit events = %+v, want a single block", auditor.Events)
+	}
+	if details := auditor.Events[0].Details; details["source"] != ipfiltermodels.SourceAuto || details["cidr"] != "203.0.113.7/32" {
+		t.Errorf("audit details = %v", details)
+	}
+
+	clock.now = clock.now.Add(31 * time.Minute)
+	if allowed, _ := p.Allowed(ctx, ip); !allowed {
+		t.Errorf("Allowed() = false after the auto block expired")
+	}
+
+	p.cfg.IPFilter.AutoBlock = false
+	other := net.ParseIP("198.51.100.1")
+	for i := 0; i < 5; i++ {
+		p.TokenAnomaly(ctx, other)
+	}
+	if allowed, _ := p.Allowed(ctx, other); !allowed {
+		t.Errorf("Allowed() = false with auto block disabled")
+	}
+}
@@ -10,7 +10,11 @@ import (
 
 	"github.com/tjsampson/token-svc/internal/config"
 	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
 	"github.com/tjsampson/token-svc/internal/models/tokenmodels"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/internal/services/ipfilterservice"
 	"github.com/tjsampson/token-svc/pkg/metrics"
 
 	"github.com/dgrijalva/jwt-go"
@@ -38,18 +42,41 @@ const (
 )
 
 type (
+	// auth_time, amr and acr are how and when the user authenticated (they are kept on re-issue, see step-up)
 	customClaims struct {
-		Roles []string `json:"roles"`
-		Name  string   `json:"name"`
+		Roles    []string `json:"roles"`
+		Name     string   `json:"name"`
+		AuthTime int64    `json:"auth_time,omitempty"`
+		AMR      []string `json:"amr,omitempty"`
+		ACR      string   `json:"acr,omitempty"`
+		// ClientID is the oauth client of a client credentials token
+		ClientID string `json:"client_id,omitempty"`
+	}
+
+	// confirmation is the key a sender constrained token is bound to (RFC 7800), jkt is the DPoP key thumbprint
+	// and x5t#S256 is the client certificate thumbprint (mutual tls, RFC 8705)
+	confirmation struct {
+		JKT string `json:"jkt,omitempty"`
+		X5T string `json:"x5t#S256,omitempty"`
+	}
+
+	// boundClaims is the cnf claim (only a bound token has it)
+	boundClaims struct {
+		Cnf *confirmation `json:"cnf,omitempty"`
 	}
 
 	accessTokenClaims struct {
 		*jwt.StandardClaims
 		customClaims
+		boundClaims
 	}
 
+	// the refresh token keeps the login's auth_time and amr, a refreshed access token is not a new authentication
 	refreshTokenClaims struct {
 		*jwt.StandardClaims
+		AuthTime int64    `json:"auth_time,omitempty"`
+		AMR      []string `json:"amr,omitempty"`
+		boundClaims
 	}
 )
 
@@ -58,6 +85,7 @@ type Provider interface {
 	GenerateAccessToken(ctx context.Context, aTokenChan chan tokenmodels.TokenResult, tokenData map[string]interface{})
 	GenerateRefreshToken(ctx context.Context, rTokenChan chan tokenmodels.TokenResult, tokenData map[string]interface{})
 	IsValidAccessToken(ctx context.Context, tkn string) (*accessTokenClaims, bool)
+	IsValidRefreshToken(ctx context.Context, tkn string) (*refreshTokenClaims, bool)
 }
 
 type provider struct {
@@ -69,10 +97,12 @@ type provider struct {
 	logger      log.Factory
 	metrics     *metrics.Provider
 	tracer      opentracing.Tracer
+	auditor     auditservice.Provider
+	ipFilter    ipfilterservice.Provider
 }
 
 // New returns a JWT provider used for Signing and Verifying token
-func New(cfg *config.Config, logger log.Factory, tracer opentracing.Tracer, metricProvider *metrics.Provider) (Provider, error) {
+func New(cfg *config.Config, logger log.Factory, tracer opentracing.Tracer, metricProvider *metrics.Provider, auditor auditservice.Provider, ipFilter ipfilterservice.Provider) (Provider, error) {
 
 	signBytes, err := ioutil.ReadFile(cfg.Token.AuthPrivateKeyPath)
 	if err != nil {
@@ -102,10 +132,23 @@ func New(cfg *config.Config, logger log.Factory, tracer opentracing.Tracer, metr
 		verifyKey:   verifyKey,
 		tracer:      tracer,
 		metrics:     metricProvider,
+		auditor:     auditor,
+		ipFilter:    ipFilter,
 		logger:      logger.With(zap.String("package", "jwt")),
 	}, nil
 }
 
+// auditTokenAnomaly records the suspicious token validation error
+// and counts it against the client ip (too many and the ip filter blocks the ip)
+func (p *provider) auditTokenAnomaly(ctx context.Context, kind string, err error) {
+	p.auditor.Record(ctx, auditmodels.Event{
+		Event:   auditmodels.EventTokenAnomaly,
+		Outcome: auditmodels.OutcomeDenied,
+		Details: map[string]interface{}{"kind": kind, "error": err.Error()},
+	})
+	p.ipFilter.TokenAnomaly(ctx, requestcontext.UserIP(ctx))
+}
+
 func (p *provider) investigateJWTError(ctx context.Context, err error) {
 	// Lets audit these JWT Errors
 	switch err.Error() {
@@ -121,14 +164,13 @@ func (p *provider) investigateJWTError(ctx context.Context, err error) {
 		jwt.ErrSignatureInvalid.Error(),
 		jwt.NoneSignatureTypeDisallowedError.Error():
 		p.logger.For(ctx).Error(auditEventJWTError, zap.Error(err), zap.Bool("audit", true))
-		p.metrics.StatAuditCount.WithLabelValues(auditEventJWTError).Inc()
+		p.auditTokenAnomaly(ctx, auditEventJWTError, err)
 	default:
 		// Trap JWT Validation Errors
 		// A "normal" error is an Expired Token (ValidationErrorExpired)
 		// unknown/suspicious errors are basically everything else
 		// we want to audit these suspicious/unknown errors
 		// more than likely a client is messing with the token (i.e. hacker)
-		// TODO: implement audit logger (isolate audit logs from application logs)
 		if pgerr, ok := err.(*jwt.ValidationError); ok {
 			switch pgerr.Errors {
 			case jwt.ValidationErrorExpired:
@@ -148,12 +190,12 @@ func (p *provider) investigateJWTError(ctx context.Context, err error) {
 				jwt.ValidationErrorSignatureInvalid,
 				jwt.ValidationErrorUnverifiable:
 				p.logger.For(ctx).Error(auditEventJWTValidation, zap.Error(err), zap.Bool("audit", true))
-				p.metrics.StatAuditCount.WithLabelValues(auditEventJWTValidation).Inc()
+				p.auditTokenAnomaly(ctx, auditEventJWTValidation, err)
 			default:
 				// Not sure this should ever happen
 				// but if it does, we should audit it
 				p.logger.For(ctx).Error(fmt.Sprintf("unknown %s", auditEventJWTValidation), zap.Error(err), zap.Bool("audit", true))
-				p.metrics.StatAuditCount.WithLabelValues(auditEventJWTValidation).Inc()
+				p.auditTokenAnomaly(ctx, auditEventJWTValidation, err)
 			}
 		}
 	}
@@ -185,23 +227,100 @@ func (p *provider) IsValidAccessToken(ctx context.Context, tkn string) (*accessT
 	return tokenClaims, token.Valid
 }
 
+// DPoPThumbprint returns the thumbprint of the DPoP key the token is bound to ("" for an unbound token)
+func (c boundClaims) DPoPThumbprint() string {
+	if c.Cnf == nil {
+		return ""
+	}
+	return c.Cnf.JKT
+}
+
+// CertThumbprint returns the thumbprint of the client certificate the token is bound to ("" for an unbound token)
+func (c boundClaims) CertThumbprint() string {
+	if c.Cnf == nil {
+		return ""
+	}
+	return c.Cnf.X5T
+}
+
+// bind returns the cnf claim of the token data's DPoP key thumbprint (jkt) and client certificate thumbprint (x5t)
+func bind(tokenData map[string]interface{}) boundClaims {
+	jkt, _ := tokenData["jkt"].(string)
+	x5t, _ := tokenData["x5t"].(string)
+	if jkt == "" && x5t == "" {
+		return boundClaims{}
+	}
+	return boundClaims{Cnf: &confirmation{JKT: jkt, X5T: x5t}}
+}
+
+// AuthInfo returns how and when the token's user authenticated
+func (c *accessTokenClaims) AuthInfo() requestcontext.AuthInfo {
+	// tokens issued before auth_time was added authenticated when they were issued
+	authTime := c.AuthTime
+	if authTime == 0 {
+		authTime = c.IssuedAt
+	}
+	return requestcontext.AuthInfo{
+		Time:    time.Unix(authTime, 0),
+		Methods: c.AMR,
+		Level:   c.ACR,
+		Expires: time.Unix(c.ExpiresAt, 0),
+	}
+}
+
+// IsValidRefreshToken parses and verifies the refresh token (the caller checks it is the session's current refresh token)
+func (p *provider) IsValidRefreshToken(ctx context.Context, tkn string) (*refreshTokenClaims, bool) {
+	p.logger.For(ctx).Info("entering jwtservice.IsValidRefreshToken")
+	token, err := jwt.ParseWithClaims(tkn, &refreshTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return p.verifyKey, nil
+	})
+	if err != nil {
+		p.logger.For(ctx).Error("invalid refresh token", zap.Error(err))
+		p.investigateJWTError(ctx, err)
+		return nil, false
+	}
+
+	tokenClaims := token.Claims.(*refreshTokenClaims)
+
+	p.logger.For(ctx).Info("leaving jwtservice.IsValidRefreshToken", zap.Bool("is_valid", token.Valid))
+	return tokenClaims, token.Valid
+}
+
 
 
 func (p *provider) GenerateAccessToken(ctx context.Context, aTokenChan chan tokenmodels.TokenResult, tokenData map[string]interface{}) {
 	p.logger.For(ctx).Info("entering jwtservice.GenerateAccessToken")
+	roles, _ := tokenData["roles"].([]string)
+	amr, _ := tokenData["amr"].([]string)
+	acr, _ := tokenData["acr"].(string)
+	clientID, _ := tokenData["client_id"].(string)
+	// auth_time defaults to now (a login), a re-issued token keeps its session expiry
+	authTime, _ := tokenData["auth_time"].(int64)
+	if authTime == 0 {
+		authTime = time.Now().Unix()
+	}
+	expiresAt, _ := tokenData["expires_at"].(int64)
+	if expiresAt == 0 {
+		expiresAt = time.Now().Add(time.Minute * time.Duration(p.cfg.Token.AccessTokenLifeSpanMins)).Unix()
+	}
 	accessToken := jwt.New(jwt.GetSigningMethod("RS256"))
 	accessToken.Claims = &accessTokenClaims{
 		&jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Minute * time.Duration(p.cfg.Token.AccessTokenLifeSpanMins)).Unix(),
+			ExpiresAt: expiresAt,
 			IssuedAt:  time.Now().Unix(),
 			Issuer:    p.cfg.Token.Issuer,
 			Subject:   tokenData["subject"].(string),
 			Id:        tokenData["id"].(string),
 		},
 		customClaims{
-			Roles: []string{"test"},
-			Name:  tokenData["name"].(string),
+			Roles:    roles,
+			Name:     tokenData["name"].(string),
+			AuthTime: authTime,
+			AMR:      amr,
+			ACR:      acr,
+			ClientID: clientID,
 		},
+		bind(tokenData),
 	}
 	accessTokenSigned, err := accessToken.SignedString(p.signKey)
 	aTokenChan <- tokenmodels.TokenResult{Token: accessTokenSigned, Err: err}
@@ -211,6 +330,11 @@ func (p *provider) GenerateAccessToken(ctx context.Context, aTokenChan chan toke
 
 func (p *provider) GenerateRefreshToken(ctx context.Context, rTokenChan chan tokenmodels.TokenResult, tokenData map[string]interface{}) {
 	p.logger.For(ctx).Info("entering jwtservice.GenerateRefreshToken")
+	amr, _ := tokenData["amr"].([]string)
+	authTime, _ := tokenData["auth_time"].(int64)
+	if authTime == 0 {
+		authTime = time.Now().Unix()
+	}
 	refreshToken := jwt.New(jwt.GetSigningMethod("RS256"))
 	refreshToken.Claims = &refreshTokenClaims{
 		&jwt.StandardClaims{
@@ -220,6 +344,9 @@ func (p *provider) GenerateRefreshToken(ctx context.Context, rTokenChan chan tok
 			Subject:   tokenData["subject"].(string),
 			Id:        tokenData["id"].(string),
 		},
+		authTime,
+		amr,
+		bind(tokenData),
 	}
 	refreshTokenSigned, err := refreshToken.SignedString(p.signKey)
 	rTokenChan <- tokenmodels.TokenResult{Token: refreshTokenSigned, Err: err}
@@ -0,0 +1,170 @@
+package loginhistoryservice
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/loginmodels"
+	"github.com/tjsampson/token-svc/internal/repos/loginrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/internal/services/mailservice"
+
+	"go.uber.org/zap"
+)
+
+// Provider is the login history provider interface
+// Record assesses the login's risk signals (a new device, a new network, a burst of failures) and records it,
+// a risky login is audited (login.suspicious) and the user is emailed
+type Provider interface {
+	Record(ctx context.Context, attempt loginmodels.Attempt) (loginmodels.Login, error)
+	List(ctx context.Context, userID int) ([]loginmodels.Login, error)
+}
+
+type provider struct {
+	logger  log.Factory
+	cfg     *config.Config
+	repo    loginrepo.Store
+	auditor auditservice.Provider
+	mailer  mailservice.Provider
+}
+
+// New returns a new login history Provider
+func New(cfg *config.Config, logger log.Factory, repo loginrepo.Store, auditor auditservice.Provider, mailer mailservice.Provider) Provider {
+	return &provider{
+		logger:  logger.With(zap.String("package", "loginhistoryservice")),
+		cfg:     cfg,
+		repo:    repo,
+		auditor: auditor,
+		mailer:  mailer,
+	}
+}
+
+// signalDescriptions explain the signals in the notification email
+var signalDescriptions = map[string]string{
+	loginmodels.SignalNewDevice:    "a device you have not signed in from",
+	loginmodels.SignalNewNetwork:   "a network you have not signed in from",
+	loginmodels.SignalFailureBurst: "several failed sign in attempts came first",
+}
+
+// Record assesses and records the login
+// the history is best effort (a database error never fails a login), only a forced mfa rejects the login
+// a rejected login is not recorded, so the device and network stay unknown
+func (p *provider) Record(ctx context.Context, attempt loginmodels.Attempt) (loginmodels.Login, error) {
+	if !p.cfg.LoginHistory.Enabled {
+		return loginmodels.Login{}, nil
+	}
+	p.logger.For(ctx).Info("entering loginhistoryservice.Record", zap.Int("user_id", attempt.UserID))
+
+	userIP := requestcontext.UserIP(ctx)
+	userAgent := requestcontext.UserAgent(ctx)
+	login := loginmodels.Login{
+		UserID:    attempt.UserID,
+		Method:    attempt.Method,
+		Network:   loginmodels.Network(userIP),
+		UserAgent: userAgent,
+		Device:    loginmodels.Device(userAgent),
+		Signals:   []string{},
+	}
+	if userIP != nil {
+		login.IP = userIP.String()
+	}
+
+	// the first login has nothing to compare with
+	known, err := p.repo.Known(ctx, attempt.UserID, login.Device, login.Network)
+	if err != nil {
+		p.logger.For(ctx).Error("failed to read the login history", zap.Error(err), zap.Int("user_id", attempt.UserID))
+	} else if known.Logins > 0 {
+		if known.Device == 0 {
+			login.Signals = append(login.Signals, loginmodels.SignalNewDevice)
+		}
+		if known.Network == 0 && login.Network != "" {
+			login.Signals = append(login.Signals, loginmodels.SignalNewNetwork)
+		}
+	}
+	if burst := p.cfg.LoginHistory.FailureBurst; burst > 0 && attempt.RecentFailures >= burst {
+		login.Signals = append(login.Signals, loginmodels.SignalFailureBurst)
+	}
+
+	if login.Risky() {
+		forceMFA := p.cfg.LoginHistory.ForceMFA && !authmodels.IsMultiFactor(attempt.AMR)
+		p.suspicious(ctx, attempt, login, forceMFA)
+		if forceMFA {
+			return login, &errors.RestError{
+				Code:    http.StatusForbidden,
+				Message: "a multi factor login is required from a new device or network",
+				Reason:  errors.ReasonMFARequired,
+			}
+		}
+	}
+
+	inserted, err := p.repo.Insert(ctx, login)
+	if err != nil {
+		p.logger.For(ctx).Error("failed to record the login", zap.Error(err), zap.Int("user_id", attempt.UserID))
+		return login, nil
+	}
+	if err = p.repo.Prune(ctx, attempt.UserID, p.cfg.LoginHistory.MaxHistory); err != nil {
+		p.logger.For(ctx).Error("failed to prune the login history", zap.Error(err), zap.Int("user_id", attempt.UserID))
+	}
+
+	p.logger.For(ctx).Info("leaving loginhistoryservice.Record", zap.Int("user_id", attempt.UserID), zap.Strings("signals", login.Signals))
+	return inserted, nil
+}
+
+// suspicious audits the risky login and emails the user (best effort)
+func (p *provider) suspicious(ctx context.Context, attempt loginmodels.Attempt, login loginmodels.Login, denied bool) {
+	outcome := auditmodels.OutcomeSuccess
+	if denied {
+		outcome = auditmodels.OutcomeDenied
+	}
+	p.auditor.Record(ctx, auditmodels.Event{
+		Event:     auditmodels.EventLoginSuspicious,
+		Outcome:   outcome,
+		ActorID:   attempt.UserID,
+		SubjectID: attempt.UserID,
+		Email:     attempt.Email,
+		Details: map[string]interface{}{
+			"signals": login.Signals,
+			"method":  login.Method,
+			"device":  login.Device,
+			"network": login.Network,
+		},
+	})
+
+	if !p.cfg.LoginHistory.Notify {
+		return
+	}
+	reasons := []string{}
+	for _, signal := range login.Signals {
+		reasons = append(reasons, signalDescriptions[signal])
+	}
+	device := login.Device
+	if device == "" {
+		device = "unknown"
+	}
+	action := "If this was you, you can ignore this email."
+	if denied {
+		action = "The sign in was blocked until it is done with multi factor authentication."
+	}
+	body := fmt.Sprintf("We noticed a new sign in to your %s account.\n\n"+
+		"Device: %s\nIP address: %s\nTime: %s\nWhy: %s\n\n"+
+		"%s If it was not you, change your password and review your recent sign ins.\n",
+		p.cfg.API.ServiceName, device, login.IP, time.Now().UTC().Format(time.RFC1123), strings.Join(reasons, ", "), action)
+	if err := p.mailer.Send(ctx, attempt.Email, "New sign in to your account", body); err != nil {
+		p.logger.For(ctx).Error("failed to send the login notification", zap.Error(err), zap.Int("user_id", attempt.UserID))
+	}
+}
+
+// List lists the user's recent logins (newest first)
+func (p *provider) List(ctx context.Context, userID int) ([]loginmodels.Login, error) {
+	logins, err := p.repo.List(ctx, userID, p.cfg.LoginHistory.MaxHistory)
+	return logins, errors.ErrorWrapper(err, "LoginHistoryService.List")
+}
@@ -0,0 +1,169 @@
+package loginhistoryservice
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/loginmodels"
+	"github.com/tjsampson/token-svc/internal/repos/loginrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	gopkgerrors "github.com/pkg/errors"
+)
+
+const (
+	chromeMac  = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_4) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/81.0.4044.138 Safari/537.36"
+	firefoxWin = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:76.0) Gecko/20100101 Firefox/76.0"
+)
+
+type mockLoginRepo struct {
+	loginrepo.Store
+	logins []loginmodels.Login
+}
+
+func (m *mockLoginRepo) Insert(ctx context.Context, login loginmodels.Login) (loginmodels.Login, error) {
+	login.ID = int64(len(m.logins) + 1)
+	m.logins = append(m.logins, login)
+	return login, nil
+}
+
+func (m *mockLoginRepo) Known(ctx context.Context, userID int, device, network string) (loginmodels.Known, error) {
+	known := loginmodels.Known{}
+	for _, login := range m.logins {
+		if login.UserID != userID {
+			continue
+		}
+		known.Logins++
+		if login.Device == device {
+			known.Device++
+		}
+		if login.Network == network {
+			known.Network++
+		}
+	}
+	return known, nil
+}
+
+func (m *mockLoginRepo) Prune(ctx context.Context, userID int, keep int) error {
+	return nil
+}
+
+type mockMailer struct {
+	sent []string
+}
+
+func (m *mockMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+func requestContext(ip, userAgent string) context.Context {
+	ctx := requestcontext.NewUserIPContext(context.Background(), net.ParseIP(ip))
+	return requestcontext.NewUserAgentContext(ctx, userAgent)
+}
+
+func TestRecord(t *testing.T) {
+	tests := []struct {
+		name        string
+		history     bool
+		ip          string
+		userAgent   string
+		failures    int64
+		amr         []string
+		forceMFA    bool
+		wantSignals []string
+		wantDenied  bool
+	}{
+		{name: "first login", ip: "203.0.113.7", userAgent: firefoxWin, wantSignals: []string{}},
+		{name: "known device and network", history: true, ip: "198.51.100.20", userAgent: chromeMac, wantSignals: []string{}},
+		{name: "browser update", history: true, ip: "198.51.100.9", userAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_5) Chrome/83.0.4103.61 Safari/537.36", wantSignals: []string{}},
+		{name: "new device", history: true, ip: "198.51.100.20", userAgent: firefoxWin, wantSignals: []string{loginmodels.SignalNewDevice}},
+		{name: "new network", history: true, ip: "203.0.113.7", userAgent: chromeMac, wantSignals: []string{loginmodels.SignalNewNetwork}},
+		{name: "failure burst", history: true, ip: "198.51.100.20", userAgent: chromeMac, failures: 3, wantSignals: []string{loginmodels.SignalFailureBurst}},
+		{name: "forced mfa", history: true, ip: "203.0.113.7", userAgent: firefoxWin, amr: []string{"pwd"}, forceMFA: true, wantSignals: []string{loginmodels.SignalNewDevice, loginmodels.SignalNewNetwork}, wantDenied: true},
+		{name: "forced mfa with mfa", history: true, ip: "203.0.113.7", userAgent: chromeMac, amr: []string{"pwd", "mfa"}, forceMFA: true, wantSignals: []string{loginmodels.SignalNewNetwork}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.LoginHistory.Enabled = true
+			cfg.LoginHistory.FailureBurst = 3
+			cfg.LoginHistory.Notify = true
+			cfg.LoginHistory.ForceMFA = tt.forceMFA
+			cfg.LoginHistory.MaxHistory = 100
+			repo := &mockLoginRepo{}
+			if tt.history {
+				repo.logins = []loginmodels.Login{{UserID: 7, Device: loginmodels.Device(chromeMac), Network: "198.51.100.0/24"}}
+			}
+			auditor := &testhelper.Auditor{}
+			mailer := &mockMailer{}
+			p := New(cfg, log.NewNopFactory(), repo, auditor, mailer)
+
+			before := len(repo.logins)
+			login, err := p.Record(requestContext(tt.ip, tt.userAgent), loginmodels.Attempt{UserID: 7, Email: "jane@homerow.tech", Method: "local", AMR: tt.amr, RecentFailures: tt.failures})
+			if !reflect.DeepEqual(login.Signals, tt.wantSignals) {
+				t.Errorf("signals = %v, want %v", login.Signals, tt.wantSignals)
+			}
+			if tt.wantDenied {
+				if rerr, ok := gopkgerrors.Cause(err).(*errors.RestError); !ok || rerr.Reason != errors.ReasonMFARequired {
+					t.Fatalf("Record() error = %v, want mfa_required", err)
+				}
+				if len(repo.logins) != before {
+					t.Errorf("a rejected login was recorded")
+				}
+			} else if err != nil || len(repo.logins) != before+1 {
+				t.Fatalf("Record() error = %v, recorded %d logins", err, len(repo.logins)-before)
+			}
+
+			risky := len(tt.wantSignals) > 0
+			if got := len(auditor.Events) == 1 && auditor.Events[0].Event == auditmodels.EventLoginSuspicious; got != risky {
+				t.Errorf("audit events = %+v, want suspicious %v", auditor.Events, risky)
+			}
+			if got := len(mailer.sent) == 1; got != risky {
+				t.Errorf("notified = %v, want %v", got, risky)
+			}
+		})
+	}
+}
+
+func TestDevice(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{chromeMac, "Chrome on macOS"},
+		{firefoxWin, "Firefox on Windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/83.0.4103.97 Safari/537.36 Edg/83.0.478.45", "Edge on Windows"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 13_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.1 Mobile/15E148 Safari/604.1", "Safari on iOS"},
+		{"curl/7.64.1", "curl"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := loginmodels.Device(tt.userAgent); got != tt.want {
+			t.Errorf("Device(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{net.ParseIP("203.0.113.77"), "203.0.113.0/24"},
+		{net.ParseIP("2001:db8:abcd:12:1:2:3:4"), "2001:db8:abcd:12::/64"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := loginmodels.Network(tt.ip); got != tt.want {
+			t.Errorf("Network(%v) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
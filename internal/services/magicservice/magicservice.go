@@ -0,0 +1,293 @@
+package magicservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/internal/services/authenticatorservice"
+	"github.com/tjsampson/token-svc/internal/services/mailservice"
+	"github.com/tjsampson/token-svc/internal/services/throttleservice"
+
+	"go.uber.org/zap"
+)
+
+const codeDigits = 6
+
+// Provider is the passwordless (magic link and email code) login interface
+// Start emails a single use link and code, bound to the requesting browser by the returned binding (a cookie)
+// Verify checks the link token or code from the same browser and returns the user to log in
+type Provider interface {
+	Start(ctx context.Context, email string) (binding string, err error)
+	Verify(ctx context.Context, binding string, verify *authmodels.MagicLoginVerify) (userID int, err error)
+}
+
+// Cache is the subset of redis.Provider the magic link provider uses (the single use links)
+type Cache interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, exp time.Duration) error
+	Incr(ctx context.Context, key string, exp time.Duration) (int64, error)
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	Del(ctx context.Context, keys ...string) error
+}
+
+type provider struct {
+	logger        log.Factory
+	cfg           *config.Config
+	redis         Cache
+	userRepo      userrepo.Store
+	authenticator authenticatorservice.Provider
+	throttle      throttleservice.Provider
+	auditor       auditservice.Provider
+	mailer        mailservice.Provider
+}
+
+// pendingLogin is the cached login (keyed by the hash of the binding)
+// the token and code are hashed with the binding, the cache alone can not be used to guess a code
+type pendingLogin struct {
+	UserID        int    `json:"user_id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	TokenHash     string `json:"token_hash"`
+	CodeHash      string `json:"code_hash"`
+}
+
+// New returns a new magic login Provider
+func New(cfg *config.Config, logger log.Factory, redisClient Cache, userRepo userrepo.Store, authenticator authenticatorservice.Provider, throttle throttleservice.Provider, auditor auditservice.Provider, mailer mailservice.Provider) Provider {
+	return &provider{
+		logger:        logger.With(zap.String("package", "magicservice")),
+		cfg:           cfg,
+		redis:         redisClient,
+		userRepo:      userRepo,
+		authenticator: authenticator,
+		throttle:      throttle,
+		auditor:       auditor,
+		mailer:        mailer,
+	}
+}
+
+func notEnabled() error {
+	return &errors.RestError{
+		Code:    404,
+		Message: "magic link login is not enabled",
+	}
+}
+
+func invalidLogin(originalErr error) error {
+	return &errors.RestError{
+		Code:          401,
+		Message:       "invalid or expired login code",
+		OriginalError: originalErr,
+	}
+}
+
+// randomHex returns a random hex string
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// randomCode returns a random numeric code
+func randomCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", codeDigits, n.Int64()), nil
+}
+
+// hashSecret hashes the token or code with the browser binding
+func hashSecret(binding, secret string) string {
+	sum := sha256.Sum256([]byte(binding + ":" + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *provider) lifeSpan() time.Duration {
+	return time.Duration(p.cfg.Magic.LifeSpanSecs) * time.Second
+}
+
+func (p *provider) loginKey(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return fmt.Sprintf("%v-%v", p.cfg.Magic.CacheKeyID, hex.EncodeToString(sum[:]))
+}
+
+func (p *provider) sendsKey(email string) string {
+	return fmt.Sprintf("%v-sends-%v", p.cfg.Magic.CacheKeyID, strings.ToLower(email))
+}
+
+// isNotFound reports if the repo error is a missing record
+func isNotFound(err error) bool {
+	restErr, ok := err.(*errors.RestError)
+	return ok && restErr.Code == 404
+}
+
+// Start emails a login link and code to the user
+// the response is the same whether or not the email has an account (only active local accounts get an email)
+func (p *provider) Start(ctx context.Context, email string) (string, error) {
+	p.logger.For(ctx).Info("entering magicservice.Start", zap.String("email", email))
+	if !p.cfg.Magic.Enabled {
+		return "", notEnabled()
+	}
+
+	if err := p.throttle.Allow(ctx, requestcontext.UserIP(ctx), email); err != nil {
+		p.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginBlocked, Outcome: auditmodels.OutcomeDenied, Email: email, Details: map[string]interface{}{"reason": err.Error(), "method": "magic"}})
+		return "", err
+	}
+
+	// the emails per address are limited (known or not), so the limit reveals nothing
+	sends, err := p.redis.Incr(ctx, p.sendsKey(email), p.lifeSpan())
+	if err != nil {
+		return "", errors.ErrorWrapper(err, "MagicService.Start.Incr")
+	}
+	if sends > int64(p.cfg.Magic.MaxSends) {
+		retryAfter, _ := p.redis.TTL(ctx, p.sendsKey(email))
+		if retryAfter <= 0 {
+			retryAfter = p.lifeSpan()
+		}
+		return "", &errors.RestError{Code: 429, Message: "too many login emails, try again later", RetryAfterSecs: int(retryAfter.Seconds()) + 1}
+	}
+
+	binding, err := randomHex(32)
+	if err != nil {
+		return "", errors.ErrorWrapper(err, "MagicService.Start.binding")
+	}
+
+	user, err := p.userRepo.ReadByEmail(ctx, email)
+	if isNotFound(err) {
+		p.logger.For(ctx).Info("magic login for an unknown email", zap.String("email", email))
+		return binding, nil
+	}
+	if err != nil {
+		return "", errors.ErrorWrapper(err, "MagicService.Start.ReadByEmail")
+	}
+	// directory accounts sign in with the directory (it may have disabled the account)
+	if !user.CanAuthenticate() || p.authenticator.Backend(user.Email) != authenticatorservice.BackendLocal {
+		p.logger.For(ctx).Info("magic login not allowed for the account", zap.String("email", email), zap.String("status", user.Status))
+		return binding, nil
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return "", errors.ErrorWrapper(err, "MagicService.Start.token")
+	}
+	code, err := randomCode()
+	if err != nil {
+		return "", errors.ErrorWrapper(err, "MagicService.Start.code")
+	}
+
+	cached, _ := json.Marshal(pendingLogin{
+		UserID:        user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		TokenHash:     hashSecret(binding, token),
+		CodeHash:      hashSecret(binding, code),
+	})
+	if err = p.redis.Set(ctx, p.loginKey(binding), string(cached), p.lifeSpan()); err != nil {
+		return "", errors.ErrorWrapper(err, "MagicService.Start.cacheLogin")
+	}
+
+	link := p.cfg.Magic.LinkURL + "?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Sign in to %s with this link:\n\n%s\n\nor enter the code %s\n\n"+
+		"The link and code expire in %d minutes and only work in the browser you requested them from. "+
+		"If you did not request them, ignore this email.\n",
+		p.cfg.API.ServiceName, link, code, p.cfg.Magic.LifeSpanSecs/60)
+	if err = p.mailer.Send(ctx, user.Email, "Your sign in link", body); err != nil {
+		return "", errors.ErrorWrapper(err, "MagicService.Start.Send")
+	}
+
+	p.logger.For(ctx).Info("leaving magicservice.Start", zap.String("email", email))
+	return binding, nil
+}
+
+// Verify checks the link token or code, a login is single use and allows MaxAttempts guesses
+func (p *provider) Verify(ctx context.Context, binding string, verify *authmodels.MagicLoginVerify) (int, error) {
+	p.logger.For(ctx).Info("entering magicservice.Verify")
+	if !p.cfg.Magic.Enabled {
+		return 0, notEnabled()
+	}
+	if binding == "" {
+		return 0, invalidLogin(fmt.Errorf("missing browser binding"))
+	}
+
+	key := p.loginKey(binding)
+	cached, err := p.redis.Get(ctx, key)
+	if err != nil {
+		return 0, invalidLogin(err)
+	}
+	login := pendingLogin{}
+	if err = json.Unmarshal([]byte(cached), &login); err != nil {
+		return 0, errors.ErrorWrapper(err, "MagicService.Verify.pendingLogin")
+	}
+
+	loginFailure := func(reason string) {
+		p.auditor.Record(ctx, auditmodels.Event{Event: auditmodels.EventLoginFailure, Outcome: auditmodels.OutcomeFailure, SubjectID: login.UserID, Email: login.Email, Details: map[string]interface{}{"reason": reason, "method": "magic"}})
+	}
+
+	attempts, err := p.redis.Incr(ctx, key+"-attempts", p.lifeSpan())
+	if err != nil {
+		return 0, errors.ErrorWrapper(err, "MagicService.Verify.Incr")
+	}
+	if attempts > int64(p.cfg.Magic.MaxAttempts) {
+		// the login is burned, the user has to request another one
+		if err = p.redis.Del(ctx, key); err != nil {
+			p.logger.For(ctx).Error("failed to delete magic login", zap.Error(err))
+		}
+		loginFailure("too many attempts")
+		return 0, invalidLogin(fmt.Errorf("too many attempts"))
+	}
+
+	secret, expected := verify.Token, login.TokenHash
+	if verify.Token == "" {
+		secret, expected = verify.Code, login.CodeHash
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(binding, secret)), []byte(expected)) != 1 {
+		loginFailure("invalid code")
+		if throttleErr := p.throttle.Failed(ctx, requestcontext.UserIP(ctx), login.Email); throttleErr != nil {
+			return 0, throttleErr
+		}
+		return 0, invalidLogin(nil)
+	}
+
+	// single use, a concurrent verify of the same login loses
+	used, err := p.redis.Incr(ctx, key+"-used", p.lifeSpan())
+	if err != nil || used > 1 {
+		return 0, invalidLogin(err)
+	}
+	if err = p.redis.Del(ctx, key, key+"-attempts"); err != nil {
+		p.logger.For(ctx).Error("failed to delete magic login", zap.Error(err))
+	}
+
+	// the user received the email, the address is verified
+	if !login.EmailVerified {
+		if _, err = p.userRepo.VerifyEmail(ctx, login.UserID, outboxmodels.Event{
+			Type:   outboxmodels.EventEmailVerified,
+			UserID: login.UserID,
+			Data:   map[string]interface{}{"email": login.Email, "method": "magic"},
+		}); err != nil {
+			return 0, errors.ErrorWrapper(err, "MagicService.Verify.VerifyEmail")
+		}
+	}
+
+	p.logger.For(ctx).Info("leaving magicservice.Verify", zap.Int("user_id", login.UserID))
+	return login.UserID, nil
+}
@@ -0,0 +1,276 @@
+package magicservice
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/authmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/services/authenticatorservice"
+	"github.com/tjsampson/token-svc/internal/services/throttleservice"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	gopkgerrors "github.com/pkg/errors"
+)
+
+type mockUserRepo struct {
+	userrepo.Store
+	users  map[string]usermodels.Record
+	events []outboxmodels.Event
+}
+
+func (m *mockUserRepo) ReadByEmail(ctx context.Context, email string) (usermodels.Record, error) {
+	user, ok := m.users[email]
+	if !ok {
+		return user, &errors.RestError{Code: 404, Message: "Resource not found"}
+	}
+	return user, nil
+}
+
+func (m *mockUserRepo) VerifyEmail(ctx context.Context, userID int, events ...outboxmodels.Event) (bool, error) {
+	m.events = append(m.events, events...)
+	return true, nil
+}
+
+type mockAuthenticator struct {
+	authenticatorservice.Provider
+}
+
+func (m *mockAuthenticator) Backend(email string) string {
+	if email == "ldap@staff.example.com" {
+		return authenticatorservice.BackendLDAP
+	}
+	return authenticatorservice.BackendLocal
+}
+
+type mockThrottle struct {
+	throttleservice.Provider
+	failed int
+}
+
+func (m *mockThrottle) Allow(ctx context.Context, ip net.IP, email string) error {
+	return nil
+}
+
+func (m *mockThrottle) Failed(ctx context.Context, ip net.IP, email string) error {
+	m.failed++
+	return nil
+}
+
+type sentMail struct {
+	to, body string
+}
+
+type mockMailer struct {
+	sent []sentMail
+}
+
+func (m *mockMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.sent = append(m.sent, sentMail{to: to, body: body})
+	return nil
+}
+
+type testDeps struct {
+	userRepo *mockUserRepo
+	redis    *testhelper.Redis
+	throttle *mockThrottle
+	mailer   *mockMailer
+}
+
+func newTestProvider() (*provider, testDeps) {
+	cfg := &config.Config{}
+	cfg.API.ServiceName = "token-svc"
+	cfg.Magic.Enabled = true
+	cfg.Magic.LinkURL = "https://id.example.com/login/magic"
+	cfg.Magic.LifeSpanSecs = 600
+	cfg.Magic.MaxAttempts = 3
+	cfg.Magic.MaxSends = 2
+	cfg.Magic.CacheKeyID = "magic-login"
+	deps := testDeps{
+		redis:    testhelper.NewRedis(),
+		throttle: &mockThrottle{},
+		mailer:   &mockMailer{},
+	}
+	deps.userRepo = &mockUserRepo{users: map[string]usermodels.Record{
+		"jane@example.com":       {ID: 7, Email: "jane@example.com", Status: usermodels.StatusActive},
+		"locked@example.com":     {ID: 8, Email: "locked@example.com", Status: usermodels.StatusLocked},
+		"ldap@staff.example.com": {ID: 9, Email: "ldap@staff.example.com", Status: usermodels.StatusActive},
+		"sam@example.com":        {ID: 10, Email: "sam@example.com", EmailVerified: true, Status: usermodels.StatusActive},
+	}}
+	p := New(cfg, log.NewNopFactory(), deps.redis, deps.userRepo, &mockAuthenticator{}, deps.throttle, &testhelper.Auditor{}, deps.mailer).(*provider)
+	return p, deps
+}
+
+var codePattern = regexp.MustCompile(`code (\d{6})`)
+var linkPattern = regexp.MustCompile(`https://\S+`)
+
+// secrets returns the link token and code from the email
+func secrets(t *testing.T, body string) (string, string) {
+	link, err := url.Parse(linkPattern.FindString(body))
+	if err != nil {
+		t.Fatalf("no link in %q", body)
+	}
+	code := codePattern.FindStringSubmatch(body)
+	if len(code) != 2 {
+		t.Fatalf("no code in %q", body)
+	}
+	return link.Query().Get("token"), code[1]
+}
+
+func errCode(err error) int {
+	if rerr, ok := gopkgerrors.Cause(err).(*errors.RestError); ok {
+		return rerr.Code
+	}
+	return 0
+}
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		wantMail bool
+	}{
+		{name: "active local account", email: "jane@example.com", wantMail: true},
+		{name: "unknown email", email: "nobody@example.com"},
+		{name: "locked account", email: "locked@example.com"},
+		{name: "directory account", email: "ldap@staff.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, deps := newTestProvider()
+			binding, err := p.Start(context.Background(), tt.email)
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			// the response is the same for every email
+			if len(binding) != 64 {
+				t.Errorf("binding = %q, want 32 random bytes", binding)
+			}
+			if got := len(deps.mailer.sent) == 1; got != tt.wantMail {
+				t.Errorf("mail sent = %v, want %v", got, tt.wantMail)
+			}
+		})
+	}
+}
+
+func TestStartSendLimit(t *testing.T) {
+	p, deps := newTestProvider()
+	for i := 0; i < 2; i++ {
+		if _, err := p.Start(context.Background(), "jane@example.com"); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+	}
+	if _, err := p.Start(context.Background(), "Jane@example.com"); errCode(err) != 429 {
+		t.Errorf("Start() error = %v, want 429", err)
+	}
+	if len(deps.mailer.sent) != 2 {
+		t.Errorf("sent %d emails, want 2", len(deps.mailer.sent))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name        string
+		otherDevice bool
+		wrongFirst  int
+		useToken    bool
+		wantErr     bool
+	}{
+		{name: "code", useToken: false},
+		{name: "link token", useToken: true},
+		{name: "code after a wrong guess", wrongFirst: 1},
+		{name: "another browser", otherDevice: true, wantErr: true},
+		{name: "too many attempts", wrongFirst: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, deps := newTestProvider()
+			ctx := context.Background()
+			binding, err := p.Start(ctx, "jane@example.com")
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			token, code := secrets(t, deps.mailer.sent[0].body)
+
+			for i := 0; i < tt.wrongFirst; i++ {
+				wrong := fmt.Sprintf("%06d", (i+1)*111111)
+				if wrong == code {
+					wrong = "000000"
+				}
+				if _, err = p.Verify(ctx, binding, &authmodels.MagicLoginVerify{Code: wrong}); errCode(err) != 401 {
+					t.Fatalf("Verify(wrong code) error = %v, want 401", err)
+				}
+			}
+			if deps.throttle.failed != tt.wrongFirst {
+				t.Errorf("throttle failures = %d, want %d", deps.throttle.failed, tt.wrongFirst)
+			}
+
+			verify := &authmodels.MagicLoginVerify{Code: code}
+			if tt.useToken {
+				verify = &authmodels.MagicLoginVerify{Token: token}
+			}
+			if tt.otherDevice {
+				binding, _ = randomHex(32)
+			}
+			userID, err := p.Verify(ctx, binding, verify)
+			if tt.wantErr {
+				if errCode(err) != 401 {
+					t.Fatalf("Verify() error = %v, want 401", err)
+				}
+				return
+			}
+			if err != nil || userID != 7 {
+				t.Fatalf("Verify() = %d, %v, want user 7", userID, err)
+			}
+
+			// single use
+			if _, err = p.Verify(ctx, binding, verify); errCode(err) != 401 {
+				t.Errorf("second Verify() error = %v, want 401", err)
+			}
+		})
+	}
+}
+
+func TestVerifyEmailVerified(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		wantEvents int
+	}{
+		{"unverified email", "jane@example.com", 1},
+		{"already verified", "sam@example.com", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, deps := newTestProvider()
+			ctx := context.Background()
+			binding, err := p.Start(ctx, tt.email)
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			_, code := secrets(t, deps.mailer.sent[0].body)
+			if deps.userRepo.events != nil {
+				t.Fatalf("Start() verified the email before the code was entered")
+			}
+
+			if _, err = p.Verify(ctx, binding, &authmodels.MagicLoginVerify{Code: code}); err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if len(deps.userRepo.events) != tt.wantEvents {
+				t.Fatalf("Verify() events = %+v, want %d", deps.userRepo.events, tt.wantEvents)
+			}
+			if tt.wantEvents != 0 && (deps.userRepo.events[0].Type != outboxmodels.EventEmailVerified || deps.userRepo.events[0].Data["email"] != tt.email) {
+				t.Errorf("Verify() event = %+v", deps.userRepo.events[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package mailservice
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+
+	"go.uber.org/zap"
+)
+
+// Mail backends
+// the log backend writes the message to the log instead of sending it (local development only)
+const (
+	BackendLog  = "log"
+	BackendSMTP = "smtp"
+)
+
+// Provider is the outgoing mail interface (plain text messages)
+type Provider interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+type logProvider struct {
+	logger log.Factory
+}
+
+type smtpProvider struct {
+	logger log.Factory
+	cfg    *config.Config
+}
+
+// New returns the configured mail Provider
+func New(cfg *config.Config, logger log.Factory) Provider {
+	logger = logger.With(zap.String("package", "mailservice"))
+	if cfg.Mail.Backend == BackendSMTP {
+		return &smtpProvider{logger: logger, cfg: cfg}
+	}
+	return &logProvider{logger: logger}
+}
+
+func (p *logProvider) Send(ctx context.Context, to, subject, body string) error {
+	p.logger.For(ctx).Info("mail (log backend, not sent)", zap.String("to", to), zap.String("subject", subject), zap.String("body", body))
+	return nil
+}
+
+// message returns the RFC 5322 message
+func message(from, to, subject, body string) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().UTC().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.Replace(body, "\n", "\r\n", -1))
+}
+
+// Send sends the message, STARTTLS is required unless the server is local (the message holds login secrets)
+func (p *smtpProvider) Send(ctx context.Context, to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("mail header contains a line break")
+	}
+	p.logger.For(ctx).Info("entering mailservice.Send", zap.String("to", to), zap.String("subject", subject))
+	defer p.logger.For(ctx).Info("leaving mailservice.Send", zap.String("to", to))
+
+	addr := net.JoinHostPort(p.cfg.Mail.Host, fmt.Sprint(p.cfg.Mail.Port))
+	timeout := time.Duration(p.cfg.Mail.TimeoutSecs) * time.Second
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	client, err := smtp.NewClient(conn, p.cfg.Mail.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: p.cfg.Mail.Host}); err != nil {
+			return err
+		}
+	} else if !p.cfg.Mail.AllowInsecure {
+		return fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+	}
+	if p.cfg.Mail.Username != "" {
+		if err = client.Auth(smtp.PlainAuth("", p.cfg.Mail.Username, p.cfg.Mail.Password, p.cfg.Mail.Host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(p.cfg.Mail.From); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(message(p.cfg.Mail.From, to, subject, body)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,166 @@
+package mtlsservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/tokenmodels"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+	"github.com/tjsampson/token-svc/internal/services/jwtservice"
+
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+)
+
+// Provider is the mutual tls (RFC 8705) interface
+// TLSConfig is the server's tls config (nil when mtls is disabled), a client certificate is optional
+// and is verified against the client ca bundle, ClientCredentials authenticates an oauth client by its
+// certificate (tls_client_auth) and issues it an access token bound to the certificate (cnf.x5t#S256)
+type Provider interface {
+	TLSConfig() *tls.Config
+	ClientCredentials(ctx context.Context, clientID string, state *tls.ConnectionState) (tokenmodels.ClientTokenResponse, error)
+}
+
+type provider struct {
+	logger    log.Factory
+	cfg       *config.Config
+	jwtClient jwtservice.Provider
+	auditor   auditservice.Provider
+	tlsConfig *tls.Config
+	clients   map[string]config.MTLSClient
+}
+
+// New returns a new mtls Provider (an unreadable certificate or an invalid client is an error)
+func New(cfg *config.Config, logger log.Factory, jwtClient jwtservice.Provider, auditor auditservice.Provider) (Provider, error) {
+	p := &provider{
+		logger:    logger.With(zap.String("package", "mtlsservice")),
+		cfg:       cfg,
+		jwtClient: jwtClient,
+		auditor:   auditor,
+		clients:   map[string]config.MTLSClient{},
+	}
+	if !cfg.MTLS.Enabled {
+		return p, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cfg.MTLS.CertificatePath, cfg.MTLS.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mtls server certificate: %v", err)
+	}
+	caBundle, err := ioutil.ReadFile(cfg.MTLS.ClientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mtls client ca bundle: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("invalid mtls client ca bundle: no certificates in %s", cfg.MTLS.ClientCAPath)
+	}
+
+	for _, client := range cfg.MTLS.Clients {
+		if client.ClientID == "" || (client.SubjectDN == "") == (client.SANDNS == "") {
+			return nil, fmt.Errorf("invalid mtls client %q: a client id and either a subject dn or a san dns name are required", client.ClientID)
+		}
+		p.clients[client.ClientID] = client
+	}
+
+	p.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    clientCAs,
+		// browsers and api clients without a certificate still connect, a presented certificate must verify
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}
+	return p, nil
+}
+
+func (p *provider) TLSConfig() *tls.Config {
+	return p.tlsConfig
+}
+
+// ClientCredentials issues the client's access token (client credentials grant)
+// the client is authenticated by its verified certificate, which must have the client's subject dn or san dns name
+func (p *provider) ClientCredentials(ctx context.Context, clientID string, state *tls.ConnectionState) (tokenmodels.ClientTokenResponse, error) {
+	p.logger.For(ctx).Info("entering mtlsservice.ClientCredentials", zap.String("client_id", clientID))
+	if !p.cfg.MTLS.Enabled {
+		return tokenmodels.ClientTokenResponse{}, &errors.RestError{Code: http.StatusNotFound, Message: "mutual tls is disabled"}
+	}
+
+	cert := PeerCertificate(state)
+	client, ok := p.clients[clientID]
+	if !ok || cert == nil || !matches(client, cert) {
+		reason := "certificate does not match the client"
+		if cert == nil {
+			reason = "no client certificate"
+		}
+		p.logger.For(ctx).Error("client authentication failed", zap.String("client_id", clientID), zap.String("reason", reason))
+		p.auditor.Record(ctx, auditmodels.Event{
+			Event:   auditmodels.EventClientToken,
+			Outcome: auditmodels.OutcomeFailure,
+			Details: map[string]interface{}{"client_id": clientID, "reason": reason},
+		})
+		return tokenmodels.ClientTokenResponse{}, &errors.RestError{Code: http.StatusUnauthorized, Message: "invalid client"}
+	}
+
+	x5t := Thumbprint(cert)
+	accessTokenChan := make(chan tokenmodels.TokenResult, 1)
+	p.jwtClient.GenerateAccessToken(ctx, accessTokenChan, map[string]interface{}{
+		"subject":   clientID,
+		"id":        uuid.NewV4().String(),
+		"name":      clientID,
+		"client_id": clientID,
+		"x5t":       x5t,
+	})
+	accessTokenResult := <-accessTokenChan
+	if accessTokenResult.Err != nil {
+		return tokenmodels.ClientTokenResponse{}, errors.ErrorWrapper(accessTokenResult.Err, "MTLSService.ClientCredentials.GenerateAccessToken")
+	}
+
+	p.auditor.Record(ctx, auditmodels.Event{
+		Event:   auditmodels.EventClientToken,
+		Outcome: auditmodels.OutcomeSuccess,
+		Details: map[string]interface{}{"client_id": clientID, "x5t#S256": x5t},
+	})
+	p.logger.For(ctx).Info("leaving mtlsservice.ClientCredentials", zap.String("client_id", clientID))
+	return tokenmodels.ClientTokenResponse{
+		AccessToken: accessTokenResult.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   60 * int(p.cfg.Token.AccessTokenLifeSpanMins),
+	}, nil
+}
+
+// matches reports if the certificate is the client's (tls_client_auth_subject_dn or tls_client_auth_san_dns)
+func matches(client config.MTLSClient, cert *x509.Certificate) bool {
+	if client.SubjectDN != "" {
+		return cert.Subject.String() == client.SubjectDN
+	}
+	for _, name := range cert.DNSNames {
+		if name == client.SANDNS {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerCertificate returns the connection's verified client certificate (nil without one, or without tls)
+func PeerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// Thumbprint returns the certificate's x5t#S256 (the base64url SHA-256 of its DER encoding)
+func Thumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,256 @@
+package mtlsservice
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/tokenmodels"
+	"github.com/tjsampson/token-svc/internal/services/jwtservice"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	gopkgerrors "github.com/pkg/errors"
+)
+
+type mockJWTClient struct {
+	jwtservice.Provider
+	tokenData map[string]interface{}
+}
+
+func (m *mockJWTClient) GenerateAccessToken(ctx context.Context, aTokenChan chan tokenmodels.TokenResult, tokenData map[string]interface{}) {
+	m.tokenData = tokenData
+	aTokenChan <- tokenmodels.TokenResult{Token: "access-token"}
+	close(aTokenChan)
+}
+
+// testCA issues the test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate (and its key) signed by the ca, as PEM
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) clientCert(t *testing.T, template *x509.Certificate) tls.Certificate {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	certPEM, keyPEM := ca.issue(t, template)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testConfig writes the server certificate and client ca bundle, the clients are billing (subject dn) and reports (san dns)
+func testConfig(t *testing.T, dir string, serverCA, clientCA *testCA) *config.Config {
+	certPEM, keyPEM := serverCA.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "token-svc"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	cfg := &config.Config{}
+	cfg.Token.AccessTokenLifeSpanMins = 15
+	cfg.MTLS.Enabled = true
+	cfg.MTLS.CertificatePath = writeFile(t, dir, "server.crt", certPEM)
+	cfg.MTLS.KeyPath = writeFile(t, dir, "server.key", keyPEM)
+	cfg.MTLS.ClientCAPath = writeFile(t, dir, "client-ca.crt", clientCA.pem)
+	cfg.MTLS.Clients = []config.MTLSClient{
+		{ClientID: "billing", SubjectDN: "CN=billing,O=Homerow"},
+		{ClientID: "reports", SANDNS: "reports.homerow.internal"},
+	}
+	return cfg
+}
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtlsservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCA, clientCA := newTestCA(t, "server ca"), newTestCA(t, "client ca")
+
+	tests := []struct {
+		name    string
+		edit    func(cfg *config.Config)
+		wantErr bool
+	}{
+		{name: "valid", edit: func(cfg *config.Config) {}},
+		{name: "disabled", edit: func(cfg *config.Config) { cfg.MTLS.Enabled, cfg.MTLS.CertificatePath = false, "missing" }},
+		{name: "missing server certificate", edit: func(cfg *config.Config) { cfg.MTLS.CertificatePath = "missing" }, wantErr: true},
+		{name: "empty ca bundle", edit: func(cfg *config.Config) { cfg.MTLS.ClientCAPath = writeFile(t, dir, "empty.crt", []byte("")) }, wantErr: true},
+		{name: "client without a match", edit: func(cfg *config.Config) { cfg.MTLS.Clients = []config.MTLSClient{{ClientID: "billing"}} }, wantErr: true},
+		{name: "client with both matches", edit: func(cfg *config.Config) {
+			cfg.MTLS.Clients = []config.MTLSClient{{ClientID: "billing", SubjectDN: "CN=billing", SANDNS: "billing"}}
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, dir, serverCA, clientCA)
+			tt.edit(cfg)
+			p, err := New(cfg, log.NewNopFactory(), &mockJWTClient{}, &testhelper.Auditor{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (p.TLSConfig() != nil) != cfg.MTLS.Enabled {
+				t.Errorf("TLSConfig() = %v, want a config only when enabled", p.TLSConfig())
+			}
+		})
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtlsservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverCA, clientCA, otherCA := newTestCA(t, "server ca"), newTestCA(t, "client ca"), newTestCA(t, "other ca")
+
+	jwtClient := &mockJWTClient{}
+	auditor := &testhelper.Auditor{}
+	p, err := New(testConfig(t, dir, serverCA, clientCA), log.NewNopFactory(), jwtClient, auditor)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// the token endpoint, it reports the request's certificate thumbprint
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if cert := PeerCertificate(req.TLS); cert != nil {
+			res.Header().Set("X-Thumbprint", Thumbprint(cert))
+		}
+		if _, err := p.ClientCredentials(req.Context(), req.FormValue("client_id"), req.TLS); err != nil {
+			res.WriteHeader(gopkgerrors.Cause(err).(*errors.RestError).Code)
+		}
+	}))
+	server.TLS = p.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	billing := clientCA.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Homerow"}}})
+	reports := clientCA.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "reports"}, DNSNames: []string{"reports.homerow.internal"}})
+	untrusted := otherCA.clientCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Homerow"}}})
+
+	tests := []struct {
+		name          string
+		clientID      string
+		cert          *tls.Certificate
+		wantStatus    int
+		wantHandshake bool
+	}{
+		{name: "subject dn", clientID: "billing", cert: &billing, wantStatus: http.StatusOK},
+		{name: "san dns", clientID: "reports", cert: &reports, wantStatus: http.StatusOK},
+		{name: "another client's certificate", clientID: "billing", cert: &reports, wantStatus: http.StatusUnauthorized},
+		{name: "unknown client", clientID: "payroll", cert: &billing, wantStatus: http.StatusUnauthorized},
+		{name: "no certificate", clientID: "billing", wantStatus: http.StatusUnauthorized},
+		{name: "untrusted certificate", clientID: "billing", cert: &untrusted, wantHandshake: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roots := x509.NewCertPool()
+			roots.AppendCertsFromPEM(serverCA.pem)
+			// the certificate is always sent (a go client skips one the server's ca list does not accept)
+			tlsConfig := &tls.Config{RootCAs: roots, GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				if tt.cert == nil {
+					return &tls.Certificate{}, nil
+				}
+				return tt.cert, nil
+			}}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			jwtClient.tokenData = nil
+
+			res, err := client.PostForm(server.URL, map[string][]string{"grant_type": {"client_credentials"}, "client_id": {tt.clientID}})
+			if tt.wantHandshake {
+				if err == nil {
+					res.Body.Close()
+					t.Fatalf("PostForm() error = nil, want a failed handshake")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PostForm() error = %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", res.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			// the token is bound to the certificate the client connected with
+			x5t := res.Header.Get("X-Thumbprint")
+			if x5t == "" || jwtClient.tokenData["x5t"] != x5t || jwtClient.tokenData["client_id"] != tt.clientID {
+				t.Errorf("token data = %v, want client_id %v and x5t %v", jwtClient.tokenData, tt.clientID, x5t)
+			}
+		})
+	}
+
+	if len(auditor.Events) != 5 {
+		t.Errorf("audit events = %d, want 5 (2 issued, 3 failed)", len(auditor.Events))
+	}
+}
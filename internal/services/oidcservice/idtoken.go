@@ -0,0 +1,192 @@
+package oidcservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tjsampson/token-svc/pkg/helpers/jwkhelpers"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.uber.org/zap"
+)
+
+const (
+	// clockSkew is the leeway allowed on the ID token times
+	clockSkew = time.Minute
+	// keysRefreshInterval limits the JWKS refetches triggered by an unknown key id
+	keysRefreshInterval = time.Minute
+)
+
+// audience is the aud claim (a string or an array of strings)
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// claimBool is a boolean claim, some providers send "true"/"false" strings
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = claimBool(v)
+	case string:
+		*b = claimBool(v == "true")
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// idTokenClaims are the ID token claims (OpenID Connect Core 2)
+type idTokenClaims struct {
+	Issuer          string    `json:"iss"`
+	Subject         string    `json:"sub"`
+	Audience        audience  `json:"aud"`
+	AuthorizedParty string    `json:"azp"`
+	ExpiresAt       int64     `json:"exp"`
+	IssuedAt        int64     `json:"iat"`
+	Nonce           string    `json:"nonce"`
+	Email           string    `json:"email"`
+	EmailVerified   claimBool `json:"email_verified"`
+	Name            string    `json:"name"`
+	AMR             []string  `json:"amr"`
+}
+
+// Valid checks the token times (exp is required)
+func (c *idTokenClaims) Valid() error {
+	now := time.Now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(clockSkew)) {
+		return fmt.Errorf("id token is expired")
+	}
+	if c.IssuedAt != 0 && now.Add(clockSkew).Before(time.Unix(c.IssuedAt, 0)) {
+		return fmt.Errorf("id token is issued in the future")
+	}
+	return nil
+}
+
+// verifyIDToken validates the ID token signature (against the provider's JWKS) and claims (OpenID Connect Core 3.1.3.7)
+func (p *provider) verifyIDToken(ctx context.Context, disc *discovery, rawIDToken, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		// asymmetric algorithms only (never none or an HMAC keyed with a public key)
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing algorithm %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, disc, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != disc.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("id token is missing the subject")
+	}
+	if !claims.Audience.contains(p.cfg.OIDC.ClientID) {
+		return nil, fmt.Errorf("id token audience %v does not include the client id", claims.Audience)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.OIDC.ClientID {
+		return nil, fmt.Errorf("unexpected authorized party %q", claims.AuthorizedParty)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("id token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// signingKey returns the provider's public key for the key id
+// an unknown key id refetches the JWKS (the provider rotated its keys)
+func (p *provider) signingKey(ctx context.Context, disc *discovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < keysRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	keys, err := p.fetchKeys(ctx, disc.JWKSURI)
+	p.keysFetchedAt = time.Now()
+	if err != nil {
+		p.logger.For(ctx).Error("failed to fetch oidc signing keys", zap.Error(err), zap.String("jwks_uri", disc.JWKSURI))
+		return nil, err
+	}
+	p.keys = keys
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds the key by id, a token without a key id is only accepted from a single key set
+func (p *provider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// fetchKeys reads the signing keys (RSA and EC) from the JWKS, other keys are skipped
+func (p *provider) fetchKeys(ctx context.Context, jwksURI string) (map[string]interface{}, error) {
+	jwks := struct {
+		Keys []jwkhelpers.JSONWebKey `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			p.logger.For(ctx).Error("skipping invalid oidc signing key", zap.Error(err), zap.String("kid", jwk.Kid))
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys in %s", jwksURI)
+	}
+	return keys, nil
+}
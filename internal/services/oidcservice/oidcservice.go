@@ -0,0 +1,283 @@
+package oidcservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+
+	"go.uber.org/zap"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+// Provider is the upstream OpenID Connect provider interface (authorization code flow with PKCE)
+// AuthCodeURL starts a login (the state must be bound to the browser), Exchange completes it
+// and returns the identity from the validated ID token
+type Provider interface {
+	AuthCodeURL(ctx context.Context) (authURL string, state string, err error)
+	Exchange(ctx context.Context, state, code string) (usermodels.Identity, error)
+}
+
+// Cache is the subset of redis.Provider the oidc provider uses (the login state cache)
+type Cache interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, exp time.Duration) error
+	Del(ctx context.Context, keys ...string) error
+}
+
+type provider struct {
+	logger log.Factory
+	cfg    *config.Config
+	redis  Cache
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *discovery
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+// discovery is the subset of the provider's discovery document we use
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// loginState is the cached per login data (keyed by the state)
+type loginState struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+type tokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+// New returns a new OIDC Provider
+// the discovery document and keys are fetched on first use (an unavailable identity provider never fails startup)
+func New(cfg *config.Config, logger log.Factory, redisClient Cache) Provider {
+	return &provider{
+		logger: logger.With(zap.String("package", "oidcservice")),
+		cfg:    cfg,
+		redis:  redisClient,
+		client: &http.Client{Timeout: time.Duration(cfg.OIDC.HTTPTimeoutSecs) * time.Second},
+	}
+}
+
+func notEnabled() error {
+	return &errors.RestError{
+		Code:    404,
+		Message: "oidc login is not enabled",
+	}
+}
+
+func invalidLogin(reason string, originalErr error) error {
+	return &errors.RestError{
+		Code:          401,
+		Message:       fmt.Sprintf("oidc login failed: %s", reason),
+		OriginalError: originalErr,
+	}
+}
+
+// randomToken returns a url safe random string
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (p *provider) stateKey(state string) string {
+	return fmt.Sprintf("%v-%v", p.cfg.OIDC.StateCacheKeyID, state)
+}
+
+// AuthCodeURL returns the identity provider's authorization url for a new login
+func (p *provider) AuthCodeURL(ctx context.Context) (string, string, error) {
+	if !p.cfg.OIDC.Enabled {
+		return "", "", notEnabled()
+	}
+	disc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", "", errors.ErrorWrapper(err, "OIDCService.AuthCodeURL.getDiscovery")
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", "", errors.ErrorWrapper(err, "OIDCService.AuthCodeURL.state")
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", "", errors.ErrorWrapper(err, "OIDCService.AuthCodeURL.nonce")
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		return "", "", errors.ErrorWrapper(err, "OIDCService.AuthCodeURL.verifier")
+	}
+
+	cached, _ := json.Marshal(loginState{Nonce: nonce, CodeVerifier: verifier})
+	if err = p.redis.Set(ctx, p.stateKey(state), string(cached), time.Duration(p.cfg.OIDC.StateLifeSpanSecs)*time.Second); err != nil {
+		return "", "", errors.ErrorWrapper(err, "OIDCService.AuthCodeURL.cacheState")
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.OIDC.ClientID},
+		"redirect_uri":          {p.cfg.OIDC.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.OIDC.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return disc.AuthorizationEndpoint + separator + params.Encode(), state, nil
+}
+
+// Exchange redeems the authorization code and validates the returned ID token
+// the state is single use, a replayed or expired state is rejected
+func (p *provider) Exchange(ctx context.Context, state, code string) (usermodels.Identity, error) {
+	p.logger.For(ctx).Info("entering oidcservice.Exchange")
+	if !p.cfg.OIDC.Enabled {
+		return usermodels.Identity{}, notEnabled()
+	}
+
+	cached, err := p.redis.Get(ctx, p.stateKey(state))
+	if err != nil || state == "" {
+		return usermodels.Identity{}, &errors.RestError{Code: 400, Message: "invalid or expired login state", OriginalError: err}
+	}
+	if err = p.redis.Del(ctx, p.stateKey(state)); err != nil {
+		p.logger.For(ctx).Error("failed to delete oidc login state", zap.Error(err))
+	}
+	login := loginState{}
+	if err = json.Unmarshal([]byte(cached), &login); err != nil {
+		return usermodels.Identity{}, errors.ErrorWrapper(err, "OIDCService.Exchange.loginState")
+	}
+
+	disc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return usermodels.Identity{}, errors.ErrorWrapper(err, "OIDCService.Exchange.getDiscovery")
+	}
+
+	rawIDToken, err := p.redeemCode(ctx, disc, code, login.CodeVerifier)
+	if err != nil {
+		return usermodels.Identity{}, invalidLogin("code exchange", err)
+	}
+
+	claims, err := p.verifyIDToken(ctx, disc, rawIDToken, login.Nonce)
+	if err != nil {
+		p.logger.For(ctx).Error("invalid oidc id token", zap.Error(err))
+		return usermodels.Identity{}, invalidLogin("invalid id token", err)
+	}
+
+	p.logger.For(ctx).Info("leaving oidcservice.Exchange", zap.String("issuer", claims.Issuer))
+	return usermodels.Identity{
+		Issuer:        claims.Issuer,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+		AMR:           claims.AMR,
+	}, nil
+}
+
+// redeemCode posts the authorization code to the token endpoint and returns the raw ID token
+func (p *provider) redeemCode(ctx context.Context, disc *discovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.OIDC.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic (the credentials are form encoded first, RFC 6749 2.3.1)
+	req.SetBasicAuth(url.QueryEscape(p.cfg.OIDC.ClientID), url.QueryEscape(p.cfg.OIDC.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded %d: %s", res.StatusCode, body)
+	}
+
+	tokens := tokenResponse{}
+	if err = json.Unmarshal(body, &tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", fmt.Errorf("token response is missing the id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// getDiscovery returns the (cached) discovery document
+// the document's issuer must match the configured issuer (OpenID Connect Discovery 4.3)
+func (p *provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	disc := &discovery{}
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.OIDC.Issuer, "/")+discoveryPath, disc); err != nil {
+		p.logger.For(ctx).Error("failed oidc discovery", zap.Error(err), zap.String("issuer", p.cfg.OIDC.Issuer))
+		return nil, err
+	}
+	if disc.Issuer != p.cfg.OIDC.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match the configured issuer %q", disc.Issuer, p.cfg.OIDC.Issuer)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing an endpoint")
+	}
+	p.discovery = disc
+	return disc, nil
+}
+
+func (p *provider) getJSON(ctx context.Context, target string, model interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %d", target, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(model)
+}
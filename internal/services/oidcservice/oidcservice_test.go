@@ -0,0 +1,245 @@
+package oidcservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testClientID = "token-svc"
+
+// mockIdentityProvider is a minimal OIDC provider, the token endpoint returns the idToken built for the redeemed code
+type mockIdentityProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	idToken  func(nonce string) string
+	verifier string
+	nonce    string
+}
+
+func newMockIdentityProvider(t *testing.T) *mockIdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdentityProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(res http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(res).Encode(discovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(res http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(res).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		clientID, secret, _ := req.BasicAuth()
+		if clientID != testClientID || secret != "shh" || req.FormValue("code") != "the-code" || req.FormValue("grant_type") != "authorization_code" {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		idp.verifier = req.FormValue("code_verifier")
+		json.NewEncoder(res).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idp.idToken(idp.nonce)})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *mockIdentityProvider) sign(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (idp *mockIdentityProvider) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            "248289761001",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(5 * time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "jane@homerow.tech",
+		"email_verified": true,
+		"name":           "Jane Doe",
+	}
+}
+
+func testProvider(issuer string) (*provider, *testhelper.Redis) {
+	cfg := &config.Config{}
+	cfg.OIDC.Enabled = true
+	cfg.OIDC.Issuer = issuer
+	cfg.OIDC.ClientID = testClientID
+	cfg.OIDC.ClientSecret = "shh"
+	cfg.OIDC.RedirectURL = "https://dev.homerow.tech/login/oidc/callback"
+	cfg.OIDC.Scopes = []string{"openid", "email"}
+	cfg.OIDC.StateCacheKeyID = "oidc-state"
+	cfg.OIDC.StateLifeSpanSecs = 600
+	cfg.OIDC.HTTPTimeoutSecs = 2
+	redisClient := testhelper.NewRedis()
+	return New(cfg, log.NewNopFactory(), redisClient).(*provider), redisClient
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	defer idp.server.Close()
+	p, redisClient := testProvider(idp.server.URL)
+
+	authURL, state, err := p.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatalf("AuthCodeURL() error = %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := parsed.Query()
+	if parsed.Path != "/authorize" || params.Get("client_id") != testClientID || params.Get("response_type") != "code" ||
+		params.Get("scope") != "openid email" || params.Get("state") != state || params.Get("code_challenge_method") != "S256" ||
+		params.Get("redirect_uri") != p.cfg.OIDC.RedirectURL {
+		t.Errorf("AuthCodeURL() = %s", authURL)
+	}
+
+	cached := loginState{}
+	if err = json.Unmarshal([]byte(redisClient.Values["oidc-state-"+state]), &cached); err != nil {
+		t.Fatalf("login state not cached: %v", err)
+	}
+	challenge := sha256.Sum256([]byte(cached.CodeVerifier))
+	if params.Get("nonce") != cached.Nonce || params.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		t.Errorf("AuthCodeURL() nonce/challenge do not match the cached login state")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	defer idp.server.Close()
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name         string
+		idToken      func(nonce string) string
+		badState     bool
+		wantErr      bool
+		wantVerified bool
+	}{
+		{"valid", func(nonce string) string {
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, idp.claims(nonce))
+		}, false, false, true},
+		{"email_verified string", func(nonce string) string {
+			claims := idp.claims(nonce)
+			claims["email_verified"] = "true"
+			claims["aud"] = []string{testClientID, "other"}
+			claims["azp"] = testClientID
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, claims)
+		}, false, false, true},
+		{"unverified email", func(nonce string) string {
+			claims := idp.claims(nonce)
+			delete(claims, "email_verified")
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, claims)
+		}, false, false, false},
+		{"unknown state", func(nonce string) string {
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, idp.claims(nonce))
+		}, true, true, false},
+		{"nonce mismatch", func(nonce string) string {
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, idp.claims("replayed"))
+		}, false, true, false},
+		{"wrong audience", func(nonce string) string {
+			claims := idp.claims(nonce)
+			claims["aud"] = "another-client"
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, claims)
+		}, false, true, false},
+		{"wrong issuer", func(nonce string) string {
+			claims := idp.claims(nonce)
+			claims["iss"] = "https://evil.example.com"
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, claims)
+		}, false, true, false},
+		{"expired", func(nonce string) string {
+			claims := idp.claims(nonce)
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, claims)
+		}, false, true, false},
+		{"missing exp", func(nonce string) string {
+			claims := idp.claims(nonce)
+			delete(claims, "exp")
+			return idp.sign(t, jwt.SigningMethodRS256, idp.key, claims)
+		}, false, true, false},
+		{"wrong signing key", func(nonce string) string {
+			return idp.sign(t, jwt.SigningMethodRS256, otherKey, idp.claims(nonce))
+		}, false, true, false},
+		{"hmac algorithm", func(nonce string) string {
+			return idp.sign(t, jwt.SigningMethodHS256, []byte("secret"), idp.claims(nonce))
+		}, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, redisClient := testProvider(idp.server.URL)
+			_, state, err := p.AuthCodeURL(context.Background())
+			if err != nil {
+				t.Fatalf("AuthCodeURL() error = %v", err)
+			}
+			cached := loginState{}
+			json.Unmarshal([]byte(redisClient.Values["oidc-state-"+state]), &cached)
+			idp.nonce = cached.Nonce
+			idp.idToken = tt.idToken
+			if tt.badState {
+				state = "forged"
+			}
+
+			identity, err := p.Exchange(context.Background(), state, "the-code")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exchange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(redisClient.Values) != 0 && !tt.badState {
+				t.Errorf("Exchange() left the login state cached (state must be single use)")
+			}
+			if tt.wantErr {
+				return
+			}
+			if idp.verifier != cached.CodeVerifier {
+				t.Errorf("Exchange() sent code_verifier %q, want %q", idp.verifier, cached.CodeVerifier)
+			}
+			if identity.Issuer != idp.server.URL || identity.Subject != "248289761001" || identity.Email != "jane@homerow.tech" || identity.EmailVerified != tt.wantVerified {
+				t.Errorf("Exchange() = %+v", identity)
+			}
+		})
+	}
+}
+
+func TestNotEnabled(t *testing.T) {
+	p, _ := testProvider("https://idp.example.com")
+	p.cfg.OIDC.Enabled = false
+	if _, _, err := p.AuthCodeURL(context.Background()); err == nil {
+		t.Errorf("AuthCodeURL() expected an error when oidc is disabled")
+	}
+	if _, err := p.Exchange(context.Background(), "state", "code"); err == nil {
+		t.Errorf("Exchange() expected an error when oidc is disabled")
+	}
+}
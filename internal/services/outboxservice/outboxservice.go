@@ -0,0 +1,94 @@
+package outboxservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"go.uber.org/zap"
+)
+
+// Provider is the outbox relay provider interface
+// the user lifecycle events written to the outbox (in the user change's transaction) are published, in order,
+// to the configured sink (at least once, consumers drop duplicates by event id)
+type Provider interface {
+	Relay(ctx context.Context) (int, error)
+	Run(done <-chan bool)
+}
+
+// Cache is the subset of redis.Provider the outbox redis stream sink uses
+type Cache interface {
+	XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error)
+}
+
+type provider struct {
+	logger  log.Factory
+	cfg     *config.Config
+	repo    outboxrepo.Store
+	sink    Sink
+	metrics *metrics.Provider
+}
+
+// New returns a new outbox relay Provider for the configured sink
+func New(cfg *config.Config, logger log.Factory, repo outboxrepo.Store, redisClient Cache, metricProvider *metrics.Provider) (Provider, error) {
+	sink, err := newSink(cfg, redisClient)
+	if err != nil {
+		return nil, err
+	}
+	return &provider{
+		logger:  logger.With(zap.String("package", "outboxservice")),
+		cfg:     cfg,
+		repo:    repo,
+		sink:    sink,
+		metrics: metricProvider,
+	}, nil
+}
+
+// Relay publishes a batch of unpublished events, returns the number of published events
+func (p *provider) Relay(ctx context.Context) (int, error) {
+	published, err := p.repo.Relay(ctx, p.cfg.Outbox.BatchSize, func(event outboxmodels.Event) error {
+		if err := p.sink.Publish(ctx, event); err != nil {
+			p.metrics.StatOutboxPublishCount.WithLabelValues(p.cfg.Outbox.Sink, "failure").Inc()
+			p.logger.For(ctx).Error("failed to publish outbox event", zap.Error(err), zap.String("sink", p.cfg.Outbox.Sink), zap.String("event_id", event.UID), zap.String("type", event.Type))
+			return err
+		}
+		p.metrics.StatOutboxPublishCount.WithLabelValues(p.cfg.Outbox.Sink, "success").Inc()
+		return nil
+	})
+	if published > 0 {
+		p.logger.For(ctx).Info("outbox relayed", zap.Int("published", published), zap.String("sink", p.cfg.Outbox.Sink))
+	}
+	return published, errors.ErrorWrapper(err, "OutboxService.Relay")
+}
+
+// Run relays the outbox on the configured poll interval until done is closed
+// a full batch is followed immediately by the next batch (catching up after downtime)
+func (p *provider) Run(done <-chan bool) {
+	if !p.cfg.Outbox.Enabled {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(p.cfg.Outbox.PollIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for {
+				published, err := p.Relay(context.Background())
+				if err != nil {
+					p.logger.Bg().Error("failed outbox relay", zap.Error(err))
+				}
+				if err != nil || published < p.cfg.Outbox.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package outboxservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type mockOutboxRepo struct {
+	outboxrepo.Store
+	events    []outboxmodels.Event
+	published []string
+}
+
+func (m *mockOutboxRepo) Relay(ctx context.Context, limit int, publish func(outboxmodels.Event) error) (int, error) {
+	count := 0
+	for _, event := range m.events[len(m.published):] {
+		if count == limit {
+			break
+		}
+		if err := publish(event); err != nil {
+			return count, err
+		}
+		m.published = append(m.published, event.UID)
+		count++
+	}
+	return count, nil
+}
+
+type mockSink struct {
+	failOn string
+	events []string
+}
+
+func (m *mockSink) Publish(ctx context.Context, event outboxmodels.Event) error {
+	if event.UID == m.failOn {
+		return fmt.Errorf("sink down")
+	}
+	m.events = append(m.events, event.UID)
+	return nil
+}
+
+func testConfig(sink string) *config.Config {
+	cfg := &config.Config{}
+	cfg.Outbox.Sink = sink
+	cfg.Outbox.BatchSize = 2
+	cfg.Outbox.HTTPTimeoutSecs = 2
+	cfg.Outbox.StreamKey = "token-svc-user-events"
+	cfg.Outbox.StreamMaxLen = 1000
+	return cfg
+}
+
+func testEvent(uid string) outboxmodels.Event {
+	return outboxmodels.Event{
+		UID:       uid,
+		Type:      outboxmodels.EventUserRegistered,
+		UserID:    7,
+		Data:      map[string]interface{}{"email": "jane@example.com"},
+		CreatedAt: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestRelay(t *testing.T) {
+	tests := []struct {
+		name          string
+		failOn        string
+		wantPublished []string
+		wantErr       bool
+	}{
+		{"batch", "", []string{"a", "b"}, false},
+		{"sink failure keeps order", "b", []string{"a"}, true},
+		{"first event fails", "a", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &mockOutboxRepo{events: []outboxmodels.Event{testEvent("a"), testEvent("b"), testEvent("c")}}
+			sink := &mockSink{failOn: tt.failOn}
+			p := &provider{
+				logger:  log.NewNopFactory(),
+				cfg:     testConfig(SinkLog),
+				repo:    repo,
+				sink:    sink,
+				metrics: &metrics.Provider{StatOutboxPublishCount: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "outbox_publish_total"}, []string{"sink", "result"})},
+			}
+
+			published, err := p.Relay(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Relay() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if published != len(tt.wantPublished) || !reflect.DeepEqual(repo.published, tt.wantPublished) || !reflect.DeepEqual(sink.events, tt.wantPublished) {
+				t.Errorf("Relay() published %d %v (sink %v), want %v", published, repo.published, sink.events, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		sink    string
+		url     string
+		wantErr bool
+	}{
+		{"redis", SinkRedis, "", false},
+		{"http", SinkHTTP, "https://events.example.com", false},
+		{"http without url", SinkHTTP, "", true},
+		{"unknown", "kafka", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(tt.sink)
+			cfg.Outbox.HTTPURL = tt.url
+			if _, err := newSink(cfg, testhelper.NewRedis()); (err != nil) != tt.wantErr {
+				t.Errorf("newSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseCode int
+		wantErr      bool
+	}{
+		{"accepted", http.StatusAccepted, false},
+		{"rejected", http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received outboxmodels.Event
+			var auth, eventID string
+			receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				json.Unmarshal(body, &received)
+				auth = req.Header.Get("Authorization")
+				eventID = req.Header.Get(EventIDHeader)
+				res.WriteHeader(tt.responseCode)
+			}))
+			defer receiver.Close()
+
+			cfg := testConfig(SinkHTTP)
+			cfg.Outbox.HTTPURL = receiver.URL
+			cfg.Outbox.HTTPToken = "secret-token"
+			sink, err := newSink(cfg, nil)
+			if err != nil {
+				t.Fatalf("newSink() error = %v", err)
+			}
+
+			if err = sink.Publish(context.Background(), testEvent("a")); (err != nil) != tt.wantErr {
+				t.Errorf("Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if auth != "Bearer secret-token" || eventID != "a" || received.Type != outboxmodels.EventUserRegistered || received.UserID != 7 {
+				t.Errorf("received %+v (auth %q, event id %q)", received, auth, eventID)
+			}
+		})
+	}
+}
+
+func TestRedisSink(t *testing.T) {
+	redisClient := testhelper.NewRedis()
+	sink, err := newSink(testConfig(SinkRedis), redisClient)
+	if err != nil {
+		t.Fatalf("newSink() error = %v", err)
+	}
+	if err = sink.Publish(context.Background(), testEvent("a")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	want := map[string]interface{}{
+		"id":          "a",
+		"type":        outboxmodels.EventUserRegistered,
+		"user_id":     "7",
+		"data":        `{"email":"jane@example.com"}`,
+		"occurred_at": "2020-05-01T12:00:00Z",
+	}
+	if len(redisClient.Streams["token-svc-user-events"]) != 1 || !reflect.DeepEqual(redisClient.Streams["token-svc-user-events"][0], want) {
+		t.Errorf("XAdd(%s) = %v, want %v", "token-svc-user-events", redisClient.Streams, want)
+	}
+}
@@ -0,0 +1,146 @@
+package outboxservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Event stream sinks
+const (
+	SinkLog   = "log"
+	SinkHTTP  = "http"
+	SinkRedis = "redis"
+)
+
+// EventIDHeader is the http sink header holding the event id (consumers drop duplicates by id)
+const EventIDHeader = "X-Event-ID"
+
+// Sink publishes outbox events to a downstream event stream
+type Sink interface {
+	Publish(ctx context.Context, event outboxmodels.Event) error
+}
+
+// newSink returns the configured sink
+func newSink(cfg *config.Config, redisClient Cache) (Sink, error) {
+	switch cfg.Outbox.Sink {
+	case SinkLog:
+		return newLogSink(cfg)
+	case SinkHTTP:
+		if cfg.Outbox.HTTPURL == "" {
+			return nil, fmt.Errorf("outbox http sink requires an httpurl")
+		}
+		return &httpSink{
+			url:    cfg.Outbox.HTTPURL,
+			token:  cfg.Outbox.HTTPToken,
+			client: &http.Client{Timeout: time.Duration(cfg.Outbox.HTTPTimeoutSecs) * time.Second},
+		}, nil
+	case SinkRedis:
+		return &redisSink{redis: redisClient, stream: cfg.Outbox.StreamKey, maxLen: cfg.Outbox.StreamMaxLen}, nil
+	}
+	return nil, fmt.Errorf("unknown outbox sink: %s", cfg.Outbox.Sink)
+}
+
+// logSink writes each event as a json log line (for log shipping pipelines)
+type logSink struct {
+	logger *zap.Logger
+}
+
+func newLogSink(appCfg *config.Config) (Sink, error) {
+	cfg := zap.Config{
+		Level:            zap.NewAtomicLevelAt(zap.InfoLevel),
+		Encoding:         "json",
+		OutputPaths:      appCfg.Outbox.LogOutputPaths,
+		ErrorOutputPaths: appCfg.Logger.ErrorOutputPaths,
+		InitialFields: map[string]interface{}{
+			"service": appCfg.API.ServiceName,
+		},
+		EncoderConfig: zapcore.EncoderConfig{
+			MessageKey: "type",
+		},
+	}
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &logSink{logger: logger}, nil
+}
+
+func (s *logSink) Publish(ctx context.Context, event outboxmodels.Event) error {
+	s.logger.Info(event.Type,
+		zap.String("id", event.UID),
+		zap.Int("user_id", event.UserID),
+		zap.Any("data", event.Data),
+		zap.Time("occurred_at", event.CreatedAt))
+	return nil
+}
+
+// httpSink POSTs each event (json), any 2xx response is published
+type httpSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpSink) Publish(ctx context.Context, event outboxmodels.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, event.UID)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// redisSink appends each event to a redis stream (consumers read it with XREAD / consumer groups)
+type redisSink struct {
+	redis  Cache
+	stream string
+	maxLen int64
+}
+
+func (s *redisSink) Publish(ctx context.Context, event outboxmodels.Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = s.redis.XAdd(ctx, s.stream, s.maxLen, map[string]interface{}{
+		"id":          event.UID,
+		"type":        event.Type,
+		"user_id":     strconv.Itoa(event.UserID),
+		"data":        string(data),
+		"occurred_at": event.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	return err
+}
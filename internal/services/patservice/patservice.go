@@ -0,0 +1,204 @@
+package patservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/patmodels"
+	"github.com/tjsampson/token-svc/internal/repos/patrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+
+	"go.uber.org/zap"
+)
+
+const (
+	prefixBytes = 6
+	secretBytes = 32
+)
+
+// Provider is the personal access token provider interface
+// a token is tsvc_pat_<prefix>_<secret>, the prefix finds the token and only the sha256 of the whole token is stored
+type Provider interface {
+	Create(ctx context.Context, userID int, req *patmodels.CreateRequest) (patmodels.Token, error)
+	List(ctx context.Context, userID int) ([]patmodels.Token, error)
+	Revoke(ctx context.Context, userID int, id int64) error
+	Authenticate(ctx context.Context, bearer string) (patmodels.Token, error)
+}
+
+type provider struct {
+	logger  log.Factory
+	cfg     *config.Config
+	repo    patrepo.Store
+	auditor auditservice.Provider
+}
+
+// New returns a new personal access token Provider
+func New(cfg *config.Config, logger log.Factory, repo patrepo.Store, auditor auditservice.Provider) Provider {
+	return &provider{
+		logger:  logger.With(zap.String("package", "patservice")),
+		cfg:     cfg,
+		repo:    repo,
+		auditor: auditor,
+	}
+}
+
+// newToken returns a random token and its lookup prefix
+func newToken() (string, string, error) {
+	random := make([]byte, prefixBytes+secretBytes)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+	prefix := hex.EncodeToString(random[:prefixBytes])
+	return patmodels.TokenPrefix + prefix + "_" + hex.EncodeToString(random[prefixBytes:]), prefix, nil
+}
+
+// parseToken returns the lookup prefix of the token
+func parseToken(bearer string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(bearer, patmodels.TokenPrefix), "_")
+	if !patmodels.IsToken(bearer) || len(parts) != 2 || len(parts[0]) != 2*prefixBytes || len(parts[1]) != 2*secretBytes {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func invalidAuth() error {
+	return &errors.RestError{Code: http.StatusUnauthorized, Message: "invalid auth"}
+}
+
+// Create creates the token, the token is only returned here
+func (p *provider) Create(ctx context.Context, userID int, req *patmodels.CreateRequest) (patmodels.Token, error) {
+	if !p.cfg.PAT.Enabled {
+		return patmodels.Token{}, &errors.RestError{Code: http.StatusNotFound, Message: "personal access tokens are disabled"}
+	}
+
+	lifespanDays := req.ExpiresInDays
+	if lifespanDays == 0 {
+		lifespanDays = p.cfg.PAT.DefaultLifespanDays
+	}
+	if lifespanDays > p.cfg.PAT.MaxLifespanDays {
+		return patmodels.Token{}, &errors.RestError{Code: http.StatusBadRequest, Message: fmt.Sprintf("token expiry exceeds %d days", p.cfg.PAT.MaxLifespanDays)}
+	}
+
+	count, err := p.repo.CountActive(ctx, userID)
+	if err != nil {
+		return patmodels.Token{}, errors.ErrorWrapper(err, "PATService.Create.CountActive")
+	}
+	if count >= p.cfg.PAT.MaxPerUser {
+		return patmodels.Token{}, &errors.RestError{Code: http.StatusConflict, Message: fmt.Sprintf("token limit reached (%d), revoke a token first", p.cfg.PAT.MaxPerUser)}
+	}
+
+	secret, prefix, err := newToken()
+	if err != nil {
+		return patmodels.Token{}, errors.ErrorWrapper(err, "PATService.Create.newToken")
+	}
+
+	token, err := p.repo.Insert(ctx, patmodels.Token{
+		UserID: userID,
+		Name:   req.Name,
+		Prefix: prefix,
+		Hash:   hashToken(secret),
+		Scopes: dedupe(req.Scopes),
+	}, lifespanDays)
+	if err != nil {
+		return token, errors.ErrorWrapper(err, "PATService.Create.Insert")
+	}
+	token.Token = secret
+
+	p.audit(ctx, auditmodels.EventAccessTokenCreate, userID, token)
+	p.logger.For(ctx).Info("personal access token created", zap.Int("user_id", userID), zap.Int64("token_id", token.ID), zap.Strings("scopes", token.Scopes))
+	return token, nil
+}
+
+// List lists the user's active tokens
+func (p *provider) List(ctx context.Context, userID int) ([]patmodels.Token, error) {
+	tokens, err := p.repo.List(ctx, userID)
+	return tokens, errors.ErrorWrapper(err, "PATService.List")
+}
+
+// Revoke revokes the user's token
+func (p *provider) Revoke(ctx context.Context, userID int, id int64) error {
+	if err := p.repo.Revoke(ctx, userID, id); err != nil {
+		return errors.ErrorWrapper(err, "PATService.Revoke")
+	}
+	p.audit(ctx, auditmodels.EventAccessTokenRevoke, userID, patmodels.Token{ID: id})
+	p.logger.For(ctx).Info("personal access token revoked", zap.Int("user_id", userID), zap.Int64("token_id", id))
+	return nil
+}
+
+// Authenticate returns the active token matching the bearer token and records its use
+// every failure is the same 401 (the caller can not tell an unknown token from a revoked one)
+func (p *provider) Authenticate(ctx context.Context, bearer string) (patmodels.Token, error) {
+	if !p.cfg.PAT.Enabled {
+		return patmodels.Token{}, invalidAuth()
+	}
+	prefix, ok := parseToken(bearer)
+	if !ok {
+		return patmodels.Token{}, invalidAuth()
+	}
+
+	token, err := p.repo.ReadByPrefix(ctx, prefix)
+	if err != nil {
+		if rerr, ok := err.(*errors.RestError); ok && rerr.Code == http.StatusNotFound {
+			return patmodels.Token{}, invalidAuth()
+		}
+		return patmodels.Token{}, errors.ErrorWrapper(err, "PATService.Authenticate.ReadByPrefix")
+	}
+	if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashToken(bearer))) != 1 {
+		return patmodels.Token{}, invalidAuth()
+	}
+
+	// last used tracking is best effort, it never fails the request
+	ip := ""
+	if userIP := requestcontext.UserIP(ctx); userIP != nil {
+		ip = userIP.String()
+	}
+	interval := time.Duration(p.cfg.PAT.LastUsedIntervalSecs) * time.Second
+	if err = p.repo.TouchLastUsed(ctx, token.ID, ip, interval); err != nil {
+		p.logger.For(ctx).Error("failed to record personal access token use", zap.Error(err), zap.Int64("token_id", token.ID))
+	}
+	return token, nil
+}
+
+func (p *provider) audit(ctx context.Context, event string, userID int, token patmodels.Token) {
+	details := map[string]interface{}{"token_id": token.ID}
+	if token.Name != "" {
+		details["name"] = token.Name
+		details["scopes"] = token.Scopes
+	}
+	p.auditor.Record(ctx, auditmodels.Event{
+		Event:     event,
+		Outcome:   auditmodels.OutcomeSuccess,
+		ActorID:   userID,
+		SubjectID: userID,
+		Details:   details,
+	})
+}
+
+func dedupe(values []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,195 @@
+package patservice
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/patmodels"
+	"github.com/tjsampson/token-svc/internal/repos/patrepo"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	gopkgerrors "github.com/pkg/errors"
+)
+
+type mockPATRepo struct {
+	patrepo.Store
+	tokens       map[string]patmodels.Token
+	lifespanDays int
+	touched      []int64
+}
+
+func (m *mockPATRepo) Insert(ctx context.Context, token patmodels.Token, lifespanDays int) (patmodels.Token, error) {
+	token.ID = int64(len(m.tokens) + 1)
+	token.ExpiresAt = time.Now().AddDate(0, 0, lifespanDays)
+	m.lifespanDays = lifespanDays
+	m.tokens[token.Prefix] = token
+	return token, nil
+}
+
+func (m *mockPATRepo) ReadByPrefix(ctx context.Context, prefix string) (patmodels.Token, error) {
+	token, ok := m.tokens[prefix]
+	if !ok {
+		return token, &errors.RestError{Code: 404, Message: "Resource not found"}
+	}
+	return token, nil
+}
+
+func (m *mockPATRepo) CountActive(ctx context.Context, userID int) (int, error) {
+	count := 0
+	for _, token := range m.tokens {
+		if token.UserID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *mockPATRepo) TouchLastUsed(ctx context.Context, id int64, ip string, interval time.Duration) error {
+	m.touched = append(m.touched, id)
+	return nil
+}
+
+func newTestProvider() (*provider, *mockPATRepo, *testhelper.Auditor) {
+	cfg := &config.Config{}
+	cfg.PAT.Enabled = true
+	cfg.PAT.MaxPerUser = 2
+	cfg.PAT.DefaultLifespanDays = 90
+	cfg.PAT.MaxLifespanDays = 365
+	cfg.PAT.LastUsedIntervalSecs = 60
+	repo := &mockPATRepo{tokens: map[string]patmodels.Token{}}
+	auditor := &testhelper.Auditor{}
+	return New(cfg, log.NewNopFactory(), repo, auditor).(*provider), repo, auditor
+}
+
+func errCode(err error) int {
+	if rerr, ok := gopkgerrors.Cause(err).(*errors.RestError); ok {
+		return rerr.Code
+	}
+	return 0
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     int
+		req          patmodels.CreateRequest
+		wantCode     int
+		lifespanDays int
+	}{
+		{name: "default expiry", req: patmodels.CreateRequest{Name: "ci", Scopes: []string{"read"}}, lifespanDays: 90},
+		{name: "requested expiry", req: patmodels.CreateRequest{Name: "ci", Scopes: []string{"read"}, ExpiresInDays: 7}, lifespanDays: 7},
+		{name: "expiry over the max", req: patmodels.CreateRequest{Name: "ci", Scopes: []string{"read"}, ExpiresInDays: 366}, wantCode: http.StatusBadRequest},
+		{name: "token limit", existing: 2, req: patmodels.CreateRequest{Name: "ci", Scopes: []string{"read"}}, wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, repo, auditor := newTestProvider()
+			for i := 0; i < tt.existing; i++ {
+				repo.tokens[string(rune('a'+i))] = patmodels.Token{UserID: 7}
+			}
+			token, err := p.Create(context.Background(), 7, &tt.req)
+			if tt.wantCode != 0 {
+				if errCode(err) != tt.wantCode {
+					t.Fatalf("Create() error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			if repo.lifespanDays != tt.lifespanDays {
+				t.Errorf("lifespan = %d, want %d", repo.lifespanDays, tt.lifespanDays)
+			}
+			if !strings.HasPrefix(token.Token, patmodels.TokenPrefix+token.Prefix+"_") {
+				t.Errorf("token %q does not start with its prefix %q", token.Token, token.Prefix)
+			}
+			if stored := repo.tokens[token.Prefix]; stored.Hash != hashToken(token.Token) || stored.Token != "" {
+				t.Errorf("stored token = %+v, want only the hash", stored)
+			}
+			if len(auditor.Events) != 1 || auditor.Events[0].Event != auditmodels.EventAccessTokenCreate {
+				t.Errorf("audit events = %+v", auditor.Events)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	p, repo, _ := newTestProvider()
+	created, err := p.Create(context.Background(), 7, &patmodels.CreateRequest{Name: "ci", Scopes: []string{"read", "read"}})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if len(created.Scopes) != 1 {
+		t.Errorf("scopes = %v, want deduped", created.Scopes)
+	}
+	// the same prefix with another secret
+	forged := created.Token[:len(created.Token)-4] + "0000"
+	if forged == created.Token {
+		forged = created.Token[:len(created.Token)-4] + "1111"
+	}
+
+	tests := []struct {
+		name    string
+		bearer  string
+		enabled bool
+		wantErr bool
+	}{
+		{name: "valid", bearer: created.Token, enabled: true},
+		{name: "wrong secret", bearer: forged, enabled: true, wantErr: true},
+		{name: "unknown prefix", bearer: patmodels.TokenPrefix + "000000000000_" + strings.Repeat("0", 64), enabled: true, wantErr: true},
+		{name: "malformed", bearer: patmodels.TokenPrefix + "abc", enabled: true, wantErr: true},
+		{name: "a jwt", bearer: "eyJhbGciOiJSUzI1NiJ9.e30.sig", enabled: true, wantErr: true},
+		{name: "disabled", bearer: created.Token, enabled: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.cfg.PAT.Enabled = tt.enabled
+			repo.touched = nil
+			token, err := p.Authenticate(context.Background(), tt.bearer)
+			if tt.wantErr {
+				if errCode(err) != http.StatusUnauthorized {
+					t.Fatalf("Authenticate() error = %v, want 401", err)
+				}
+				if len(repo.touched) != 0 {
+					t.Errorf("last used recorded for a failed auth")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if token.ID != created.ID || token.UserID != 7 {
+				t.Errorf("Authenticate() = %+v, want token %d", token, created.ID)
+			}
+			if len(repo.touched) != 1 || repo.touched[0] != created.ID {
+				t.Errorf("touched = %v, want [%d]", repo.touched, created.ID)
+			}
+		})
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		method string
+		want   bool
+	}{
+		{scopes: []string{"read"}, method: "GET", want: true},
+		{scopes: []string{"read"}, method: "POST", want: false},
+		{scopes: []string{"write"}, method: "GET", want: true},
+		{scopes: []string{"write"}, method: "DELETE", want: true},
+		{scopes: []string{"admin"}, method: "GET", want: false},
+	}
+	for _, tt := range tests {
+		if got := patmodels.HasScope(tt.scopes, patmodels.MethodScope(tt.method)); got != tt.want {
+			t.Errorf("HasScope(%v, %s) = %v, want %v", tt.scopes, tt.method, got, tt.want)
+		}
+	}
+}
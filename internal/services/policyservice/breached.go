@@ -0,0 +1,72 @@
+package policyservice
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// rangePrefixLength is the k-anonymity range prefix length (same as the HIBP range API)
+const rangePrefixLength = 5
+
+// breachedCorpus is a local k-anonymity breached password corpus
+// entries are (full or truncated) upper case hex SHA-1 hashes bucketed by their 5 char range prefix
+// only the matching bucket is searched, mirroring the HIBP range API without leaving the service
+type breachedCorpus struct {
+	ranges map[string][]string
+	size   int
+}
+
+// loadBreachedCorpus loads the corpus file
+// one SHA-1 (or SHA-1 prefix) per line, an optional ":count" suffix is ignored (HIBP format)
+func loadBreachedCorpus(path string) (*breachedCorpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breached password corpus: %v", err)
+	}
+	defer f.Close()
+	return readBreachedCorpus(f)
+}
+
+func readBreachedCorpus(r io.Reader) (*breachedCorpus, error) {
+	corpus := &breachedCorpus{ranges: map[string][]string{}}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		entry = strings.ToUpper(strings.SplitN(entry, ":", 2)[0])
+		if len(entry) < rangePrefixLength || len(entry) > sha1.Size*2 {
+			return nil, fmt.Errorf("invalid breached password corpus entry on line %d", line)
+		}
+		if _, err := hex.DecodeString(entry[:len(entry)-len(entry)%2]); err != nil {
+			return nil, fmt.Errorf("invalid breached password corpus entry on line %d", line)
+		}
+		prefix := entry[:rangePrefixLength]
+		corpus.ranges[prefix] = append(corpus.ranges[prefix], entry[rangePrefixLength:])
+		corpus.size++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read breached password corpus: %v", err)
+	}
+	return corpus, nil
+}
+
+// contains reports if the password's SHA-1 matches an entry in the corpus
+func (c *breachedCorpus) contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	digest := strings.ToUpper(hex.EncodeToString(sum[:]))
+	for _, suffix := range c.ranges[digest[:rangePrefixLength]] {
+		if strings.HasPrefix(digest[rangePrefixLength:], suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package policyservice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/services/hashservice"
+
+	"go.uber.org/zap"
+)
+
+// Provider is the password policy provider interface
+// policy violations are returned as a 400 RestError with one message per violation
+type Provider interface {
+	Validate(ctx context.Context, email, password string) error
+	ValidateHistory(ctx context.Context, userID int, password string) error
+}
+
+type provider struct {
+	logger   log.Factory
+	cfg      *config.Config
+	hasher   hashservice.Provider
+	userRepo userrepo.Store
+	breached *breachedCorpus
+}
+
+// New returns a new password policy Provider
+// the breached password corpus is loaded into memory (if configured)
+func New(cfg *config.Config, logger log.Factory, hasher hashservice.Provider, usrRepo userrepo.Store) (Provider, error) {
+	p := &provider{
+		logger:   logger.With(zap.String("package", "policyservice")),
+		cfg:      cfg,
+		hasher:   hasher,
+		userRepo: usrRepo,
+	}
+
+	if cfg.PasswordPolicy.BreachedCorpusPath != "" {
+		corpus, err := loadBreachedCorpus(cfg.PasswordPolicy.BreachedCorpusPath)
+		if err != nil {
+			return nil, err
+		}
+		p.breached = corpus
+		p.logger.Bg().Info("loaded breached password corpus", zap.String("path", cfg.PasswordPolicy.BreachedCorpusPath), zap.Int("entries", corpus.size))
+	}
+
+	return p, nil
+}
+
+func policyErr(messages []string) error {
+	return &errors.RestError{
+		Code:     400,
+		Message:  "password policy violation(s)",
+		Messages: messages,
+	}
+}
+
+// Validate checks the password against the configured policy rules
+func (p *provider) Validate(ctx context.Context, email, password string) error {
+	p.logger.For(ctx).Info("entering policyservice.Validate", zap.String("email", email))
+	policy := p.cfg.PasswordPolicy
+	violations := []string{}
+
+	length := len([]rune(password))
+	if policy.MinLength > 0 && length < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("Password must be at least %d characters in length", policy.MinLength))
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, fmt.Sprintf("Password must be a maximum of %d characters in length", policy.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r), unicode.IsSymbol(r), unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUpper && !hasUpper {
+		violations = append(violations, "Password must contain an uppercase letter")
+	}
+	if policy.RequireLower && !hasLower {
+		violations = append(violations, "Password must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		violations = append(violations, "Password must contain a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		violations = append(violations, "Password must contain a symbol")
+	}
+
+	if policy.RejectEmailLocalPart {
+		localPart := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+		if localPart != "" && strings.Contains(strings.ToLower(password), localPart) {
+			violations = append(violations, "Password must not contain your email address")
+		}
+	}
+
+	if p.breached != nil && p.breached.contains(password) {
+		p.logger.For(ctx).Info("breached password rejected", zap.String("email", email))
+		violations = append(violations, "Password has appeared in a data breach, please choose a different password")
+	}
+
+	p.logger.For(ctx).Info("leaving policyservice.Validate", zap.String("email", email), zap.Int("violations", len(violations)))
+	if len(violations) > 0 {
+		return policyErr(violations)
+	}
+	return nil
+}
+
+// ValidateHistory rejects passwords that match one of the user's recent passwords
+func (p *provider) ValidateHistory(ctx context.Context, userID int, password string) error {
+	if p.cfg.PasswordPolicy.HistoryCount <= 0 {
+		return nil
+	}
+	p.logger.For(ctx).Info("entering policyservice.ValidateHistory", zap.Int("user_id", userID))
+	defer p.logger.For(ctx).Info("leaving policyservice.ValidateHistory", zap.Int("user_id", userID))
+
+	hashes, err := p.userRepo.ListPasswordHistory(ctx, userID, p.cfg.PasswordPolicy.HistoryCount)
+	if err != nil {
+		return errors.ErrorWrapper(err, "PolicyService.ValidateHistory")
+	}
+
+	for _, hash := range hashes {
+		if match, _ := p.hasher.Verify(ctx, hash, password); match {
+			return policyErr([]string{fmt.Sprintf("Password must not match any of your last %d passwords", p.cfg.PasswordPolicy.HistoryCount)})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package policyservice
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+)
+
+type mockHasher struct{}
+
+func (m *mockHasher) Hash(ctx context.Context, password string) (string, error) {
+	return "hashed:" + password, nil
+}
+
+func (m *mockHasher) Verify(ctx context.Context, encodedHash, password string) (bool, error) {
+	return encodedHash == "hashed:"+password, nil
+}
+
+func (m *mockHasher) NeedsRehash(ctx context.Context, encodedHash string) bool {
+	return false
+}
+
+type mockUserRepo struct {
+	userrepo.Store
+	history []string
+}
+
+func (m *mockUserRepo) ListPasswordHistory(ctx context.Context, userID int, limit int) ([]string, error) {
+	if len(m.history) > limit {
+		return m.history[:limit], nil
+	}
+	return m.history, nil
+}
+
+func stubConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.PasswordPolicy.MinLength = 12
+	cfg.PasswordPolicy.MaxLength = 64
+	cfg.PasswordPolicy.RequireUpper = true
+	cfg.PasswordPolicy.RequireLower = true
+	cfg.PasswordPolicy.RequireDigit = true
+	cfg.PasswordPolicy.RequireSymbol = true
+	cfg.PasswordPolicy.RejectEmailLocalPart = true
+	cfg.PasswordPolicy.HistoryCount = 2
+	return cfg
+}
+
+func violations(err error) []string {
+	if rerr, ok := err.(*errors.RestError); ok {
+		return rerr.Messages
+	}
+	return nil
+}
+
+func Test_provider_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		want     int
+	}{
+		{"valid", "jane@homerow.tech", "Correct-Horse-9", 0},
+		{"too short", "jane@homerow.tech", "Aa1!", 1},
+		{"too long", "jane@homerow.tech", "Aa1!" + strings.Repeat("x", 64), 1},
+		{"missing classes", "jane@homerow.tech", "correcthorsebattery", 3},
+		{"contains email local part", "jane@homerow.tech", "Hello-JANE-12345", 1},
+		{"everything wrong", "jane@homerow.tech", "jane", 5},
+	}
+	p, err := New(stubConfig(), log.NewNopFactory(), &mockHasher{}, &mockUserRepo{})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Validate(context.Background(), tt.email, tt.password)
+			if got := len(violations(err)); got != tt.want {
+				t.Errorf("Validate() violations = %v, want %d", violations(err), tt.want)
+			}
+			if err != nil && err.(*errors.RestError).Code != 400 {
+				t.Errorf("Validate() code = %d, want 400", err.(*errors.RestError).Code)
+			}
+		})
+	}
+}
+
+func Test_provider_ValidateHistory(t *testing.T) {
+	repo := &mockUserRepo{history: []string{"hashed:Newest-Pass-1", "hashed:Older-Pass-22", "hashed:Oldest-Pass-333"}}
+	p, _ := New(stubConfig(), log.NewNopFactory(), &mockHasher{}, repo)
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"reused newest", "Newest-Pass-1", true},
+		{"reused within history count", "Older-Pass-22", true},
+		{"outside history count", "Oldest-Pass-333", false},
+		{"new password", "Brand-New-Pass-4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.ValidateHistory(context.Background(), 1, tt.password); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateHistory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_breachedCorpus(t *testing.T) {
+	// sha1("password") = 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	// sha1("Password1") = 70CCD9007338D6D81DD3B6271621B9CF9A97EA00
+	corpus, err := readBreachedCorpus(strings.NewReader(`# comment
+5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3730471
+70ccd9007338
+`))
+	if err != nil {
+		t.Fatalf("readBreachedCorpus() error = %v", err)
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"Password1", true},
+		{"Correct-Horse-9", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := corpus.contains(tt.password); got != tt.want {
+				t.Errorf("contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readBreachedCorpus(strings.NewReader("ZZZZZZ\n")); err == nil {
+		t.Errorf("readBreachedCorpus() expected error for invalid entry")
+	}
+}
@@ -0,0 +1,69 @@
+package ratelimitservice
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often full (idle) buckets are dropped from memory
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens       float64
+	ts           time.Time
+	capacity     int
+	refillPerSec float64
+}
+
+// memoryStore is the per instance token bucket store
+type memoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.ts).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.capacity), b.tokens+elapsed*b.refillPerSec)
+		b.ts = now
+	}
+}
+
+func (m *memoryStore) take(key string, capacity int, refillPerSec float64, now time.Time) (bool, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > sweepInterval {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(capacity), ts: now, capacity: capacity, refillPerSec: refillPerSec}
+		m.buckets[key] = b
+	}
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false, b.tokens
+	}
+	b.tokens--
+	return true, b.tokens
+}
+
+// sweep drops the buckets that have refilled (they are the same as a new bucket)
+func (m *memoryStore) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.capacity) {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastSweep = now
+}
@@ -0,0 +1,137 @@
+package ratelimitservice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// KeyIP limits by the client IP address
+	KeyIP = "ip"
+	// KeySubject limits by the authenticated subject (falls back to IP)
+	KeySubject = "subject"
+	// KeyClient limits by the client ID header (falls back to IP)
+	KeyClient = "client"
+
+	// ModeRedis shares the buckets across all instances
+	ModeRedis = "redis"
+	// ModeMemory keeps the buckets in the instance memory
+	ModeMemory = "memory"
+
+	defaultRoute = "*"
+)
+
+// Rule is the rate limit applied to a route
+type Rule struct {
+	Route        string
+	Key          string
+	Capacity     int
+	RefillPerSec float64
+}
+
+// Result is the outcome of taking a token from the bucket
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the bucket is full
+	RetryAfter time.Duration // until the next token (only when not allowed)
+}
+
+// Provider is the token bucket rate limit provider interface
+type Provider interface {
+	Rule(path string) (Rule, bool)
+	Take(ctx context.Context, rule Rule, id string) Result
+}
+
+// Cache is the subset of redis.Provider the rate limiter uses
+type Cache interface {
+	TakeToken(ctx context.Context, key string, capacity int, refillPerSec float64) (bool, float64, error)
+}
+
+type provider struct {
+	logger log.Factory
+	cfg    *config.Config
+	redis  Cache
+	memory *memoryStore
+	rules  map[string]Rule
+}
+
+// New returns a new rate limit Provider
+// in redis mode the in-memory buckets are used as a fallback when redis is unavailable
+func New(cfg *config.Config, logger log.Factory, redis Cache) (Provider, error) {
+	if cfg.RateLimit.Mode != ModeRedis && cfg.RateLimit.Mode != ModeMemory {
+		return nil, fmt.Errorf("unsupported rate limit mode: %q", cfg.RateLimit.Mode)
+	}
+
+	rules := map[string]Rule{}
+	for _, route := range cfg.RateLimit.Routes {
+		switch route.Key {
+		case KeyIP, KeySubject, KeyClient:
+		default:
+			return nil, fmt.Errorf("unsupported rate limit key %q for route %s", route.Key, route.Path)
+		}
+		if route.Capacity <= 0 || route.RefillPerSec <= 0 {
+			return nil, fmt.Errorf("invalid rate limit capacity/refill for route %s", route.Path)
+		}
+		rules[route.Path] = Rule{Route: route.Path, Key: route.Key, Capacity: route.Capacity, RefillPerSec: route.RefillPerSec}
+	}
+
+	return &provider{
+		logger: logger.With(zap.String("package", "ratelimitservice")),
+		cfg:    cfg,
+		redis:  redis,
+		memory: newMemoryStore(),
+		rules:  rules,
+	}, nil
+}
+
+// Rule returns the rule for the path (or the default "*" rule)
+func (p *provider) Rule(path string) (Rule, bool) {
+	if rule, ok := p.rules[path]; ok {
+		return rule, true
+	}
+	rule, ok := p.rules[defaultRoute]
+	return rule, ok
+}
+
+// Take takes a token from the bucket identified by the rule and id
+func (p *provider) Take(ctx context.Context, rule Rule, id string) Result {
+	key := fmt.Sprintf("%v-%v-%v-%v", p.cfg.RateLimit.CacheKeyID, rule.Route, rule.Key, id)
+
+	var allowed bool
+	var remaining float64
+	var err error
+	if p.cfg.RateLimit.Mode == ModeRedis {
+		allowed, remaining, err = p.redis.TakeToken(ctx, key, rule.Capacity, rule.RefillPerSec)
+		if err != nil {
+			p.logger.For(ctx).Error("rate limit redis failure, using memory fallback", zap.Error(err), zap.String("cache_key", key))
+		}
+	}
+	if p.cfg.RateLimit.Mode == ModeMemory || err != nil {
+		allowed, remaining = p.memory.take(key, rule.Capacity, rule.RefillPerSec, time.Now())
+	}
+
+	return result(rule, allowed, remaining)
+}
+
+func result(rule Rule, allowed bool, remaining float64) Result {
+	perToken := time.Duration(float64(time.Second) / rule.RefillPerSec)
+	res := Result{
+		Allowed:   allowed,
+		Limit:     rule.Capacity,
+		Remaining: int(math.Floor(remaining)),
+		Reset:     time.Duration((float64(rule.Capacity) - remaining) * float64(perToken)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - remaining) * float64(perToken))
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+package ratelimitservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+)
+
+func testConfig(mode string) *config.Config {
+	cfg := &config.Config{}
+	cfg.RateLimit.Enabled = true
+	cfg.RateLimit.Mode = mode
+	cfg.RateLimit.CacheKeyID = "rate-limit"
+	cfg.RateLimit.Routes = []config.RateLimitRoute{
+		{Path: "/login", Key: KeyIP, Capacity: 3, RefillPerSec: 1},
+		{Path: "*", Key: KeyIP, Capacity: 100, RefillPerSec: 10},
+	}
+	return cfg
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	tests := []struct {
+		name    string
+		takes   int
+		wait    time.Duration
+		allowed bool
+	}{
+		{"within capacity", 3, 0, true},
+		{"capacity exceeded", 4, 0, false},
+		{"refilled", 4, 1500 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			now := time.Now()
+			var allowed bool
+			for i := 0; i < tt.takes; i++ {
+				if i == tt.takes-1 {
+					now = now.Add(tt.wait)
+				}
+				allowed, _ = store.take("key", 3, 1, now)
+			}
+			if allowed != tt.allowed {
+				t.Errorf("take() allowed = %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	store := newMemoryStore()
+	now := time.Now()
+	store.take("idle", 3, 1, now)
+	store.take("busy", 3, 0.001, now)
+	store.take("new", 3, 1, now.Add(2*sweepInterval))
+
+	if _, ok := store.buckets["idle"]; ok {
+		t.Errorf("sweep() kept the refilled bucket")
+	}
+	if _, ok := store.buckets["busy"]; !ok {
+		t.Errorf("sweep() dropped the partially drained bucket")
+	}
+}
+
+func TestProviderRule(t *testing.T) {
+	p, err := New(testConfig(ModeMemory), log.NewNopFactory(), &testhelper.Redis{Down: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	tests := []struct {
+		path     string
+		capacity int
+	}{
+		{"/login", 3},
+		{"/users", 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rule, ok := p.Rule(tt.path)
+			if !ok || rule.Capacity != tt.capacity {
+				t.Errorf("Rule(%s) = %v, %v, want capacity %d", tt.path, rule, ok, tt.capacity)
+			}
+		})
+	}
+}
+
+func TestProviderTakeRedisFallback(t *testing.T) {
+	redis := &testhelper.Redis{Down: true}
+	p, err := New(testConfig(ModeRedis), log.NewNopFactory(), redis)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	rule, _ := p.Rule("/login")
+
+	for i := 0; i < 3; i++ {
+		if res := p.Take(context.Background(), rule, "ip-10.0.0.1"); !res.Allowed {
+			t.Fatalf("Take() #%d not allowed", i+1)
+		}
+	}
+	res := p.Take(context.Background(), rule, "ip-10.0.0.1")
+	if res.Allowed || res.Remaining != 0 || res.RetryAfter <= 0 {
+		t.Errorf("Take() = %+v, want rejected with retry after", res)
+	}
+	if redis.Calls["TakeToken"] != 4 {
+		t.Errorf("redis TakeToken calls = %d, want 4", redis.Calls["TakeToken"])
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	cfg := testConfig(ModeMemory)
+	cfg.RateLimit.Routes[0].Key = "session"
+	if _, err := New(cfg, log.NewNopFactory(), &testhelper.Redis{Down: true}); err == nil {
+		t.Errorf("New() expected an error for an unsupported key")
+	}
+
+	cfg = testConfig("memcached")
+	if _, err := New(cfg, log.NewNopFactory(), &testhelper.Redis{Down: true}); err == nil {
+		t.Errorf("New() expected an error for an unsupported mode")
+	}
+}
@@ -0,0 +1,376 @@
+package samlservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+	"go.uber.org/zap"
+)
+
+// Provider is the SAML 2.0 service provider interface (HTTP-Redirect AuthnRequest, HTTP-POST response)
+// AuthRequestURL starts a login (the relay state must be bound to the browser), ParseResponse completes it
+// and returns the identity from the validated (signed) assertion
+type Provider interface {
+	Metadata(ctx context.Context) ([]byte, error)
+	AuthRequestURL(ctx context.Context) (authURL string, relayState string, err error)
+	ParseResponse(ctx context.Context, samlResponse, relayState string) (usermodels.Identity, error)
+}
+
+// Cache is the subset of redis.Provider the saml provider uses (the login request and used assertion caches)
+type Cache interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, exp time.Duration) error
+	SetNX(ctx context.Context, key string, value string, exp time.Duration) (bool, error)
+	Del(ctx context.Context, keys ...string) error
+}
+
+type provider struct {
+	logger log.Factory
+	cfg    *config.Config
+	redis  Cache
+
+	mu sync.Mutex
+	sp *saml.ServiceProvider
+}
+
+// New returns a new SAML Provider
+// the key pair and idp metadata are loaded on first use (a missing file never fails startup)
+func New(cfg *config.Config, logger log.Factory, redisClient Cache) Provider {
+	return &provider{
+		logger: logger.With(zap.String("package", "samlservice")),
+		cfg:    cfg,
+		redis:  redisClient,
+	}
+}
+
+func notEnabled() error {
+	return &errors.RestError{
+		Code:    404,
+		Message: "saml login is not enabled",
+	}
+}
+
+func invalidLogin(reason string, originalErr error) error {
+	return &errors.RestError{
+		Code:          401,
+		Message:       fmt.Sprintf("saml login failed: %s", reason),
+		OriginalError: originalErr,
+	}
+}
+
+// randomToken returns a url safe random string
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (p *provider) requestKey(relayState string) string {
+	return fmt.Sprintf("%v-%v", p.cfg.SAML.RequestCacheKeyID, relayState)
+}
+
+// serviceProvider returns the configured saml service provider, it is built once (on success)
+func (p *provider) serviceProvider() (*saml.ServiceProvider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sp != nil {
+		return p.sp, nil
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(p.cfg.SAML.CertificatePath, p.cfg.SAML.PrivateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("saml private key must be RSA")
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := ioutil.ReadFile(p.cfg.SAML.IDPMetadataPath)
+	if err != nil {
+		return nil, err
+	}
+	idpMetadata, err := parseMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	entityURL, err := url.Parse(p.cfg.SAML.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(p.cfg.SAML.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+
+	p.sp = &saml.ServiceProvider{
+		EntityID:          p.cfg.SAML.EntityID,
+		Key:               key,
+		Certificate:       cert,
+		MetadataURL:       *entityURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AllowIDPInitiated: p.cfg.SAML.AllowIDPInitiated,
+		SignatureMethod:   dsig.RSASHA256SignatureMethod,
+	}
+	return p.sp, nil
+}
+
+// parseMetadata parses the idp metadata (an EntityDescriptor, or the idp of an EntitiesDescriptor)
+func parseMetadata(metadata []byte) (*saml.EntityDescriptor, error) {
+	entity := &saml.EntityDescriptor{}
+	err := xml.Unmarshal(metadata, entity)
+	if err == nil {
+		return entity, nil
+	}
+
+	entities := &saml.EntitiesDescriptor{}
+	if xml.Unmarshal(metadata, entities) != nil {
+		return nil, err
+	}
+	for i := range entities.EntityDescriptors {
+		if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no idp entity in the saml metadata")
+}
+
+// Metadata returns our (signed AuthnRequests, signed assertions) service provider metadata
+func (p *provider) Metadata(ctx context.Context) ([]byte, error) {
+	if !p.cfg.SAML.Enabled {
+		return nil, notEnabled()
+	}
+	sp, err := p.serviceProvider()
+	if err != nil {
+		p.logger.For(ctx).Error("failed to load the saml service provider", zap.Error(err))
+		return nil, errors.ErrorWrapper(err, "SAMLService.Metadata.serviceProvider")
+	}
+	metadata, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, errors.ErrorWrapper(err, "SAMLService.Metadata.Marshal")
+	}
+	return append([]byte(xml.Header), metadata...), nil
+}
+
+// AuthRequestURL returns the idp's single sign on url (with a signed AuthnRequest) for a new login
+// the request id is cached by the relay state, the response must be in response to it
+func (p *provider) AuthRequestURL(ctx context.Context) (string, string, error) {
+	if !p.cfg.SAML.Enabled {
+		return "", "", notEnabled()
+	}
+	sp, err := p.serviceProvider()
+	if err != nil {
+		p.logger.For(ctx).Error("failed to load the saml service provider", zap.Error(err))
+		return "", "", errors.ErrorWrapper(err, "SAMLService.AuthRequestURL.serviceProvider")
+	}
+
+	relayState, err := randomToken()
+	if err != nil {
+		return "", "", errors.ErrorWrapper(err, "SAMLService.AuthRequestURL.relayState")
+	}
+	authnRequest, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", errors.ErrorWrapper(err, "SAMLService.AuthRequestURL.MakeAuthenticationRequest")
+	}
+	if err = p.redis.Set(ctx, p.requestKey(relayState), authnRequest.ID, time.Duration(p.cfg.SAML.RequestLifeSpanSecs)*time.Second); err != nil {
+		return "", "", errors.ErrorWrapper(err, "SAMLService.AuthRequestURL.cacheRequest")
+	}
+	authURL, err := authnRequest.Redirect(relayState, sp)
+	if err != nil {
+		return "", "", errors.ErrorWrapper(err, "SAMLService.AuthRequestURL.Redirect")
+	}
+	return authURL.String(), relayState, nil
+}
+
+// ParseResponse validates the (base64) SAMLResponse and maps the assertion to an identity
+// the relay state is our (browser bound) relay state, empty for an idp initiated login
+func (p *provider) ParseResponse(ctx context.Context, samlResponse, relayState string) (usermodels.Identity, error) {
+	p.logger.For(ctx).Info("entering samlservice.ParseResponse")
+	if !p.cfg.SAML.Enabled {
+		return usermodels.Identity{}, notEnabled()
+	}
+	sp, err := p.serviceProvider()
+	if err != nil {
+		p.logger.For(ctx).Error("failed to load the saml service provider", zap.Error(err))
+		return usermodels.Identity{}, errors.ErrorWrapper(err, "SAMLService.ParseResponse.serviceProvider")
+	}
+
+	// the request id is single use, an sp initiated response is only accepted once per login request
+	// (an idp initiated response is not in response to any request, the assertion id check below stops its replay)
+	requestIDs := []string{}
+	if relayState != "" {
+		requestID, err := p.redis.Get(ctx, p.requestKey(relayState))
+		if err != nil || requestID == "" {
+			return usermodels.Identity{}, invalidLogin("unknown or expired login request", err)
+		}
+		p.redis.Del(ctx, p.requestKey(relayState))
+		requestIDs = append(requestIDs, requestID)
+	}
+
+	rawResponse, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return usermodels.Identity{}, invalidLogin("invalid response encoding", err)
+	}
+	assertion, err := sp.ParseXMLResponse(rawResponse, requestIDs)
+	if err != nil {
+		// the InvalidResponseError's reason is private (logged, never returned)
+		if invalidErr, ok := err.(*saml.InvalidResponseError); ok {
+			err = invalidErr.PrivateErr
+		}
+		p.logger.For(ctx).Error("invalid saml response", zap.Error(err))
+		return usermodels.Identity{}, invalidLogin("invalid assertion", err)
+	}
+
+	if err = p.useAssertion(ctx, assertion); err != nil {
+		return usermodels.Identity{}, err
+	}
+
+	identity, err := p.mapIdentity(assertion)
+	if err != nil {
+		return identity, invalidLogin(err.Error(), err)
+	}
+	p.logger.For(ctx).Info("leaving samlservice.ParseResponse", zap.String("email", identity.Email))
+	return identity, nil
+}
+
+func (p *provider) assertionKey(issuer, assertionID string) string {
+	return fmt.Sprintf("%v-%v-%v", p.cfg.SAML.AssertionCacheKeyID, issuer, assertionID)
+}
+
+// useAssertion marks the (validated) assertion used until it expires, a replayed assertion is rejected
+// the assertion is accepted until its latest NotOnOrAfter (plus the allowed clock skew), so it is remembered as long
+func (p *provider) useAssertion(ctx context.Context, assertion *saml.Assertion) error {
+	if assertion.ID == "" {
+		return invalidLogin("assertion has no id", nil)
+	}
+	expires := time.Time{}
+	if assertion.Conditions != nil {
+		expires = assertion.Conditions.NotOnOrAfter
+	}
+	if assertion.Subject != nil {
+		for _, confirmation := range assertion.Subject.SubjectConfirmations {
+			if data := confirmation.SubjectConfirmationData; data != nil && data.NotOnOrAfter.After(expires) {
+				expires = data.NotOnOrAfter
+			}
+		}
+	}
+	ttl := time.Until(expires.Add(saml.MaxClockSkew))
+	if expires.IsZero() || ttl <= 0 {
+		ttl = saml.MaxClockSkew
+	}
+
+	used, err := p.redis.SetNX(ctx, p.assertionKey(assertion.Issuer.Value, assertion.ID), "used", ttl)
+	if err != nil {
+		// fail closed, a replay can not be ruled out
+		p.logger.For(ctx).Error("failed to cache the saml assertion id", zap.Error(err))
+		return errors.ErrorWrapper(err, "SAMLService.ParseResponse.useAssertion")
+	}
+	if !used {
+		p.logger.For(ctx).Error("replayed saml assertion", zap.String("assertion_id", assertion.ID))
+		return invalidLogin("assertion already used", nil)
+	}
+	return nil
+}
+
+// mapIdentity maps the assertion's subject and attributes to an identity
+func (p *provider) mapIdentity(assertion *saml.Assertion) (usermodels.Identity, error) {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return usermodels.Identity{}, fmt.Errorf("assertion has no subject")
+	}
+	nameID := assertion.Subject.NameID
+
+	identity := usermodels.Identity{
+		Issuer:        assertion.Issuer.Value,
+		Subject:       nameID.Value,
+		Email:         firstValue(attributeValues(assertion, p.cfg.SAML.EmailAttribute)),
+		EmailVerified: p.cfg.SAML.TrustEmail,
+		Name:          firstValue(attributeValues(assertion, p.cfg.SAML.NameAttribute)),
+	}
+	if identity.Email == "" && nameID.Format == string(saml.EmailAddressNameIDFormat) {
+		identity.Email = nameID.Value
+	}
+	if identity.Email == "" {
+		return identity, fmt.Errorf("assertion has no email")
+	}
+	if p.cfg.SAML.SyncGroups {
+		identity.Groups = mapGroups(p.cfg.SAML.GroupMap, attributeValues(assertion, p.cfg.SAML.GroupsAttribute))
+	}
+	return identity, nil
+}
+
+// mapGroups maps the idp's groups to local groups with saml.groupmap, an unmapped idp group is dropped
+// (the idp's group names are not trusted as local group names, an idp group named admin must not grant the admin api)
+func mapGroups(groupMap map[string]string, idpGroups []string) []string {
+	groups := []string{}
+	for _, idpGroup := range idpGroups {
+		group, ok := groupMap[idpGroup]
+		if !ok || group == "" || containsGroup(groups, group) {
+			continue
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func containsGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// attributeValues returns the values of the attribute (matched by name or friendly name)
+func attributeValues(assertion *saml.Assertion, name string) []string {
+	values := []string{}
+	if name == "" {
+		return values
+	}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, value := range attr.Values {
+				if v := strings.TrimSpace(value.Value); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+	}
+	return values
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
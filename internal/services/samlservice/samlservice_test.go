@@ -0,0 +1,411 @@
+package samlservice
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testIDPEntityID = "https://idp.example.com/metadata"
+	testIDPSSOURL   = "https://idp.example.com/sso"
+	testEntityID    = "https://dev.homerow.tech/saml/metadata"
+	testACSURL      = "https://dev.homerow.tech/saml/acs"
+)
+
+// testKeyPair returns a self signed RSA key pair (valid for an hour either side of now)
+func testKeyPair(t *testing.T, commonName string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// fixture is a SAMLResponse (one assertion) from the test idp, the zero values are a valid response
+type fixture struct {
+	inResponseTo string
+	issuer       string
+	audience     string
+	recipient    string
+	notOnOrAfter time.Time
+	email        string
+	signingKey   *rsa.PrivateKey
+	unsigned     bool
+	tamper       bool
+}
+
+type testIDP struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+	dir  string
+}
+
+// newTestIDP writes our key pair and the test idp's metadata to a temp dir
+func newTestIDP(t *testing.T) *testIDP {
+	dir, err := ioutil.TempDir("", "samlservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIDP{dir: dir}
+	idp.key, idp.cert = testKeyPair(t, "idp.example.com")
+
+	spKey, spCert := testKeyPair(t, "dev.homerow.tech")
+	writeFile(t, filepath.Join(dir, "saml.key"), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(spKey)}))
+	writeFile(t, filepath.Join(dir, "saml.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: spCert.Raw}))
+
+	metadataURL, _ := url.Parse(testIDPEntityID)
+	ssoURL, _ := url.Parse(testIDPSSOURL)
+	metadata, err := xml.Marshal((&saml.IdentityProvider{
+		Key:         idp.key,
+		Certificate: idp.cert,
+		MetadataURL: *metadataURL,
+		SSOURL:      *ssoURL,
+	}).Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "idp-metadata.xml"), metadata)
+	return idp
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (idp *testIDP) config() *config.Config {
+	cfg := &config.Config{}
+	cfg.SAML.Enabled = true
+	cfg.SAML.EntityID = testEntityID
+	cfg.SAML.ACSURL = testACSURL
+	cfg.SAML.CertificatePath = filepath.Join(idp.dir, "saml.crt")
+	cfg.SAML.PrivateKeyPath = filepath.Join(idp.dir, "saml.key")
+	cfg.SAML.IDPMetadataPath = filepath.Join(idp.dir, "idp-metadata.xml")
+	cfg.SAML.EmailAttribute = "email"
+	cfg.SAML.NameAttribute = "displayName"
+	cfg.SAML.GroupsAttribute = "groups"
+	cfg.SAML.TrustEmail = true
+	cfg.SAML.SyncGroups = true
+	cfg.SAML.GroupMap = map[string]string{"support": "support"}
+	cfg.SAML.RequestCacheKeyID = "saml-request"
+	cfg.SAML.RequestLifeSpanSecs = 600
+	cfg.SAML.AssertionCacheKeyID = "saml-assertion"
+	return cfg
+}
+
+func testProvider(cfg *config.Config) (*provider, *testhelper.Redis) {
+	redisClient := testhelper.NewRedis()
+	return New(cfg, log.NewNopFactory(), redisClient).(*provider), redisClient
+}
+
+// response returns the base64 SAMLResponse for the fixture, the assertion is signed by the idp key
+func (idp *testIDP) response(t *testing.T, f fixture) string {
+	now := time.Now().UTC()
+	if f.issuer == "" {
+		f.issuer = testIDPEntityID
+	}
+	if f.audience == "" {
+		f.audience = testEntityID
+	}
+	if f.recipient == "" {
+		f.recipient = testACSURL
+	}
+	if f.notOnOrAfter.IsZero() {
+		f.notOnOrAfter = now.Add(5 * time.Minute)
+	}
+	if f.signingKey == nil {
+		f.signingKey = idp.key
+	}
+	emailAttribute := ""
+	if f.email != "" {
+		emailAttribute = fmt.Sprintf(`<saml:Attribute Name="email"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute>`, f.email)
+	}
+
+	issueInstant := now.Format(time.RFC3339)
+	assertion := etree.NewDocument()
+	err := assertion.ReadFromString(fmt.Sprintf(`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_assertion-1" Version="2.0" IssueInstant="%[1]s">`+
+		`<saml:Issuer>%[2]s</saml:Issuer>`+
+		`<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">jane.doe@corp.example.com</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><saml:SubjectConfirmationData InResponseTo="%[3]s" NotOnOrAfter="%[4]s" Recipient="%[5]s"/></saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore="%[1]s" NotOnOrAfter="%[4]s"><saml:AudienceRestriction><saml:Audience>%[6]s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`<saml:AuthnStatement AuthnInstant="%[1]s"><saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement>`+
+		`<saml:AttributeStatement>%[7]s`+
+		`<saml:Attribute Name="displayName"><saml:AttributeValue>Jane Doe</saml:AttributeValue></saml:Attribute>`+
+		`<saml:Attribute Name="groups"><saml:AttributeValue>admin</saml:AttributeValue><saml:AttributeValue>support</saml:AttributeValue></saml:Attribute>`+
+		`</saml:AttributeStatement></saml:Assertion>`,
+		issueInstant, f.issuer, f.inResponseTo, f.notOnOrAfter.Format(time.RFC3339), f.recipient, f.audience, emailAttribute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertionEl := assertion.Root()
+
+	if !f.unsigned {
+		signingContext := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+			Certificate: [][]byte{idp.cert.Raw},
+			PrivateKey:  f.signingKey,
+		}))
+		signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+		assertionEl, err = signingContext.SignEnveloped(assertionEl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the signature is appended, the schema puts it after the issuer
+		signatureEl := assertionEl.Child[len(assertionEl.Child)-1]
+		assertionEl.Child = assertionEl.Child[:len(assertionEl.Child)-1]
+		assertionEl.InsertChildAt(1, signatureEl)
+	}
+	if f.tamper {
+		assertionEl.FindElement(".//NameID").SetText("mallory@corp.example.com")
+	}
+
+	response := etree.NewDocument()
+	err = response.ReadFromString(fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_response-1" Version="2.0" IssueInstant="%s" Destination="%s" InResponseTo="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status></samlp:Response>`,
+		issueInstant, testACSURL, f.inResponseTo, f.issuer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Root().AddChild(assertionEl)
+	raw, err := response.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestMetadata(t *testing.T) {
+	idp := newTestIDP(t)
+	defer os.RemoveAll(idp.dir)
+	p, _ := testProvider(idp.config())
+
+	metadata, err := p.Metadata(context.Background())
+	if err != nil {
+		t.Fatalf("Metadata() error = %v", err)
+	}
+	entity := saml.EntityDescriptor{}
+	if err = xml.Unmarshal(metadata, &entity); err != nil {
+		t.Fatalf("Metadata() is not an EntityDescriptor: %v", err)
+	}
+	if entity.EntityID != testEntityID || len(entity.SPSSODescriptors) != 1 {
+		t.Fatalf("Metadata() = %s", metadata)
+	}
+	sp := entity.SPSSODescriptors[0]
+	if len(sp.AssertionConsumerServices) == 0 || sp.AssertionConsumerServices[0].Location != testACSURL || len(sp.KeyDescriptors) == 0 {
+		t.Errorf("Metadata() acs/keys = %+v %+v", sp.AssertionConsumerServices, sp.KeyDescriptors)
+	}
+	if sp.WantAssertionsSigned == nil || !*sp.WantAssertionsSigned {
+		t.Errorf("Metadata() does not require signed assertions")
+	}
+}
+
+func TestAuthRequestURL(t *testing.T) {
+	idp := newTestIDP(t)
+	defer os.RemoveAll(idp.dir)
+	p, redisClient := testProvider(idp.config())
+
+	authURL, relayState, err := p.AuthRequestURL(context.Background())
+	if err != nil {
+		t.Fatalf("AuthRequestURL() error = %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := parsed.Query()
+	if !strings.HasPrefix(authURL, testIDPSSOURL+"?") || params.Get("SAMLRequest") == "" || params.Get("RelayState") != relayState ||
+		params.Get("SigAlg") != dsig.RSASHA256SignatureMethod || params.Get("Signature") == "" {
+		t.Errorf("AuthRequestURL() = %s", authURL)
+	}
+	if redisClient.Values["saml-request-"+relayState] == "" {
+		t.Errorf("AuthRequestURL() did not cache the request id")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	idp := newTestIDP(t)
+	defer os.RemoveAll(idp.dir)
+	otherKey, _ := testKeyPair(t, "evil.example.com")
+
+	tests := []struct {
+		name              string
+		fixture           fixture
+		idpInitiated      bool
+		allowIDPInitiated bool
+		syncGroups        bool
+		wantErr           bool
+		wantEmail         string
+		wantGroups        []string
+	}{
+		{"valid", fixture{email: "jane@corp.example.com"}, false, false, true, false, "jane@corp.example.com", []string{"support"}},
+		{"email from name id", fixture{}, false, false, true, false, "jane.doe@corp.example.com", []string{"support"}},
+		{"groups not synced", fixture{email: "jane@corp.example.com"}, false, false, false, false, "jane@corp.example.com", nil},
+		{"idp initiated", fixture{email: "jane@corp.example.com"}, true, true, true, false, "jane@corp.example.com", []string{"support"}},
+		{"idp initiated not allowed", fixture{email: "jane@corp.example.com"}, true, false, true, true, "", nil},
+		{"wrong audience", fixture{audience: "https://other.example.com"}, false, false, true, true, "", nil},
+		{"wrong recipient", fixture{recipient: "https://other.example.com/acs"}, false, false, true, true, "", nil},
+		{"wrong issuer", fixture{issuer: "https://evil.example.com"}, false, false, true, true, "", nil},
+		{"expired", fixture{notOnOrAfter: time.Now().Add(-time.Hour)}, false, false, true, true, "", nil},
+		{"wrong signing key", fixture{signingKey: otherKey}, false, false, true, true, "", nil},
+		{"unsigned", fixture{unsigned: true}, false, false, true, true, "", nil},
+		{"tampered", fixture{tamper: true}, false, false, true, true, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := idp.config()
+			cfg.SAML.AllowIDPInitiated = tt.allowIDPInitiated
+			cfg.SAML.SyncGroups = tt.syncGroups
+			p, redisClient := testProvider(cfg)
+
+			relayState := ""
+			if !tt.idpInitiated {
+				_, relayState, _ = p.AuthRequestURL(context.Background())
+				tt.fixture.inResponseTo = redisClient.Values["saml-request-"+relayState]
+			}
+
+			identity, err := p.ParseResponse(context.Background(), idp.response(t, tt.fixture), relayState)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := redisClient.Values["saml-request-"+relayState]; ok && relayState != "" {
+				t.Errorf("ParseResponse() left the request id cached (requests must be single use)")
+			}
+			if tt.wantErr {
+				return
+			}
+			if identity.Issuer != testIDPEntityID || identity.Subject != "jane.doe@corp.example.com" || identity.Email != tt.wantEmail ||
+				identity.Name != "Jane Doe" || !identity.EmailVerified || !reflect.DeepEqual(identity.Groups, tt.wantGroups) {
+				t.Errorf("ParseResponse() = %+v", identity)
+			}
+		})
+	}
+}
+
+func TestParseResponseReplay(t *testing.T) {
+	idp := newTestIDP(t)
+	defer os.RemoveAll(idp.dir)
+
+	for _, allowIDPInitiated := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allowidpinitiated %v", allowIDPInitiated), func(t *testing.T) {
+			cfg := idp.config()
+			cfg.SAML.AllowIDPInitiated = allowIDPInitiated
+			p, redisClient := testProvider(cfg)
+
+			_, relayState, _ := p.AuthRequestURL(context.Background())
+			response := idp.response(t, fixture{inResponseTo: redisClient.Values["saml-request-"+relayState]})
+			if _, err := p.ParseResponse(context.Background(), response, relayState); err != nil {
+				t.Fatalf("ParseResponse() error = %v", err)
+			}
+			if _, err := p.ParseResponse(context.Background(), response, relayState); err == nil {
+				t.Errorf("ParseResponse() accepted a replayed response")
+			}
+			// posted without the relay state cookie, the InResponseTo check is skipped when idp initiated logins are allowed
+			if _, err := p.ParseResponse(context.Background(), response, ""); err == nil {
+				t.Errorf("ParseResponse() accepted a replayed response as idp initiated")
+			}
+		})
+	}
+
+	t.Run("idp initiated", func(t *testing.T) {
+		cfg := idp.config()
+		cfg.SAML.AllowIDPInitiated = true
+		p, redisClient := testProvider(cfg)
+
+		response := idp.response(t, fixture{})
+		if _, err := p.ParseResponse(context.Background(), response, ""); err != nil {
+			t.Fatalf("ParseResponse() error = %v", err)
+		}
+		if ttl := redisClient.TTLs["saml-assertion-"+testIDPEntityID+"-_assertion-1"]; ttl <= 0 {
+			t.Errorf("ParseResponse() assertion id ttl = %v, want until it expires", ttl)
+		}
+		if _, err := p.ParseResponse(context.Background(), response, ""); err == nil {
+			t.Errorf("ParseResponse() accepted a replayed idp initiated response")
+		}
+	})
+
+	t.Run("cache down", func(t *testing.T) {
+		cfg := idp.config()
+		cfg.SAML.AllowIDPInitiated = true
+		p, redisClient := testProvider(cfg)
+		redisClient.Down = true
+
+		if _, err := p.ParseResponse(context.Background(), idp.response(t, fixture{}), ""); err == nil {
+			t.Errorf("ParseResponse() accepted an assertion it could not mark used")
+		}
+	})
+}
+
+func TestNotEnabled(t *testing.T) {
+	p, _ := testProvider(&config.Config{})
+	if _, err := p.Metadata(context.Background()); err == nil {
+		t.Errorf("Metadata() expected an error when saml is disabled")
+	}
+	if _, _, err := p.AuthRequestURL(context.Background()); err == nil {
+		t.Errorf("AuthRequestURL() expected an error when saml is disabled")
+	}
+	if _, err := p.ParseResponse(context.Background(), "response", ""); err == nil {
+		t.Errorf("ParseResponse() expected an error when saml is disabled")
+	}
+}
+
+func TestMapGroups(t *testing.T) {
+	groupMap := map[string]string{"Token Svc Admins": "admin", "Support": "support", "Helpdesk": "support", "Unset": ""}
+	tests := []struct {
+		name      string
+		idpGroups []string
+		want      []string
+	}{
+		{"mapped", []string{"Token Svc Admins", "Support"}, []string{"admin", "support"}},
+		{"unmapped dropped", []string{"admin", "Engineering", "Support"}, []string{"support"}},
+		{"exact match", []string{"token svc admins", "Support "}, []string{}},
+		{"duplicates", []string{"Support", "Helpdesk"}, []string{"support"}},
+		{"empty mapping", []string{"Unset"}, []string{}},
+		{"no groups", []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mapGroups(groupMap, tt.idpGroups); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mapGroups() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package scimservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+)
+
+// token kinds
+const (
+	tokenWord = iota
+	tokenString
+	tokenOpen
+	tokenClose
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type token struct {
+	kind  int
+	value string
+}
+
+// comparison operators (pr takes no value)
+var compareOps = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+func invalidFilter(format string, args ...interface{}) error {
+	return scimmodels.NewError(400, scimmodels.ErrInvalidFilter, fmt.Sprintf(format, args...))
+}
+
+// tokenize splits the filter into words, (json) string literals, parentheses and brackets
+func tokenize(filter string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{kind: tokenOpenBracket})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{kind: tokenCloseBracket})
+			i++
+		case r == '"':
+			end := i + 1
+			for ; end < len(runes) && runes[end] != '"'; end++ {
+				if runes[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(runes) {
+				return nil, invalidFilter("unterminated string")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(string(runes[i:end+1])), &value); err != nil {
+				return nil, invalidFilter("invalid string %s", string(runes[i:end+1]))
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value})
+			i = end + 1
+		default:
+			end := i
+			for ; end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()[]"`, runes[end]); end++ {
+			}
+			tokens = append(tokens, token{kind: tokenWord, value: string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// parser is a recursive descent parser (and binds tighter than or)
+// attribute paths are lower cased, the attributes of a value path filter are prefixed with its attribute
+type parser struct {
+	tokens []token
+	pos    int
+	prefix string
+}
+
+// ParseFilter parses a SCIM filter (RFC 7644 3.4.2.2), an empty filter is nil
+func ParseFilter(filter string) (*scimmodels.Filter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	parsed, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, invalidFilter("unexpected %q", p.tokens[p.pos].value)
+	}
+	return parsed, nil
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) next() (token, bool) {
+	t, ok := p.peek()
+	if ok {
+		p.pos++
+	}
+	return t, ok
+}
+
+func (p *parser) expect(kind int, what string) error {
+	if t, ok := p.next(); !ok || t.kind != kind {
+		return invalidFilter("expected %s", what)
+	}
+	return nil
+}
+
+// isKeyword reports if the next token is the (case insensitive) keyword
+func (p *parser) isKeyword(keyword string) bool {
+	t, ok := p.peek()
+	return ok && t.kind == tokenWord && strings.EqualFold(t.value, keyword)
+}
+
+func (p *parser) parseOr() (*scimmodels.Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimmodels.Filter{Op: "or", Filters: []*scimmodels.Filter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (*scimmodels.Filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimmodels.Filter{Op: "and", Filters: []*scimmodels.Filter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (*scimmodels.Filter, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, invalidFilter("unexpected end of filter")
+	}
+
+	if p.isKeyword("not") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == tokenOpen {
+		p.pos += 2
+		operand, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+		return &scimmodels.Filter{Op: "not", Filters: []*scimmodels.Filter{operand}}, nil
+	}
+
+	if t.kind == tokenOpen {
+		p.pos++
+		grouped, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(tokenClose, ")"); err != nil {
+			return nil, err
+		}
+		return grouped, nil
+	}
+
+	if t.kind != tokenWord {
+		return nil, invalidFilter("expected an attribute")
+	}
+	p.pos++
+	attr := p.prefix + AttributePath(t.value)
+
+	// a value path filters the values of a multi valued attribute, ex: emails[type eq "work"]
+	if next, ok := p.peek(); ok && next.kind == tokenOpenBracket {
+		if p.prefix != "" {
+			return nil, invalidFilter("nested value path %q", t.value)
+		}
+		p.pos++
+		p.prefix = attr + "."
+		filtered, err := p.parseOr()
+		p.prefix = ""
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(tokenCloseBracket, "]"); err != nil {
+			return nil, err
+		}
+		return filtered, nil
+	}
+
+	opToken, ok := p.next()
+	if !ok || opToken.kind != tokenWord {
+		return nil, invalidFilter("expected an operator after %q", t.value)
+	}
+	op := strings.ToLower(opToken.value)
+	if op == "pr" {
+		return &scimmodels.Filter{Op: op, Attr: attr}, nil
+	}
+	if !compareOps[op] {
+		return nil, invalidFilter("unsupported operator %q", opToken.value)
+	}
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return &scimmodels.Filter{Op: op, Attr: attr, Value: value}, nil
+}
+
+// parseValue parses a comparison value (string, true, false, null or a number)
+func (p *parser) parseValue() (interface{}, error) {
+	t, ok := p.next()
+	if !ok {
+		return nil, invalidFilter("expected a value")
+	}
+	if t.kind == tokenString {
+		return t.value, nil
+	}
+	if t.kind != tokenWord {
+		return nil, invalidFilter("expected a value")
+	}
+	switch strings.ToLower(t.value) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(t.value, 64)
+	if err != nil {
+		return nil, invalidFilter("invalid value %q", t.value)
+	}
+	return number, nil
+}
+
+// AttributePath returns the lower case attribute path without a core schema urn prefix
+// ex: urn:ietf:params:scim:schemas:core:2.0:User:name.givenName is name.givenname
+func AttributePath(path string) string {
+	return strings.ToLower(trimSchema(path))
+}
+
+// trimSchema trims a core schema urn prefix from the path (an extension schema path is returned as is)
+func trimSchema(path string) string {
+	for _, schema := range []string{scimmodels.SchemaUser, scimmodels.SchemaGroup} {
+		if prefix := schema + ":"; len(path) > len(prefix) && strings.EqualFold(path[:len(prefix)], prefix) {
+			return path[len(prefix):]
+		}
+	}
+	return path
+}
+
+// matches reports if the (multi valued attribute's) value matches the filter, the filter attributes are relative
+// to the value (ex: type, value), only (case insensitive) string and boolean comparisons are supported
+func matches(filter *scimmodels.Filter, value map[string]interface{}) bool {
+	switch filter.Op {
+	case "and":
+		return matches(filter.Filters[0], value) && matches(filter.Filters[1], value)
+	case "or":
+		return matches(filter.Filters[0], value) || matches(filter.Filters[1], value)
+	case "not":
+		return !matches(filter.Filters[0], value)
+	}
+
+	var actual interface{}
+	for key, v := range value {
+		if strings.ToLower(key) == filter.Attr {
+			actual = v
+		}
+	}
+	if filter.Op == "pr" {
+		return actual != nil && actual != ""
+	}
+
+	if expected, ok := filter.Value.(bool); ok {
+		b, _ := actual.(bool)
+		return (filter.Op == "eq" && b == expected) || (filter.Op == "ne" && b != expected)
+	}
+	expected, ok := filter.Value.(string)
+	if !ok {
+		return false
+	}
+	s, _ := actual.(string)
+	s, expected = strings.ToLower(s), strings.ToLower(expected)
+	switch filter.Op {
+	case "eq":
+		return s == expected
+	case "ne":
+		return s != expected
+	case "co":
+		return strings.Contains(s, expected)
+	case "sw":
+		return strings.HasPrefix(s, expected)
+	case "ew":
+		return strings.HasSuffix(s, expected)
+	case "gt":
+		return s > expected
+	case "ge":
+		return s >= expected
+	case "lt":
+		return s < expected
+	case "le":
+		return s <= expected
+	}
+	return false
+}
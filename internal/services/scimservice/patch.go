@@ -0,0 +1,343 @@
+package scimservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+)
+
+// schema is the patchable attributes of a resource (lower case path to attribute name)
+// multiValued attributes are arrays of complex values, readOnly attributes can not be patched
+type schema struct {
+	attributes  map[string]string
+	multiValued map[string]bool
+	readOnly    map[string]bool
+}
+
+var userSchema = schema{
+	attributes:  map[string]string{"externalid": "externalId", "username": "userName", "name": "name", "emails": "emails", "active": "active"},
+	multiValued: map[string]bool{"emails": true},
+	readOnly:    map[string]bool{"id": true, "meta": true, "schemas": true, "groups": true},
+}
+
+var groupSchema = schema{
+	attributes:  map[string]string{"externalid": "externalId", "displayname": "displayName", "members": "members"},
+	multiValued: map[string]bool{"members": true},
+	readOnly:    map[string]bool{"id": true, "meta": true, "schemas": true},
+}
+
+// subAttributes are the sub attribute names of the complex attributes (name, emails, members)
+var subAttributes = map[string]string{
+	"formatted":  "formatted",
+	"givenname":  "givenName",
+	"middlename": "middleName",
+	"familyname": "familyName",
+	"value":      "value",
+	"type":       "type",
+	"primary":    "primary",
+	"display":    "display",
+}
+
+// patchPath is a parsed patch path: attr[filter].sub (the filter and sub attribute are optional)
+type patchPath struct {
+	attr   string
+	filter *scimmodels.Filter
+	sub    string
+}
+
+func invalidPath(path string) error {
+	return scimmodels.NewError(400, scimmodels.ErrInvalidPath, fmt.Sprintf("invalid patch path %q", path))
+}
+
+// parsePath parses the patch path, ok is false for an extension schema attribute (which is ignored)
+func (s schema) parsePath(path string) (patchPath, bool, error) {
+	trimmed := trimSchema(path)
+	if strings.HasPrefix(strings.ToLower(trimmed), "urn:") {
+		return patchPath{}, false, nil
+	}
+
+	parsed := patchPath{}
+	attr, sub := trimmed, ""
+	if open := strings.Index(trimmed, "["); open >= 0 {
+		closing := strings.LastIndex(trimmed, "]")
+		if closing < open {
+			return parsed, false, invalidPath(path)
+		}
+		filter, err := ParseFilter(trimmed[open+1 : closing])
+		if err != nil || filter == nil {
+			return parsed, false, invalidPath(path)
+		}
+		parsed.filter = filter
+		attr, sub = trimmed[:open], trimmed[closing+1:]
+		if sub != "" && !strings.HasPrefix(sub, ".") {
+			return parsed, false, invalidPath(path)
+		}
+		sub = strings.TrimPrefix(sub, ".")
+	} else if dot := strings.Index(trimmed, "."); dot >= 0 {
+		attr, sub = trimmed[:dot], trimmed[dot+1:]
+	}
+
+	attr = strings.ToLower(attr)
+	if s.readOnly[attr] {
+		return parsed, false, scimmodels.NewError(400, scimmodels.ErrMutability, fmt.Sprintf("%s is read only", attr))
+	}
+	if parsed.attr = s.attributes[attr]; parsed.attr == "" {
+		return parsed, false, invalidPath(path)
+	}
+	if parsed.filter != nil && !s.multiValued[attr] {
+		return parsed, false, invalidPath(path)
+	}
+	if sub != "" {
+		if parsed.sub = subAttributes[strings.ToLower(sub)]; parsed.sub == "" {
+			return parsed, false, invalidPath(path)
+		}
+	}
+	return parsed, true, nil
+}
+
+// apply applies the patch operations to the resource (a json object)
+func (s schema) apply(resource map[string]interface{}, operations []scimmodels.PatchOperation) error {
+	for _, operation := range operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return scimmodels.NewError(400, scimmodels.ErrInvalidSyntax, fmt.Sprintf("unsupported patch op %q", operation.Op))
+		}
+
+		var value interface{}
+		if len(operation.Value) > 0 {
+			if err := json.Unmarshal(operation.Value, &value); err != nil {
+				return scimmodels.NewError(400, scimmodels.ErrInvalidSyntax, "invalid patch value")
+			}
+		}
+
+		// without a path the value is an object of the attributes to add or replace
+		if operation.Path == "" {
+			if op == "remove" {
+				return scimmodels.NewError(400, scimmodels.ErrNoTarget, "remove requires a path")
+			}
+			attributes, ok := value.(map[string]interface{})
+			if !ok {
+				return scimmodels.NewError(400, scimmodels.ErrInvalidValue, "patch value must be an object")
+			}
+			for name, attrValue := range attributes {
+				if strings.ToLower(name) == "schemas" {
+					continue
+				}
+				path, ok, err := s.parsePath(name)
+				if err != nil {
+					return err
+				}
+				if ok {
+					if err = s.applyPath(resource, op, path, attrValue); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		path, ok, err := s.parsePath(operation.Path)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err = s.applyPath(resource, op, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyPath applies the operation to the attribute the path points at
+func (s schema) applyPath(resource map[string]interface{}, op string, path patchPath, value interface{}) error {
+	if s.multiValued[strings.ToLower(path.attr)] {
+		return applyMultiValued(resource, op, path, value)
+	}
+
+	if path.sub == "" {
+		switch {
+		case op == "remove":
+			delete(resource, path.attr)
+		case op == "add":
+			// adding a complex value merges its sub attributes
+			current, isMap := resource[path.attr].(map[string]interface{})
+			if added, ok := value.(map[string]interface{}); ok && isMap {
+				merge(current, added)
+				return nil
+			}
+			resource[path.attr] = value
+		default:
+			resource[path.attr] = value
+		}
+		return nil
+	}
+
+	complexValue, ok := resource[path.attr].(map[string]interface{})
+	if !ok {
+		if op == "remove" {
+			return nil
+		}
+		complexValue = map[string]interface{}{}
+		resource[path.attr] = complexValue
+	}
+	if op == "remove" {
+		delete(complexValue, path.sub)
+	} else {
+		complexValue[path.sub] = value
+	}
+	return nil
+}
+
+// applyMultiValued applies the operation to a multi valued attribute (emails, members)
+func applyMultiValued(resource map[string]interface{}, op string, path patchPath, value interface{}) error {
+	current := elements(resource[path.attr])
+
+	// the whole attribute
+	if path.filter == nil && path.sub == "" {
+		switch op {
+		case "add":
+			resource[path.attr] = append(current, elements(value)...)
+		case "replace":
+			resource[path.attr] = elements(value)
+		case "remove":
+			// a remove with a value removes the listed values (ex: members), otherwise every value
+			if value == nil {
+				delete(resource, path.attr)
+				return nil
+			}
+			removed := map[string]bool{}
+			for _, element := range elements(value) {
+				removed[fmt.Sprint(element["value"])] = true
+			}
+			kept := []map[string]interface{}{}
+			for _, element := range current {
+				if !removed[fmt.Sprint(element["value"])] {
+					kept = append(kept, element)
+				}
+			}
+			resource[path.attr] = kept
+		}
+		return nil
+	}
+
+	// the sub attribute of every value (a single valued attribute, ex: emails.value, gets a value)
+	if path.filter == nil {
+		if len(current) == 0 && op != "remove" {
+			current = []map[string]interface{}{{}}
+		}
+		for _, element := range current {
+			if op == "remove" {
+				delete(element, path.sub)
+			} else {
+				element[path.sub] = value
+			}
+		}
+		resource[path.attr] = current
+		return nil
+	}
+
+	// the values matching the filter
+	matched := false
+	kept := []map[string]interface{}{}
+	for _, element := range current {
+		if !matches(path.filter, element) {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+		switch {
+		case op == "remove" && path.sub == "":
+			continue
+		case op == "remove":
+			delete(element, path.sub)
+		case path.sub != "":
+			element[path.sub] = value
+		default:
+			replacement, ok := value.(map[string]interface{})
+			if !ok {
+				return scimmodels.NewError(400, scimmodels.ErrInvalidValue, "patch value must be an object")
+			}
+			merge(element, replacement)
+		}
+		kept = append(kept, element)
+	}
+	// removing a value that is already gone is not an error
+	if !matched && op != "remove" {
+		return scimmodels.NewError(400, scimmodels.ErrNoTarget, fmt.Sprintf("no %s match the filter", path.attr))
+	}
+	resource[path.attr] = kept
+	return nil
+}
+
+// elements returns the (complex) values of a multi valued attribute, a single value is a list of one
+func elements(value interface{}) []map[string]interface{} {
+	if patched, ok := value.([]map[string]interface{}); ok {
+		return patched
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		if value == nil {
+			return []map[string]interface{}{}
+		}
+		values = []interface{}{value}
+	}
+	result := []map[string]interface{}{}
+	for _, v := range values {
+		if element, ok := v.(map[string]interface{}); ok {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// merge merges the sub attributes (matched case insensitively) into the complex value
+func merge(complexValue, values map[string]interface{}) {
+	for name, value := range values {
+		if canonical, ok := subAttributes[strings.ToLower(name)]; ok {
+			name = canonical
+		}
+		complexValue[name] = value
+	}
+}
+
+// patch applies the operations to the resource through its json representation
+// normalize fixes up the patched attributes (ex: a "False" string for a boolean) before it is decoded
+func patch(resource interface{}, s schema, patchOp scimmodels.PatchOp, normalize func(map[string]interface{}), patched interface{}) error {
+	if len(patchOp.Operations) == 0 {
+		return scimmodels.NewError(400, scimmodels.ErrInvalidSyntax, "patch requires operations")
+	}
+	raw, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	object := map[string]interface{}{}
+	if err = json.Unmarshal(raw, &object); err != nil {
+		return err
+	}
+	if err = s.apply(object, patchOp.Operations); err != nil {
+		return err
+	}
+	if normalize != nil {
+		normalize(object)
+	}
+	if raw, err = json.Marshal(object); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(raw, patched); err != nil {
+		return scimmodels.NewError(400, scimmodels.ErrInvalidValue, fmt.Sprintf("invalid patched resource: %v", err))
+	}
+	return nil
+}
+
+// normalizeUser accepts a string active ("True"/"False"), as sent by some provisioning clients
+func normalizeUser(user map[string]interface{}) {
+	if active, ok := user["active"].(string); ok {
+		if b, err := strconv.ParseBool(active); err == nil {
+			user["active"] = b
+		}
+	}
+}
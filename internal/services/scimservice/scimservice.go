@@ -0,0 +1,518 @@
+package scimservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/scimrepo"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+
+	"go.uber.org/zap"
+)
+
+// Provider is the SCIM 2.0 provisioning interface (RFC 7643, RFC 7644)
+// users are provisioned without a password (they sign in through a federated login), an inactive
+// or deleted user is deprovisioned: its outstanding tokens are revoked
+type Provider interface {
+	Authenticate(ctx context.Context, token string) bool
+	ServiceProviderConfig(ctx context.Context) scimmodels.ServiceProviderConfig
+	ListUsers(ctx context.Context, query scimmodels.ListQuery) (scimmodels.ListResponse, error)
+	CreateUser(ctx context.Context, user scimmodels.User) (scimmodels.User, error)
+	ReadUser(ctx context.Context, id string) (scimmodels.User, error)
+	ReplaceUser(ctx context.Context, id string, user scimmodels.User) (scimmodels.User, error)
+	PatchUser(ctx context.Context, id string, patchOp scimmodels.PatchOp) (scimmodels.User, error)
+	DeleteUser(ctx context.Context, id string) error
+	ListGroups(ctx context.Context, query scimmodels.ListQuery) (scimmodels.ListResponse, error)
+	CreateGroup(ctx context.Context, group scimmodels.Group) (scimmodels.Group, error)
+	ReadGroup(ctx context.Context, id string) (scimmodels.Group, error)
+	ReplaceGroup(ctx context.Context, id string, group scimmodels.Group) (scimmodels.Group, error)
+	PatchGroup(ctx context.Context, id string, patchOp scimmodels.PatchOp) (scimmodels.Group, error)
+	DeleteGroup(ctx context.Context, id string) error
+}
+
+// Sessions revokes a user's outstanding tokens (userservice.Service implements it)
+type Sessions interface {
+	RevokeSessions(ctx context.Context, userID int)
+}
+
+type provider struct {
+	logger   log.Factory
+	cfg      *config.Config
+	repo     scimrepo.Store
+	sessions Sessions
+	auditor  auditservice.Provider
+}
+
+// New returns a new SCIM Provider
+func New(cfg *config.Config, logger log.Factory, repo scimrepo.Store, sessions Sessions, auditor auditservice.Provider) Provider {
+	return &provider{
+		logger:   logger.With(zap.String("package", "scimservice")),
+		cfg:      cfg,
+		repo:     repo,
+		sessions: sessions,
+		auditor:  auditor,
+	}
+}
+
+// deprovisionReason is the status reason of a user deactivated through scim
+const deprovisionReason = "deprovisioned by scim"
+
+// Authenticate reports if the token is the provisioning client's bearer token
+// the digests are compared so the comparison time does not depend on the token length
+func (p *provider) Authenticate(ctx context.Context, token string) bool {
+	if !p.cfg.SCIM.Enabled || p.cfg.SCIM.Token == "" || token == "" {
+		return false
+	}
+	expected := sha256.Sum256([]byte(p.cfg.SCIM.Token))
+	actual := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+}
+
+// ServiceProviderConfig returns the supported features
+func (p *provider) ServiceProviderConfig(ctx context.Context) scimmodels.ServiceProviderConfig {
+	return scimmodels.ServiceProviderConfig{
+		Schemas: []string{scimmodels.SchemaServiceProviderConfig},
+		Patch:   scimmodels.Supported{Supported: true},
+		Filter:  scimmodels.FilterSupport{Supported: true, MaxResults: p.cfg.SCIM.MaxResults},
+		AuthenticationSchemes: []scimmodels.AuthenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "Bearer Token",
+			Description: "the provisioning client's bearer token",
+		}},
+	}
+}
+
+// page returns the (0 based) offset and limit of the list query, the count is capped at the max results
+func (p *provider) page(query scimmodels.ListQuery) (int, int) {
+	startIndex, count := query.StartIndex, query.Count
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 || count > p.cfg.SCIM.MaxResults {
+		count = p.cfg.SCIM.MaxResults
+	}
+	return startIndex - 1, count
+}
+
+func notFound(resourceType, id string) error {
+	return scimmodels.NewError(404, "", fmt.Sprintf("%s %s not found", resourceType, id))
+}
+
+// isNotFound reports if the (repo) error is a not found
+func isNotFound(err error) bool {
+	rerr, ok := err.(*errors.RestError)
+	return ok && rerr.Code == 404
+}
+
+func (p *provider) location(resourceType, id string) string {
+	return fmt.Sprintf("%s/%ss/%s", strings.TrimSuffix(p.cfg.SCIM.BaseURL, "/"), resourceType, id)
+}
+
+// toUser maps the user record to a scim user
+func (p *provider) toUser(record scimmodels.UserRecord) scimmodels.User {
+	active := record.Status != usermodels.StatusDisabled
+	user := scimmodels.User{
+		Schemas:    []string{scimmodels.SchemaUser},
+		ID:         record.UID,
+		ExternalID: record.ExternalID,
+		UserName:   record.Email,
+		Emails:     []scimmodels.Email{{Value: record.Email, Type: "work", Primary: true}},
+		Active:     &active,
+		Meta: &scimmodels.Meta{
+			ResourceType: scimmodels.ResourceUser,
+			Created:      record.CreatedAt,
+			LastModified: record.UpdatedAt,
+			Location:     p.location(scimmodels.ResourceUser, record.UID),
+		},
+	}
+	if record.FirstName != "" || record.MiddleName != "" || record.LastName != "" {
+		names := []string{}
+		for _, name := range []string{record.FirstName, record.MiddleName, record.LastName} {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		user.Name = &scimmodels.Name{
+			Formatted:  strings.Join(names, " "),
+			GivenName:  record.FirstName,
+			MiddleName: record.MiddleName,
+			FamilyName: record.LastName,
+		}
+	}
+	for _, group := range record.Groups {
+		user.Groups = append(user.Groups, scimmodels.Ref{
+			Value:   group.UID,
+			Ref:     p.location(scimmodels.ResourceGroup, group.UID),
+			Display: group.Display,
+		})
+	}
+	return user
+}
+
+// fromUser maps the scim user's attributes to the user record (the status is left to the caller)
+// the userName is the user's email
+func fromUser(user scimmodels.User, record scimmodels.UserRecord) (scimmodels.UserRecord, error) {
+	userName := strings.TrimSpace(user.UserName)
+	if address, err := mail.ParseAddress(userName); err != nil || address.Address != userName {
+		return record, scimmodels.NewError(400, scimmodels.ErrInvalidValue, "userName must be an email address")
+	}
+	record.Email = userName
+	record.ExternalID = user.ExternalID
+	record.FirstName, record.MiddleName, record.LastName = "", "", ""
+	if user.Name != nil {
+		record.FirstName, record.MiddleName, record.LastName = user.Name.GivenName, user.Name.MiddleName, user.Name.FamilyName
+	}
+	return record, nil
+}
+
+// ListUsers lists a page of the users matching the query's filter
+func (p *provider) ListUsers(ctx context.Context, query scimmodels.ListQuery) (scimmodels.ListResponse, error) {
+	filter, err := ParseFilter(query.Filter)
+	if err != nil {
+		return scimmodels.ListResponse{}, err
+	}
+	offset, limit := p.page(query)
+	records, total, err := p.repo.ListUsers(ctx, filter, offset, limit)
+	if err != nil {
+		return scimmodels.ListResponse{}, errors.ErrorWrapper(err, "SCIMService.ListUsers")
+	}
+	users := make([]scimmodels.User, 0, len(records))
+	for _, record := range records {
+		users = append(users, p.toUser(record))
+	}
+	return scimmodels.ListResponse{
+		Schemas:      []string{scimmodels.SchemaListResponse},
+		TotalResults: total,
+		StartIndex:   offset + 1,
+		ItemsPerPage: len(users),
+		Resources:    users,
+	}, nil
+}
+
+// CreateUser provisions a (passwordless) user, a user without active is active
+func (p *provider) CreateUser(ctx context.Context, user scimmodels.User) (scimmodels.User, error) {
+	p.logger.For(ctx).Info("entering scimservice.CreateUser", zap.String("user_name", user.UserName))
+	record, err := fromUser(user, scimmodels.UserRecord{Status: usermodels.StatusActive})
+	if err != nil {
+		return scimmodels.User{}, err
+	}
+	if user.Active != nil && !*user.Active {
+		record.Status, record.StatusReason = usermodels.StatusDisabled, deprovisionReason
+	}
+
+	record, err = p.repo.InsertUser(ctx, record, outboxmodels.Event{
+		Type: outboxmodels.EventUserRegistered,
+		Data: map[string]interface{}{"email": record.Email, "source": "scim"},
+	})
+	if err != nil {
+		return scimmodels.User{}, errors.ErrorWrapper(err, "SCIMService.CreateUser.InsertUser")
+	}
+	p.audit(ctx, "create", scimmodels.ResourceUser, record.UID, record.ID, record.Email)
+	p.logger.For(ctx).Info("leaving scimservice.CreateUser", zap.Int("user_id", record.ID))
+	return p.toUser(record), nil
+}
+
+func (p *provider) readUser(ctx context.Context, id string) (scimmodels.UserRecord, error) {
+	record, err := p.repo.ReadUser(ctx, id)
+	if isNotFound(err) {
+		return record, notFound(scimmodels.ResourceUser, id)
+	}
+	return record, errors.ErrorWrapper(err, "SCIMService.readUser")
+}
+
+// ReadUser reads the user by its id (uid)
+func (p *provider) ReadUser(ctx context.Context, id string) (scimmodels.User, error) {
+	record, err := p.readUser(ctx, id)
+	if err != nil {
+		return scimmodels.User{}, err
+	}
+	return p.toUser(record), nil
+}
+
+// ReplaceUser replaces the user's attributes, a user without active keeps its status
+func (p *provider) ReplaceUser(ctx context.Context, id string, user scimmodels.User) (scimmodels.User, error) {
+	record, err := p.readUser(ctx, id)
+	if err != nil {
+		return scimmodels.User{}, err
+	}
+	return p.updateUser(ctx, "replace", record, user)
+}
+
+// PatchUser applies the patch operations to the user
+func (p *provider) PatchUser(ctx context.Context, id string, patchOp scimmodels.PatchOp) (scimmodels.User, error) {
+	record, err := p.readUser(ctx, id)
+	if err != nil {
+		return scimmodels.User{}, err
+	}
+	patched := scimmodels.User{}
+	if err = patch(p.toUser(record), userSchema, patchOp, normalizeUser, &patched); err != nil {
+		return scimmodels.User{}, errors.ErrorWrapper(err, "SCIMService.PatchUser.patch")
+	}
+	return p.updateUser(ctx, "patch", record, patched)
+}
+
+// updateUser persists the user's new attributes and status
+// deactivating a user disables it (and revokes its tokens), activating a disabled user enables it
+// other statuses (ex: an admin lock) are left alone
+func (p *provider) updateUser(ctx context.Context, action string, record scimmodels.UserRecord, user scimmodels.User) (scimmodels.User, error) {
+	p.logger.For(ctx).Info("entering scimservice.updateUser", zap.Int("user_id", record.ID), zap.String("action", action))
+	updated, err := fromUser(user, record)
+	if err != nil {
+		return scimmodels.User{}, err
+	}
+
+	events := []outboxmodels.Event{}
+	switch {
+	case user.Active != nil && !*user.Active && record.Status != usermodels.StatusDisabled:
+		updated.Status, updated.StatusReason = usermodels.StatusDisabled, deprovisionReason
+		events = append(events,
+			statusEvent(outboxmodels.EventUserDisabled, updated),
+			outboxmodels.Event{
+				Type:   outboxmodels.EventSessionRevoked,
+				UserID: record.ID,
+				Data:   map[string]interface{}{"email": updated.Email, "reason": "account disabled"},
+			})
+	case user.Active != nil && *user.Active && record.Status == usermodels.StatusDisabled:
+		updated.Status, updated.StatusReason = usermodels.StatusActive, "provisioned by scim"
+		events = append(events, statusEvent(outboxmodels.EventUserEnabled, updated))
+	}
+
+	updated, err = p.repo.UpdateUser(ctx, updated, events...)
+	if err != nil {
+		return scimmodels.User{}, errors.ErrorWrapper(err, "SCIMService.updateUser.UpdateUser")
+	}
+	if updated.Status == usermodels.StatusDisabled && record.Status != usermodels.StatusDisabled {
+		p.sessions.RevokeSessions(ctx, record.ID)
+	}
+	p.audit(ctx, action, scimmodels.ResourceUser, record.UID, record.ID, updated.Email)
+	p.logger.For(ctx).Info("leaving scimservice.updateUser", zap.Int("user_id", record.ID), zap.String("status", updated.Status))
+	return p.toUser(updated), nil
+}
+
+// statusEvent returns the outbox event for the provisioned status change
+func statusEvent(eventType string, record scimmodels.UserRecord) outboxmodels.Event {
+	return outboxmodels.Event{
+		Type:   eventType,
+		UserID: record.ID,
+		Data: map[string]interface{}{
+			"email":  record.Email,
+			"status": record.Status,
+			"reason": record.StatusReason,
+		},
+	}
+}
+
+// DeleteUser deletes the user and revokes its tokens
+func (p *provider) DeleteUser(ctx context.Context, id string) error {
+	p.logger.For(ctx).Info("entering scimservice.DeleteUser", zap.String("id", id))
+	record, err := p.readUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = p.repo.DeleteUser(ctx, record.ID,
+		outboxmodels.Event{
+			Type:   outboxmodels.EventUserDeleted,
+			UserID: record.ID,
+			Data:   map[string]interface{}{"email": record.Email, "source": "scim"},
+		},
+		outboxmodels.Event{
+			Type:   outboxmodels.EventSessionRevoked,
+			UserID: record.ID,
+			Data:   map[string]interface{}{"email": record.Email, "reason": "account deleted"},
+		})
+	if isNotFound(err) {
+		return notFound(scimmodels.ResourceUser, id)
+	}
+	if err != nil {
+		return errors.ErrorWrapper(err, "SCIMService.DeleteUser.DeleteUser")
+	}
+	p.sessions.RevokeSessions(ctx, record.ID)
+	p.audit(ctx, "delete", scimmodels.ResourceUser, record.UID, record.ID, record.Email)
+	p.logger.For(ctx).Info("leaving scimservice.DeleteUser", zap.Int("user_id", record.ID))
+	return nil
+}
+
+// toGroup maps the group record to a scim group
+func (p *provider) toGroup(record scimmodels.GroupRecord) scimmodels.Group {
+	group := scimmodels.Group{
+		Schemas:     []string{scimmodels.SchemaGroup},
+		ID:          record.UID,
+		ExternalID:  record.ExternalID,
+		DisplayName: record.Name,
+		Meta: &scimmodels.Meta{
+			ResourceType: scimmodels.ResourceGroup,
+			Created:      record.CreatedAt,
+			LastModified: record.UpdatedAt,
+			Location:     p.location(scimmodels.ResourceGroup, record.UID),
+		},
+	}
+	for _, member := range record.Members {
+		group.Members = append(group.Members, scimmodels.Ref{
+			Value:   member.UID,
+			Ref:     p.location(scimmodels.ResourceUser, member.UID),
+			Display: member.Display,
+		})
+	}
+	return group
+}
+
+// fromGroup maps the scim group's attributes to the group record, the members are user ids
+func fromGroup(group scimmodels.Group, record scimmodels.GroupRecord) (scimmodels.GroupRecord, error) {
+	record.Name = strings.TrimSpace(group.DisplayName)
+	if record.Name == "" {
+		return record, scimmodels.NewError(400, scimmodels.ErrInvalidValue, "displayName is required")
+	}
+	record.ExternalID = group.ExternalID
+	record.Members = []scimmodels.ResourceRef{}
+	for _, member := range group.Members {
+		if member.Value == "" {
+			return record, scimmodels.NewError(400, scimmodels.ErrInvalidValue, "member value is required")
+		}
+		record.Members = append(record.Members, scimmodels.ResourceRef{UID: member.Value})
+	}
+	return record, nil
+}
+
+// ListGroups lists a page of the groups matching the query's filter
+// excluding the members attribute skips loading them
+func (p *provider) ListGroups(ctx context.Context, query scimmodels.ListQuery) (scimmodels.ListResponse, error) {
+	filter, err := ParseFilter(query.Filter)
+	if err != nil {
+		return scimmodels.ListResponse{}, err
+	}
+	excludeMembers := false
+	for _, attr := range query.ExcludedAttributes {
+		if AttributePath(strings.TrimSpace(attr)) == "members" {
+			excludeMembers = true
+		}
+	}
+	offset, limit := p.page(query)
+	records, total, err := p.repo.ListGroups(ctx, filter, offset, limit, excludeMembers)
+	if err != nil {
+		return scimmodels.ListResponse{}, errors.ErrorWrapper(err, "SCIMService.ListGroups")
+	}
+	groups := make([]scimmodels.Group, 0, len(records))
+	for _, record := range records {
+		groups = append(groups, p.toGroup(record))
+	}
+	return scimmodels.ListResponse{
+		Schemas:      []string{scimmodels.SchemaListResponse},
+		TotalResults: total,
+		StartIndex:   offset + 1,
+		ItemsPerPage: len(groups),
+		Resources:    groups,
+	}, nil
+}
+
+// CreateGroup creates the group with its members
+func (p *provider) CreateGroup(ctx context.Context, group scimmodels.Group) (scimmodels.Group, error) {
+	p.logger.For(ctx).Info("entering scimservice.CreateGroup", zap.String("display_name", group.DisplayName))
+	record, err := fromGroup(group, scimmodels.GroupRecord{})
+	if err != nil {
+		return scimmodels.Group{}, err
+	}
+	record, err = p.repo.InsertGroup(ctx, record)
+	if err != nil {
+		return scimmodels.Group{}, errors.ErrorWrapper(err, "SCIMService.CreateGroup.InsertGroup")
+	}
+	p.audit(ctx, "create", scimmodels.ResourceGroup, record.UID, 0, "")
+	p.logger.For(ctx).Info("leaving scimservice.CreateGroup", zap.Int("group_id", record.ID))
+	return p.toGroup(record), nil
+}
+
+func (p *provider) readGroup(ctx context.Context, id string) (scimmodels.GroupRecord, error) {
+	record, err := p.repo.ReadGroup(ctx, id)
+	if isNotFound(err) {
+		return record, notFound(scimmodels.ResourceGroup, id)
+	}
+	return record, errors.ErrorWrapper(err, "SCIMService.readGroup")
+}
+
+// ReadGroup reads the group by its id (uid)
+func (p *provider) ReadGroup(ctx context.Context, id string) (scimmodels.Group, error) {
+	record, err := p.readGroup(ctx, id)
+	if err != nil {
+		return scimmodels.Group{}, err
+	}
+	return p.toGroup(record), nil
+}
+
+// ReplaceGroup replaces the group's attributes and members
+func (p *provider) ReplaceGroup(ctx context.Context, id string, group scimmodels.Group) (scimmodels.Group, error) {
+	record, err := p.readGroup(ctx, id)
+	if err != nil {
+		return scimmodels.Group{}, err
+	}
+	return p.updateGroup(ctx, "replace", record, group)
+}
+
+// PatchGroup applies the patch operations to the group (ex: adding or removing members)
+func (p *provider) PatchGroup(ctx context.Context, id string, patchOp scimmodels.PatchOp) (scimmodels.Group, error) {
+	record, err := p.readGroup(ctx, id)
+	if err != nil {
+		return scimmodels.Group{}, err
+	}
+	patched := scimmodels.Group{}
+	if err = patch(p.toGroup(record), groupSchema, patchOp, nil, &patched); err != nil {
+		return scimmodels.Group{}, errors.ErrorWrapper(err, "SCIMService.PatchGroup.patch")
+	}
+	return p.updateGroup(ctx, "patch", record, patched)
+}
+
+func (p *provider) updateGroup(ctx context.Context, action string, record scimmodels.GroupRecord, group scimmodels.Group) (scimmodels.Group, error) {
+	p.logger.For(ctx).Info("entering scimservice.updateGroup", zap.Int("group_id", record.ID), zap.String("action", action))
+	updated, err := fromGroup(group, record)
+	if err != nil {
+		return scimmodels.Group{}, err
+	}
+	updated, err = p.repo.UpdateGroup(ctx, updated)
+	if err != nil {
+		return scimmodels.Group{}, errors.ErrorWrapper(err, "SCIMService.updateGroup.UpdateGroup")
+	}
+	p.audit(ctx, action, scimmodels.ResourceGroup, record.UID, 0, "")
+	p.logger.For(ctx).Info("leaving scimservice.updateGroup", zap.Int("group_id", record.ID))
+	return p.toGroup(updated), nil
+}
+
+// DeleteGroup deletes the group (and its memberships)
+func (p *provider) DeleteGroup(ctx context.Context, id string) error {
+	record, err := p.readGroup(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = p.repo.DeleteGroup(ctx, record.ID)
+	if isNotFound(err) {
+		return notFound(scimmodels.ResourceGroup, id)
+	}
+	if err != nil {
+		return errors.ErrorWrapper(err, "SCIMService.DeleteGroup.DeleteGroup")
+	}
+	p.audit(ctx, "delete", scimmodels.ResourceGroup, record.UID, 0, "")
+	return nil
+}
+
+// audit records the provisioning change (the actor is the provisioning client, not a user)
+func (p *provider) audit(ctx context.Context, action, resourceType, id string, userID int, email string) {
+	p.auditor.Record(ctx, auditmodels.Event{
+		Event:     auditmodels.EventSCIMProvision,
+		Outcome:   auditmodels.OutcomeSuccess,
+		SubjectID: userID,
+		Email:     email,
+		Details: map[string]interface{}{
+			"action":   action,
+			"resource": resourceType,
+			"id":       id,
+		},
+	})
+}
@@ -0,0 +1,429 @@
+package scimservice
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/scimmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/scimrepo"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+
+	gopkgerrors "github.com/pkg/errors"
+)
+
+type mockSCIMRepo struct {
+	scimrepo.Store
+	users   map[string]scimmodels.UserRecord
+	groups  map[string]scimmodels.GroupRecord
+	events  []string
+	deleted []int
+}
+
+func (m *mockSCIMRepo) ReadUser(ctx context.Context, uid string) (scimmodels.UserRecord, error) {
+	user, ok := m.users[uid]
+	if !ok {
+		return user, &errors.RestError{Code: 404, Message: "Resource not found"}
+	}
+	return user, nil
+}
+
+func (m *mockSCIMRepo) InsertUser(ctx context.Context, user scimmodels.UserRecord, events ...outboxmodels.Event) (scimmodels.UserRecord, error) {
+	user.ID, user.UID = 9, "new-user"
+	m.users[user.UID] = user
+	m.appendEvents(events)
+	return user, nil
+}
+
+func (m *mockSCIMRepo) UpdateUser(ctx context.Context, user scimmodels.UserRecord, events ...outboxmodels.Event) (scimmodels.UserRecord, error) {
+	m.users[user.UID] = user
+	m.appendEvents(events)
+	return user, nil
+}
+
+func (m *mockSCIMRepo) DeleteUser(ctx context.Context, userID int, events ...outboxmodels.Event) error {
+	m.deleted = append(m.deleted, userID)
+	m.appendEvents(events)
+	return nil
+}
+
+func (m *mockSCIMRepo) ReadGroup(ctx context.Context, uid string) (scimmodels.GroupRecord, error) {
+	group, ok := m.groups[uid]
+	if !ok {
+		return group, &errors.RestError{Code: 404, Message: "Resource not found"}
+	}
+	return group, nil
+}
+
+func (m *mockSCIMRepo) UpdateGroup(ctx context.Context, group scimmodels.GroupRecord) (scimmodels.GroupRecord, error) {
+	m.groups[group.UID] = group
+	return group, nil
+}
+
+func (m *mockSCIMRepo) appendEvents(events []outboxmodels.Event) {
+	for _, event := range events {
+		m.events = append(m.events, event.Type)
+	}
+}
+
+type mockSessions struct {
+	revoked []int
+}
+
+func (m *mockSessions) RevokeSessions(ctx context.Context, userID int) {
+	m.revoked = append(m.revoked, userID)
+}
+
+func testConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.SCIM.Enabled = true
+	cfg.SCIM.Token = "provisioning-token"
+	cfg.SCIM.BaseURL = "https://id.example.com/scim/v2"
+	cfg.SCIM.MaxResults = 100
+	return cfg
+}
+
+func newTestProvider(cfg *config.Config) (*provider, *mockSCIMRepo, *mockSessions, *testhelper.Auditor) {
+	repo := &mockSCIMRepo{
+		users: map[string]scimmodels.UserRecord{
+			"jane": {ID: 7, UID: "jane", Email: "jane@example.com", Status: usermodels.StatusActive, FirstName: "Jane", LastName: "Doe"},
+		},
+		groups: map[string]scimmodels.GroupRecord{
+			"eng": {ID: 3, UID: "eng", Name: "engineering", Members: []scimmodels.ResourceRef{{UID: "jane", Display: "jane@example.com"}, {UID: "john", Display: "john@example.com"}}},
+		},
+	}
+	sessions := &mockSessions{}
+	auditor := &testhelper.Auditor{}
+	return New(cfg, log.NewNopFactory(), repo, sessions, auditor).(*provider), repo, sessions, auditor
+}
+
+func scimErrorCode(err error) (int, string) {
+	if scimErr, ok := gopkgerrors.Cause(err).(*scimmodels.Error); ok {
+		return scimErr.Code, scimErr.ScimType
+	}
+	return 0, ""
+}
+
+func TestParseFilter(t *testing.T) {
+	eq := func(attr string, value interface{}) *scimmodels.Filter {
+		return &scimmodels.Filter{Op: "eq", Attr: attr, Value: value}
+	}
+	tests := []struct {
+		name     string
+		filter   string
+		want     *scimmodels.Filter
+		wantCode int
+	}{
+		{"empty", "  ", nil, 0},
+		{"eq", `userName eq "Jane@Example.com"`, eq("username", "Jane@Example.com"), 0},
+		{"case insensitive operator", `userName EQ "jane"`, eq("username", "jane"), 0},
+		{"schema prefix", `urn:ietf:params:scim:schemas:core:2.0:User:name.familyName co "O'Neil"`, &scimmodels.Filter{Op: "co", Attr: "name.familyname", Value: "O'Neil"}, 0},
+		{"escaped string", `displayName eq "say \"hi\""`, eq("displayname", `say "hi"`), 0},
+		{"boolean", `active eq false`, eq("active", false), 0},
+		{"present", `externalId pr`, &scimmodels.Filter{Op: "pr", Attr: "externalid"}, 0},
+		{"and binds tighter", `a eq "1" or b eq "2" and c eq "3"`, &scimmodels.Filter{Op: "or", Filters: []*scimmodels.Filter{
+			eq("a", "1"),
+			{Op: "and", Filters: []*scimmodels.Filter{eq("b", "2"), eq("c", "3")}},
+		}}, 0},
+		{"parentheses", `(a eq "1" or b eq "2") and c eq "3"`, &scimmodels.Filter{Op: "and", Filters: []*scimmodels.Filter{
+			{Op: "or", Filters: []*scimmodels.Filter{eq("a", "1"), eq("b", "2")}},
+			eq("c", "3"),
+		}}, 0},
+		{"not", `not (active eq true)`, &scimmodels.Filter{Op: "not", Filters: []*scimmodels.Filter{eq("active", true)}}, 0},
+		{"value path", `emails[type eq "work" and value co "@example.com"]`, &scimmodels.Filter{Op: "and", Filters: []*scimmodels.Filter{
+			eq("emails.type", "work"),
+			{Op: "co", Attr: "emails.value", Value: "@example.com"},
+		}}, 0},
+		{"unknown operator", `userName like "jane"`, nil, 400},
+		{"missing value", `userName eq`, nil, 400},
+		{"unterminated string", `userName eq "jane`, nil, 400},
+		{"unbalanced parentheses", `(userName eq "jane"`, nil, 400},
+		{"trailing tokens", `userName eq "jane" "john"`, nil, 400},
+		{"nested value path", `emails[value[type eq "work"]]`, nil, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFilter(tt.filter)
+			if code, scimType := scimErrorCode(err); code != tt.wantCode || (code != 0 && scimType != scimmodels.ErrInvalidFilter) {
+				t.Fatalf("ParseFilter(%q) error = %v, want code %d", tt.filter, err, tt.wantCode)
+			}
+			if tt.wantCode == 0 && !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Errorf("ParseFilter(%q) = %s, want %s", tt.filter, gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		token   string
+		want    bool
+	}{
+		{"valid token", true, "provisioning-token", true},
+		{"wrong token", true, "provisioning-tokem", false},
+		{"prefix of the token", true, "provisioning", false},
+		{"empty token", true, "", false},
+		{"not enabled", false, "provisioning-token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.SCIM.Enabled = tt.enabled
+			p, _, _, _ := newTestProvider(cfg)
+			if got := p.Authenticate(context.Background(), tt.token); got != tt.want {
+				t.Errorf("Authenticate(%q) = %v, want %v", tt.token, got, tt.want)
+			}
+		})
+	}
+
+	cfg := testConfig()
+	cfg.SCIM.Token = ""
+	p, _, _, _ := newTestProvider(cfg)
+	if p.Authenticate(context.Background(), "") {
+		t.Error("Authenticate() with no configured token = true, want false")
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations string
+		wantCode   int
+		wantType   string
+		check      func(scimmodels.UserRecord) bool
+	}{
+		{"replace given name", `[{"op": "replace", "path": "name.givenName", "value": "Janet"}]`, 0, "", func(u scimmodels.UserRecord) bool {
+			return u.FirstName == "Janet" && u.LastName == "Doe"
+		}},
+		{"replace without path", `[{"op": "Replace", "value": {"externalId": "00u1", "name.familyName": "Smith"}}]`, 0, "", func(u scimmodels.UserRecord) bool {
+			return u.ExternalID == "00u1" && u.LastName == "Smith" && u.FirstName == "Jane"
+		}},
+		{"add merges name", `[{"op": "add", "path": "name", "value": {"middleName": "Q"}}]`, 0, "", func(u scimmodels.UserRecord) bool {
+			return u.FirstName == "Jane" && u.MiddleName == "Q"
+		}},
+		{"replace email by filter", `[{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "jane.doe@example.com"}]`, 0, "", func(u scimmodels.UserRecord) bool {
+			return u.Email == "jane@example.com"
+		}},
+		{"replace user name", `[{"op": "replace", "path": "userName", "value": "jane.doe@example.com"}]`, 0, "", func(u scimmodels.UserRecord) bool {
+			return u.Email == "jane.doe@example.com"
+		}},
+		{"remove name", `[{"op": "remove", "path": "name"}]`, 0, "", func(u scimmodels.UserRecord) bool {
+			return u.FirstName == "" && u.LastName == ""
+		}},
+		{"extension attribute is ignored", `[{"op": "add", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", "value": "R&D"}]`, 0, "", func(u scimmodels.UserRecord) bool {
+			return u.Status == usermodels.StatusActive
+		}},
+		{"read only attribute", `[{"op": "replace", "path": "id", "value": "other"}]`, 400, scimmodels.ErrMutability, nil},
+		{"unknown attribute", `[{"op": "replace", "path": "nickName", "value": "JD"}]`, 400, scimmodels.ErrInvalidPath, nil},
+		{"unknown op", `[{"op": "move", "path": "userName"}]`, 400, scimmodels.ErrInvalidSyntax, nil},
+		{"remove without path", `[{"op": "remove"}]`, 400, scimmodels.ErrNoTarget, nil},
+		{"no matching value", `[{"op": "replace", "path": "emails[type eq \"home\"].value", "value": "x@example.com"}]`, 400, scimmodels.ErrNoTarget, nil},
+		{"invalid user name", `[{"op": "replace", "path": "userName", "value": "jane"}]`, 400, scimmodels.ErrInvalidValue, nil},
+		{"no operations", `[]`, 400, scimmodels.ErrInvalidSyntax, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, repo, _, _ := newTestProvider(testConfig())
+			patchOp := scimmodels.PatchOp{Schemas: []string{scimmodels.SchemaPatchOp}}
+			if err := json.Unmarshal([]byte(tt.operations), &patchOp.Operations); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := p.PatchUser(context.Background(), "jane", patchOp)
+			if code, scimType := scimErrorCode(err); code != tt.wantCode || scimType != tt.wantType {
+				t.Fatalf("PatchUser() error = %v, want %d %s", err, tt.wantCode, tt.wantType)
+			}
+			if tt.check != nil && !tt.check(repo.users["jane"]) {
+				t.Errorf("PatchUser() user = %+v", repo.users["jane"])
+			}
+		})
+	}
+}
+
+func TestPatchGroupMembers(t *testing.T) {
+	tests := []struct {
+		name        string
+		operations  string
+		wantMembers []string
+	}{
+		{"add member", `[{"op": "add", "path": "members", "value": [{"value": "ann"}]}]`, []string{"jane", "john", "ann"}},
+		{"remove member by filter", `[{"op": "remove", "path": "members[value eq \"john\"]"}]`, []string{"jane"}},
+		{"remove listed members", `[{"op": "remove", "path": "members", "value": [{"value": "jane"}]}]`, []string{"john"}},
+		{"remove missing member", `[{"op": "remove", "path": "members[value eq \"ann\"]"}]`, []string{"jane", "john"}},
+		{"replace members", `[{"op": "replace", "path": "members", "value": [{"value": "ann"}]}]`, []string{"ann"}},
+		{"remove all members", `[{"op": "remove", "path": "members"}]`, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, repo, _, _ := newTestProvider(testConfig())
+			patchOp := scimmodels.PatchOp{Schemas: []string{scimmodels.SchemaPatchOp}}
+			if err := json.Unmarshal([]byte(tt.operations), &patchOp.Operations); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := p.PatchGroup(context.Background(), "eng", patchOp); err != nil {
+				t.Fatalf("PatchGroup() error = %v", err)
+			}
+			members := []string{}
+			for _, member := range repo.groups["eng"].Members {
+				members = append(members, member.UID)
+			}
+			if !reflect.DeepEqual(members, tt.wantMembers) {
+				t.Errorf("PatchGroup() members = %v, want %v", members, tt.wantMembers)
+			}
+		})
+	}
+}
+
+func TestDeprovision(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		deprovision func(p *provider) error
+		wantStatus  string
+		wantEvents  []string
+		wantRevoke  bool
+	}{
+		{"patch active false", usermodels.StatusActive, func(p *provider) error {
+			_, err := p.PatchUser(context.Background(), "jane", scimmodels.PatchOp{Operations: []scimmodels.PatchOperation{{Op: "replace", Path: "active", Value: json.RawMessage(`false`)}}})
+			return err
+		}, usermodels.StatusDisabled, []string{outboxmodels.EventUserDisabled, outboxmodels.EventSessionRevoked}, true},
+		{"patch active string", usermodels.StatusActive, func(p *provider) error {
+			_, err := p.PatchUser(context.Background(), "jane", scimmodels.PatchOp{Operations: []scimmodels.PatchOperation{{Op: "Replace", Path: "active", Value: json.RawMessage(`"False"`)}}})
+			return err
+		}, usermodels.StatusDisabled, []string{outboxmodels.EventUserDisabled, outboxmodels.EventSessionRevoked}, true},
+		{"replace inactive", usermodels.StatusActive, func(p *provider) error {
+			active := false
+			_, err := p.ReplaceUser(context.Background(), "jane", scimmodels.User{UserName: "jane@example.com", Active: &active})
+			return err
+		}, usermodels.StatusDisabled, []string{outboxmodels.EventUserDisabled, outboxmodels.EventSessionRevoked}, true},
+		{"replace inactive disabled user", usermodels.StatusDisabled, func(p *provider) error {
+			active := false
+			_, err := p.ReplaceUser(context.Background(), "jane", scimmodels.User{UserName: "jane@example.com", Active: &active})
+			return err
+		}, usermodels.StatusDisabled, nil, false},
+		{"reactivate", usermodels.StatusDisabled, func(p *provider) error {
+			active := true
+			_, err := p.ReplaceUser(context.Background(), "jane", scimmodels.User{UserName: "jane@example.com", Active: &active})
+			return err
+		}, usermodels.StatusActive, []string{outboxmodels.EventUserEnabled}, false},
+		{"activate keeps a lock", usermodels.StatusLocked, func(p *provider) error {
+			active := true
+			_, err := p.ReplaceUser(context.Background(), "jane", scimmodels.User{UserName: "jane@example.com", Active: &active})
+			return err
+		}, usermodels.StatusLocked, nil, false},
+		{"replace without active", usermodels.StatusActive, func(p *provider) error {
+			_, err := p.ReplaceUser(context.Background(), "jane", scimmodels.User{UserName: "jane@example.com"})
+			return err
+		}, usermodels.StatusActive, nil, false},
+		{"delete", usermodels.StatusActive, func(p *provider) error {
+			return p.DeleteUser(context.Background(), "jane")
+		}, usermodels.StatusActive, []string{outboxmodels.EventUserDeleted, outboxmodels.EventSessionRevoked}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, repo, sessions, auditor := newTestProvider(testConfig())
+			user := repo.users["jane"]
+			user.Status = tt.status
+			repo.users["jane"] = user
+
+			if err := tt.deprovision(p); err != nil {
+				t.Fatalf("deprovision error = %v", err)
+			}
+			if got := repo.users["jane"].Status; got != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got, tt.wantStatus)
+			}
+			if !reflect.DeepEqual(repo.events, tt.wantEvents) {
+				t.Errorf("outbox events = %v, want %v", repo.events, tt.wantEvents)
+			}
+			if tt.wantRevoke != reflect.DeepEqual(sessions.revoked, []int{7}) {
+				t.Errorf("revoked sessions = %v, want revoke %v", sessions.revoked, tt.wantRevoke)
+			}
+			if len(auditor.Events) != 1 || auditor.Events[0].Event != auditmodels.EventSCIMProvision || auditor.Events[0].SubjectID != 7 {
+				t.Errorf("audit events = %+v, want one %s for user 7", auditor.Events, auditmodels.EventSCIMProvision)
+			}
+		})
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	active := false
+	tests := []struct {
+		name       string
+		user       scimmodels.User
+		wantCode   int
+		wantStatus string
+	}{
+		{"active by default", scimmodels.User{UserName: "ann@example.com", Name: &scimmodels.Name{GivenName: "Ann"}}, 0, usermodels.StatusActive},
+		{"inactive", scimmodels.User{UserName: "ann@example.com", Active: &active}, 0, usermodels.StatusDisabled},
+		{"user name is not an email", scimmodels.User{UserName: "ann"}, 400, ""},
+		{"user name with a display name", scimmodels.User{UserName: "Ann <ann@example.com>"}, 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, repo, _, _ := newTestProvider(testConfig())
+			created, err := p.CreateUser(context.Background(), tt.user)
+			if code, _ := scimErrorCode(err); code != tt.wantCode {
+				t.Fatalf("CreateUser() error = %v, want code %d", err, tt.wantCode)
+			}
+			if tt.wantCode != 0 {
+				return
+			}
+			if got := repo.users["new-user"].Status; got != tt.wantStatus {
+				t.Errorf("CreateUser() status = %s, want %s", got, tt.wantStatus)
+			}
+			if created.ID != "new-user" || created.Meta.Location != "https://id.example.com/scim/v2/Users/new-user" {
+				t.Errorf("CreateUser() = %+v", created)
+			}
+			if !reflect.DeepEqual(repo.events, []string{outboxmodels.EventUserRegistered}) {
+				t.Errorf("CreateUser() outbox events = %v", repo.events)
+			}
+		})
+	}
+}
+
+func TestReadNotFound(t *testing.T) {
+	p, _, _, _ := newTestProvider(testConfig())
+	if _, err := p.ReadUser(context.Background(), "nobody"); !isSCIMCode(err, 404) {
+		t.Errorf("ReadUser() error = %v, want a 404", err)
+	}
+	if err := p.DeleteGroup(context.Background(), "nothing"); !isSCIMCode(err, 404) {
+		t.Errorf("DeleteGroup() error = %v, want a 404", err)
+	}
+}
+
+func isSCIMCode(err error, code int) bool {
+	got, _ := scimErrorCode(err)
+	return got == code
+}
+
+func TestPage(t *testing.T) {
+	p, _, _, _ := newTestProvider(testConfig())
+	tests := []struct {
+		startIndex, count     int
+		wantOffset, wantLimit int
+	}{
+		{0, -1, 0, 100},
+		{1, 10, 0, 10},
+		{11, 10, 10, 10},
+		{-5, 0, 0, 0},
+		{1, 1000, 0, 100},
+	}
+	for _, tt := range tests {
+		offset, limit := p.page(scimmodels.ListQuery{StartIndex: tt.startIndex, Count: tt.count})
+		if offset != tt.wantOffset || limit != tt.wantLimit {
+			t.Errorf("page(%d, %d) = %d, %d, want %d, %d", tt.startIndex, tt.count, offset, limit, tt.wantOffset, tt.wantLimit)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package throttleservice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"go.uber.org/zap"
+)
+
+const (
+	scopeIP      = "ip"
+	scopeEmail   = "email"
+	scopeIPEmail = "ip_email"
+
+	eventFailure = "failure"
+	eventBlocked = "blocked"
+	eventLocked  = "locked"
+
+	blockKeyVal = "1"
+)
+
+// Provider is the login throttle provider interface
+// failed logins are counted (atomically) per source IP, per email and per IP+email
+//   - IP: hard limit per window (credential stuffing across many emails)
+//   - Email: the account is locked after too many failures (see config.Token.FailedLoginAttemptsMax)
+//   - IP+Email: exponential backoff once the free attempts are used up
+type Provider interface {
+	Allow(ctx context.Context, ip net.IP, email string) error
+	Failed(ctx context.Context, ip net.IP, email string) error
+	Succeeded(ctx context.Context, ip net.IP, email string)
+	Failures(ctx context.Context, email string) int64
+	LockRemaining(ctx context.Context, email string) time.Duration
+	Unlock(ctx context.Context, email string) error
+}
+
+// Cache is the subset of redis.Provider the throttle uses (the failure counters and locks)
+type Cache interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, exp time.Duration) error
+	Incr(ctx context.Context, key string, exp time.Duration) (int64, error)
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	Del(ctx context.Context, keys ...string) error
+}
+
+type provider struct {
+	logger  log.Factory
+	cfg     *config.Config
+	redis   Cache
+	metrics *metrics.Provider
+}
+
+// New returns a new login throttle Provider
+func New(cfg *config.Config, logger log.Factory, redis Cache, metricProvider *metrics.Provider) Provider {
+	return &provider{
+		logger:  logger.With(zap.String("package", "throttleservice")),
+		cfg:     cfg,
+		redis:   redis,
+		metrics: metricProvider,
+	}
+}
+
+func (p *provider) counterKey(scope, id string) string {
+	return fmt.Sprintf("%v-%v-%v", p.cfg.LoginLimit.CacheKeyID, scope, id)
+}
+
+func (p *provider) blockKey(scope, id string) string {
+	return fmt.Sprintf("%v-block-%v-%v", p.cfg.LoginLimit.CacheKeyID, scope, id)
+}
+
+func (p *provider) emailCounterKey(email string) string {
+	return fmt.Sprintf("%v-%v", p.cfg.Token.FailedLoginCacheKeyID, strings.ToLower(email))
+}
+
+func (p *provider) accountLockKey(email string) string {
+	return fmt.Sprintf("%v-%v", p.cfg.Cache.UserAccountLockedKeyID, strings.ToLower(email))
+}
+
+func ipEmailID(ip net.IP, email string) string {
+	return fmt.Sprintf("%v-%v", ip, strings.ToLower(email))
+}
+
+func tooManyRequests(retryAfter time.Duration, msg string) error {
+	return &errors.RestError{
+		Code:           429, // Too Many Requests
+		Message:        msg,
+		RetryAfterSecs: int(math.Ceil(retryAfter.Seconds())),
+	}
+}
+
+// backoff returns the block duration for the nth failure
+// base * 2^(n - free - 1), capped at the configured max
+func backoff(failures, free int64, baseSecs, maxSecs uint16) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	exponent := failures - free - 1
+	if exponent > 30 {
+		exponent = 30
+	}
+	secs := int64(baseSecs) << uint(exponent)
+	if secs > int64(maxSecs) {
+		secs = int64(maxSecs)
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// Allow returns a 429 RestError if the login is currently blocked
+// the Retry-After is the longest remaining block
+func (p *provider) Allow(ctx context.Context, ip net.IP, email string) error {
+	keys := map[string]string{scopeEmail: p.accountLockKey(email)}
+	if ip != nil {
+		keys[scopeIP] = p.blockKey(scopeIP, ip.String())
+		keys[scopeIPEmail] = p.blockKey(scopeIPEmail, ipEmailID(ip, email))
+	}
+
+	var retryAfter time.Duration
+	blockedScope := ""
+	for scope, key := range keys {
+		ttl, err := p.redis.TTL(ctx, key)
+		if err != nil {
+			// fail open, the cache is down and we still want users to be able to login
+			continue
+		}
+		if ttl > retryAfter {
+			retryAfter = ttl
+			blockedScope = scope
+		}
+	}
+
+	if blockedScope == "" {
+		return nil
+	}
+
+	p.logger.For(ctx).Info("login blocked", zap.String("email", email), zap.String("scope", blockedScope), zap.Duration("retry_after", retryAfter))
+	p.metrics.StatLoginThrottleCount.WithLabelValues(blockedScope, eventBlocked).Inc()
+	if blockedScope == scopeEmail {
+		return tooManyRequests(retryAfter, fmt.Sprintf("user account locked (%s)", email))
+	}
+	return tooManyRequests(retryAfter, "too many failed login attempts")
+}
+
+// Failed records the failed login for each scope
+// a 429 RestError is returned if this failure triggered a block
+func (p *provider) Failed(ctx context.Context, ip net.IP, email string) error {
+	window := time.Duration(p.cfg.LoginLimit.WindowMins) * time.Minute
+	var retryAfter time.Duration
+	msg := "too many failed login attempts"
+
+	// Email: lock the account once the max is exceeded
+	emailFailures, err := p.redis.Incr(ctx, p.emailCounterKey(email), time.Duration(p.cfg.Token.FailedLoginAttemptCacheLifeSpanMins)*time.Minute)
+	if err == nil {
+		p.metrics.StatLoginThrottleCount.WithLabelValues(scopeEmail, eventFailure).Inc()
+		if emailFailures > int64(p.cfg.Token.FailedLoginAttemptsMax) {
+			lockDuration := time.Duration(p.cfg.Cache.UserAccountLockedLifeSpanMins) * time.Minute
+			p.logger.For(ctx).Info("user exceeded failed login attempts", zap.String("email", email), zap.Uint16("failed_attempts_max", p.cfg.Token.FailedLoginAttemptsMax))
+			if p.block(ctx, p.accountLockKey(email), lockDuration, scopeEmail, eventLocked) {
+				retryAfter = lockDuration
+				msg = fmt.Sprintf("user account locked (%s)", email)
+			}
+		}
+	}
+
+	if ip == nil {
+		return p.throttled(retryAfter, msg)
+	}
+
+	// IP: hard limit for the remainder of the window
+	ipFailures, err := p.redis.Incr(ctx, p.counterKey(scopeIP, ip.String()), window)
+	if err == nil {
+		p.metrics.StatLoginThrottleCount.WithLabelValues(scopeIP, eventFailure).Inc()
+		if ipFailures >= int64(p.cfg.LoginLimit.MaxPerIP) {
+			ttl, _ := p.redis.TTL(ctx, p.counterKey(scopeIP, ip.String()))
+			if ttl <= 0 {
+				ttl = window
+			}
+			if p.block(ctx, p.blockKey(scopeIP, ip.String()), ttl, scopeIP, eventBlocked) && ttl > retryAfter {
+				retryAfter = ttl
+			}
+		}
+	}
+
+	// IP+Email: exponential backoff, hard limit for the remainder of the window
+	id := ipEmailID(ip, email)
+	ipEmailFailures, err := p.redis.Incr(ctx, p.counterKey(scopeIPEmail, id), window)
+	if err == nil {
+		p.metrics.StatLoginThrottleCount.WithLabelValues(scopeIPEmail, eventFailure).Inc()
+		delay := backoff(ipEmailFailures, int64(p.cfg.LoginLimit.BackoffAfter), p.cfg.LoginLimit.BackoffBaseSecs, p.cfg.LoginLimit.BackoffMaxSecs)
+		if ipEmailFailures >= int64(p.cfg.LoginLimit.MaxPerIPEmail) {
+			delay = window
+		}
+		if delay > 0 && p.block(ctx, p.blockKey(scopeIPEmail, id), delay, scopeIPEmail, eventBlocked) && delay > retryAfter {
+			retryAfter = delay
+		}
+	}
+
+	return p.throttled(retryAfter, msg)
+}
+
+func (p *provider) block(ctx context.Context, key string, exp time.Duration, scope, event string) bool {
+	if err := p.redis.Set(ctx, key, blockKeyVal, exp); err != nil {
+		p.logger.For(ctx).Error("cache set failed: login block", zap.Error(err), zap.String("scope", scope))
+		return false
+	}
+	p.metrics.StatLoginThrottleCount.WithLabelValues(scope, event).Inc()
+	return true
+}
+
+func (p *provider) throttled(retryAfter time.Duration, msg string) error {
+	if retryAfter <= 0 {
+		return nil
+	}
+	return tooManyRequests(retryAfter, msg)
+}
+
+// Succeeded resets the email and IP+Email failure counters
+// the IP counter is left alone so a single good login can not reset credential stuffing
+func (p *provider) Succeeded(ctx context.Context, ip net.IP, email string) {
+	keys := []string{p.emailCounterKey(email)}
+	if ip != nil {
+		keys = append(keys, p.counterKey(scopeIPEmail, ipEmailID(ip, email)))
+	}
+	if err := p.redis.Del(ctx, keys...); err != nil {
+		p.logger.For(ctx).Error("cache del failed: login throttle reset", zap.Error(err), zap.String("email", email))
+	}
+}
+
+// Failures returns the email's failed logins in the current window (0 if none, or the cache is down)
+// read it before Succeeded, which resets it
+func (p *provider) Failures(ctx context.Context, email string) int64 {
+	value, err := p.redis.Get(ctx, p.emailCounterKey(email))
+	if err != nil {
+		return 0
+	}
+	failures, _ := strconv.ParseInt(value, 10, 64)
+	return failures
+}
+
+// LockRemaining returns the remaining time of the failed login account lock (0 if not locked)
+func (p *provider) LockRemaining(ctx context.Context, email string) time.Duration {
+	ttl, err := p.redis.TTL(ctx, p.accountLockKey(email))
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// Unlock lifts the failed login account lock and resets the email failure counter
+func (p *provider) Unlock(ctx context.Context, email string) error {
+	if err := p.redis.Del(ctx, p.accountLockKey(email), p.emailCounterKey(email)); err != nil {
+		p.logger.For(ctx).Error("cache del failed: account unlock", zap.Error(err), zap.String("email", email))
+		return err
+	}
+	return nil
+}
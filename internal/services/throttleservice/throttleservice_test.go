@@ -0,0 +1,156 @@
+package throttleservice
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func stubConfig() *config.Config {
+	cfg := &config.Config{}
+	cfg.Token.FailedLoginCacheKeyID = "failed-login-user"
+	cfg.Token.FailedLoginAttemptsMax = 5
+	cfg.Token.FailedLoginAttemptCacheLifeSpanMins = 30
+	cfg.Cache.UserAccountLockedKeyID = "account-locked-user"
+	cfg.Cache.UserAccountLockedLifeSpanMins = 60
+	cfg.LoginLimit.CacheKeyID = "login-limit"
+	cfg.LoginLimit.WindowMins = 15
+	cfg.LoginLimit.MaxPerIP = 4
+	cfg.LoginLimit.MaxPerIPEmail = 10
+	cfg.LoginLimit.BackoffAfter = 2
+	cfg.LoginLimit.BackoffBaseSecs = 2
+	cfg.LoginLimit.BackoffMaxSecs = 5
+	return cfg
+}
+
+func stubMetrics() *metrics.Provider {
+	return &metrics.Provider{
+		StatLoginThrottleCount: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "login_throttle_total"}, []string{"scope", "event"}),
+	}
+}
+
+func retryAfter(err error) int {
+	if rerr, ok := err.(*errors.RestError); ok && rerr.Code == 429 {
+		return rerr.RetryAfterSecs
+	}
+	return 0
+}
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		failures int64
+		want     time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{100, 60 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.failures, 3, 2, 60); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func Test_provider_IPEmailBackoff(t *testing.T) {
+	ctx := context.Background()
+	ip := net.ParseIP("10.0.0.1")
+	cfg := stubConfig()
+	cfg.LoginLimit.MaxPerIP = 100
+	p := New(cfg, log.NewNopFactory(), testhelper.NewRedis(), stubMetrics())
+
+	want := []int{0, 0, 2, 4, 5}
+	for i, w := range want {
+		if got := retryAfter(p.Failed(ctx, ip, "jane@homerow.tech")); got != w {
+			t.Errorf("Failed() #%d retry after = %d, want %d", i+1, got, w)
+		}
+	}
+	if got := retryAfter(p.Allow(ctx, ip, "jane@homerow.tech")); got == 0 {
+		t.Errorf("Allow() expected 429 while backing off")
+	}
+	if err := p.Allow(ctx, net.ParseIP("10.0.0.2"), "jane@homerow.tech"); err != nil {
+		t.Errorf("Allow() other IP error = %v", err)
+	}
+}
+
+func Test_provider_IPLimit(t *testing.T) {
+	ctx := context.Background()
+	ip := net.ParseIP("10.0.0.1")
+	p := New(stubConfig(), log.NewNopFactory(), testhelper.NewRedis(), stubMetrics())
+
+	// credential stuffing: one failure for many different emails
+	emails := []string{"a@homerow.tech", "b@homerow.tech", "c@homerow.tech", "d@homerow.tech"}
+	var err error
+	for _, email := range emails {
+		err = p.Failed(ctx, ip, email)
+	}
+	if got := retryAfter(err); got != 15*60 {
+		t.Errorf("Failed() retry after = %d, want %d", got, 15*60)
+	}
+	if err := p.Allow(ctx, ip, "e@homerow.tech"); retryAfter(err) == 0 {
+		t.Errorf("Allow() expected 429 for blocked IP")
+	}
+}
+
+func Test_provider_EmailLock(t *testing.T) {
+	ctx := context.Background()
+	p := New(stubConfig(), log.NewNopFactory(), testhelper.NewRedis(), stubMetrics())
+
+	var err error
+	for i := 0; i < 6; i++ {
+		// no IP, only the email scope applies
+		err = p.Failed(ctx, nil, "jane@homerow.tech")
+	}
+	if got := retryAfter(err); got != 60*60 {
+		t.Errorf("Failed() retry after = %d, want %d", got, 60*60)
+	}
+	if err := p.Allow(ctx, net.ParseIP("10.0.0.9"), "JANE@homerow.tech"); retryAfter(err) == 0 {
+		t.Errorf("Allow() expected 429 for locked account")
+	}
+}
+
+func Test_provider_Succeeded(t *testing.T) {
+	ctx := context.Background()
+	ip := net.ParseIP("10.0.0.1")
+	redis := testhelper.NewRedis()
+	p := New(stubConfig(), log.NewNopFactory(), redis, stubMetrics())
+
+	_ = p.Failed(ctx, ip, "jane@homerow.tech")
+	p.Succeeded(ctx, ip, "jane@homerow.tech")
+
+	if redis.Values["failed-login-user-jane@homerow.tech"] != "" || redis.Values["login-limit-ip_email-10.0.0.1-jane@homerow.tech"] != "" {
+		t.Errorf("Succeeded() did not reset the email counters: %v", redis.Values)
+	}
+	if redis.Values["login-limit-ip-10.0.0.1"] != "1" {
+		t.Errorf("Succeeded() should not reset the IP counter: %v", redis.Values)
+	}
+}
+
+func Test_provider_Failures(t *testing.T) {
+	ctx := context.Background()
+	ip := net.ParseIP("10.0.0.1")
+	p := New(stubConfig(), log.NewNopFactory(), testhelper.NewRedis(), stubMetrics())
+
+	for i := 0; i < 3; i++ {
+		_ = p.Failed(ctx, ip, "jane@homerow.tech")
+	}
+	if got := p.Failures(ctx, "Jane@homerow.tech"); got != 3 {
+		t.Errorf("Failures() = %d, want 3", got)
+	}
+	p.Succeeded(ctx, ip, "jane@homerow.tech")
+	if got := p.Failures(ctx, "jane@homerow.tech"); got != 0 {
+		t.Errorf("Failures() after Succeeded() = %d, want 0", got)
+	}
+}
@@ -2,14 +2,21 @@ package userservice
 
 import (
 	"context"
+	"fmt"
+	"math"
 
 	"github.com/tjsampson/token-svc/internal/config"
-	"github.com/tjsampson/token-svc/internal/datastores/redis"
 	"github.com/tjsampson/token-svc/internal/errors"
 	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
 	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
 	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
 	"github.com/tjsampson/token-svc/internal/services/jwtservice"
+	"github.com/tjsampson/token-svc/internal/services/throttleservice"
 	"github.com/tjsampson/token-svc/internal/services/tracingservice"
 
 	"github.com/opentracing/opentracing-go"
@@ -19,6 +26,18 @@ import (
 // Service is the User Service Contract interface
 type Service interface {
 	List(ctx context.Context) ([]usermodels.Record, error)
+	IsAdmin(ctx context.Context, userID int) (bool, error)
+	AccountStatus(ctx context.Context, userID int) (usermodels.AccountStatus, error)
+	Lock(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error)
+	Unlock(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error)
+	Disable(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error)
+	Enable(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error)
+	RevokeSessions(ctx context.Context, userID int)
+}
+
+// Cache is the subset of redis.Provider the user service uses (the token caches)
+type Cache interface {
+	Del(ctx context.Context, keys ...string) error
 }
 
 type service struct {
@@ -28,11 +47,14 @@ type service struct {
 	userRepo      userrepo.Store
 	tracer        opentracing.Tracer
 	traceProvider tracingservice.Provider
-	redis         redis.Provider
+	redis         Cache
+	throttle      throttleservice.Provider
+	auditor       auditservice.Provider
+	outbox        outboxrepo.Store
 }
 
 // New returns a new Service interface implementation
-func New(logger log.Factory, cfg *config.Config, jwtClient jwtservice.Provider, usrRepo userrepo.Store, tracer opentracing.Tracer, traceProvider tracingservice.Provider, redis redis.Provider) Service {
+func New(logger log.Factory, cfg *config.Config, jwtClient jwtservice.Provider, usrRepo userrepo.Store, tracer opentracing.Tracer, traceProvider tracingservice.Provider, redis Cache, throttle throttleservice.Provider, auditor auditservice.Provider, outbox outboxrepo.Store) Service {
 	return &service{
 		logger:        logger.With(zap.String("package", "userservice")),
 		cfg:           cfg,
@@ -41,6 +63,9 @@ func New(logger log.Factory, cfg *config.Config, jwtClient jwtservice.Provider,
 		tracer:        tracer,
 		redis:         redis,
 		traceProvider: traceProvider,
+		throttle:      throttle,
+		auditor:       auditor,
+		outbox:        outbox,
 	}
 }
 
@@ -53,3 +78,180 @@ func (svc *service) List(ctx context.Context) ([]usermodels.Record, error) {
 	svc.logger.For(ctx).Info("leaving userservice List")
 	return users, errors.ErrorWrapper(err, "UserService.List")
 }
+
+// IsAdmin reports if the user is a member of the configured admin group
+func (svc *service) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	isAdmin, err := svc.userRepo.IsGroupMember(ctx, userID, svc.cfg.Admin.Group)
+	return isAdmin, errors.ErrorWrapper(err, "UserService.IsAdmin")
+}
+
+// AccountStatus returns the persistent account status and any temporary (failed login) lock
+func (svc *service) AccountStatus(ctx context.Context, userID int) (usermodels.AccountStatus, error) {
+	user, err := svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return usermodels.AccountStatus{}, errors.ErrorWrapper(err, "UserService.AccountStatus.ReadByID")
+	}
+	return svc.accountStatus(ctx, user), nil
+}
+
+func (svc *service) accountStatus(ctx context.Context, user usermodels.Record) usermodels.AccountStatus {
+	return usermodels.AccountStatus{
+		UserID:            user.ID,
+		Email:             user.Email,
+		Status:            user.Status,
+		Reason:            user.StatusReason,
+		ChangedAt:         user.StatusChangedAt,
+		TemporaryLockSecs: int(math.Ceil(svc.throttle.LockRemaining(ctx, user.Email).Seconds())),
+	}
+}
+
+// Lock locks the account until an admin unlocks it
+// the user's outstanding tokens are revoked
+func (svc *service) Lock(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error) {
+	return svc.changeStatus(ctx, "lock", userID, usermodels.StatusLocked, reason, func(user usermodels.Record) error {
+		if user.Status == usermodels.StatusDisabled {
+			return statusConflict(user, "lock")
+		}
+		return nil
+	})
+}
+
+// Unlock unlocks an admin locked account and lifts any temporary (failed login) lock
+func (svc *service) Unlock(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error) {
+	user, err := svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return usermodels.AccountStatus{}, errors.ErrorWrapper(err, "UserService.Unlock.ReadByID")
+	}
+	if user.Status == usermodels.StatusDisabled {
+		svc.auditStatusChange(ctx, "unlock", user, user.Status, reason, auditmodels.OutcomeFailure)
+		return usermodels.AccountStatus{}, statusConflict(user, "unlock")
+	}
+	if err = svc.throttle.Unlock(ctx, user.Email); err != nil {
+		return usermodels.AccountStatus{}, errors.ErrorWrapper(err, "UserService.Unlock.throttle.Unlock")
+	}
+	if user.Status != usermodels.StatusLocked {
+		svc.logger.For(ctx).Info("lifted temporary account lock", zap.Int("user_id", userID), zap.Int("admin_id", requestcontext.UserID(ctx)))
+		svc.auditStatusChange(ctx, "unlock", user, user.Status, reason, auditmodels.OutcomeSuccess)
+		event := statusEvent(outboxmodels.EventUserUnlocked, user, user.Status, reason)
+		event.Data["temporary"] = true
+		if err = svc.outbox.Insert(ctx, event); err != nil {
+			svc.logger.For(ctx).Error("failed to publish account unlock", zap.Error(err), zap.Int("user_id", userID))
+		}
+		return svc.accountStatus(ctx, user), nil
+	}
+	return svc.changeStatus(ctx, "unlock", userID, usermodels.StatusActive, reason, nil)
+}
+
+// Disable disables the account, the user's outstanding tokens are revoked
+func (svc *service) Disable(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error) {
+	return svc.changeStatus(ctx, "disable", userID, usermodels.StatusDisabled, reason, nil)
+}
+
+// Enable re-enables a disabled account
+func (svc *service) Enable(ctx context.Context, userID int, reason string) (usermodels.AccountStatus, error) {
+	return svc.changeStatus(ctx, "enable", userID, usermodels.StatusActive, reason, func(user usermodels.Record) error {
+		if user.Status != usermodels.StatusDisabled {
+			return statusConflict(user, "enable")
+		}
+		return nil
+	})
+}
+
+func statusConflict(user usermodels.Record, action string) error {
+	return &errors.RestError{
+		Code:    409,
+		Message: fmt.Sprintf("can not %s a user account with status %s", action, user.Status),
+	}
+}
+
+// changeStatus persists the status change (after the optional transition check)
+// locked and disabled accounts have their tokens revoked
+func (svc *service) changeStatus(ctx context.Context, action string, userID int, status, reason string, check func(usermodels.Record) error) (usermodels.AccountStatus, error) {
+	svc.logger.For(ctx).Info("entering userservice.changeStatus", zap.Int("user_id", userID), zap.String("status", status), zap.Int("admin_id", requestcontext.UserID(ctx)))
+
+	user, err := svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return usermodels.AccountStatus{}, errors.ErrorWrapper(err, "UserService.changeStatus.ReadByID")
+	}
+	if check != nil {
+		if err = check(user); err != nil {
+			svc.auditStatusChange(ctx, action, user, status, reason, auditmodels.OutcomeFailure)
+			return usermodels.AccountStatus{}, err
+		}
+	}
+
+	events := []outboxmodels.Event{statusEvent(statusEventTypes[action], user, status, reason)}
+	if status == usermodels.StatusLocked || status == usermodels.StatusDisabled {
+		events = append(events, outboxmodels.Event{
+			Type:   outboxmodels.EventSessionRevoked,
+			UserID: user.ID,
+			Data:   map[string]interface{}{"email": user.Email, "reason": "account " + status},
+		})
+	}
+
+	if err = svc.userRepo.UpdateStatus(ctx, userID, status, reason, events...); err != nil {
+		return usermodels.AccountStatus{}, errors.ErrorWrapper(err, "UserService.changeStatus.UpdateStatus")
+	}
+
+	svc.auditStatusChange(ctx, action, user, status, reason, auditmodels.OutcomeSuccess)
+
+	if status == usermodels.StatusLocked || status == usermodels.StatusDisabled {
+		svc.RevokeSessions(ctx, userID)
+	}
+
+	user, err = svc.userRepo.ReadByID(ctx, userID)
+	if err != nil {
+		return usermodels.AccountStatus{}, errors.ErrorWrapper(err, "UserService.changeStatus.ReadByID")
+	}
+	svc.logger.For(ctx).Info("leaving userservice.changeStatus", zap.Int("user_id", userID), zap.String("status", status), zap.String("reason", reason))
+	return svc.accountStatus(ctx, user), nil
+}
+
+// statusEventTypes maps the status change actions to their outbox event types
+var statusEventTypes = map[string]string{
+	"lock":    outboxmodels.EventUserLocked,
+	"unlock":  outboxmodels.EventUserUnlocked,
+	"disable": outboxmodels.EventUserDisabled,
+	"enable":  outboxmodels.EventUserEnabled,
+}
+
+// statusEvent returns the outbox event for the account status change
+func statusEvent(eventType string, user usermodels.Record, status, reason string) outboxmodels.Event {
+	return outboxmodels.Event{
+		Type:   eventType,
+		UserID: user.ID,
+		Data: map[string]interface{}{
+			"email":  user.Email,
+			"status": status,
+			"reason": reason,
+		},
+	}
+}
+
+// auditStatusChange records the admin account status change (the actor is the admin)
+func (svc *service) auditStatusChange(ctx context.Context, action string, user usermodels.Record, status, reason, outcome string) {
+	svc.auditor.Record(ctx, auditmodels.Event{
+		Event:     auditmodels.EventAdminAccountStatus,
+		Outcome:   outcome,
+		SubjectID: user.ID,
+		Email:     user.Email,
+		Details: map[string]interface{}{
+			"action": action,
+			"from":   user.Status,
+			"to":     status,
+			"reason": reason,
+		},
+	})
+}
+
+// RevokeSessions drops the user's cached token IDs so outstanding tokens stop validating
+// the AuthHandler also rejects locked/disabled users, so a cache failure is only logged
+func (svc *service) RevokeSessions(ctx context.Context, userID int) {
+	keys := []string{
+		fmt.Sprintf("%v-%v", svc.cfg.Token.AccessCacheKeyID, userID),
+		fmt.Sprintf("%v-%v", svc.cfg.Token.RefreshCacheKeyID, userID),
+	}
+	if err := svc.redis.Del(ctx, keys...); err != nil {
+		svc.logger.For(ctx).Error("failed to revoke user tokens", zap.Error(err), zap.Int("user_id", userID))
+	}
+}
@@ -0,0 +1,148 @@
+package userservice
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/usermodels"
+	"github.com/tjsampson/token-svc/internal/repos/outboxrepo"
+	"github.com/tjsampson/token-svc/internal/repos/userrepo"
+	"github.com/tjsampson/token-svc/internal/services/tracingservice"
+	"github.com/tjsampson/token-svc/internal/testhelper"
+)
+
+type mockUserRepo struct {
+	userrepo.Store
+	users  map[int]usermodels.Record
+	outbox *mockOutbox
+}
+
+func (m *mockUserRepo) ReadByID(ctx context.Context, userID int) (usermodels.Record, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return user, &errors.RestError{Code: 404, Message: "Resource not found"}
+	}
+	return user, nil
+}
+
+func (m *mockUserRepo) UpdateStatus(ctx context.Context, userID int, status, reason string, events ...outboxmodels.Event) error {
+	user := m.users[userID]
+	user.Status = status
+	user.StatusReason = reason
+	m.users[userID] = user
+	return m.outbox.Insert(ctx, events...)
+}
+
+type mockOutbox struct {
+	outboxrepo.Store
+	types []string
+}
+
+func (m *mockOutbox) Insert(ctx context.Context, events ...outboxmodels.Event) error {
+	for _, event := range events {
+		m.types = append(m.types, event.Type)
+	}
+	return nil
+}
+
+type mockThrottle struct {
+	unlocked []string
+}
+
+func (m *mockThrottle) Allow(ctx context.Context, ip net.IP, email string) error  { return nil }
+func (m *mockThrottle) Failed(ctx context.Context, ip net.IP, email string) error { return nil }
+func (m *mockThrottle) Succeeded(ctx context.Context, ip net.IP, email string)    {}
+func (m *mockThrottle) Failures(ctx context.Context, email string) int64          { return 0 }
+func (m *mockThrottle) LockRemaining(ctx context.Context, email string) time.Duration {
+	return 0
+}
+func (m *mockThrottle) Unlock(ctx context.Context, email string) error {
+	m.unlocked = append(m.unlocked, email)
+	return nil
+}
+
+func TestStatusChanges(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Token.AccessCacheKeyID = "token-access-user"
+	cfg.Token.RefreshCacheKeyID = "token-refresh-user"
+
+	tests := []struct {
+		name       string
+		status     string
+		action     string
+		wantStatus string
+		wantCode   int
+		wantRevoke bool
+		wantUnlock bool
+		wantEvents []string
+	}{
+		{"lock active", usermodels.StatusActive, "lock", usermodels.StatusLocked, 0, true, false, []string{outboxmodels.EventUserLocked, outboxmodels.EventSessionRevoked}},
+		{"lock disabled", usermodels.StatusDisabled, "lock", "", 409, false, false, nil},
+		{"unlock locked", usermodels.StatusLocked, "unlock", usermodels.StatusActive, 0, false, true, []string{outboxmodels.EventUserUnlocked}},
+		{"unlock temporary lock", usermodels.StatusActive, "unlock", usermodels.StatusActive, 0, false, true, []string{outboxmodels.EventUserUnlocked}},
+		{"unlock disabled", usermodels.StatusDisabled, "unlock", "", 409, false, false, nil},
+		{"disable active", usermodels.StatusActive, "disable", usermodels.StatusDisabled, 0, true, false, []string{outboxmodels.EventUserDisabled, outboxmodels.EventSessionRevoked}},
+		{"enable disabled", usermodels.StatusDisabled, "enable", usermodels.StatusActive, 0, false, false, []string{outboxmodels.EventUserEnabled}},
+		{"enable active", usermodels.StatusActive, "enable", "", 409, false, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outbox := &mockOutbox{}
+			repo := &mockUserRepo{users: map[int]usermodels.Record{7: {ID: 7, Email: "jane@example.com", Status: tt.status}}, outbox: outbox}
+			redisClient := testhelper.NewRedis()
+			throttle := &mockThrottle{}
+			auditor := &testhelper.Auditor{}
+			svc := New(log.NewNopFactory(), cfg, nil, repo, nil, tracingservice.Provider{}, redisClient, throttle, auditor, outbox)
+
+			actions := map[string]func(context.Context, int, string) (usermodels.AccountStatus, error){
+				"lock":    svc.Lock,
+				"unlock":  svc.Unlock,
+				"disable": svc.Disable,
+				"enable":  svc.Enable,
+			}
+			status, err := actions[tt.action](context.Background(), 7, "support ticket 42")
+
+			wantOutcome := auditmodels.OutcomeSuccess
+			if tt.wantCode != 0 {
+				wantOutcome = auditmodels.OutcomeFailure
+			}
+			if len(auditor.Events) != 1 || auditor.Events[0].Event != auditmodels.EventAdminAccountStatus || auditor.Events[0].Outcome != wantOutcome {
+				t.Errorf("%s() audit events = %+v, want one %s %s", tt.action, auditor.Events, auditmodels.EventAdminAccountStatus, wantOutcome)
+			}
+			if !reflect.DeepEqual(outbox.types, tt.wantEvents) {
+				t.Errorf("%s() outbox events = %v, want %v", tt.action, outbox.types, tt.wantEvents)
+			}
+
+			if tt.wantCode != 0 {
+				rerr, ok := err.(*errors.RestError)
+				if !ok || rerr.Code != tt.wantCode {
+					t.Fatalf("%s() error = %v, want code %d", tt.action, err, tt.wantCode)
+				}
+				if repo.users[7].Status != tt.status {
+					t.Errorf("%s() changed status to %s", tt.action, repo.users[7].Status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s() unexpected error = %v", tt.action, err)
+			}
+			if status.Status != tt.wantStatus {
+				t.Errorf("%s() status = %s, want %s", tt.action, status.Status, tt.wantStatus)
+			}
+			if revoked := len(redisClient.Deleted) > 0; revoked != tt.wantRevoke {
+				t.Errorf("%s() revoked tokens = %v, want %v", tt.action, revoked, tt.wantRevoke)
+			}
+			if unlocked := len(throttle.unlocked) > 0; unlocked != tt.wantUnlock {
+				t.Errorf("%s() lifted temporary lock = %v, want %v", tt.action, unlocked, tt.wantUnlock)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package webhookservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/models/webhookmodels"
+
+	"go.uber.org/zap"
+)
+
+// Webhook request headers
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+const (
+	// maxErrorLen caps the stored delivery error
+	maxErrorLen = 500
+
+	// resultRetry is the metric result of a failed attempt that will be retried
+	resultRetry = "retry"
+)
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureHeader returns the X-Webhook-Signature value: t=<unix timestamp>,v1=<signature>
+func signatureHeader(secret string, timestamp int64, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, Sign(secret, timestamp, body))
+}
+
+// VerifySignature checks the X-Webhook-Signature header against the body
+// the signed timestamp must be within the tolerance (replay protection)
+func VerifySignature(secret, header string, body []byte, tolerance time.Duration) error {
+	var timestamp int64
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return fmt.Errorf("malformed webhook signature")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("webhook signature timestamp outside the tolerance")
+	}
+	expected := Sign(secret, timestamp, body)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook signature mismatch")
+}
+
+// backoff returns the delay before the next attempt, base * 2^(attempts - 1) capped at the configured max
+func backoff(attempts int, baseSecs, maxSecs uint16) time.Duration {
+	exponent := attempts - 1
+	if exponent < 0 {
+		exponent = 0
+	}
+	if exponent > 30 {
+		exponent = 30
+	}
+	secs := int64(baseSecs) << uint(exponent)
+	if secs > int64(maxSecs) {
+		secs = int64(maxSecs)
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// Dispatch fans the new outbox events out to the subscriptions and sends the due deliveries
+func (p *provider) Dispatch(ctx context.Context) error {
+	if _, err := p.repo.FanOut(ctx, p.cfg.Webhook.BatchSize); err != nil {
+		return errors.ErrorWrapper(err, "WebhookService.Dispatch.FanOut")
+	}
+
+	// the lease covers every attempt in the batch, an unfinished delivery is retried once it expires
+	lease := time.Duration(p.cfg.Webhook.TimeoutSecs) * time.Second * time.Duration(p.cfg.Webhook.BatchSize/p.concurrency()+1)
+	deliveries, err := p.repo.ClaimDeliveries(ctx, p.cfg.Webhook.BatchSize, lease)
+	if err != nil {
+		return errors.ErrorWrapper(err, "WebhookService.Dispatch.ClaimDeliveries")
+	}
+
+	sem := make(chan struct{}, p.concurrency())
+	wg := sync.WaitGroup{}
+	for _, delivery := range deliveries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(delivery webhookmodels.Delivery) {
+			defer func() { <-sem; wg.Done() }()
+			p.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (p *provider) concurrency() int {
+	if p.cfg.Webhook.Concurrency < 1 {
+		return 1
+	}
+	return p.cfg.Webhook.Concurrency
+}
+
+// deliver sends the delivery and stores the attempt result
+func (p *provider) deliver(ctx context.Context, delivery webhookmodels.Delivery) {
+	code, err := p.send(ctx, delivery)
+
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	delivery.LastError = ""
+	now := time.Now().UTC()
+	result := webhookmodels.StatusSucceeded
+	switch {
+	case err == nil:
+		delivery.Status = webhookmodels.StatusSucceeded
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = now
+	case delivery.Attempts >= p.cfg.Webhook.MaxAttempts:
+		result = webhookmodels.StatusDead
+		delivery.Status = webhookmodels.StatusDead
+		delivery.NextAttemptAt = now
+	default:
+		result = resultRetry
+		delivery.Status = webhookmodels.StatusPending
+		delivery.NextAttemptAt = now.Add(backoff(delivery.Attempts, p.cfg.Webhook.BackoffBaseSecs, p.cfg.Webhook.BackoffMaxSecs))
+	}
+	if err != nil {
+		delivery.LastError = err.Error()
+		if len(delivery.LastError) > maxErrorLen {
+			delivery.LastError = delivery.LastError[:maxErrorLen]
+		}
+	}
+	p.metrics.StatWebhookDeliveryCount.WithLabelValues(delivery.EventType, result).Inc()
+
+	fields := []zap.Field{zap.Int64("delivery_id", delivery.ID), zap.Int64("subscription_id", delivery.SubscriptionID), zap.String("event", delivery.EventType), zap.Int("attempts", delivery.Attempts), zap.Int("response_code", code)}
+	switch result {
+	case webhookmodels.StatusDead:
+		p.logger.For(ctx).Error("webhook delivery dead", append(fields, zap.Error(err))...)
+	case resultRetry:
+		p.logger.For(ctx).Error("webhook delivery failed", append(fields, zap.Error(err), zap.Time("next_attempt", delivery.NextAttemptAt))...)
+	default:
+		p.logger.For(ctx).Info("webhook delivered", fields...)
+	}
+
+	if err = p.repo.UpdateDelivery(ctx, delivery); err != nil {
+		// the lease expires and the delivery is sent again (at least once delivery)
+		p.logger.For(ctx).Error("failed to update webhook delivery", append(fields, zap.Error(err))...)
+	}
+}
+
+// send posts the signed event, any 2xx response is a successful delivery
+func (p *provider) send(ctx context.Context, delivery webhookmodels.Delivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", p.cfg.API.ServiceName+"-webhooks")
+	req.Header.Set(EventHeader, delivery.Event.Type)
+	req.Header.Set(DeliveryHeader, delivery.UID)
+	req.Header.Set(SignatureHeader, signatureHeader(delivery.Secret, time.Now().Unix(), body))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// drain (a little of) the body so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("unexpected response status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Run dispatches the webhooks on the configured poll interval until done is closed
+func (p *provider) Run(done <-chan bool) {
+	if !p.cfg.Webhook.Enabled {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(p.cfg.Webhook.PollIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := p.Dispatch(context.Background()); err != nil {
+				p.logger.Bg().Error("failed webhook dispatch", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package webhookservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/webhookmodels"
+	"github.com/tjsampson/token-svc/internal/repos/webhookrepo"
+	"github.com/tjsampson/token-svc/internal/requestcontext"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+
+	secretPrefix = "whsec_"
+)
+
+// Provider is the webhook provider interface
+// identity events are read from the outbox, fanned out to the matching subscriptions and delivered (HMAC signed)
+// failed deliveries are retried with exponential backoff until they are dead (the dead-letter queue)
+type Provider interface {
+	CreateSubscription(ctx context.Context, req *webhookmodels.SubscriptionRequest) (webhookmodels.Subscription, error)
+	ReadSubscription(ctx context.Context, id int64) (webhookmodels.Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]webhookmodels.Subscription, error)
+	DeleteSubscription(ctx context.Context, id int64) error
+	ListDeliveries(ctx context.Context, query webhookmodels.DeliveryQuery) (webhookmodels.DeliveryPage, error)
+	RetryDelivery(ctx context.Context, id int64) (webhookmodels.Delivery, error)
+	Dispatch(ctx context.Context) error
+	Run(done <-chan bool)
+}
+
+type provider struct {
+	logger  log.Factory
+	cfg     *config.Config
+	repo    webhookrepo.Store
+	client  *http.Client
+	metrics *metrics.Provider
+}
+
+// New returns a new webhook Provider
+func New(cfg *config.Config, logger log.Factory, repo webhookrepo.Store, metricProvider *metrics.Provider) Provider {
+	return &provider{
+		logger:  logger.With(zap.String("package", "webhookservice")),
+		cfg:     cfg,
+		repo:    repo,
+		client:  &http.Client{Timeout: time.Duration(cfg.Webhook.TimeoutSecs) * time.Second},
+		metrics: metricProvider,
+	}
+}
+
+// newSecret returns a random signing secret
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return secretPrefix + hex.EncodeToString(secret), nil
+}
+
+// CreateSubscription creates the subscription and its signing secret (the secret is only returned here)
+func (p *provider) CreateSubscription(ctx context.Context, req *webhookmodels.SubscriptionRequest) (webhookmodels.Subscription, error) {
+	unknown := []string{}
+	for _, event := range req.Events {
+		if event != webhookmodels.AllEvents && !outboxmodels.IsEventType(event) {
+			unknown = append(unknown, "unknown event type: "+event)
+		}
+	}
+	if len(unknown) > 0 {
+		return webhookmodels.Subscription{}, &errors.RestError{Code: http.StatusBadRequest, Message: "invalid webhook subscription", Messages: unknown}
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return webhookmodels.Subscription{}, errors.ErrorWrapper(err, "WebhookService.CreateSubscription.newSecret")
+	}
+
+	sub, err := p.repo.InsertSubscription(ctx, webhookmodels.Subscription{
+		URL:         req.URL,
+		Secret:      secret,
+		Events:      req.Events,
+		Description: req.Description,
+		CreatedBy:   requestcontext.UserID(ctx),
+	})
+	if err != nil {
+		return sub, errors.ErrorWrapper(err, "WebhookService.CreateSubscription.InsertSubscription")
+	}
+	p.logger.For(ctx).Info("webhook subscription created", zap.Int64("subscription_id", sub.ID), zap.String("url", sub.URL), zap.Strings("events", sub.Events))
+	return sub, nil
+}
+
+func (p *provider) ReadSubscription(ctx context.Context, id int64) (webhookmodels.Subscription, error) {
+	sub, err := p.repo.ReadSubscription(ctx, id)
+	sub.Secret = ""
+	return sub, errors.ErrorWrapper(err, "WebhookService.ReadSubscription")
+}
+
+func (p *provider) ListSubscriptions(ctx context.Context) ([]webhookmodels.Subscription, error) {
+	subs, err := p.repo.ListSubscriptions(ctx)
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return subs, errors.ErrorWrapper(err, "WebhookService.ListSubscriptions")
+}
+
+// DeleteSubscription deletes the subscription (and its delivery log)
+func (p *provider) DeleteSubscription(ctx context.Context, id int64) error {
+	if err := p.repo.DeleteSubscription(ctx, id); err != nil {
+		return errors.ErrorWrapper(err, "WebhookService.DeleteSubscription")
+	}
+	p.logger.For(ctx).Info("webhook subscription deleted", zap.Int64("subscription_id", id))
+	return nil
+}
+
+// ListDeliveries returns a page of the delivery log (newest first)
+func (p *provider) ListDeliveries(ctx context.Context, query webhookmodels.DeliveryQuery) (webhookmodels.DeliveryPage, error) {
+	switch query.Status {
+	case "", webhookmodels.StatusPending, webhookmodels.StatusSucceeded, webhookmodels.StatusDead:
+	default:
+		return webhookmodels.DeliveryPage{}, &errors.RestError{Code: http.StatusBadRequest, Message: "invalid delivery status: " + query.Status}
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultPageSize
+	}
+	if query.Limit > maxPageSize {
+		query.Limit = maxPageSize
+	}
+
+	// fetch one extra delivery to know if there is a next page
+	limit := query.Limit
+	query.Limit++
+	deliveries, err := p.repo.ListDeliveries(ctx, query)
+	if err != nil {
+		return webhookmodels.DeliveryPage{}, errors.ErrorWrapper(err, "WebhookService.ListDeliveries")
+	}
+
+	page := webhookmodels.DeliveryPage{Deliveries: deliveries}
+	if len(deliveries) > limit {
+		page.Deliveries = deliveries[:limit]
+		page.NextBefore = page.Deliveries[limit-1].ID
+	}
+	return page, nil
+}
+
+// RetryDelivery requeues a dead delivery with a fresh set of attempts
+func (p *provider) RetryDelivery(ctx context.Context, id int64) (webhookmodels.Delivery, error) {
+	delivery, err := p.repo.ReadDelivery(ctx, id)
+	if err != nil {
+		return delivery, errors.ErrorWrapper(err, "WebhookService.RetryDelivery.ReadDelivery")
+	}
+	if delivery.Status != webhookmodels.StatusDead {
+		return delivery, &errors.RestError{Code: http.StatusConflict, Message: "can not retry a webhook delivery with status " + delivery.Status}
+	}
+
+	delivery.Status = webhookmodels.StatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now().UTC()
+	if err = p.repo.UpdateDelivery(ctx, delivery); err != nil {
+		return delivery, errors.ErrorWrapper(err, "WebhookService.RetryDelivery.UpdateDelivery")
+	}
+	p.logger.For(ctx).Info("webhook delivery requeued", zap.Int64("delivery_id", id), zap.Int("admin_id", requestcontext.UserID(ctx)))
+	return delivery, nil
+}
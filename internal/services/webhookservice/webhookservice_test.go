@@ -0,0 +1,224 @@
+package webhookservice
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/config"
+	"github.com/tjsampson/token-svc/internal/errors"
+	"github.com/tjsampson/token-svc/internal/log"
+	"github.com/tjsampson/token-svc/internal/models/outboxmodels"
+	"github.com/tjsampson/token-svc/internal/models/webhookmodels"
+	"github.com/tjsampson/token-svc/internal/repos/webhookrepo"
+	"github.com/tjsampson/token-svc/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type mockWebhookRepo struct {
+	webhookrepo.Store
+	deliveries map[int64]webhookmodels.Delivery
+}
+
+func (m *mockWebhookRepo) FanOut(ctx context.Context, limit int) (int64, error) {
+	return 0, nil
+}
+
+func (m *mockWebhookRepo) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookmodels.Delivery, error) {
+	claimed := []webhookmodels.Delivery{}
+	for id, delivery := range m.deliveries {
+		if delivery.Status == webhookmodels.StatusPending && !delivery.NextAttemptAt.After(time.Now()) {
+			delivery.NextAttemptAt = time.Now().Add(lease)
+			m.deliveries[id] = delivery
+			claimed = append(claimed, delivery)
+		}
+	}
+	return claimed, nil
+}
+
+func (m *mockWebhookRepo) UpdateDelivery(ctx context.Context, delivery webhookmodels.Delivery) error {
+	m.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (m *mockWebhookRepo) ReadDelivery(ctx context.Context, id int64) (webhookmodels.Delivery, error) {
+	delivery, ok := m.deliveries[id]
+	if !ok {
+		return delivery, &errors.RestError{Code: 404, Message: "Resource not found"}
+	}
+	return delivery, nil
+}
+
+func testProvider(repo webhookrepo.Store) *provider {
+	cfg := &config.Config{}
+	cfg.API.ServiceName = "token-svc"
+	cfg.Webhook.BatchSize = 10
+	cfg.Webhook.Concurrency = 2
+	cfg.Webhook.TimeoutSecs = 2
+	cfg.Webhook.MaxAttempts = 3
+	cfg.Webhook.BackoffBaseSecs = 30
+	cfg.Webhook.BackoffMaxSecs = 3600
+	metricProvider := &metrics.Provider{
+		StatWebhookDeliveryCount: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "webhook_delivery_total"}, []string{"event", "result"}),
+	}
+	return New(cfg, log.NewNopFactory(), repo, metricProvider).(*provider)
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"type":"user.registered"}`)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		body    []byte
+		wantErr bool
+	}{
+		{"valid", "whsec_test", signatureHeader("whsec_test", now, body), body, false},
+		{"rotated secret", "whsec_new", signatureHeader("whsec_old", now, body) + ",v1=" + Sign("whsec_new", now, body), body, false},
+		{"wrong secret", "whsec_other", signatureHeader("whsec_test", now, body), body, true},
+		{"modified body", "whsec_test", signatureHeader("whsec_test", now, body), []byte(`{"type":"user.locked"}`), true},
+		{"replayed", "whsec_test", signatureHeader("whsec_test", now-3600, body), body, true},
+		{"malformed", "whsec_test", "v1=abc", body, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifySignature(tt.secret, tt.header, tt.body, 5*time.Minute); (err != nil) != tt.wantErr {
+				t.Errorf("VerifySignature() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{20, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts, 30, 3600); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseCode int
+		attempts     int
+		wantStatus   string
+		wantAttempts int
+		wantDelay    time.Duration
+	}{
+		{"delivered", http.StatusNoContent, 0, webhookmodels.StatusSucceeded, 1, 0},
+		{"retried", http.StatusInternalServerError, 0, webhookmodels.StatusPending, 1, 30 * time.Second},
+		{"backed off", http.StatusBadGateway, 1, webhookmodels.StatusPending, 2, time.Minute},
+		{"dead lettered", http.StatusInternalServerError, 2, webhookmodels.StatusDead, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received outboxmodels.Event
+			var signatureErr error
+			receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				signatureErr = VerifySignature("whsec_test", req.Header.Get(SignatureHeader), body, time.Minute)
+				json.Unmarshal(body, &received)
+				res.WriteHeader(tt.responseCode)
+			}))
+			defer receiver.Close()
+
+			repo := &mockWebhookRepo{deliveries: map[int64]webhookmodels.Delivery{
+				1: {
+					ID:            1,
+					UID:           "8f4b2c1e-0000-4000-8000-000000000001",
+					EventType:     outboxmodels.EventUserRegistered,
+					Status:        webhookmodels.StatusPending,
+					Attempts:      tt.attempts,
+					NextAttemptAt: time.Now().Add(-time.Second),
+					URL:           receiver.URL,
+					Secret:        "whsec_test",
+					Event:         outboxmodels.Event{UID: "2d1c", Type: outboxmodels.EventUserRegistered, UserID: 7, Data: map[string]interface{}{"email": "jane@example.com"}},
+				},
+			}}
+			p := testProvider(repo)
+
+			if err := p.Dispatch(context.Background()); err != nil {
+				t.Fatalf("Dispatch() error = %v", err)
+			}
+			if signatureErr != nil {
+				t.Errorf("receiver signature error = %v", signatureErr)
+			}
+			if received.Type != outboxmodels.EventUserRegistered || received.UserID != 7 || received.Data["email"] != "jane@example.com" {
+				t.Errorf("receiver event = %+v", received)
+			}
+
+			delivery := repo.deliveries[1]
+			if delivery.Status != tt.wantStatus || delivery.Attempts != tt.wantAttempts || delivery.ResponseCode != tt.responseCode {
+				t.Errorf("delivery = %s (%d attempts, %d), want %s (%d attempts, %d)", delivery.Status, delivery.Attempts, delivery.ResponseCode, tt.wantStatus, tt.wantAttempts, tt.responseCode)
+			}
+			if tt.wantStatus == webhookmodels.StatusSucceeded && (delivery.DeliveredAt == nil || delivery.LastError != "") {
+				t.Errorf("delivered delivery = %+v", delivery)
+			}
+			if tt.wantDelay > 0 {
+				if delay := time.Until(delivery.NextAttemptAt); delay < tt.wantDelay-5*time.Second || delay > tt.wantDelay {
+					t.Errorf("next attempt in %v, want %v", delay, tt.wantDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		wantCode int
+	}{
+		{"dead", webhookmodels.StatusDead, 0},
+		{"pending", webhookmodels.StatusPending, 409},
+		{"succeeded", webhookmodels.StatusSucceeded, 409},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &mockWebhookRepo{deliveries: map[int64]webhookmodels.Delivery{
+				1: {ID: 1, Status: tt.status, Attempts: 3, NextAttemptAt: time.Now().Add(-time.Hour)},
+			}}
+			p := testProvider(repo)
+
+			delivery, err := p.RetryDelivery(context.Background(), 1)
+			if tt.wantCode != 0 {
+				if rerr, ok := err.(*errors.RestError); !ok || rerr.Code != tt.wantCode {
+					t.Errorf("RetryDelivery() error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RetryDelivery() unexpected error = %v", err)
+			}
+			if delivery.Status != webhookmodels.StatusPending || delivery.Attempts != 0 || repo.deliveries[1].Status != webhookmodels.StatusPending {
+				t.Errorf("RetryDelivery() = %+v, want a pending delivery with no attempts", delivery)
+			}
+		})
+	}
+}
+
+func TestCreateSubscriptionUnknownEvent(t *testing.T) {
+	p := testProvider(&mockWebhookRepo{})
+	_, err := p.CreateSubscription(context.Background(), &webhookmodels.SubscriptionRequest{URL: "https://example.com/hooks", Events: []string{outboxmodels.EventUserLocked, "user.exploded"}})
+	if rerr, ok := err.(*errors.RestError); !ok || rerr.Code != http.StatusBadRequest || len(rerr.Messages) != 1 {
+		t.Errorf("CreateSubscription() error = %v, want a 400 for the unknown event", err)
+	}
+}
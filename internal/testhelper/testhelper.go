@@ -0,0 +1,235 @@
+// Package testhelper holds the fakes shared by the service tests
+// (an in-memory redis and an audit event recorder), it is only imported by _test files
+package testhelper
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tjsampson/token-svc/internal/datastores/redis"
+	"github.com/tjsampson/token-svc/internal/models/auditmodels"
+	"github.com/tjsampson/token-svc/internal/services/auditservice"
+)
+
+// ErrDown is returned by every Redis call while the Redis is down
+var ErrDown = fmt.Errorf("redis: down")
+
+// ErrNil is returned by Get for a missing key (like redis.Nil)
+var ErrNil = fmt.Errorf("redis: nil")
+
+var _ redis.Provider = (*Redis)(nil)
+
+// Redis is an in-memory redis.Provider (it implements every service's Cache)
+// expirations are recorded (TTLs) but keys never expire
+type Redis struct {
+	mu sync.Mutex
+
+	// Down fails every call with ErrDown
+	Down bool
+
+	Values  map[string]string
+	TTLs    map[string]time.Duration
+	Hashes  map[string]map[string]string
+	Streams map[string][]map[string]interface{}
+	// Deleted are the keys passed to Del (in order)
+	Deleted []string
+	// Calls counts the calls by method name (ex: Calls["HGetAll"])
+	Calls map[string]int
+}
+
+// NewRedis returns an empty (up) Redis (a &Redis{Down: true} is enough for a down one)
+func NewRedis() *Redis {
+	return &Redis{
+		Values:  map[string]string{},
+		TTLs:    map[string]time.Duration{},
+		Hashes:  map[string]map[string]string{},
+		Streams: map[string][]map[string]interface{}{},
+		Calls:   map[string]int{},
+	}
+}
+
+// call counts the call and locks the Redis, the caller must unlock it
+func (r *Redis) call(method string) error {
+	r.mu.Lock()
+	if r.Calls == nil {
+		r.Calls = map[string]int{}
+	}
+	r.Calls[method]++
+	if r.Down {
+		return ErrDown
+	}
+	return nil
+}
+
+// Ping returns pong
+func (r *Redis) Ping(ctx context.Context) (string, error) {
+	defer r.mu.Unlock()
+	if err := r.call("Ping"); err != nil {
+		return "", err
+	}
+	return "pong", nil
+}
+
+// Close is a no-op
+func (r *Redis) Close() error {
+	return nil
+}
+
+// Set sets the key (and records its expiration)
+func (r *Redis) Set(ctx context.Context, key string, value string, exp time.Duration) error {
+	defer r.mu.Unlock()
+	if err := r.call("Set"); err != nil {
+		return err
+	}
+	r.Values[key], r.TTLs[key] = value, exp
+	return nil
+}
+
+// SetNX sets the key only if it is missing
+func (r *Redis) SetNX(ctx context.Context, key string, value string, exp time.Duration) (bool, error) {
+	defer r.mu.Unlock()
+	if err := r.call("SetNX"); err != nil {
+		return false, err
+	}
+	if _, ok := r.Values[key]; ok {
+		return false, nil
+	}
+	r.Values[key], r.TTLs[key] = value, exp
+	return true, nil
+}
+
+// Get returns the key, ErrNil when it is missing
+func (r *Redis) Get(ctx context.Context, key string) (string, error) {
+	defer r.mu.Unlock()
+	if err := r.call("Get"); err != nil {
+		return "", err
+	}
+	value, ok := r.Values[key]
+	if !ok {
+		return "", ErrNil
+	}
+	return value, nil
+}
+
+// Incr increments the counter, the expiration is recorded when the key is created
+func (r *Redis) Incr(ctx context.Context, key string, exp time.Duration) (int64, error) {
+	defer r.mu.Unlock()
+	if err := r.call("Incr"); err != nil {
+		return 0, err
+	}
+	count, _ := strconv.ParseInt(r.Values[key], 10, 64)
+	count++
+	if count == 1 {
+		r.TTLs[key] = exp
+	}
+	r.Values[key] = strconv.FormatInt(count, 10)
+	return count, nil
+}
+
+// TTL returns the recorded expiration, negative for a missing key
+func (r *Redis) TTL(ctx context.Context, key string) (time.Duration, error) {
+	defer r.mu.Unlock()
+	if err := r.call("TTL"); err != nil {
+		return 0, err
+	}
+	if ttl, ok := r.TTLs[key]; ok {
+		return ttl, nil
+	}
+	return -2 * time.Millisecond, nil
+}
+
+// Del removes the keys (and records them in Deleted)
+func (r *Redis) Del(ctx context.Context, keys ...string) error {
+	defer r.mu.Unlock()
+	if err := r.call("Del"); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(r.Values, key)
+		delete(r.TTLs, key)
+		delete(r.Hashes, key)
+	}
+	r.Deleted = append(r.Deleted, keys...)
+	return nil
+}
+
+// TakeToken takes a token from the bucket, it never refills
+func (r *Redis) TakeToken(ctx context.Context, key string, capacity int, refillPerSec float64) (bool, float64, error) {
+	defer r.mu.Unlock()
+	if err := r.call("TakeToken"); err != nil {
+		return false, 0, err
+	}
+	taken, _ := strconv.Atoi(r.Values[key])
+	if taken >= capacity {
+		return false, 0, nil
+	}
+	taken++
+	r.Values[key] = strconv.Itoa(taken)
+	return true, float64(capacity - taken), nil
+}
+
+// XAdd appends the entry to the stream
+func (r *Redis) XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) (string, error) {
+	defer r.mu.Unlock()
+	if err := r.call("XAdd"); err != nil {
+		return "", err
+	}
+	r.Streams[stream] = append(r.Streams[stream], values)
+	return fmt.Sprintf("0-%d", len(r.Streams[stream])), nil
+}
+
+// HSet sets the hash field
+func (r *Redis) HSet(ctx context.Context, key, field, value string) error {
+	defer r.mu.Unlock()
+	if err := r.call("HSet"); err != nil {
+		return err
+	}
+	if r.Hashes[key] == nil {
+		r.Hashes[key] = map[string]string{}
+	}
+	r.Hashes[key][field] = value
+	return nil
+}
+
+// HGetAll returns a copy of the hash
+func (r *Redis) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	defer r.mu.Unlock()
+	if err := r.call("HGetAll"); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for field, value := range r.Hashes[key] {
+		values[field] = value
+	}
+	return values, nil
+}
+
+// HDel removes the hash fields
+func (r *Redis) HDel(ctx context.Context, key string, fields ...string) error {
+	defer r.mu.Unlock()
+	if err := r.call("HDel"); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		delete(r.Hashes[key], field)
+	}
+	return nil
+}
+
+// Auditor records the audit events (an auditservice.Provider, only Record is implemented)
+type Auditor struct {
+	auditservice.Provider
+
+	mu     sync.Mutex
+	Events []auditmodels.Event
+}
+
+// Record appends the event to Events
+func (a *Auditor) Record(ctx context.Context, event auditmodels.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Events = append(a.Events, event)
+}
@@ -0,0 +1,157 @@
+package iphelpers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultHeader is the forwarding header of the trusted proxies when none is configured (the nginx in etc/nginx sets it)
+const DefaultHeader = "X-Forwarded-For"
+
+// ParseNetwork parses the CIDR, a bare IP is a single host (/32 or /128)
+func ParseNetwork(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", cidr)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+// Networks are a list of networks (ex: an allow or deny list)
+type Networks []*net.IPNet
+
+// ParseNetworks parses the CIDRs (a bare IP is a single host)
+func ParseNetworks(cidrs []string) (Networks, error) {
+	networks := Networks{}
+	for _, cidr := range cidrs {
+		network, err := ParseNetwork(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains reports if the ip is in one of the networks
+func (n Networks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Proxies are the trusted proxy networks, only a trusted hop's forwarding headers are believed
+type Proxies Networks
+
+// ParseProxies parses the trusted proxy CIDRs (a bare IP is a single host)
+func ParseProxies(cidrs []string) (Proxies, error) {
+	networks, err := ParseNetworks(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	return Proxies(networks), nil
+}
+
+// Trusted reports if the ip is a trusted proxy
+func (p Proxies) Trusted(ip net.IP) bool {
+	return Networks(p).Contains(ip)
+}
+
+// ClientIP resolves the client IP of the request and returns the chain of hops (client first, the remote address last)
+// only the forwarding header the trusted proxies set (ex: X-Forwarded-For, X-Real-IP or RFC 7239 Forwarded) is read,
+// and only when the remote address is a trusted proxy (a proxy passes the other headers through as the client sent them)
+// the chain is walked from the remote address back, the client is the first hop that is not a trusted proxy
+// (a client can prepend anything to the headers, only the entries added by trusted proxies are believed)
+func (p Proxies) ClientIP(req *http.Request, header string) (net.IP, []net.IP, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("userip: %q is not IP:port", req.RemoteAddr)
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return nil, nil, fmt.Errorf("userip: %q is not IP:port", req.RemoteAddr)
+	}
+	if !p.Trusted(remote) {
+		return remote, []net.IP{remote}, nil
+	}
+
+	hops := forwardedHops(req.Header, header)
+	chain := make([]net.IP, 0, len(hops)+1)
+	for _, hop := range hops {
+		if ip := parseHop(hop); ip != nil {
+			chain = append(chain, ip)
+		}
+	}
+	chain = append(chain, remote)
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			// an unknown or obfuscated hop, the trusted proxy that forwarded it is as far as we can tell
+			break
+		}
+		client = ip
+		if !p.Trusted(ip) {
+			break
+		}
+	}
+	return client, chain, nil
+}
+
+// forwardedHops returns the forwarded for hops from the named header (client first), DefaultHeader when empty
+func forwardedHops(header http.Header, name string) []string {
+	if name == "" {
+		name = DefaultHeader
+	}
+	name = http.CanonicalHeaderKey(name)
+	values := header[name]
+	hops := []string{}
+	switch name {
+	case "Forwarded":
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, kv[1])
+				}
+			}
+		}
+	case "X-Real-Ip":
+		if len(values) > 0 && values[0] != "" {
+			hops = append(hops, values[0])
+		}
+	default:
+		if len(values) > 0 {
+			hops = append(hops, strings.Split(strings.Join(values, ","), ",")...)
+		}
+	}
+	return hops
+}
+
+// parseHop parses a forwarded hop, it may be quoted and have a port (ex: "[2001:db8:cafe::17]:4711" or 192.0.2.43:47011)
+// nil for unknown, obfuscated (_hidden) or invalid hops
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if strings.HasPrefix(hop, "[") {
+		if end := strings.Index(hop, "]"); end > 0 {
+			hop = hop[1:end]
+		}
+	} else if strings.Count(hop, ":") == 1 {
+		hop = strings.SplitN(hop, ":", 2)[0]
+	}
+	return net.ParseIP(hop)
+}
@@ -0,0 +1,162 @@
+package iphelpers
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.0/8", "172.16.0.0/12", "192.168.1.5", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatalf("ParseProxies() error = %v", err)
+	}
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		proxyHeader string
+		header      http.Header
+		want        string
+		wantChain   []string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.7:5555",
+			want:       "203.0.113.7",
+			wantChain:  []string{"203.0.113.7"},
+		},
+		{
+			name:       "untrusted remote spoofing the header",
+			remoteAddr: "203.0.113.7:5555",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "203.0.113.7",
+			wantChain:  []string{"203.0.113.7"},
+		},
+		{
+			name:       "x-forwarded-for from the proxy",
+			remoteAddr: "10.0.0.2:5555",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "198.51.100.1",
+			wantChain:  []string{"198.51.100.1", "10.0.0.2"},
+		},
+		{
+			name:       "client prepended entry is not believed",
+			remoteAddr: "10.0.0.2:5555",
+			header:     http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1, 10.0.0.9"}},
+			want:       "198.51.100.1",
+			wantChain:  []string{"1.2.3.4", "198.51.100.1", "10.0.0.9", "10.0.0.2"},
+		},
+		{
+			name:        "x-real-ip",
+			remoteAddr:  "192.168.1.5:80",
+			proxyHeader: "X-Real-IP",
+			header:      http.Header{"X-Real-Ip": {"198.51.100.1"}},
+			want:        "198.51.100.1",
+			wantChain:   []string{"198.51.100.1", "192.168.1.5"},
+		},
+		{
+			name:       "x-real-ip is ignored when not the proxy header",
+			remoteAddr: "192.168.1.5:80",
+			header:     http.Header{"X-Real-Ip": {"198.51.100.1"}},
+			want:       "192.168.1.5",
+			wantChain:  []string{"192.168.1.5"},
+		},
+		{
+			name:        "forwarded",
+			remoteAddr:  "10.0.0.2:5555",
+			proxyHeader: "forwarded",
+			header:      http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.3`}, "X-Forwarded-For": {"1.2.3.4"}},
+			want:        "2001:db8:cafe::17",
+			wantChain:   []string{"2001:db8:cafe::17", "10.0.0.3", "10.0.0.2"},
+		},
+		{
+			name:       "spoofed forwarded passed through by the proxy",
+			remoteAddr: "172.17.0.1:5555",
+			header:     http.Header{"Forwarded": {"for=9.9.9.9"}, "X-Forwarded-For": {"203.0.113.50"}},
+			want:       "203.0.113.50",
+			wantChain:  []string{"203.0.113.50", "172.17.0.1"},
+		},
+		{
+			name:        "forwarded ipv4 with a port",
+			remoteAddr:  "[2001:db8:1::1]:443",
+			proxyHeader: "Forwarded",
+			header:      http.Header{"Forwarded": {`For="198.51.100.1:47011"`}},
+			want:        "198.51.100.1",
+			wantChain:   []string{"198.51.100.1", "2001:db8:1::1"},
+		},
+		{
+			name:        "unknown hop stops at the proxy",
+			remoteAddr:  "10.0.0.2:5555",
+			proxyHeader: "Forwarded",
+			header:      http.Header{"Forwarded": {"for=unknown"}},
+			want:        "10.0.0.2",
+			wantChain:   []string{"10.0.0.2"},
+		},
+		{
+			name:       "all trusted",
+			remoteAddr: "10.0.0.2:5555",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.5"}},
+			want:       "10.0.0.5",
+			wantChain:  []string{"10.0.0.5", "10.0.0.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tt.remoteAddr, Header: tt.header}
+			if req.Header == nil {
+				req.Header = http.Header{}
+			}
+			got, chain, err := proxies.ClientIP(req, tt.proxyHeader)
+			if err != nil {
+				t.Fatalf("ClientIP() error = %v", err)
+			}
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+			gotChain := []string{}
+			for _, ip := range chain {
+				gotChain = append(gotChain, ip.String())
+			}
+			if !reflect.DeepEqual(gotChain, tt.wantChain) {
+				t.Errorf("ClientIP() chain = %v, want %v", gotChain, tt.wantChain)
+			}
+		})
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	if _, err := ParseProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("ParseProxies() expected an error for an invalid cidr")
+	}
+	if _, err := ParseProxies([]string{"proxy.local"}); err == nil {
+		t.Errorf("ParseProxies() expected an error for a hostname")
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    string
+		wantErr bool
+	}{
+		{cidr: "203.0.113.7", want: "203.0.113.7/32"},
+		{cidr: "2001:db8::1", want: "2001:db8::1/128"},
+		{cidr: "203.0.113.7/24", want: "203.0.113.0/24"},
+		{cidr: "::ffff:203.0.113.7", want: "203.0.113.7/32"},
+		{cidr: "203.0.113.0/33", wantErr: true},
+		{cidr: "proxy.local", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseNetwork(tt.cidr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseNetwork(%q) expected an error", tt.cidr)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("ParseNetwork(%q) = %v, %v, want %v", tt.cidr, got, err, tt.want)
+		}
+	}
+}
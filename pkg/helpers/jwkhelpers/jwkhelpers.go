@@ -0,0 +1,128 @@
+package jwkhelpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// JSONWebKey is a public RSA or EC JSON Web Key (RFC 7517)
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// PublicKey returns the key's *rsa.PublicKey or *ecdsa.PublicKey
+func (jwk JSONWebKey) PublicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// Thumbprint returns the key's SHA-256 thumbprint (RFC 7638), base64url encoded
+// only the required members are hashed, in lexicographic order
+func (jwk JSONWebKey) Thumbprint() (string, error) {
+	var members string
+	switch jwk.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Crv, jwk.X, jwk.Y)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// FromPublicKey returns the JSON Web Key of the *rsa.PublicKey or *ecdsa.PublicKey
+func FromPublicKey(key interface{}) (JSONWebKey, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JSONWebKey{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(padded(key.X, size)),
+			Y:   base64.RawURLEncoding.EncodeToString(padded(key.Y, size)),
+		}, nil
+	}
+	return JSONWebKey{}, fmt.Errorf("unsupported public key type %T", key)
+}
+
+// FromMap returns the JSON Web Key of a decoded JSON object (ex: a JWT header's jwk)
+func FromMap(value interface{}) (JSONWebKey, error) {
+	jwk := JSONWebKey{}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return jwk, err
+	}
+	err = json.Unmarshal(raw, &jwk)
+	return jwk, err
+}
+
+// padded returns the big endian bytes of the coordinate, left padded to the curve size
+func padded(value *big.Int, size int) []byte {
+	b := value.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,72 @@
+package jwkhelpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"reflect"
+	"testing"
+)
+
+func TestJSONWebKey_Thumbprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwk     JSONWebKey
+		want    string
+		wantErr bool
+	}{
+		{
+			// RFC 7638 3.1
+			name: "rsa",
+			jwk: JSONWebKey{
+				Kty: "RSA",
+				Kid: "2011-04-29",
+				N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+				E:   "AQAB",
+			},
+			want: "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		},
+		{name: "unsupported", jwk: JSONWebKey{Kty: "oct"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.jwk.Thumbprint()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Thumbprint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Thumbprint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromPublicKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, public := range []interface{}{&rsaKey.PublicKey, &ecKey.PublicKey} {
+		jwk, err := FromPublicKey(public)
+		if err != nil {
+			t.Fatalf("FromPublicKey(%T) error = %v", public, err)
+		}
+		// the key survives a trip through a decoded JSON object (a JWT header)
+		jwk, err = FromMap(map[string]interface{}{"kty": jwk.Kty, "n": jwk.N, "e": jwk.E, "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y})
+		if err != nil {
+			t.Fatalf("FromMap() error = %v", err)
+		}
+		got, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatalf("PublicKey() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, public) {
+			t.Errorf("PublicKey() = %v, want %v", got, public)
+		}
+	}
+}
@@ -10,7 +10,10 @@ import (
 type Provider struct {
 	StatMemAllocGuage, StatMemTotalAllocGuage, StatMemSysGuage, StatMemNumGCGuage, StatGoRoutineGuage prometheus.Gauge
 	StatRequestSaturationGuage, StatRequestDurationGuage, StatBuildInfo                               *prometheus.GaugeVec
-	StatHTTPRequestCount, StatHTTPResponseCount, StatAuditCount                                       *prometheus.CounterVec
+	StatHTTPRequestCount, StatHTTPResponseCount, StatAuditCount, StatLoginThrottleCount               *prometheus.CounterVec
+	StatRateLimitRejectCount, StatWebhookDeliveryCount, StatOutboxPublishCount                        *prometheus.CounterVec
+	StatIPFilterRejectCount                                                                           *prometheus.CounterVec
+	StatCookieKeyFallbackCount                                                                        prometheus.Counter
 	StatRequestDurationHistogram                                                                      *prometheus.HistogramVec
 }
 
@@ -62,6 +65,36 @@ func New() *Provider {
 				Name: "audit_total",
 				Help: "The total number of audit events",
 			}, []string{"event"}),
+		StatLoginThrottleCount: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "login_throttle_total",
+				Help: "The total number of login throttle events (failures recorded and logins blocked) by scope",
+			}, []string{"scope", "event"}),
+		StatRateLimitRejectCount: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rate_limit_rejected_total",
+				Help: "The total number of requests rejected by the rate limiter",
+			}, []string{"route", "key"}),
+		StatIPFilterRejectCount: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "ip_filter_rejected_total",
+				Help: "The total number of requests rejected by the ip filter by reason (deny, blocklist, allow)",
+			}, []string{"reason"}),
+		StatCookieKeyFallbackCount: promauto.NewCounter(
+			prometheus.CounterOpts{
+				Name: "cookie_key_fallback_total",
+				Help: "The total number of cookies decoded with a previous cookie key pair (not the current one)",
+			}),
+		StatWebhookDeliveryCount: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "webhook_delivery_total",
+				Help: "The total number of webhook delivery attempts by result (succeeded, retry, dead)",
+			}, []string{"event", "result"}),
+		StatOutboxPublishCount: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "outbox_publish_total",
+				Help: "The total number of outbox events published to the event stream sink by result",
+			}, []string{"sink", "result"}),
 		StatHTTPRequestCount: promauto.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "http_request_total",
@@ -5,13 +5,15 @@ consul kv put services/token-svc/config/api/metricsport 4001
 consul kv put services/token-svc/config/api/port 4000
 consul kv put services/token-svc/config/api/allowedmethods '["GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"]'
 consul kv put services/token-svc/config/api/allowedorigins '["*"]'
-consul kv put services/token-svc/config/api/allowedheaders '["X-Requested-With","X-Request-ID", "jaeger-debug-id", "Content-Type", "Authorization"]'
-consul kv put services/token-svc/config/api/openendpoints '["/login", "/health/ping", "/register"]'
+consul kv put services/token-svc/config/api/allowedheaders '["X-Requested-With","X-Request-ID", "jaeger-debug-id", "Content-Type", "Authorization", "X-CSRF-Token", "X-Session-Mode", "DPoP"]'
+consul kv put services/token-svc/config/api/openendpoints '["/login", "/health/ping", "/register", "/login/oidc", "/login/oidc/callback", "/saml/metadata", "/saml/login", "/saml/acs", "/login/magic", "/login/magic/verify", "/oauth/token"]'
 consul kv put services/token-svc/config/api/shutdowntimeoutsecs 120
 consul kv put services/token-svc/config/api/idletimeoutsecs 90
 consul kv put services/token-svc/config/api/writetimeoutsecs 30
 consul kv put services/token-svc/config/api/readtimeoutsecs 5
 consul kv put services/token-svc/config/api/timeoutsecs 30
+consul kv put services/token-svc/config/proxy/trustedcidrs '["127.0.0.1/32", "::1/128"]'
+consul kv put services/token-svc/config/proxy/header X-Forwarded-For
 consul kv put services/token-svc/config/logger/level debug
 consul kv put services/token-svc/config/logger/encoding json
 consul kv put services/token-svc/config/logger/outputpaths '["stdout", "/tmp/tokensvc.logs"]'
@@ -36,7 +38,155 @@ consul kv put services/token-svc/config/cookie/keyuserid 'id'
 consul kv put services/token-svc/config/cookie/keyemail 'email'
 consul kv put services/token-svc/config/cookie/keyjwtaccessid 'jti-access'
 consul kv put services/token-svc/config/cookie/keyjwtrefreshid 'jti-refresh'
+consul kv put services/token-svc/config/cookie/samesite 'lax'
 consul kv put services/token-svc/config/cache/host 'redis'
 consul kv put services/token-svc/config/cache/port '6379'
-consul kv put services/token-svc/config/cache/useraccountlockedkeyid = "account-locked-user"
-consul kv put services/token-svc/config/cache/useraccountlockedlifespanmins = 60
\ No newline at end of file
+consul kv put services/token-svc/config/cache/useraccountlockedkeyid 'account-locked-user'
+consul kv put services/token-svc/config/cache/useraccountlockedlifespanmins 60
+consul kv put services/token-svc/config/password/algorithm 'argon2id'
+consul kv put services/token-svc/config/password/bcryptcost 12
+consul kv put services/token-svc/config/password/argon2memorykib 65536
+consul kv put services/token-svc/config/password/argon2maxmemorykib 262144
+consul kv put services/token-svc/config/password/argon2iterations 3
+consul kv put services/token-svc/config/password/argon2parallelism 2
+consul kv put services/token-svc/config/password/argon2saltlength 16
+consul kv put services/token-svc/config/password/argon2keylength 32
+consul kv put services/token-svc/config/passwordpolicy/minlength 12
+consul kv put services/token-svc/config/passwordpolicy/maxlength 64
+consul kv put services/token-svc/config/passwordpolicy/requireupper true
+consul kv put services/token-svc/config/passwordpolicy/requirelower true
+consul kv put services/token-svc/config/passwordpolicy/requiredigit true
+consul kv put services/token-svc/config/passwordpolicy/requiresymbol false
+consul kv put services/token-svc/config/passwordpolicy/rejectemaillocalpart true
+consul kv put services/token-svc/config/passwordpolicy/historycount 5
+consul kv put services/token-svc/config/passwordpolicy/breachedcorpuspath ''
+consul kv put services/token-svc/config/loginlimit/cachekeyid 'login-limit'
+consul kv put services/token-svc/config/loginlimit/windowmins 15
+consul kv put services/token-svc/config/loginlimit/maxperip 50
+consul kv put services/token-svc/config/loginlimit/maxperipemail 10
+consul kv put services/token-svc/config/loginlimit/backoffafter 3
+consul kv put services/token-svc/config/loginlimit/backoffbasesecs 2
+consul kv put services/token-svc/config/loginlimit/backoffmaxsecs 300
+consul kv put services/token-svc/config/ratelimit/enabled true
+consul kv put services/token-svc/config/ratelimit/mode 'redis'
+consul kv put services/token-svc/config/ratelimit/cachekeyid 'rate-limit'
+consul kv put services/token-svc/config/ratelimit/clientidheader 'X-Client-ID'
+consul kv put services/token-svc/config/ratelimit/routes '[{ path = "/register", key = "ip", capacity = 5, refillpersec = 0.1 }, { path = "/login", key = "ip", capacity = 20, refillpersec = 1.0 }, { path = "/health", key = "ip", capacity = 10, refillpersec = 1.0 }, { path = "/users", key = "subject", capacity = 30, refillpersec = 1.0 }, { path = "*", key = "ip", capacity = 100, refillpersec = 10.0 }]'
+consul kv put services/token-svc/config/admin/group 'admin'
+consul kv put services/token-svc/config/audit/outputpaths '[]'
+consul kv put services/token-svc/config/audit/defaultpagesize 50
+consul kv put services/token-svc/config/audit/maxpagesize 500
+consul kv put services/token-svc/config/audit/checkpointintervalmins 60
+consul kv put services/token-svc/config/webhook/enabled true
+consul kv put services/token-svc/config/webhook/pollintervalsecs 5
+consul kv put services/token-svc/config/webhook/batchsize 100
+consul kv put services/token-svc/config/webhook/concurrency 4
+consul kv put services/token-svc/config/webhook/timeoutsecs 10
+consul kv put services/token-svc/config/webhook/maxattempts 8
+consul kv put services/token-svc/config/webhook/backoffbasesecs 30
+consul kv put services/token-svc/config/webhook/backoffmaxsecs 21600
+consul kv put services/token-svc/config/outbox/enabled true
+consul kv put services/token-svc/config/outbox/sink 'log'
+consul kv put services/token-svc/config/outbox/pollintervalsecs 2
+consul kv put services/token-svc/config/outbox/batchsize 100
+consul kv put services/token-svc/config/outbox/logoutputpaths '["stdout"]'
+consul kv put services/token-svc/config/outbox/httpurl ''
+consul kv put services/token-svc/config/outbox/httptimeoutsecs 10
+consul kv put services/token-svc/config/outbox/streamkey 'token-svc-user-events'
+consul kv put services/token-svc/config/outbox/streammaxlen 100000
+consul kv put services/token-svc/config/oidc/enabled false
+consul kv put services/token-svc/config/oidc/issuer ''
+consul kv put services/token-svc/config/oidc/clientid ''
+consul kv put services/token-svc/config/oidc/redirecturl 'https://dev.homerow.tech/login/oidc/callback'
+consul kv put services/token-svc/config/oidc/scopes '["openid", "email", "profile"]'
+consul kv put services/token-svc/config/oidc/createusers true
+consul kv put services/token-svc/config/oidc/statecachekeyid 'oidc-state'
+consul kv put services/token-svc/config/oidc/statelifespansecs 600
+consul kv put services/token-svc/config/oidc/httptimeoutsecs 10
+consul kv put services/token-svc/config/ldap/enabled false
+consul kv put services/token-svc/config/ldap/url 'ldaps://ldap.homerow.tech:636'
+consul kv put services/token-svc/config/ldap/starttls false
+consul kv put services/token-svc/config/ldap/insecureskipverify false
+consul kv put services/token-svc/config/ldap/binddn 'cn=token-svc,ou=services,dc=homerow,dc=tech'
+consul kv put services/token-svc/config/ldap/basedn 'ou=people,dc=homerow,dc=tech'
+consul kv put services/token-svc/config/ldap/userfilter '(&(objectClass=person)(mail={email}))'
+consul kv put services/token-svc/config/ldap/groupattribute 'memberOf'
+consul kv put services/token-svc/config/ldap/syncgroups false
+consul kv put services/token-svc/config/ldap/groupmap '{}'
+consul kv put services/token-svc/config/ldap/domains '["staff.homerow.tech"]'
+consul kv put services/token-svc/config/ldap/timeoutsecs 10
+consul kv put services/token-svc/config/saml/enabled false
+consul kv put services/token-svc/config/saml/entityid 'https://dev.homerow.tech/saml/metadata'
+consul kv put services/token-svc/config/saml/acsurl 'https://dev.homerow.tech/saml/acs'
+consul kv put services/token-svc/config/saml/certificatepath '/tmp/certs/saml.crt'
+consul kv put services/token-svc/config/saml/privatekeypath '/tmp/certs/saml.key'
+consul kv put services/token-svc/config/saml/idpmetadatapath '/tmp/certs/saml-idp-metadata.xml'
+consul kv put services/token-svc/config/saml/allowidpinitiated false
+consul kv put services/token-svc/config/saml/emailattribute 'email'
+consul kv put services/token-svc/config/saml/nameattribute 'displayName'
+consul kv put services/token-svc/config/saml/groupsattribute 'groups'
+consul kv put services/token-svc/config/saml/trustemail true
+consul kv put services/token-svc/config/saml/createusers true
+consul kv put services/token-svc/config/saml/syncgroups false
+consul kv put services/token-svc/config/saml/groupmap '{}'
+consul kv put services/token-svc/config/saml/requestcachekeyid 'saml-request'
+consul kv put services/token-svc/config/saml/requestlifespansecs 600
+consul kv put services/token-svc/config/saml/assertioncachekeyid 'saml-assertion'
+consul kv put services/token-svc/config/scim/enabled false
+consul kv put services/token-svc/config/scim/baseurl 'https://dev.homerow.tech/scim/v2'
+consul kv put services/token-svc/config/scim/maxresults 200
+consul kv put services/token-svc/config/pat/enabled true
+consul kv put services/token-svc/config/pat/maxperuser 50
+consul kv put services/token-svc/config/pat/defaultlifespandays 90
+consul kv put services/token-svc/config/pat/maxlifespandays 365
+consul kv put services/token-svc/config/pat/lastusedintervalsecs 60
+consul kv put services/token-svc/config/mail/backend 'log'
+consul kv put services/token-svc/config/mail/host 'smtp.homerow.tech'
+consul kv put services/token-svc/config/mail/port 587
+consul kv put services/token-svc/config/mail/username ''
+consul kv put services/token-svc/config/mail/from 'token-svc <no-reply@homerow.tech>'
+consul kv put services/token-svc/config/mail/allowinsecure false
+consul kv put services/token-svc/config/mail/timeoutsecs 10
+consul kv put services/token-svc/config/magic/enabled false
+consul kv put services/token-svc/config/magic/linkurl 'https://dev.homerow.tech/login/magic'
+consul kv put services/token-svc/config/magic/lifespansecs 600
+consul kv put services/token-svc/config/magic/maxattempts 5
+consul kv put services/token-svc/config/magic/maxsends 3
+consul kv put services/token-svc/config/magic/cachekeyid 'magic-login'
+consul kv put services/token-svc/config/stepup/enabled true
+consul kv put services/token-svc/config/stepup/maxagemins 10
+consul kv put services/token-svc/config/stepup/adminrequiremfa false
+consul kv put services/token-svc/config/loginhistory/enabled true
+consul kv put services/token-svc/config/loginhistory/failureburst 3
+consul kv put services/token-svc/config/loginhistory/notify true
+consul kv put services/token-svc/config/loginhistory/forcemfa false
+consul kv put services/token-svc/config/loginhistory/maxhistory 100
+consul kv put services/token-svc/config/ipfilter/enabled true
+consul kv put services/token-svc/config/ipfilter/allow '[]'
+consul kv put services/token-svc/config/ipfilter/deny '[]'
+consul kv put services/token-svc/config/ipfilter/cachekeyid ip-blocklist
+consul kv put services/token-svc/config/ipfilter/refreshsecs 5
+consul kv put services/token-svc/config/ipfilter/defaultblockmins 60
+consul kv put services/token-svc/config/ipfilter/maxblockmins 43200
+consul kv put services/token-svc/config/ipfilter/autoblock false
+consul kv put services/token-svc/config/ipfilter/autoblockthreshold 10
+consul kv put services/token-svc/config/ipfilter/autoblockwindowmins 10
+consul kv put services/token-svc/config/ipfilter/autoblockmins 60
+consul kv put services/token-svc/config/csrf/enabled true
+consul kv put services/token-svc/config/csrf/cookiename 'csrf_token'
+consul kv put services/token-svc/config/csrf/headername 'X-CSRF-Token'
+consul kv put services/token-svc/config/csrf/trustedorigins '["https://dev.homerow.tech"]'
+consul kv put services/token-svc/config/csrf/requireorigin true
+consul kv put services/token-svc/config/csrf/exemptpaths '["/saml/acs"]'
+consul kv put services/token-svc/config/session/mode 'header'
+consul kv put services/token-svc/config/session/accesscookiename 'homerow-access'
+consul kv put services/token-svc/config/session/refreshcookiename 'homerow-refresh'
+consul kv put services/token-svc/config/dpop/enabled true
+consul kv put services/token-svc/config/dpop/cachekeyid 'dpop-jti'
+consul kv put services/token-svc/config/dpop/prooflifespansecs 300
+consul kv put services/token-svc/config/dpop/clockskewsecs 30
+consul kv put services/token-svc/config/mtls/enabled false
+consul kv put services/token-svc/config/mtls/certificatepath '/tmp/certs/server.crt'
+consul kv put services/token-svc/config/mtls/keypath '/tmp/certs/server.key'
+consul kv put services/token-svc/config/mtls/clientcapath '/tmp/certs/client-ca.crt'
+consul kv put services/token-svc/config/mtls/clients '[]'